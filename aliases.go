@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxAliasNodes bounds how many nodes alias expansion may copy into a prompt
+// file, so a few nested aliases cannot expand into millions of operations.
+const maxAliasNodes = 10000
+
+// expandAliases replaces every alias in the document with a copy of its
+// anchored node. An alias in the prompt list that refers to a list of
+// operations is spliced into it, so shared blocks can be defined once under
+// definitions and reused.
+func expandAliases(doc *yaml.Node) error {
+	budget := maxAliasNodes
+	expanded, err := expandNode(doc, &budget, false)
+	if err != nil {
+		return err
+	}
+	*doc = *expanded
+
+	root := doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "prompt" {
+			expandPromptList(root.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// expandNode returns the node with aliases resolved, copying only what the
+// aliases reference. Inside copies, every node counts against the budget.
+func expandNode(node *yaml.Node, budget *int, copying bool) (*yaml.Node, error) {
+	if node.Kind == yaml.AliasNode {
+		if node.Alias == nil {
+			return nil, fmt.Errorf("line %d: unknown alias *%s", node.Line, node.Value)
+		}
+		return expandNode(node.Alias, budget, true)
+	}
+	if copying {
+		*budget--
+		if *budget < 0 {
+			return nil, fmt.Errorf("aliases expand to more than %d nodes", maxAliasNodes)
+		}
+	}
+	if len(node.Content) == 0 && !copying {
+		return node, nil
+	}
+
+	result := *node
+	result.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		expanded, err := expandNode(child, budget, copying)
+		if err != nil {
+			return nil, err
+		}
+		result.Content[i] = expanded
+	}
+	return &result, nil
+}
+
+// expandPromptList splices lists nested in the prompt list, such as an
+// aliased block of operations, into it.
+func expandPromptList(list *yaml.Node) {
+	if list.Kind != yaml.SequenceNode {
+		return
+	}
+	var items []*yaml.Node
+	for _, item := range list.Content {
+		if item.Kind == yaml.SequenceNode {
+			expandPromptList(item)
+			items = append(items, item.Content...)
+			continue
+		}
+		items = append(items, item)
+	}
+	list.Content = items
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AssertSpec checks a variable or a labeled section while compiling,
+// failing the compile when the check does not hold.
+type AssertSpec struct {
+	Var   string `yaml:"var,omitempty"`
+	Label string `yaml:"label,omitempty"`
+
+	Matches  string `yaml:"matches,omitempty"`
+	Contains string `yaml:"contains,omitempty"`
+
+	// Message explains the failure in the user's terms.
+	Message string `yaml:"message,omitempty"`
+}
+
+func (a AssertSpec) subject() string {
+	if a.Var != "" {
+		return a.Var
+	}
+	return "#" + a.Label
+}
+
+// String describes the assertion for plans and reports.
+func (a AssertSpec) String() string {
+	var parts []string
+	if a.Matches != "" {
+		parts = append(parts, fmt.Sprintf("matches %q", a.Matches))
+	}
+	if a.Contains != "" {
+		parts = append(parts, fmt.Sprintf("contains %q", a.Contains))
+	}
+	return a.subject() + " " + strings.Join(parts, " and ")
+}
+
+func validateAssert(a AssertSpec) error {
+	if (a.Var == "") == (a.Label == "") {
+		return fmt.Errorf("assert must name exactly one of: var, label")
+	}
+	if a.Matches == "" && a.Contains == "" {
+		return fmt.Errorf("assert must give matches or contains")
+	}
+	if _, err := regexp.Compile(a.Matches); err != nil {
+		return fmt.Errorf("invalid assert pattern %q: %w", a.Matches, err)
+	}
+	return nil
+}
+
+// processAssertOperation evaluates an assertion against the variables and
+// labeled sections produced so far. It contributes no content.
+func processAssertOperation(a AssertSpec, ctx *ProcessingContext) error {
+	var value, shown string
+	if a.Var != "" {
+		v, ok := ctx.vars[a.Var]
+		if !ok {
+			return ErrAssertionFailed{Message: a.Message, Reason: fmt.Sprintf("variable %s is not set", a.Var)}
+		}
+		value, shown = v, fmt.Sprintf("%s = %q", a.Var, v)
+	} else {
+		section, ok := ctx.labels[a.Label]
+		if !ok {
+			return ErrAssertionFailed{Message: a.Message, Reason: fmt.Sprintf("no section labeled #%s before the assert", a.Label)}
+		}
+		value, shown = section.Content, fmt.Sprintf("section #%s", a.Label)
+	}
+
+	if a.Matches != "" && !regexp.MustCompile(a.Matches).MatchString(value) {
+		return ErrAssertionFailed{Message: a.Message, Reason: fmt.Sprintf("%s does not match %q", shown, a.Matches)}
+	}
+	if a.Contains != "" && !strings.Contains(value, a.Contains) {
+		return ErrAssertionFailed{Message: a.Message, Reason: fmt.Sprintf("%s does not contain %q", shown, a.Contains)}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validBinaryPolicies are the values of binary:, which says what a file
+// operation does with a binary file.
+var validBinaryPolicies = map[string]bool{
+	"error": true,
+	"stub":  true,
+	"skip":  true,
+}
+
+func validateBinaryPolicy(op Operation, opType OperationType) error {
+	if op.Binary == "" {
+		return nil
+	}
+	if opType != FileOp && opType != DirOp {
+		return fmt.Errorf("binary applies only to file and dir operations")
+	}
+	if !validBinaryPolicies[op.Binary] {
+		return fmt.Errorf("invalid binary policy %q, expected error, stub or skip", op.Binary)
+	}
+	return nil
+}
+
+// binaryStub describes a binary file in one line, so the reader knows the
+// asset exists without its content.
+func binaryStub(filePath, source string, size int64) string {
+	return fmt.Sprintf("[binary file: %s, %d bytes, %s]", source, size, binaryFileType(filePath))
+}
+
+// binaryFileType sniffs a file's media type from its first bytes, falling
+// back to its extension when the content is not recognized.
+func binaryFileType(filePath string) string {
+	detected := "application/octet-stream"
+	if file, err := os.Open(filePath); err == nil {
+		buffer := make([]byte, 512)
+		n, _ := file.Read(buffer)
+		file.Close()
+		detected = http.DetectContentType(buffer[:n])
+	}
+	if detected == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(filepath.Ext(filePath)); byExtension != "" {
+			detected = byExtension
+		}
+	}
+	mediaType, _, _ := strings.Cut(detected, ";")
+	return mediaType
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func runBuild(args []string) error {
+	opts := Options{Vars: make(map[string]string)}
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	registerCompileFlags(fs, &opts)
+	fs.Var(varFlag(opts.Vars), "set", "Set a variable (name=value, repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp build -f <prompt-file> [flags] [target]
+
+Compiles the targets defined in the prompt file's outputs map. With no target
+every target is built to its configured output path. With a target, -o
+overrides the target's output path.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.PromptFile == "" {
+		return fmt.Errorf("-f flag is required")
+	}
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("build accepts at most one target, got %d", fs.NArg())
+	}
+
+	pf, err := parsePromptFile(opts.PromptFile)
+	if err != nil {
+		return err
+	}
+	if len(pf.Outputs) == 0 {
+		return fmt.Errorf("prompt file %s does not define any outputs", opts.PromptFile)
+	}
+
+	if fs.NArg() == 1 {
+		return buildTarget(pf, fs.Arg(0), opts)
+	}
+
+	if opts.OutputFile != "" {
+		return fmt.Errorf("-o can only be used when building a single target")
+	}
+	for _, name := range targetNames(pf) {
+		if pf.Outputs[name].Output == "" {
+			return fmt.Errorf("output target %s has no output path; build it by name to write to stdout", name)
+		}
+		if err := buildTarget(pf, name, opts); err != nil {
+			return fmt.Errorf("building target %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func buildTarget(pf *PromptFile, name string, opts Options) error {
+	target, ok := pf.Outputs[name]
+	if !ok {
+		return ErrUnknownTarget{Target: name, Available: targetNames(pf)}
+	}
+
+	opts.Target = name
+	if target.MaxWords > 0 {
+		opts.MaxWords = target.MaxWords
+		opts.maxWordsSet = true
+	}
+	if opts.OutputFile == "" && target.Output != "" {
+		opts.OutputFile = target.Output
+		if !filepath.IsAbs(opts.OutputFile) {
+			opts.OutputFile = filepath.Join(filepath.Dir(opts.PromptFile), opts.OutputFile)
+		}
+	}
+
+	return runCompile(opts)
+}
+
+func targetNames(pf *PromptFile) []string {
+	names := make([]string, 0, len(pf.Outputs))
+	for name := range pf.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// buildFileTarget is a target of a build file with the command that runs it
+// and its documentation, if it has any.
+type buildFileTarget struct {
+	command string
+	doc     string
+}
+
+// taskfileName matches the names task looks for, lowercased.
+var taskfileName = regexp.MustCompile(`^taskfile(\.dist)?\.ya?ml$`)
+
+// buildTool returns the tool that runs the build file at path, from its
+// name: make, task or just.
+func buildTool(path string) (string, error) {
+	name := filepath.Base(path)
+	lower := strings.ToLower(name)
+	switch {
+	case lower == "makefile" || name == "GNUmakefile" || filepath.Ext(lower) == ".mk":
+		return "make", nil
+	case taskfileName.MatchString(lower):
+		return "task", nil
+	case lower == "justfile" || lower == ".justfile" || filepath.Ext(lower) == ".just":
+		return "just", nil
+	}
+	return "", fmt.Errorf("%s is not a Makefile, Taskfile or justfile", displayPath(path))
+}
+
+// processBuildTargetsOperation lists the targets of a build file, one per
+// line as the command that runs it, with its documentation as a comment.
+func processBuildTargetsOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	tool, err := buildTool(p.Path)
+	if err != nil {
+		return ContentSection{}, err
+	}
+	data, err := ctx.ReadFile(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+
+	var targets []buildFileTarget
+	switch tool {
+	case "make":
+		targets = makeTargets(string(data))
+	case "task":
+		if targets, err = taskfileTargets(data); err != nil {
+			return ContentSection{}, ErrInvalidYAML{File: p.Path, Err: err}
+		}
+	case "just":
+		targets = justTargets(string(data))
+	}
+	if len(targets) == 0 {
+		ctx.Warn("no targets found in %s", displayPath(p.Value))
+	}
+
+	width := 0
+	for _, target := range targets {
+		if target.doc != "" {
+			width = max(width, len(target.command))
+		}
+	}
+	var lines []string
+	for _, target := range targets {
+		line := tool + " " + target.command
+		if target.doc != "" {
+			line = fmt.Sprintf("%s %-*s  # %s", tool, width, target.command, target.doc)
+		}
+		lines = append(lines, line)
+	}
+
+	return ContentSection{
+		Source:  displayPath(p.Value),
+		Content: normalizeContent(strings.Join(lines, "\n")),
+		Type:    BuildTargetsOp,
+	}, nil
+}
+
+// makeRule matches a rule's targets, up to a colon that does not start an
+// assignment such as :=.
+var makeRule = regexp.MustCompile(`^([^\s#=:][^#=:]*?)\s*::?(?:[^=]|$)`)
+
+// makeTargets finds the explicit targets of a Makefile. A target is
+// documented by a trailing "## text" on its rule, the self-documenting
+// Makefile convention, or else by the comment immediately above it.
+// Special targets such as .PHONY, pattern rules and targets named by
+// variables are left out.
+func makeTargets(content string) []buildFileTarget {
+	var targets []buildFileTarget
+	seen := make(map[string]bool)
+	var comment []string
+	inDefine := false
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[i])
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inDefine:
+			inDefine = trimmed != "endef"
+			continue
+		case strings.HasPrefix(trimmed, "define "):
+			inDefine = true
+			comment = nil
+			continue
+		case strings.HasPrefix(line, "\t"):
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			comment = append(comment, strings.TrimSpace(strings.TrimLeft(trimmed, "#")))
+			continue
+		}
+
+		m := makeRule.FindStringSubmatch(line)
+		if m == nil {
+			comment = nil
+			continue
+		}
+		doc := strings.Join(comment, " ")
+		if _, trailing, found := strings.Cut(line, "##"); found {
+			doc = strings.TrimSpace(trailing)
+		}
+		comment = nil
+		for _, name := range strings.Fields(m[1]) {
+			if seen[name] || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "%$") {
+				continue
+			}
+			seen[name] = true
+			targets = append(targets, buildFileTarget{command: name, doc: doc})
+		}
+	}
+	return targets
+}
+
+// taskfileTargets lists the tasks of a go-task Taskfile in file order,
+// documented by their desc or else the first line of their summary.
+// Internal tasks cannot be run directly and are left out.
+func taskfileTargets(data []byte) ([]buildFileTarget, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, nil
+	}
+	tasks := mappingValue(doc.Content[0], "tasks")
+	if tasks == nil || tasks.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	var targets []buildFileTarget
+	for i := 0; i+1 < len(tasks.Content); i += 2 {
+		target := buildFileTarget{command: tasks.Content[i].Value}
+		if task := tasks.Content[i+1]; task.Kind == yaml.MappingNode {
+			if internal := mappingValue(task, "internal"); internal != nil && internal.Value == "true" {
+				continue
+			}
+			if desc := mappingValue(task, "desc"); desc != nil {
+				target.doc = strings.TrimSpace(desc.Value)
+			} else if summary := mappingValue(task, "summary"); summary != nil {
+				target.doc, _, _ = strings.Cut(strings.TrimSpace(summary.Value), "\n")
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// justRecipe matches a justfile recipe header: its name and parameters,
+// up to a colon that does not start an assignment.
+var justRecipe = regexp.MustCompile(`^@?([A-Za-z_][\w-]*)((?:\s+[^:\s][^:]*)?)\s*:(?:[^=]|$)`)
+
+// justTargets lists the recipes of a justfile with their parameters,
+// documented by the comment above them. Private recipes, named with a
+// leading underscore or marked [private], are left out.
+func justTargets(content string) []buildFileTarget {
+	var targets []buildFileTarget
+	var comment []string
+	private := false
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			comment = append(comment, strings.TrimSpace(strings.TrimLeft(trimmed, "#")))
+			continue
+		case strings.HasPrefix(trimmed, "["):
+			private = private || strings.Contains(trimmed, "private")
+			continue
+		}
+
+		m := justRecipe.FindStringSubmatch(line)
+		if m != nil && !private && !strings.HasPrefix(m[1], "_") && m[1] != "set" && m[1] != "alias" {
+			command := m[1]
+			if params := strings.TrimSpace(m[2]); params != "" {
+				command += " " + params
+			}
+			targets = append(targets, buildFileTarget{command: command, doc: strings.Join(comment, " ")})
+		}
+		comment = nil
+		private = false
+	}
+	return targets
+}
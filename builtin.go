@@ -0,0 +1,42 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// builtinPrefix marks a prompt path as one of the fragments embedded in
+// pcp, such as "builtin:code-review".
+const builtinPrefix = "builtin:"
+
+//go:embed builtin/*.yml
+var builtinPrompts embed.FS
+
+func isBuiltinPrompt(filePath string) bool {
+	return strings.HasPrefix(filePath, builtinPrefix)
+}
+
+// readBuiltinPrompt returns the prompt file a builtin: path names.
+func readBuiltinPrompt(filePath string) ([]byte, error) {
+	name := strings.TrimPrefix(filePath, builtinPrefix)
+	data, err := builtinPrompts.ReadFile("builtin/" + name + ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown builtin prompt %q (available: %s)", name, strings.Join(builtinPromptNames(), ", "))
+	}
+	return data, nil
+}
+
+// builtinPromptNames lists the embedded fragments, sorted.
+func builtinPromptNames() []string {
+	entries, _ := fs.ReadDir(builtinPrompts, "builtin")
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleManifest describes the contents of a -o *.tar.gz bundle.
+type bundleManifest struct {
+	PromptFile string          `json:"prompt_file"`
+	Output     string          `json:"output"`
+	SHA256     string          `json:"sha256"`
+	Words      int             `json:"words"`
+	Sections   []dirIndexEntry `json:"sections"`
+	Sources    []string        `json:"sources,omitempty"`
+}
+
+// isBundlePath reports whether an output path asks for a tar.gz bundle.
+func isBundlePath(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+// writeBundle writes a gzipped tarball holding the compiled output, a
+// manifest.json and, with -bundle-sources, copies of every prompt file and
+// file the compile read, under sources/. Entries carry fixed timestamps so
+// the same inputs produce the same bundle.
+func writeBundle(path, output string, content CompiledContent, opts Options) error {
+	outputName := "context" + formatExtensions[resolveFormat(opts.Format, "")]
+	sum := sha256.Sum256([]byte(output))
+	manifest := bundleManifest{
+		PromptFile: displayPath(filepath.Base(opts.PromptFile)),
+		Output:     outputName,
+		SHA256:     hex.EncodeToString(sum[:]),
+		Words:      content.Stats.Words,
+		Sections:   make([]dirIndexEntry, 0, len(content.Sections)),
+	}
+	for _, section := range content.Sections {
+		manifest.Sections = append(manifest.Sections, dirIndexEntry{
+			ID:       section.ID,
+			Source:   section.Source,
+			Type:     section.Type.String(),
+			Words:    sectionWords(section),
+			ExitCode: section.ExitCode,
+		})
+	}
+
+	type entry struct {
+		name string
+		data []byte
+	}
+	entries := []entry{{outputName, []byte(output)}}
+	if opts.BundleSources {
+		rootDir, _ := filepath.Abs(filepath.Dir(opts.PromptFile))
+		for _, dependency := range content.Dependencies {
+			info, err := os.Stat(dependency)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(dependency)
+			if err != nil {
+				return fmt.Errorf("failed to read %s for bundle: %w", dependency, err)
+			}
+			name := bundleSourceName(rootDir, dependency)
+			manifest.Sources = append(manifest.Sources, name)
+			entries = append(entries, entry{name, data})
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	entries = append(entries, entry{"manifest.json", append(manifestData, '\n')})
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:    e.name,
+			Mode:    0644,
+			Size:    int64(len(e.data)),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return writeOutputFile(path, buf.Bytes(), opts.OutputMode)
+}
+
+// bundleSourceName places a source file under sources/, keeping its path
+// relative to the root prompt file's directory. Files outside that
+// directory go under sources/external/ with their absolute path.
+func bundleSourceName(rootDir, path string) string {
+	rel, err := filepath.Rel(rootDir, path)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "sources/" + filepath.ToSlash(rel)
+	}
+	external := strings.ReplaceAll(filepath.ToSlash(path), ":", "")
+	return "sources/external/" + strings.TrimLeft(external, "/")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceCache keeps parsed prompt files and file contents in memory between
+// compiles. Entries are revalidated against the file's size and modification
+// time on every use, so edits are always picked up.
+type sourceCache struct {
+	mu      sync.Mutex
+	prompts map[string]cachedPrompt
+	files   map[string]cachedFile
+}
+
+type cachedPrompt struct {
+	modTime time.Time
+	size    int64
+	prompt  *PromptFile
+}
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func newSourceCache() *sourceCache {
+	return &sourceCache{
+		prompts: make(map[string]cachedPrompt),
+		files:   make(map[string]cachedFile),
+	}
+}
+
+func (c *sourceCache) parsePromptFile(filePath string) (*PromptFile, error) {
+	absPath, _ := filepath.Abs(filePath)
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return parsePromptFile(filePath)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.prompts[absPath]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.prompt, nil
+	}
+
+	pf, err := parsePromptFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.prompts[absPath] = cachedPrompt{modTime: info.ModTime(), size: info.Size(), prompt: pf}
+	c.mu.Unlock()
+	return pf, nil
+}
+
+func (c *sourceCache) readFile(filePath string) ([]byte, error) {
+	absPath, _ := filepath.Abs(filePath)
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.files[absPath]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.data, nil
+	}
+
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.files[absPath] = cachedFile{modTime: info.ModTime(), size: info.Size(), data: data}
+	c.mu.Unlock()
+	return data, nil
+}
+
+// cachePolicy controls whether a command's output may be reused from the
+// on-disk result cache.
+type cachePolicy struct {
+	// Mode is "never", "content" (reuse while the command text and working
+	// directory are unchanged) or "ttl" (reuse for up to TTL).
+	Mode string
+	TTL  time.Duration
+}
+
+func parseCachePolicy(s string) (cachePolicy, error) {
+	switch {
+	case s == "" || s == "never":
+		return cachePolicy{Mode: "never"}, nil
+	case s == "content":
+		return cachePolicy{Mode: "content"}, nil
+	case strings.HasPrefix(s, "ttl="):
+		ttl, err := time.ParseDuration(strings.TrimPrefix(s, "ttl="))
+		if err != nil || ttl <= 0 {
+			return cachePolicy{}, fmt.Errorf("invalid cache policy %q: ttl must be a positive duration such as ttl=5m", s)
+		}
+		return cachePolicy{Mode: "ttl", TTL: ttl}, nil
+	default:
+		return cachePolicy{}, fmt.Errorf("invalid cache policy %q, expected never, content or ttl=<duration>", s)
+	}
+}
+
+// resultCache stores command results on disk so they survive between runs.
+type resultCache struct {
+	dir string
+}
+
+type cachedResult struct {
+	Command  string    `json:"command"`
+	Dir      string    `json:"dir"`
+	Output   string    `json:"output"`
+	ExitCode int       `json:"exit_code"`
+	Created  time.Time `json:"created"`
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "pcp-cache")
+	}
+	return filepath.Join(dir, "pcp")
+}
+
+func cacheKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *resultCache) path(key string) string {
+	return filepath.Join(c.dir, "commands", key+".json")
+}
+
+func (c *resultCache) responsePath(rawURL string) string {
+	return filepath.Join(c.dir, "http", cacheKey("url", rawURL)+".json")
+}
+
+// load returns the cached result for key if it is younger than maxAge. A zero
+// maxAge accepts results of any age.
+func (c *resultCache) load(key string, maxAge time.Duration) (cachedResult, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return cachedResult{}, false
+	}
+	var result cachedResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return cachedResult{}, false
+	}
+	if maxAge > 0 && time.Since(result.Created) > maxAge {
+		return cachedResult{}, false
+	}
+	return result, true
+}
+
+func (c *resultCache) store(key string, result cachedResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path(key)), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(key), data, 0600)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validateCapture checks capture_as and suppress on an operation.
+func validateCapture(op Operation, opType OperationType) error {
+	if op.CaptureAs == "" {
+		if op.Suppress {
+			return fmt.Errorf("suppress requires capture_as")
+		}
+		return nil
+	}
+	if opType != CommandOp && opType != FileOp {
+		return fmt.Errorf("capture_as applies only to command and file operations")
+	}
+	if !varNamePattern.MatchString(op.CaptureAs) {
+		return fmt.Errorf("invalid capture_as name %q", op.CaptureAs)
+	}
+	return nil
+}
+
+// planCapture is called while planning an operation with capture_as. The
+// variable's value is only known once the operation runs, so later
+// operations keep their references to it until then.
+func planCapture(name string, ctx *ProcessingContext) {
+	ctx.captureNames[name] = true
+	delete(ctx.vars, name)
+}
+
+// checkCapturedRefs rejects nested prompt paths that use a captured
+// variable: prompts are resolved before any command runs.
+func checkCapturedRefs(p PlannedOperation, ctx *ProcessingContext) error {
+	if p.Type != PromptOp {
+		return nil
+	}
+	if name := capturedRef(p.Value, ctx); name != "" {
+		return fmt.Errorf("captured variable %s cannot be used in a prompt path, which is resolved before commands run", name)
+	}
+	return nil
+}
+
+// capturedRef returns the first captured variable value refers to, or "".
+func capturedRef(value string, ctx *ProcessingContext) string {
+	for _, match := range varPattern.FindAllStringSubmatch(value, -1) {
+		if ctx.captureNames[match[1]] {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// expandCaptured expands variables captured by earlier operations into a
+// planned operation, just before it runs.
+func expandCaptured(p PlannedOperation, ctx *ProcessingContext) PlannedOperation {
+	if len(ctx.captured) == 0 {
+		return p
+	}
+	switch p.Type {
+	case CommandOp, ScriptOp:
+		if p.Args != nil {
+			args := make([]string, len(p.Args))
+			for i, arg := range p.Args {
+				args[i] = expandVars(arg, ctx.captured)
+			}
+			p.Args = args
+			p.Value = shellJoin(args)
+		} else {
+			p.Value = expandShellVars(p.Value, ctx.captured)
+		}
+	case FileOp, SymbolOp, RelatedOp, CoverageOp, StacktraceOp, LogOp, DiffOp, BuildTargetsOp, TreeOp, GitOp:
+		value := expandVars(p.Value, ctx.captured)
+		if p.Type == DiffOp && p.Op.Diff.isGit() {
+			p.Value = value
+		} else if value != p.Value {
+			dir, _ := filepath.Abs(filepath.Dir(p.File))
+			p.Value = value
+			file := value
+			if p.Type == SymbolOp || p.Type == RelatedOp {
+				file, _ = splitSymbol(value)
+			}
+			p.Path = resolvePath(dir, file)
+			ctx.AddDependency(p.Path)
+		}
+	default:
+		p.Value = expandVars(p.Value, ctx.captured)
+	}
+	return p
+}
+
+// captureSection stores an operation's output as a variable, without the
+// trailing newline so values such as a branch name can be used inline.
+func captureSection(name string, section ContentSection, ctx *ProcessingContext) {
+	ctx.captured[name] = strings.TrimRight(section.Content, "\n")
+	ctx.vars[name] = ctx.captured[name]
+}
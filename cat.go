@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func runCat(args []string) error {
+	opts := Options{Vars: make(map[string]string)}
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	registerCompileFlags(fs, &opts)
+	fs.Var(varFlag(opts.Vars), "set", "Set a variable (name=value, repeatable)")
+	emit := fs.String("emit-yaml", "", "Write the equivalent prompt file instead of compiling")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp cat [-emit-yaml <prompt-file>] [flags] <path>...
+
+Compiles the paths as if each were an operation of a prompt file: a
+directory becomes a dir operation and anything else, globs included, a file
+operation. With -emit-yaml the equivalent prompt file is written instead, to
+edit or compile later. Flags go before the paths.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.PromptFile != "" {
+		return fmt.Errorf("cat builds its own prompt file; use -emit-yaml to keep it")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("cat needs at least one path")
+	}
+	for _, path := range fs.Args() {
+		if _, err := os.Stat(path); err != nil && !isGlobPattern(path) {
+			return ErrFileNotFound{File: path}
+		}
+	}
+	return compileAdHoc(opts, ".", fs.Args(), *emit)
+}
+
+// adHocPromptFile writes the prompt file for paths relative to root, one
+// operation per path: dir for directories and file for anything else.
+func adHocPromptFile(root string, paths []string) string {
+	var result strings.Builder
+	result.WriteString("prompt:\n")
+	for _, path := range paths {
+		key := "file"
+		if info, err := os.Stat(filepath.Join(root, path)); err == nil && info.IsDir() {
+			key = "dir"
+		}
+		fmt.Fprintf(&result, "  - %s: %s\n", key, strconv.Quote(filepath.ToSlash(path)))
+	}
+	return result.String()
+}
+
+// compileAdHoc compiles paths relative to root as pcp cat and pcp pick
+// do, or with emit set writes the prompt file to emit instead, with the
+// paths made relative to it.
+func compileAdHoc(opts Options, root string, paths []string, emit string) error {
+	if emit != "" {
+		emitDir, err := filepath.Abs(filepath.Dir(emit))
+		if err != nil {
+			return err
+		}
+		rootDir, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		relative := make([]string, len(paths))
+		for i, path := range paths {
+			relative[i] = path
+			if !filepath.IsAbs(path) {
+				if rel, err := filepath.Rel(emitDir, filepath.Join(rootDir, path)); err == nil {
+					relative[i] = rel
+				}
+			}
+		}
+		if err := os.WriteFile(emit, []byte(adHocPromptFile(emitDir, relative)), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", emit, err)
+		}
+		fmt.Fprintf(os.Stderr, "pcp: wrote %d operations to %s\n", len(paths), emit)
+		return nil
+	}
+
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	// Paths in a prompt file are relative to it, so the selection is
+	// compiled from a hidden prompt file in root
+	promptFile, err := os.CreateTemp(root, ".pcp-*.yml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(promptFile.Name())
+	_, err = promptFile.WriteString(adHocPromptFile(root, paths))
+	if closeErr := promptFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	opts.PromptFile = promptFile.Name()
+	return runCompile(opts)
+}
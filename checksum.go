@@ -0,0 +1,15 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// appendChecksum adds a trailer recording the sha256 of the output and the
+// number of top-level sections, so a consumer can check the context it
+// received is complete. The hash covers every byte before the trailer line.
+func appendChecksum(output string, sections int) string {
+	sum := sha256.Sum256([]byte(output))
+	return output + fmt.Sprintf("<!-- pcp-checksum: sha256=%s sections=%d -->\n", hex.EncodeToString(sum[:]), sections)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var validCompressions = map[string]bool{
+	"none": true,
+	"gzip": true,
+	"zstd": true,
+}
+
+// compressionExtensions are stripped from output paths before the format is
+// inferred, so context.md.gz is still markdown, and name the compression
+// an output file gets when -compress is not given.
+var compressionExtensions = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+}
+
+// resolveCompression returns the compression for an output file: method if
+// given, otherwise the one its extension names, or none.
+func resolveCompression(method, outputFile string) string {
+	if method != "" {
+		return method
+	}
+	if inferred, ok := compressionExtensions[strings.ToLower(filepath.Ext(outputFile))]; ok {
+		return inferred
+	}
+	return "none"
+}
+
+// compressOutput compresses output with the -compress method.
+func compressOutput(data []byte, method string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch method {
+	case "", "none":
+		return data, nil
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", method)
+	}
+	return buf.Bytes(), nil
+}
+
+// trimCompressionExt removes a trailing .gz or .zst from a path.
+func trimCompressionExt(path string) string {
+	if ext := filepath.Ext(path); compressionExtensions[strings.ToLower(ext)] != "" {
+		return strings.TrimSuffix(path, ext)
+	}
+	return path
+}
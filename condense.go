@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultDescriptionLimit is how many characters of each description a
+// condensed API spec keeps.
+const defaultDescriptionLimit = 100
+
+// openAPINameMaps are the OpenAPI keys whose mappings are keyed by names
+// the spec chose, such as property names, rather than by OpenAPI keywords.
+// A property called "example" is part of the skeleton, not an example.
+var openAPINameMaps = map[string]bool{
+	"paths": true, "properties": true, "definitions": true, "schemas": true,
+	"parameters": true, "responses": true, "headers": true, "requestBodies": true,
+	"securitySchemes": true, "links": true, "callbacks": true, "content": true,
+	"patternProperties": true, "$defs": true,
+}
+
+// condenseAPISpec reduces an OpenAPI (or Swagger) document or a protobuf
+// file to its skeleton: endpoints, messages and their fields, with
+// examples and extensions dropped and descriptions cut to limit characters.
+func condenseAPISpec(content, path string, limit int) (string, error) {
+	if strings.EqualFold(filepath.Ext(path), ".proto") {
+		return condenseProto(content, limit), nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return "", fmt.Errorf("cannot condense %s: %w", path, err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 ||
+		(mappingValue(doc.Content[0], "openapi") == nil && mappingValue(doc.Content[0], "swagger") == nil) {
+		return "", fmt.Errorf("cannot condense %s: condense supports OpenAPI documents and .proto files", path)
+	}
+	condenseOpenAPINode(doc.Content[0], false, limit)
+
+	// JSON specs come out as YAML, which is the more compact of the two
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc.Content[0]); err != nil {
+		return "", fmt.Errorf("cannot condense %s: %w", path, err)
+	}
+	return out.String(), nil
+}
+
+// condenseOpenAPINode prunes node in place. names is true when node's keys
+// are names chosen by the spec, which are never dropped.
+func condenseOpenAPINode(node *yaml.Node, names bool, limit int) {
+	node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+	// The encoder quotes scalars again where YAML needs it
+	node.Style = 0
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			condenseOpenAPINode(item, false, limit)
+		}
+	case yaml.MappingNode:
+		var kept []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if !names {
+				switch {
+				case key.Value == "example" || key.Value == "examples" || key.Value == "externalDocs" || strings.HasPrefix(key.Value, "x-"):
+					continue
+				case (key.Value == "description" || key.Value == "summary") && value.Kind == yaml.ScalarNode:
+					value.Value = truncateDescription(value.Value, limit)
+					value.Style = 0
+				}
+			}
+			key.HeadComment, key.LineComment, key.FootComment = "", "", ""
+			key.Style = 0
+			condenseOpenAPINode(value, !names && openAPINameMaps[key.Value], limit)
+			kept = append(kept, key, value)
+		}
+		node.Content = kept
+	}
+}
+
+// truncateDescription joins a description onto one line and cuts it to
+// limit characters, at a word boundary when there is one, marking the cut
+// with an ellipsis.
+func truncateDescription(text string, limit int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	cut := string(runes[:limit])
+	if i := strings.LastIndex(cut, " "); i > 0 && runes[limit] != ' ' {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ") + "…"
+}
+
+// condenseProto keeps a protobuf file's declarations, drops blank lines and
+// file-level options, and shortens each comment block to a single line of
+// at most limit characters.
+func condenseProto(content string, limit int) string {
+	var result []string
+	var comment []string
+	inBlock := false
+	depth := 0
+	flush := func(indent string) {
+		if text := truncateDescription(strings.Join(comment, " "), limit); text != "" {
+			result = append(result, indent+"// "+text)
+		}
+		comment = nil
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inBlock {
+			text, closed := strings.CutSuffix(trimmed, "*/")
+			if !closed {
+				if i := strings.Index(trimmed, "*/"); i >= 0 {
+					text, closed = trimmed[:i], true
+				}
+			}
+			comment = append(comment, strings.TrimLeft(text, "* "))
+			inBlock = !closed
+			continue
+		}
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "//"):
+			comment = append(comment, strings.TrimSpace(strings.TrimLeft(trimmed, "/")))
+			continue
+		case strings.HasPrefix(trimmed, "/*"):
+			text, closed := strings.CutSuffix(strings.TrimPrefix(trimmed, "/*"), "*/")
+			comment = append(comment, strings.TrimLeft(text, "* "))
+			inBlock = !closed
+			continue
+		}
+
+		if depth == 0 && strings.HasPrefix(trimmed, "option ") {
+			comment = nil
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		flush(indent)
+		// A trailing comment on a field is shortened like the others
+		if code, trailing, found := strings.Cut(line, "//"); found && !strings.Contains(code, `"`) {
+			line = strings.TrimRight(code, " \t")
+			if text := truncateDescription(trailing, limit); text != "" {
+				line += " // " + text
+			}
+		}
+		result = append(result, line)
+		depth += strings.Count(trimmed, "{") - strings.Count(trimmed, "}")
+	}
+	return strings.Join(result, "\n") + "\n"
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CoverageSpec includes the Go files, or just the functions, that a test
+// run executed, read from a coverage profile written by go test
+// -coverprofile.
+type CoverageSpec struct {
+	Profile string `yaml:"profile"`
+
+	// Min is the share of a file's statements, in percent, that must have
+	// run for the file to be included. Zero includes any file that ran.
+	Min float64 `yaml:"min,omitempty"`
+
+	// Functions includes only the functions that ran instead of whole files.
+	Functions bool `yaml:"functions,omitempty"`
+}
+
+func validateCoverage(spec CoverageSpec) error {
+	if spec.Profile == "" {
+		return fmt.Errorf("coverage needs a profile")
+	}
+	if spec.Min < 0 || spec.Min > 100 {
+		return fmt.Errorf("coverage min must be a percentage from 0 to 100")
+	}
+	return nil
+}
+
+// coverBlock is one line of a coverage profile: a range of lines, its
+// statement count and how often it ran.
+type coverBlock struct {
+	startLine, endLine int
+	statements, count  int
+}
+
+// parseCoverProfile reads a Go coverage profile into blocks by file, as the
+// file names appear in it (import path and file name). Profiles from
+// several packages may repeat a block; its counts are added.
+func parseCoverProfile(data string) (map[string][]coverBlock, error) {
+	blocks := make(map[string][]coverBlock)
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// name.go:startLine.startCol,endLine.endCol statements count
+		colon := strings.LastIndex(line, ":")
+		fields := strings.Fields(line[colon+1:])
+		if colon < 0 || len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: not a coverage profile line", lineNumber)
+		}
+		start, end, _ := strings.Cut(fields[0], ",")
+		startLine, err1 := strconv.Atoi(strings.Split(start, ".")[0])
+		endLine, err2 := strconv.Atoi(strings.Split(end, ".")[0])
+		statements, err3 := strconv.Atoi(fields[1])
+		count, err4 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, fmt.Errorf("line %d: not a coverage profile line", lineNumber)
+		}
+		file := line[:colon]
+		key := file + ":" + fields[0]
+		if i, ok := index[key]; ok {
+			blocks[file][i].count += count
+			continue
+		}
+		index[key] = len(blocks[file])
+		blocks[file] = append(blocks[file], coverBlock{startLine, endLine, statements, count})
+	}
+	return blocks, scanner.Err()
+}
+
+// coveredShare returns the percentage of statements in blocks that ran.
+func coveredShare(blocks []coverBlock) float64 {
+	total, covered := 0, 0
+	for _, block := range blocks {
+		total += block.statements
+		if block.count > 0 {
+			covered += block.statements
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+// coverageFilePath maps a profile's file name, an import path, to a file
+// below the module root that contains the profile. Absolute names, as in
+// GOPATH-mode profiles, are used as they are.
+func coverageFilePath(name, moduleRoot, modulePath string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return name, true
+	}
+	if modulePath == "" || (name != modulePath && !strings.HasPrefix(name, modulePath+"/")) {
+		return "", false
+	}
+	return filepath.Join(moduleRoot, filepath.FromSlash(strings.TrimPrefix(name, modulePath+"/"))), true
+}
+
+// findModule returns the directory and module path of the go.mod at or
+// above dir.
+func findModule(dir string) (root, modulePath string) {
+	for {
+		if data, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "module "); ok {
+					return dir, strings.Trim(strings.TrimSpace(rest), `"`)
+				}
+			}
+			return dir, ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// processCoverageOperation reads the profile when the operation runs, so a
+// command earlier in the prompt can produce it.
+func processCoverageOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec := *p.Op.Coverage
+	data, err := ctx.ReadFile(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+	profile, err := parseCoverProfile(string(data))
+	if err != nil {
+		return ContentSection{}, fmt.Errorf("invalid coverage profile %s: %w", p.Path, err)
+	}
+	profileDir, _ := filepath.Abs(filepath.Dir(p.Path))
+	moduleRoot, modulePath := findModule(profileDir)
+
+	names := make([]string, 0, len(profile))
+	for name := range profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var blocks []string
+	for _, name := range names {
+		share := coveredShare(profile[name])
+		if share == 0 || share < spec.Min {
+			continue
+		}
+		path, ok := coverageFilePath(name, moduleRoot, modulePath)
+		if !ok {
+			return ContentSection{}, fmt.Errorf("cannot find %s from the coverage profile: it is not in the module at %s", name, profileDir)
+		}
+		ctx.AddDependency(path)
+		content, err := ctx.ReadFile(path)
+		if err != nil {
+			return ContentSection{}, ErrFileNotFound{File: path}
+		}
+		header := "// " + displayPath(name)
+		if moduleRoot != "" {
+			if rel, err := filepath.Rel(moduleRoot, path); err == nil {
+				header = "// " + displayPath(rel)
+			}
+		}
+
+		if !spec.Functions {
+			blocks = append(blocks, header+"\n"+strings.TrimRight(string(content), "\n"))
+			continue
+		}
+		decls, err := parseGoDecls(path, content)
+		if err != nil {
+			return ContentSection{}, err
+		}
+		for _, decl := range decls {
+			if decl.isFunc && ranWithin(profile[name], decl.line, decl.endLine) {
+				blocks = append(blocks, header+"\n"+decl.code)
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		ctx.Warn("coverage profile %s has no files above %g%% coverage", displayPath(p.Value), spec.Min)
+	}
+
+	return ContentSection{
+		Source:  displayPath(p.Value),
+		Content: normalizeContent(strings.Join(blocks, "\n\n")),
+		Type:    CoverageOp,
+	}, nil
+}
+
+// ranWithin reports whether any block between the lines ran.
+func ranWithin(blocks []coverBlock, startLine, endLine int) bool {
+	for _, block := range blocks {
+		if block.count > 0 && block.startLine <= endLine && block.endLine >= startLine {
+			return true
+		}
+	}
+	return false
+}
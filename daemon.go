@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// daemonRequest is one compile request, sent as a single line of JSON.
+// Relative paths are resolved against Dir, which is also where commands run.
+type daemonRequest struct {
+	PromptFile     string            `json:"prompt_file"`
+	Dir            string            `json:"dir,omitempty"`
+	MaxWords       int               `json:"max_words,omitempty"`
+	DelimiterStyle string            `json:"delimiter_style,omitempty"`
+	Format         string            `json:"format,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	Overflow       string            `json:"overflow,omitempty"`
+	Vars           map[string]string `json:"vars,omitempty"`
+}
+
+// daemonResponse answers a request with either the compiled output or an error.
+type daemonResponse struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func defaultSocketPath() string {
+	return filepath.Join(os.TempDir(), "pcp.sock")
+}
+
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socketPath := fs.String("socket", defaultSocketPath(), "Path of the unix socket to listen on")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp daemon [-socket <path>]
+
+Serves compile requests over a local socket, keeping parsed prompt files and
+file contents cached in memory between requests. Each request is one line of
+JSON and is answered with one line of JSON:
+
+  {"prompt_file": "prompt.yml", "dir": "/path/to/project", "format": "text"}
+  {"output": "..."} or {"error": "..."}
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// A leftover socket from a previous run would make Listen fail
+	if info, err := os.Stat(*socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(*socketPath)
+	}
+
+	listener, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", *socketPath, err)
+	}
+	defer os.Remove(*socketPath)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "pcp daemon listening on %s\n", *socketPath)
+	return serveDaemon(listener, newSourceCache())
+}
+
+// serveDaemon accepts connections until the listener is closed.
+func serveDaemon(listener net.Listener, cache *sourceCache) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go handleDaemonConn(conn, cache)
+	}
+}
+
+func handleDaemonConn(conn net.Conn, cache *sourceCache) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req daemonRequest
+		var resp daemonResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else if output, err := compileDaemonRequest(req, cache); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Output = output
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func compileDaemonRequest(req daemonRequest, cache *sourceCache) (string, error) {
+	if req.PromptFile == "" {
+		return "", fmt.Errorf("prompt_file is required")
+	}
+
+	opts := Options{
+		PromptFile:     req.PromptFile,
+		MaxWords:       req.MaxWords,
+		DelimiterStyle: req.DelimiterStyle,
+		Format:         req.Format,
+		Target:         req.Target,
+		Overflow:       req.Overflow,
+		Vars:           req.Vars,
+		WorkDir:        req.Dir,
+		cache:          cache,
+	}
+	if opts.MaxWords == 0 {
+		opts.MaxWords = 128000
+	}
+	if opts.DelimiterStyle == "" {
+		opts.DelimiterStyle = "xml"
+	}
+	if req.Dir != "" && !filepath.IsAbs(opts.PromptFile) {
+		opts.PromptFile = filepath.Join(req.Dir, opts.PromptFile)
+	}
+	if err := validateOptions(opts); err != nil {
+		return "", err
+	}
+
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		return "", err
+	}
+	return renderOutput(compiled, resolveFormat(opts.Format, ""), opts.DelimiterStyle, opts.sectionSeparator())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// summarizeDependencies reduces a dependency manifest to its direct
+// dependencies and their versions: go.mod, package.json, or a pip
+// requirements file.
+func summarizeDependencies(content, path string) (string, error) {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case name == "go.mod":
+		return summarizeGoMod(content), nil
+	case name == "package.json":
+		return summarizePackageJSON(content, path)
+	case strings.HasPrefix(name, "requirements") && strings.HasSuffix(name, ".txt"):
+		return summarizeRequirements(content), nil
+	}
+	return "", fmt.Errorf("deps_summary supports go.mod, package.json and requirements*.txt files, not %s", path)
+}
+
+// summarizeGoMod keeps a go.mod's module path, Go version, direct
+// requirements and replacements, dropping // indirect requirements.
+func summarizeGoMod(content string) string {
+	var header, requires, replaces []string
+	block := ""
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		code, comment, _ := strings.Cut(line, "//")
+		fields := strings.Fields(code)
+		if len(fields) == 0 {
+			continue
+		}
+		if block != "" {
+			if fields[0] == ")" {
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+
+		switch fields[0] {
+		case "module", "go":
+			header = append(header, strings.Join(fields, " "))
+		case "require":
+			if strings.TrimSpace(comment) != "indirect" && len(fields) == 3 {
+				requires = append(requires, "  "+fields[1]+" "+fields[2])
+			}
+		case "replace":
+			replaces = append(replaces, "  "+strings.Join(fields[1:], " "))
+		}
+	}
+	return joinDependencyGroups(strings.Join(header, "\n"), map[string][]string{"require": requires, "replace": replaces}, []string{"require", "replace"})
+}
+
+// packageJSONGroups are the package.json fields listing a package's own
+// dependencies, in the order they are shown.
+var packageJSONGroups = []string{"dependencies", "devDependencies", "peerDependencies", "optionalDependencies"}
+
+// summarizePackageJSON keeps a package.json's name, version and dependency
+// lists, dropping scripts, configuration and other metadata.
+func summarizePackageJSON(content, path string) (string, error) {
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		return "", fmt.Errorf("invalid package.json %s: %w", path, err)
+	}
+	var name, version string
+	json.Unmarshal(manifest["name"], &name)
+	json.Unmarshal(manifest["version"], &version)
+
+	groups := make(map[string][]string)
+	for _, group := range packageJSONGroups {
+		var deps map[string]string
+		if raw, ok := manifest[group]; !ok || json.Unmarshal(raw, &deps) != nil {
+			continue
+		}
+		names := make([]string, 0, len(deps))
+		for dep := range deps {
+			names = append(names, dep)
+		}
+		sort.Strings(names)
+		for _, dep := range names {
+			groups[group] = append(groups[group], "  "+dep+" "+deps[dep])
+		}
+	}
+	return joinDependencyGroups(strings.TrimSpace(name+" "+version), groups, packageJSONGroups), nil
+}
+
+func joinDependencyGroups(header string, groups map[string][]string, order []string) string {
+	parts := []string{}
+	if header != "" {
+		parts = append(parts, header)
+	}
+	for _, group := range order {
+		if len(groups[group]) > 0 {
+			parts = append(parts, group+":\n"+strings.Join(groups[group], "\n"))
+		}
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// pipViaRequirement matches the "# via -r requirements.in" annotation
+// pip-compile writes under a requirement that was asked for directly.
+var pipViaRequirement = regexp.MustCompile(`^#\s+(?:via\s+)?-[rc]\s`)
+
+// summarizeRequirements keeps the requirements of a pip requirements
+// file, without comments, options or --hash pins. In files written by
+// pip-compile, requirements only pulled in by other packages, whose "# via"
+// annotations name no requirements file, are indirect and dropped.
+func summarizeRequirements(content string) string {
+	type requirement struct {
+		spec     string
+		via      bool
+		viaInput bool
+	}
+	var requirements []*requirement
+	var current *requirement
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[i])
+		}
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			if current == nil {
+				continue
+			}
+			if strings.HasPrefix(line, "# via") {
+				current.via = true
+			}
+			if current.via && pipViaRequirement.MatchString(line) {
+				current.viaInput = true
+			}
+			continue
+		case strings.HasPrefix(line, "-"):
+			current = nil
+			continue
+		}
+
+		spec, _, _ := strings.Cut(line, " #")
+		if i := strings.Index(spec, " --"); i >= 0 {
+			spec = spec[:i]
+		}
+		current = &requirement{spec: strings.TrimSpace(spec)}
+		requirements = append(requirements, current)
+	}
+
+	var kept []string
+	for _, r := range requirements {
+		if !r.via || r.viaInput {
+			kept = append(kept, r.spec)
+		}
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DiffSpec compares two files, or with neither A nor B, shows changes in
+// the git repository containing the prompt file. B is resolved like A,
+// relative to the prompt file. Written as a string, a diff is a git range.
+type DiffSpec struct {
+	A string `yaml:"a,omitempty"`
+	B string `yaml:"b,omitempty"`
+
+	// Range is what git diff compares, such as HEAD~1..HEAD or main; with
+	// Staged the index is compared instead of the working tree. Paths
+	// limits the diff, and Context sets the lines of context around each
+	// change: 0 leaves only the changed lines.
+	Range   string   `yaml:"range,omitempty"`
+	Staged  bool     `yaml:"staged,omitempty"`
+	Paths   []string `yaml:"paths,omitempty"`
+	Context *int     `yaml:"context,omitempty"`
+}
+
+func (s *DiffSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Range)
+	}
+	// The fields, without this method
+	type diffFields DiffSpec
+	if err := checkUnknownKeys(node, reflect.TypeOf(diffFields{})); err != nil {
+		return err
+	}
+	return node.Decode((*diffFields)(s))
+}
+
+// isGit reports whether the diff runs git diff rather than comparing two
+// files.
+func (s DiffSpec) isGit() bool {
+	return s.A == "" && s.B == ""
+}
+
+// String is the git diff command a git diff shows as its source.
+func (s DiffSpec) String() string {
+	if !s.isGit() {
+		return s.A
+	}
+	args := []string{"git", "diff"}
+	if s.Staged {
+		args = append(args, "--staged")
+	}
+	if s.Range != "" {
+		args = append(args, s.Range)
+	}
+	if len(s.Paths) > 0 {
+		args = append(append(args, "--"), s.Paths...)
+	}
+	return strings.Join(args, " ")
+}
+
+func validateDiff(spec DiffSpec) error {
+	if spec.isGit() {
+		// git would read a leading dash as an option
+		if strings.HasPrefix(spec.Range, "-") {
+			return fmt.Errorf("invalid diff range %q", spec.Range)
+		}
+		if spec.Context != nil && *spec.Context < 0 {
+			return fmt.Errorf("diff context must not be negative")
+		}
+		return nil
+	}
+	if spec.A == "" || spec.B == "" {
+		return fmt.Errorf("diff needs both a and b")
+	}
+	if spec.Range != "" || spec.Staged || spec.Paths != nil || spec.Context != nil {
+		return fmt.Errorf("range, staged, paths and context apply only to git diffs, without a and b")
+	}
+	return nil
+}
+
+// processDiffOperation renders a unified diff of the two files natively, so
+// the output is the same on every platform whichever diff is installed.
+func processDiffOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec := *p.Op.Diff
+	if spec.isGit() {
+		return processGitDiff(p, ctx)
+	}
+	// b is expanded here, once variables captured earlier have their values
+	nameB := displayPath(ctx.Expand(spec.B))
+	promptDir, _ := filepath.Abs(filepath.Dir(p.File))
+	pathB := resolvePath(promptDir, filepath.FromSlash(nameB))
+	ctx.AddDependency(pathB)
+
+	var contents [2]string
+	for i, path := range []string{p.Path, pathB} {
+		if isBinaryFile(path) {
+			return ContentSection{}, ErrBinaryFile{File: path}
+		}
+		data, err := ctx.ReadFile(path)
+		if err != nil {
+			return ContentSection{}, ErrFileNotFound{File: path}
+		}
+		contents[i] = strings.ReplaceAll(string(data), "\r\n", "\n")
+	}
+
+	nameA := displayPath(p.Value)
+	content := fmt.Sprintf("%s and %s are identical", nameA, nameB)
+	if contents[0] != contents[1] {
+		content = unifiedDiff(nameA, nameB, contents[0], contents[1])
+	}
+	return ContentSection{
+		Source:  nameA + ".." + nameB,
+		Content: normalizeContent(content),
+		Type:    DiffOp,
+	}, nil
+}
+
+// unifiedDiff renders the line changes from before to after as a unified
+// diff with three lines of context.
+func unifiedDiff(fromName, toName, before, after string) string {
+	a, b := splitLines(before), splitLines(after)
+
+	type line struct {
+		op   byte
+		text string
+		i, j int // positions in a and b before this line
+	}
+	var lines []line
+	i, j := 0, 0
+	for _, m := range append(commonLines(a, b), lineMatch{len(a), len(b)}) {
+		// Removals come before additions, as in diff(1)
+		for ; i < m.i; i++ {
+			lines = append(lines, line{'-', a[i], i, j})
+		}
+		for ; j < m.j; j++ {
+			lines = append(lines, line{'+', b[j], i, j})
+		}
+		if i < len(a) {
+			lines = append(lines, line{' ', a[i], i, j})
+			i, j = i+1, j+1
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines
+		first := max(start-context, 0)
+		end, last := start, start
+		for end < len(lines) && end-last <= 2*context {
+			if lines[end].op != ' ' {
+				last = end
+			}
+			end++
+		}
+		end = min(last+context+1, len(lines))
+
+		countA, countB := 0, 0
+		for _, l := range lines[first:end] {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", lines[first].i+1, countA, lines[first].j+1, countB)
+		for _, l := range lines[first:end] {
+			fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		}
+		start = end
+	}
+	return out.String()
+}
+
+// lineMatch pairs line i of one file with the equal line j of the other.
+type lineMatch struct {
+	i, j int
+}
+
+// commonLines returns the lines the two files keep in a shortest edit
+// script between them, in order. It is Myers' diff in its linear space
+// form: the middle snake of the edit graph is found by searching from both
+// ends at once, and the parts before and after it are diffed in turn, so
+// memory grows with the length of the files rather than their product.
+func commonLines(a, b []string) []lineMatch {
+	// Lines are compared as numbers, one for each distinct text. A line
+	// that is not in the other file is always an edit, so it is dropped
+	// before the search, which keeps files with little in common fast
+	ids := make(map[string]int)
+	for _, text := range a {
+		if _, ok := ids[text]; !ok {
+			ids[text] = -1
+		}
+	}
+	shared := 0
+	for _, text := range b {
+		if id, ok := ids[text]; ok && id < 0 {
+			ids[text] = shared
+			shared++
+		}
+	}
+	keep := func(lines []string) (kept, index []int) {
+		for i, text := range lines {
+			if id, ok := ids[text]; ok && id >= 0 {
+				kept, index = append(kept, id), append(index, i)
+			}
+		}
+		return kept, index
+	}
+	var indexA, indexB []int
+	d := myersDiff{}
+	d.a, indexA = keep(a)
+	d.b, indexB = keep(b)
+	size := len(d.a) + len(d.b) + 5
+	d.forward, d.backward = make([]int, size), make([]int, size)
+	d.compare(0, len(d.a), 0, len(d.b))
+	for k, m := range d.matches {
+		d.matches[k] = lineMatch{indexA[m.i], indexB[m.j]}
+	}
+	return d.matches
+}
+
+type myersDiff struct {
+	a, b              []int
+	forward, backward []int
+	matches           []lineMatch
+}
+
+func (d *myersDiff) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches = append(d.matches, lineMatch{aLo, bLo})
+		aLo, bLo = aLo+1, bLo+1
+	}
+	suffix := 0
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi, bHi, suffix = aHi-1, bHi-1, suffix+1
+	}
+	if aLo < aHi && bLo < bHi {
+		x, y, u, v := d.middleSnake(aLo, aHi, bLo, bHi)
+		d.compare(aLo, x, bLo, y)
+		for ; x < u; x, y = x+1, y+1 {
+			d.matches = append(d.matches, lineMatch{x, y})
+		}
+		d.compare(u, aHi, v, bHi)
+	}
+	for k := 0; k < suffix; k++ {
+		d.matches = append(d.matches, lineMatch{aHi + k, bHi + k})
+	}
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the run of equal
+// lines in the middle of a shortest edit script between a[aLo:aHi] and
+// b[bLo:bHi], which both differ in their first and last lines. forward[k]
+// is how far along a the search from the start has reached on diagonal k,
+// and backward[k] the same from the end.
+func (d *myersDiff) middleSnake(aLo, aHi, bLo, bHi int) (x, y, u, v int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	limit := (n + m + 1) / 2
+	offset := limit + 1
+	forward, backward := d.forward[:2*offset+1], d.backward[:2*offset+1]
+	forward[offset+1], backward[offset+1] = 0, 0
+	for cost := 0; cost <= limit; cost++ {
+		for k := -cost; k <= cost; k += 2 {
+			var fx int
+			if k == -cost || (k != cost && forward[offset+k-1] < forward[offset+k+1]) {
+				fx = forward[offset+k+1]
+			} else {
+				fx = forward[offset+k-1] + 1
+			}
+			fy := fx - k
+			sx, sy := fx, fy
+			for fx < n && fy < m && d.a[aLo+fx] == d.b[bLo+fy] {
+				fx, fy = fx+1, fy+1
+			}
+			forward[offset+k] = fx
+			if c := delta - k; odd && c >= -(cost-1) && c <= cost-1 && fx+backward[offset+c] >= n {
+				return aLo + sx, bLo + sy, aLo + fx, bLo + fy
+			}
+		}
+		for c := -cost; c <= cost; c += 2 {
+			var bx int
+			if c == -cost || (c != cost && backward[offset+c-1] < backward[offset+c+1]) {
+				bx = backward[offset+c+1]
+			} else {
+				bx = backward[offset+c-1] + 1
+			}
+			by := bx - c
+			sx, sy := bx, by
+			for bx < n && by < m && d.a[aHi-1-bx] == d.b[bHi-1-by] {
+				bx, by = bx+1, by+1
+			}
+			backward[offset+c] = bx
+			if k := delta - c; !odd && k >= -cost && k <= cost && forward[offset+k]+bx >= n {
+				return aHi - bx, bHi - by, aHi - sx, bHi - sy
+			}
+		}
+	}
+	// Not reached: the searches meet within limit steps
+	return aLo, bLo, aLo, bLo
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// fileDiff is one changed file of a git diff.
+type fileDiff struct {
+	from, to       string
+	status         string
+	added, removed int
+	binary         bool
+	hunks          []string
+}
+
+// processGitDiff runs git diff in the prompt file's directory and renders
+// each changed file under its own header, with what happened to it and its
+// line counts, so the model need not decode git's metadata lines.
+func processGitDiff(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec := *p.Op.Diff
+	dir, _ := filepath.Abs(filepath.Dir(p.File))
+	args := []string{"-c", "core.quotePath=false", "diff", "--no-color", "--no-ext-diff", "--find-renames"}
+	if spec.Context != nil {
+		args = append(args, fmt.Sprintf("--unified=%d", *spec.Context))
+	}
+	if spec.Staged {
+		args = append(args, "--staged")
+	}
+	if spec.Range != "" {
+		diffRange := ctx.Expand(spec.Range)
+		if strings.HasPrefix(diffRange, "-") {
+			return ContentSection{}, fmt.Errorf("invalid diff range %q", diffRange)
+		}
+		args = append(args, diffRange)
+	}
+	args = append(args, "--")
+	for _, path := range spec.Paths {
+		args = append(args, ctx.Expand(path))
+	}
+	output, err := gitOutput(dir, args...)
+	if err != nil {
+		return ContentSection{}, ErrCommandFailed{Command: p.Value, Err: err}
+	}
+
+	files := parseGitDiff(output)
+	return ContentSection{
+		Source:  p.Value,
+		Content: normalizeContent(renderGitDiff(files)),
+		Type:    DiffOp,
+	}, nil
+}
+
+// parseGitDiff splits git diff output into its files.
+func parseGitDiff(output string) []fileDiff {
+	var files []fileDiff
+	var file *fileDiff
+	inHunk := false
+	for _, line := range splitLines(output) {
+		if strings.HasPrefix(line, "diff --git ") {
+			files = append(files, fileDiff{status: "modified"})
+			file = &files[len(files)-1]
+			inHunk = false
+			// Replaced by the ---, +++ or rename lines when they follow
+			names := strings.TrimPrefix(line, "diff --git a/")
+			if i := strings.Index(names, " b/"); i >= 0 {
+				file.from, file.to = names[:i], names[i+3:]
+			}
+			continue
+		}
+		if file == nil {
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			inHunk = true
+		}
+		if inHunk {
+			file.hunks = append(file.hunks, line)
+			switch {
+			case strings.HasPrefix(line, "+"):
+				file.added++
+			case strings.HasPrefix(line, "-"):
+				file.removed++
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "new file mode"):
+			file.status = "added"
+		case strings.HasPrefix(line, "deleted file mode"):
+			file.status = "deleted"
+		case strings.HasPrefix(line, "rename from "):
+			file.status, file.from = "renamed", strings.TrimPrefix(line, "rename from ")
+		case strings.HasPrefix(line, "rename to "):
+			file.to = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "--- a/"):
+			file.from = strings.TrimRight(strings.TrimPrefix(line, "--- a/"), "\t")
+		case strings.HasPrefix(line, "+++ b/"):
+			file.to = strings.TrimRight(strings.TrimPrefix(line, "+++ b/"), "\t")
+		case strings.HasPrefix(line, "Binary files "):
+			file.binary = true
+		}
+	}
+	return files
+}
+
+// renderGitDiff renders the files of a git diff after a summary like git
+// diff --shortstat.
+func renderGitDiff(files []fileDiff) string {
+	if len(files) == 0 {
+		return "no changes"
+	}
+	added, removed := 0, 0
+	for _, file := range files {
+		added += file.added
+		removed += file.removed
+	}
+	var out strings.Builder
+	fileNoun := "files"
+	if len(files) == 1 {
+		fileNoun = "file"
+	}
+	fmt.Fprintf(&out, "%d %s changed, %d insertions(+), %d deletions(-)\n", len(files), fileNoun, added, removed)
+	for _, file := range files {
+		name := file.to
+		switch file.status {
+		case "deleted":
+			name = file.from
+		case "renamed":
+			name = file.from + " -> " + file.to
+		}
+		counts := fmt.Sprintf("+%d -%d", file.added, file.removed)
+		if file.binary {
+			counts = "binary"
+		}
+		fmt.Fprintf(&out, "\n## %s (%s, %s)\n", name, file.status, counts)
+		for _, line := range file.hunks {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func validateDirOptions(op Operation, opType OperationType) error {
+	if op.MaxDepth != 0 && opType != DirOp && opType != TreeOp {
+		return fmt.Errorf("max_depth applies only to dir and tree operations")
+	}
+	if op.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+	if op.Extensions != nil && opType != DirOp {
+		return fmt.Errorf("extensions apply only to dir operations")
+	}
+	for _, ext := range op.Extensions {
+		if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, `/\`) {
+			return fmt.Errorf("invalid extension %q", ext)
+		}
+	}
+	return nil
+}
+
+// dirFiles returns the files below root, relative to it and in sortPaths
+// order, that have one of the extensions (any file when there are none)
+// and are at most maxDepth levels down (any depth when it is zero).
+// Hidden files and directories are left out, as they are by globs, and so
+// is anything ignore ignores.
+func dirFiles(root string, extensions []string, maxDepth int, ignore ignoreSet) (files, dirs []string, err error) {
+	wanted := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		wanted[strings.ToLower("."+strings.TrimPrefix(ext, "."))] = true
+	}
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") || ignore.Ignored(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		depth := strings.Count(filepath.ToSlash(rel), "/") + 1
+		if entry.IsDir() {
+			if maxDepth > 0 && depth >= maxDepth {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if len(wanted) > 0 && !wanted[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	// WalkDir sorts each directory's entries, which puts a/b before a.txt
+	sortPaths(files)
+	return files, dirs, err
+}
+
+// planDir expands a dir operation into one file operation per file below
+// the directory. Binary files get a stub naming them unless the operation
+// sets its own binary policy.
+func planDir(p PlannedOperation, ctx *ProcessingContext) ([]PlannedOperation, error) {
+	// The files are listed while planning, before any capture has run
+	if name := capturedRef(p.Value, ctx); name != "" {
+		return nil, fmt.Errorf("dir paths cannot use the captured variable ${%s}", name)
+	}
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, ErrFileNotFound{File: p.Path}
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", p.Path)
+	}
+	files, dirs, err := dirFiles(p.Path, p.Op.Extensions, p.Op.MaxDepth, ctx.ignoreRules(p.Op, p.Path))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		ctx.AddDependency(dir)
+	}
+
+	values := make([]string, len(files))
+	for i, file := range files {
+		values[i] = filepath.Join(p.Value, file)
+	}
+	op := p.Op
+	op.Dir, op.Extensions, op.MaxDepth = nil, nil, 0
+	if op.Binary == "" {
+		op.Binary = "stub"
+	}
+	p.Op, p.Type = op, FileOp
+	planned := planFileMatches(p, values, ctx)
+	if len(planned) == 0 {
+		return nil, fmt.Errorf("no files found in %s", p.Value)
+	}
+	return planned, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// DuplicateSection records two sections with the same or nearly the same
+// content, typically the result of including a file twice.
+type DuplicateSection struct {
+	First      string
+	Second     string
+	Similarity float64
+}
+
+const (
+	// Sections at or above this shingle similarity are reported as near
+	// duplicates. Shorter sections are only compared byte for byte.
+	nearDuplicateThreshold = 0.9
+	nearDuplicateMinWords  = 20
+	shingleSize            = 3
+)
+
+// findDuplicates compares every pair of leaf sections, leaving out refs
+// (sourced as #label), which repeat content on purpose.
+func findDuplicates(sections []ContentSection) []DuplicateSection {
+	type candidate struct {
+		source   string
+		hash     [sha256.Size]byte
+		shingles map[string]bool
+	}
+
+	var candidates []candidate
+	for _, section := range leafSections(sections) {
+		if strings.HasPrefix(section.Source, "#") || strings.TrimSpace(section.Content) == "" {
+			continue
+		}
+		c := candidate{source: section.Source, hash: sha256.Sum256([]byte(section.Content))}
+		if countWords(section.Content) >= nearDuplicateMinWords {
+			c.shingles = wordShingles(section.Content)
+		}
+		candidates = append(candidates, c)
+	}
+
+	var duplicates []DuplicateSection
+	for i := range candidates {
+		for j := i + 1; j < len(candidates); j++ {
+			a, b := candidates[i], candidates[j]
+			similarity := 0.0
+			if a.hash == b.hash {
+				similarity = 1
+			} else if a.shingles != nil && b.shingles != nil {
+				similarity = jaccard(a.shingles, b.shingles)
+			}
+			if similarity >= nearDuplicateThreshold {
+				duplicates = append(duplicates, DuplicateSection{First: a.source, Second: b.source, Similarity: similarity})
+			}
+		}
+	}
+	return duplicates
+}
+
+// leafSections flattens nested prompt sections into the sections that hold
+// content.
+func leafSections(sections []ContentSection) []ContentSection {
+	var leaves []ContentSection
+	for _, section := range sections {
+		if section.Type == PromptOp {
+			leaves = append(leaves, leafSections(section.Children)...)
+			continue
+		}
+		leaves = append(leaves, section)
+	}
+	return leaves
+}
+
+func wordShingles(text string) map[string]bool {
+	words := strings.Fields(text)
+	shingles := make(map[string]bool)
+	for i := 0; i+shingleSize <= len(words); i++ {
+		shingles[strings.Join(words[i:i+shingleSize], " ")] = true
+	}
+	return shingles
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	shared := 0
+	for shingle := range a {
+		if b[shingle] {
+			shared++
+		}
+	}
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+func warnDuplicates(duplicates []DuplicateSection, ctx *ProcessingContext) {
+	for _, d := range duplicates {
+		ctx.Warn("%s", describeDuplicate(d))
+	}
+}
+
+func describeDuplicate(d DuplicateSection) string {
+	if d.Similarity == 1 {
+		return fmt.Sprintf("section %s has the same content as %s", d.Second, d.First)
+	}
+	return fmt.Sprintf("section %s is %.0f%% similar to %s", d.Second, d.Similarity*100, d.First)
+}
@@ -1,10 +1,15 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
 
 var (
-	ErrOperationEmpty    = fmt.Errorf("operation must specify exactly one of: file, prompt, command, text")
-	ErrOperationMultiple = fmt.Errorf("operation must specify exactly one of: file, prompt, command, text")
+	ErrOperationEmpty    = fmt.Errorf("operation must specify exactly one of: file, prompt, command, text, ref, sysinfo, timestamp, pcp_remote, assert, comment, symbol, related, coverage, stacktrace, log, diff, build_targets, script, dir, tree, git")
+	ErrOperationMultiple = fmt.Errorf("operation must specify exactly one of: file, prompt, command, text, ref, sysinfo, timestamp, pcp_remote, assert, comment, symbol, related, coverage, stacktrace, log, diff, build_targets, script, dir, tree, git")
 )
 
 type ErrInvalidYAML struct {
@@ -32,13 +37,35 @@ func (e ErrBinaryFile) Error() string {
 	return fmt.Sprintf("cannot process binary file: %s", e.File)
 }
 
+type ErrPatternNotFound struct {
+	File    string
+	Pattern string
+}
+
+func (e ErrPatternNotFound) Error() string {
+	return fmt.Sprintf("no line matching %q in %s", e.Pattern, e.File)
+}
+
 type ErrCircularReference struct {
 	File string
 	Path []string
 }
 
+// Error renders the include chain that leads back to File, with paths
+// relative to the directory of the first prompt file in the chain.
 func (e ErrCircularReference) Error() string {
-	return fmt.Sprintf("circular reference detected in file %s (reference path: %v)", e.File, e.Path)
+	chain := append(append([]string(nil), e.Path...), e.File)
+	base := ""
+	if len(e.Path) > 0 {
+		base = filepath.Dir(e.Path[0])
+	}
+	for i, path := range chain {
+		if rel, err := filepath.Rel(base, path); base != "" && err == nil {
+			path = rel
+		}
+		chain[i] = displayPath(path)
+	}
+	return fmt.Sprintf("circular reference detected: %s", strings.Join(chain, " -> "))
 }
 
 type ErrCommandFailed struct {
@@ -50,6 +77,31 @@ func (e ErrCommandFailed) Error() string {
 	return fmt.Sprintf("command execution failed: %s (%v)", e.Command, e.Err)
 }
 
+func (e ErrCommandFailed) Unwrap() error {
+	return e.Err
+}
+
+type ErrRemoteFetch struct {
+	URL string
+	Err error
+}
+
+func (e ErrRemoteFetch) Error() string {
+	return fmt.Sprintf("failed to fetch %s: %v", e.URL, e.Err)
+}
+
+func (e ErrRemoteFetch) Unwrap() error {
+	return e.Err
+}
+
+type ErrExecutableNotFound struct {
+	Name string
+}
+
+func (e ErrExecutableNotFound) Error() string {
+	return fmt.Sprintf("executable %s not found on PATH (set fallback_text to continue without it)", e.Name)
+}
+
 type ErrWordLimitExceeded struct {
 	Current int
 	Limit   int
@@ -58,3 +110,134 @@ type ErrWordLimitExceeded struct {
 func (e ErrWordLimitExceeded) Error() string {
 	return fmt.Sprintf("compiled output (%d words) exceeds maximum word limit (%d words)", e.Current, e.Limit)
 }
+
+type ErrByteLimitExceeded struct {
+	Current int
+	Limit   int
+}
+
+func (e ErrByteLimitExceeded) Error() string {
+	return fmt.Sprintf("compiled output (%d bytes) exceeds maximum output size (%d bytes)", e.Current, e.Limit)
+}
+
+// ErrOperationsFailed lists every operation that failed under -keep-going.
+type ErrOperationsFailed struct {
+	Failures []OperationFailure
+}
+
+func (e ErrOperationsFailed) Error() string {
+	var message strings.Builder
+	fmt.Fprintf(&message, "%d operations failed:", len(e.Failures))
+	for _, failure := range e.Failures {
+		fmt.Fprintf(&message, "\n  %s (%s): %v", operationLocation(failure.File, failure.Line, failure.Index), failure.Description, failure.Err)
+	}
+	return message.String()
+}
+
+// operationKey is an operation type key found in an operation's mapping.
+type operationKey struct {
+	Name string
+	Line int
+}
+
+// ErrMultipleOperationKeys is ErrOperationMultiple with the keys that were
+// found, and a hint for the usual cause.
+type ErrMultipleOperationKeys struct {
+	Keys []operationKey
+}
+
+func (e ErrMultipleOperationKeys) Error() string {
+	found := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		found[i] = key.Name
+		if key.Line > 0 {
+			found[i] = fmt.Sprintf("%s (line %d)", key.Name, key.Line)
+		}
+	}
+	return fmt.Sprintf("%v, found %s. If these are separate operations, start each with its own \"- \" at the same indentation", ErrOperationMultiple, strings.Join(found, ", "))
+}
+
+func (e ErrMultipleOperationKeys) Unwrap() error {
+	return ErrOperationMultiple
+}
+
+// ErrAtLocation places an error at the operation it came from, as
+// "prompt.yml:14: file not found: ...". Line is 0 when it is not known, and
+// the operation's index is shown instead.
+type ErrAtLocation struct {
+	File  string
+	Line  int
+	Index int
+	Err   error
+}
+
+func (e ErrAtLocation) Error() string {
+	return fmt.Sprintf("%s: %v", operationLocation(e.File, e.Line, e.Index), e.Err)
+}
+
+func (e ErrAtLocation) Unwrap() error {
+	return e.Err
+}
+
+// operationLocation renders where an operation is, preferring its line.
+func operationLocation(file string, line, index int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d", displayPath(file), line)
+	}
+	return fmt.Sprintf("%s operation %d", displayPath(file), index)
+}
+
+// locateError wraps err with the location of the operation that failed,
+// unless it already carries one from a nested prompt.
+func locateError(file string, index int, op Operation, err error) error {
+	var located ErrAtLocation
+	if errors.As(err, &located) {
+		return err
+	}
+	return ErrAtLocation{File: file, Line: op.Line, Index: index, Err: err}
+}
+
+type ErrUnknownTarget struct {
+	Target    string
+	Available []string
+}
+
+func (e ErrUnknownTarget) Error() string {
+	return fmt.Sprintf("unknown output target %s (available: %v)", e.Target, e.Available)
+}
+
+type ErrAssertionFailed struct {
+	Message string
+	Reason  string
+}
+
+func (e ErrAssertionFailed) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("assertion failed: %s (%s)", e.Message, e.Reason)
+	}
+	return fmt.Sprintf("assertion failed: %s", e.Reason)
+}
+
+type ErrUnknownLabel struct {
+	Label string
+}
+
+func (e ErrUnknownLabel) Error() string {
+	return fmt.Sprintf("ref to unknown label #%s (labels must be defined before they are referenced)", e.Label)
+}
+
+type ErrDuplicateLabel struct {
+	Label string
+}
+
+func (e ErrDuplicateLabel) Error() string {
+	return fmt.Sprintf("label #%s is defined more than once", e.Label)
+}
+
+type ErrStrictWarnings struct {
+	Warnings []string
+}
+
+func (e ErrStrictWarnings) Error() string {
+	return fmt.Sprintf("%d warning(s) treated as errors (-strict): %s", len(e.Warnings), strings.Join(e.Warnings, "; "))
+}
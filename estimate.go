@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// estimateBytesPerWord converts file sizes to words for -plan -stats:
+// prose averages about six bytes a word with its space, and code is close.
+const estimateBytesPerWord = 6
+
+// estimateLargest is how many of the largest files the estimate lists.
+const estimateLargest = 5
+
+type sizedFile struct {
+	path string
+	size int64
+}
+
+// printEstimate is -plan -stats: it estimates the size of the compile from
+// file metadata, without opening any file, so large trees are instant.
+// Text is counted exactly; operations whose size is only known by running
+// them, and files whose path uses a captured variable, are listed by type.
+func printEstimate(w io.Writer, plan *CompilePlan, maxWords int, charsPerToken float64) {
+	var files []sizedFile
+	var bytes int64
+	words := 0
+	unknown := make(map[string]int)
+	for _, p := range plan.Flatten() {
+		switch p.Type {
+		case FileOp:
+			info, err := os.Stat(p.Path)
+			if err != nil {
+				unknown[p.Type.String()]++
+				continue
+			}
+			files = append(files, sizedFile{displayPath(p.Value), info.Size()})
+			bytes += info.Size()
+			words += int(info.Size() / estimateBytesPerWord)
+		case TextOp:
+			bytes += int64(len(p.Value))
+			words += countWords(p.Value)
+		case CommentOp, AssertOp:
+		default:
+			unknown[p.Type.String()]++
+		}
+	}
+
+	fmt.Fprintf(w, "pcp estimate (from file sizes; nothing was read):\n")
+	fmt.Fprintf(w, "  files: %d\n", len(files))
+	fmt.Fprintf(w, "  bytes: %d\n", bytes)
+	fmt.Fprintf(w, "  words: ~%d\n", words)
+	fmt.Fprintf(w, "  tokens: ~%d\n", int64(math.Ceil(float64(bytes)/charsPerToken)))
+	if maxWords > 0 && words > maxWords {
+		fmt.Fprintf(w, "  over -max-words %d by ~%d words\n", maxWords, words-maxWords)
+	}
+	if len(unknown) > 0 {
+		var types []string
+		count := 0
+		for name, n := range unknown {
+			types = append(types, name)
+			count += n
+		}
+		sort.Strings(types)
+		fmt.Fprintf(w, "  not estimated: %d operations (%s)\n", count, strings.Join(types, ", "))
+	}
+	if len(files) > 1 {
+		sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+		fmt.Fprintf(w, "  largest files:\n")
+		for _, file := range files[:min(len(files), estimateLargest)] {
+			fmt.Fprintf(w, "    %s (%d bytes)\n", file.path, file.size)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CommandLine is a command operation's value: either a shell command string
+// or, when written as a YAML list, an argv run directly without a shell.
+type CommandLine struct {
+	Shell string
+	Args  []string
+}
+
+func (c *CommandLine) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var args []string
+		if err := node.Decode(&args); err != nil {
+			return fmt.Errorf("command list must contain only strings: %w", err)
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("line %d: command list must not be empty", node.Line)
+		}
+		c.Args = args
+		return nil
+	}
+	return node.Decode(&c.Shell)
+}
+
+// String renders the command as it would be typed into a shell, quoting
+// argv elements where needed.
+func (c CommandLine) String() string {
+	if c.Args == nil {
+		return c.Shell
+	}
+	return shellJoin(c.Args)
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for sh unless it consists only of safe characters.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%_+=:,./-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellBuiltins are names sh resolves itself, so they never need to be on PATH.
+var shellBuiltins = map[string]bool{
+	"!": true, ".": true, ":": true, "[": true, "{": true, "alias": true, "break": true,
+	"case": true, "cd": true, "command": true, "continue": true, "echo": true, "eval": true,
+	"exec": true, "exit": true, "export": true, "false": true, "for": true, "if": true,
+	"printf": true, "pwd": true, "read": true, "readonly": true, "return": true, "set": true,
+	"shift": true, "source": true, "test": true, "time": true, "trap": true, "true": true,
+	"type": true, "ulimit": true, "umask": true, "unset": true, "until": true, "wait": true,
+	"while": true,
+}
+
+// commandExecutable returns the program a shell command starts with, skipping
+// leading variable assignments. It reports false when the first word is
+// quoted, expanded or otherwise too dynamic to resolve before running.
+func commandExecutable(command string) (string, bool) {
+	for _, word := range strings.Fields(command) {
+		if strings.ContainsAny(word, "\"'`$(){}<>|;&*?\\") && !shellBuiltins[word] {
+			return "", false
+		}
+		if name, _, ok := strings.Cut(word, "="); ok && varNamePattern.MatchString(name) {
+			continue
+		}
+		return word, true
+	}
+	return "", false
+}
+
+// missingExecutable reports whether the program a command starts with is
+// neither a shell builtin nor installed. Commands it cannot resolve are
+// assumed to be runnable.
+func missingExecutable(command, dir string) (string, bool) {
+	name, ok := commandExecutable(command)
+	if !ok || shellBuiltins[name] {
+		return "", false
+	}
+	if executableExists(name, dir) {
+		return "", false
+	}
+	return name, true
+}
+
+// executableExists looks a program up on PATH, or relative to dir when the
+// name contains a slash.
+func executableExists(name, dir string) bool {
+	if strings.Contains(name, "/") {
+		path := name
+		if !filepath.IsAbs(path) && dir != "" {
+			path = filepath.Join(dir, path)
+		}
+		_, err := exec.LookPath(path)
+		return err == nil
+	}
+
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// commandEnv is the environment commands run with. On Linux a locale with a
+// non-UTF-8 character set is replaced by C.UTF-8 so tools emit UTF-8 rather
+// than bytes in some legacy encoding.
+func commandEnv() []string {
+	env := os.Environ()
+	if runtime.GOOS != "linux" || isUTF8Locale(effectiveLocale()) {
+		return env
+	}
+	return append(env, "LC_ALL=C.UTF-8")
+}
+
+// envChanges returns the entries of env that base lacks or sets differently.
+func envChanges(base, env []string) []string {
+	inherited := make(map[string]bool, len(base))
+	for _, entry := range base {
+		inherited[entry] = true
+	}
+	var changes []string
+	for _, entry := range env {
+		if !inherited[entry] {
+			changes = append(changes, entry)
+		}
+	}
+	return changes
+}
+
+// effectiveLocale returns the locale governing character encoding, following
+// the POSIX precedence of LC_ALL, LC_CTYPE and LANG.
+func effectiveLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func isUTF8Locale(locale string) bool {
+	locale = strings.ToLower(locale)
+	return strings.Contains(locale, "utf-8") || strings.Contains(locale, "utf8")
+}
+
+// exitCodeAllowed reports whether a command's exit code is acceptable. Zero
+// always is; without ok_exit_codes status 1 is tolerated too, since tools
+// like grep and diff use it for "no match" or "differences found".
+func exitCodeAllowed(code int, okCodes []int) bool {
+	if code == 0 {
+		return true
+	}
+	if okCodes == nil {
+		return code == 1
+	}
+	return slices.Contains(okCodes, code)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+
+// validateFileFilters checks the options that select or transform part of
+// a file operation's content.
+func validateFileFilters(op Operation, opType OperationType) error {
+	if op.FromPattern == "" && op.ToPattern == "" && !op.LatestEntry && !op.StripFrontmatter && !op.Condense && op.DescriptionLimit == 0 && !op.DepsSummary {
+		return nil
+	}
+	if opType != FileOp {
+		return fmt.Errorf("from_pattern, to_pattern, latest_entry, strip_frontmatter, condense and deps_summary apply only to file operations")
+	}
+	if op.DescriptionLimit != 0 && !op.Condense {
+		return fmt.Errorf("description_limit applies only with condense")
+	}
+	if op.DescriptionLimit < 0 {
+		return fmt.Errorf("description_limit must not be negative")
+	}
+	for _, pattern := range []string{op.FromPattern, op.ToPattern} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// applyFileFilters narrows a file's content as the operation asks: first
+// dropping frontmatter, then condensing an API spec or summarizing a
+// dependency manifest, then to the pattern range, then to the latest
+// changelog entry within it.
+func applyFileFilters(content string, op Operation, path string) (string, error) {
+	var err error
+	if op.StripFrontmatter {
+		content = stripFrontmatter(content)
+	}
+	if op.Condense {
+		limit := op.DescriptionLimit
+		if limit == 0 {
+			limit = defaultDescriptionLimit
+		}
+		if content, err = condenseAPISpec(content, path, limit); err != nil {
+			return "", err
+		}
+	}
+	if op.DepsSummary {
+		if content, err = summarizeDependencies(content, path); err != nil {
+			return "", err
+		}
+	}
+	if op.FromPattern != "" || op.ToPattern != "" {
+		if content, err = selectLineRange(content, op.FromPattern, op.ToPattern, path); err != nil {
+			return "", err
+		}
+	}
+	if op.LatestEntry {
+		if content, err = latestChangelogEntry(content, path); err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+// selectLineRange keeps the lines from the first one matching from through
+// the next one matching to, inclusive. An empty from starts at the top of
+// the file and an empty to runs to its end.
+func selectLineRange(content, from, to, path string) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+
+	start := 0
+	if from != "" {
+		start = matchingLine(lines, regexp.MustCompile(from), 0)
+		if start < 0 {
+			return "", ErrPatternNotFound{File: path, Pattern: from}
+		}
+	}
+
+	end := len(lines) - 1
+	if to != "" {
+		// The end line is searched after the start line, so a pattern such
+		// as ^} finds the end of the block rather than an earlier one
+		searchFrom := start
+		if from != "" {
+			searchFrom = start + 1
+		}
+		end = matchingLine(lines, regexp.MustCompile(to), searchFrom)
+		if end < 0 {
+			return "", ErrPatternNotFound{File: path, Pattern: to}
+		}
+	}
+
+	return strings.Join(lines[start:end+1], ""), nil
+}
+
+func matchingLine(lines []string, pattern *regexp.Regexp, from int) int {
+	for i := from; i < len(lines); i++ {
+		if pattern.MatchString(strings.TrimRight(lines[i], "\r\n")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// latestChangelogEntry extracts the newest release from a CHANGELOG.md-style
+// file: the first entry heading, other than an Unreleased one, through the
+// next heading at the same or a higher level. Entries are the headings
+// below a single "# Changelog" style title, or else the level of the first
+// heading.
+func latestChangelogEntry(content, path string) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+
+	type heading struct {
+		line  int
+		level int
+		title string
+	}
+	var headings []heading
+	inFence := false
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(strings.TrimSpace(trimmed), "```") {
+			inFence = !inFence
+			continue
+		}
+		if m := markdownHeading.FindStringSubmatch(trimmed); m != nil && !inFence {
+			headings = append(headings, heading{line: i, level: len(m[1]), title: m[2]})
+		}
+	}
+	if len(headings) == 0 {
+		return "", fmt.Errorf("no changelog entries found in %s: it has no markdown headings", path)
+	}
+
+	entryLevel := headings[0].level
+	if entryLevel == 1 && len(headings) > 1 {
+		titles := 0
+		for _, h := range headings {
+			if h.level == 1 {
+				titles++
+			}
+		}
+		if titles == 1 {
+			entryLevel = headings[1].level
+		}
+	}
+
+	for i, h := range headings {
+		if h.level != entryLevel || strings.Contains(strings.ToLower(h.title), "unreleased") {
+			continue
+		}
+		end := len(lines)
+		for _, next := range headings[i+1:] {
+			if next.level <= entryLevel {
+				end = next.line
+				break
+			}
+		}
+		return strings.Join(lines[h.line:end], ""), nil
+	}
+	return "", fmt.Errorf("no released changelog entry found in %s", path)
+}
+
+// stripFrontmatter removes a leading YAML (---) or TOML (+++) frontmatter
+// block, as used by Hugo and Jekyll, and the blank lines after it. Content
+// without a closed frontmatter block is returned unchanged.
+func stripFrontmatter(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) == 0 {
+		return content
+	}
+	opening := strings.TrimRight(lines[0], "\r\n")
+	if opening != "---" && opening != "+++" {
+		return content
+	}
+
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		// YAML documents may also end with "..."
+		if line == opening || (opening == "---" && line == "...") {
+			return strings.TrimLeft(strings.Join(lines[i+1:], ""), "\r\n")
+		}
+	}
+	return content
+}
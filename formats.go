@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var validFormats = map[string]bool{
+	"text":     true,
+	"markdown": true,
+	"json":     true,
+	"html":     true,
+	"records":  true,
+}
+
+// resolveFormat picks the output format. An explicit format always wins;
+// otherwise the output file extension decides, falling back to text.
+func resolveFormat(format, outputFile string) string {
+	if format != "" {
+		return format
+	}
+
+	switch strings.ToLower(filepath.Ext(trimCompressionExt(outputFile))) {
+	case ".md", ".markdown":
+		return "markdown"
+	case ".json":
+		return "json"
+	case ".html", ".htm":
+		return "html"
+	default:
+		return "text"
+	}
+}
+
+// defaultSectionSeparator is written between top-level sections of text
+// output, giving a blank line before each header.
+const defaultSectionSeparator = "\n"
+
+// separatorFlag parses -section-separator, interpreting Go escape sequences
+// such as \n and \t so separators can be written on the command line.
+type separatorFlag struct {
+	separator **string
+}
+
+func (f separatorFlag) String() string {
+	if f.separator == nil || *f.separator == nil {
+		return ""
+	}
+	quoted := strconv.Quote(**f.separator)
+	return quoted[1 : len(quoted)-1]
+}
+
+func (f separatorFlag) Set(s string) error {
+	separator, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+	if err != nil {
+		return fmt.Errorf("invalid section separator %q: use Go escapes such as \\n", s)
+	}
+	*f.separator = &separator
+	return nil
+}
+
+// sectionSeparator returns the separator between sections, or the default
+// when none was given.
+func (opts Options) sectionSeparator() string {
+	if opts.SectionSeparator == nil {
+		return defaultSectionSeparator
+	}
+	return *opts.SectionSeparator
+}
+
+func renderOutput(content CompiledContent, format, delimiterStyle, separator string) (string, error) {
+	switch format {
+	case "", "text":
+		return compileOutput(content, delimiterStyle, separator)
+	case "markdown":
+		return compileMarkdown(content), nil
+	case "json":
+		return compileJSON(content)
+	case "html":
+		return compileHTML(content), nil
+	case "records":
+		return compileRecords(content), nil
+	default:
+		return "", fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// compileMarkdown renders a heading per section. Output with more than one
+// top-level section starts with a table of contents linking to them.
+func compileMarkdown(content CompiledContent) string {
+	var result strings.Builder
+	if len(content.Sections) > 1 {
+		anchors := newMarkdownAnchors()
+		result.WriteString("## Contents\n\n")
+		anchors.anchor("Contents")
+		writeMarkdownTOC(&result, content.Sections, 0, anchors)
+	}
+	writeMarkdownSections(&result, content.Sections, 2)
+	return strings.TrimRight(result.String(), "\n") + "\n"
+}
+
+func writeMarkdownTOC(result *strings.Builder, sections []ContentSection, depth int, anchors *markdownAnchors) {
+	for _, section := range sections {
+		label := sectionLabel(section)
+		fmt.Fprintf(result, "%s- [%s](#%s)\n", strings.Repeat("  ", depth), markdownLinkText(label), anchors.anchor(label))
+		if section.Type == PromptOp {
+			writeMarkdownTOC(result, section.Children, depth+1, anchors)
+		}
+	}
+}
+
+// markdownAnchors generates the heading anchors GitHub and most renderers
+// use: lowercase, punctuation dropped, spaces as hyphens, with -1, -2, ...
+// appended to repeated headings.
+type markdownAnchors struct {
+	seen map[string]int
+}
+
+func newMarkdownAnchors() *markdownAnchors {
+	return &markdownAnchors{seen: make(map[string]int)}
+}
+
+func (a *markdownAnchors) anchor(heading string) string {
+	var slug strings.Builder
+	for _, r := range strings.ToLower(heading) {
+		switch {
+		case r == ' ':
+			slug.WriteRune('-')
+		case r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r):
+			slug.WriteRune(r)
+		}
+	}
+	base := slug.String()
+	n := a.seen[base]
+	a.seen[base] = n + 1
+	if n == 0 {
+		return base
+	}
+	return fmt.Sprintf("%s-%d", base, n)
+}
+
+// markdownLinkText escapes the characters that would end a link label early.
+func markdownLinkText(label string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(label)
+}
+
+func writeMarkdownSections(result *strings.Builder, sections []ContentSection, level int) {
+	for _, section := range sections {
+		if result.Len() > 0 {
+			result.WriteString("\n")
+		}
+		result.WriteString(fmt.Sprintf("%s %s\n\n", strings.Repeat("#", level), sectionLabel(section)))
+
+		switch section.Type {
+		case PromptOp:
+			writeMarkdownSections(result, section.Children, level+1)
+		case TextOp:
+			result.WriteString(section.Content)
+		default:
+			fence := markdownFence(section.Content)
+			lang := ""
+			if section.Type == FileOp || section.Type == SymbolOp || section.Type == RelatedOp || section.Type == CoverageOp {
+				lang = sourceExtension(section)
+			}
+			result.WriteString(fence + lang + "\n")
+			result.WriteString(section.Content)
+			result.WriteString(fence + "\n")
+		}
+	}
+}
+
+// sourceExtension returns the extension, without the dot, of the file a
+// file, symbol, related or coverage section was read from.
+func sourceExtension(section ContentSection) string {
+	source := section.Source
+	switch section.Type {
+	case SymbolOp:
+		source, _ = splitSymbol(source)
+	case RelatedOp, CoverageOp:
+		return "go"
+	}
+	return strings.TrimPrefix(filepath.Ext(source), ".")
+}
+
+// markdownFence returns a backtick fence longer than any backtick run in the
+// content, so embedded code blocks cannot terminate the section early.
+func markdownFence(content string) string {
+	longest, current := 0, 0
+	for _, r := range content {
+		if r == '`' {
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// compileRecords writes each section, nested prompts' sections included, as
+// a record ending in a NUL byte, for splitting with xargs -0 or awk -v
+// RS='\0'. A record starts with a header line holding the section's type
+// and source, and its ID under -section-ids, separated by tabs.
+func compileRecords(content CompiledContent) string {
+	headerField := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	var result strings.Builder
+	for _, section := range leafSections(content.Sections) {
+		result.WriteString(section.Type.String() + "\t" + headerField.Replace(section.Source))
+		if section.ID != "" {
+			result.WriteString("\t" + section.ID)
+		}
+		result.WriteString("\n")
+		// A NUL kept by -keep-control-chars would split the record
+		result.WriteString(strings.ReplaceAll(section.Content, "\x00", "\uFFFD"))
+		result.WriteByte(0)
+	}
+	return result.String()
+}
+
+type jsonSection struct {
+	ID       string        `json:"id,omitempty"`
+	Source   string        `json:"source"`
+	Type     string        `json:"type"`
+	Content  string        `json:"content"`
+	ExitCode int           `json:"exit_code,omitempty"`
+	Sections []jsonSection `json:"sections,omitempty"`
+}
+
+type jsonOutput struct {
+	Sections  []jsonSection `json:"sections"`
+	WordCount int           `json:"word_count"`
+}
+
+func compileJSON(content CompiledContent) (string, error) {
+	out := jsonOutput{Sections: toJSONSections(content.Sections)}
+	for _, section := range content.Sections {
+		out.WordCount += sectionWords(section)
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JSON output: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// sectionWords counts the words of a section's own content, excluding the
+// headers that nested prompt sections embed in their rendered content.
+func sectionWords(section ContentSection) int {
+	if section.Type != PromptOp {
+		return countWords(section.Content)
+	}
+	total := 0
+	for _, child := range section.Children {
+		total += sectionWords(child)
+	}
+	return total
+}
+
+func toJSONSections(sections []ContentSection) []jsonSection {
+	result := make([]jsonSection, 0, len(sections))
+	for _, section := range sections {
+		js := jsonSection{
+			ID:       section.ID,
+			Source:   section.Source,
+			Type:     section.Type.String(),
+			ExitCode: section.ExitCode,
+		}
+		if section.Type == PromptOp {
+			js.Sections = toJSONSections(section.Children)
+		} else {
+			js.Content = section.Content
+		}
+		result = append(result, js)
+	}
+	return result
+}
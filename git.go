@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitSpec includes a file as it was at a commit, tag or branch. Path is
+// resolved against the prompt file like a file operation's, and need not
+// exist in the working tree any more.
+type GitSpec struct {
+	Path string `yaml:"path"`
+	Ref  string `yaml:"ref"`
+}
+
+func validateGit(spec GitSpec) error {
+	if spec.Path == "" || spec.Ref == "" {
+		return fmt.Errorf("git needs both path and ref")
+	}
+	// git would read a leading dash as an option
+	if strings.HasPrefix(spec.Ref, "-") {
+		return fmt.Errorf("invalid git ref %q", spec.Ref)
+	}
+	return nil
+}
+
+// gitSource is the section source of a git operation, path@ref, so the old
+// and new versions of a file stay apart in headers.
+func gitSource(p PlannedOperation, ctx *ProcessingContext) string {
+	return displayPath(p.Value) + "@" + ctx.Expand(p.Op.Git.Ref)
+}
+
+// processGitOperation reads the file from the repository containing it with
+// git show, by its path from the top of the repository so paths work from
+// any prompt file.
+func processGitOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	ref := ctx.Expand(p.Op.Git.Ref)
+	top, rel, err := gitRepoPath(p.Path)
+	if err != nil {
+		return ContentSection{}, fmt.Errorf("%s is not in a git repository: %w", displayPath(p.Value), err)
+	}
+	commit, err := gitOutput(top, "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return ContentSection{}, fmt.Errorf("%s: unknown git ref %q", displayPath(p.Value), ref)
+	}
+	output, err := gitOutput(top, "show", strings.TrimSpace(commit)+":"+rel)
+	if err != nil {
+		return ContentSection{}, fmt.Errorf("%s does not exist at %s", displayPath(p.Value), ref)
+	}
+	if bytes.IndexByte([]byte(output[:min(len(output), 512)]), 0) >= 0 {
+		return ContentSection{}, ErrBinaryFile{File: p.Path + "@" + ref}
+	}
+	return ContentSection{
+		Source:  gitSource(p, ctx),
+		Content: normalizeContent(output),
+		Type:    GitOp,
+	}, nil
+}
+
+// gitRepoPath returns the top level of the repository containing path and
+// path relative to it, in slash form. The path, and directories above it,
+// may have been removed since the commit being read, so git runs from the
+// nearest directory that still exists.
+func gitRepoPath(path string) (top, rel string, err error) {
+	dir, rest := filepath.Dir(path), filepath.Base(path)
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+	// git reports the top level with symlinks resolved
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	output, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", "", err
+	}
+	top = filepath.FromSlash(strings.TrimSpace(output))
+	rel, err = filepath.Rel(top, filepath.Join(dir, rest))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("%s is outside %s", path, top)
+	}
+	return top, filepath.ToSlash(rel), nil
+}
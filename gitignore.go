@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitignoreRule is one pattern of a .gitignore file, its segments relative
+// to the file's directory.
+type gitignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// gitignore decides which paths of a repository its .gitignore files, and
+// .git/info/exclude, leave out. Each directory's .gitignore is read the
+// first time a path below it is asked about. A .pcpignore is the same with
+// only the root's file.
+type gitignore struct {
+	root string
+
+	// name is the file read in each directory, empty when only the rules
+	// given for the root apply
+	name string
+
+	// rules holds each directory's patterns, by its slash-separated path
+	// relative to root
+	rules map[string][]gitignoreRule
+}
+
+// pcpignoreName is the file of patterns, next to the root prompt file, that
+// every file, dir, tree and glob operation of a compile is kept from.
+const pcpignoreName = ".pcpignore"
+
+// ignoreSet combines ignore rules: a path is ignored if any of them ignores
+// it. The nil set ignores nothing.
+type ignoreSet []*gitignore
+
+func (s ignoreSet) Ignored(file string, isDir bool) bool {
+	for _, g := range s {
+		if g.Ignored(file, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPcpignore reads the .pcpignore in dir, returning nil if there is none.
+func loadPcpignore(dir string) *gitignore {
+	root, _ := filepath.Abs(dir)
+	data, err := os.ReadFile(filepath.Join(root, pcpignoreName))
+	if err != nil {
+		return nil
+	}
+	return &gitignore{root: root, rules: map[string][]gitignoreRule{"": parseGitignore(string(data))}}
+}
+
+// newGitignore returns the ignore rules of the repository containing dir,
+// found by looking upwards for .git. Outside a repository the .gitignore
+// files from dir down still apply.
+func newGitignore(dir string) *gitignore {
+	start, _ := filepath.Abs(dir)
+	// .git is a directory, or a file in worktrees and submodules
+	isRepo := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(dir, ".git"))
+		return err == nil
+	}
+	root := start
+	for root != filepath.Dir(root) && !isRepo(root) {
+		root = filepath.Dir(root)
+	}
+	if !isRepo(root) {
+		root = start
+	}
+	g := &gitignore{root: root, name: ".gitignore", rules: make(map[string][]gitignoreRule)}
+	if data, err := os.ReadFile(filepath.Join(root, ".git", "info", "exclude")); err == nil {
+		g.rules[""] = parseGitignore(string(data))
+	}
+	g.rules[""] = append(g.rules[""], g.readRules("")...)
+	return g
+}
+
+func (g *gitignore) readRules(dir string) []gitignoreRule {
+	if g.name == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(g.root, filepath.FromSlash(dir), g.name))
+	if err != nil {
+		return nil
+	}
+	return parseGitignore(string(data))
+}
+
+func (g *gitignore) dirRules(dir string) []gitignoreRule {
+	rules, ok := g.rules[dir]
+	if !ok {
+		rules = g.readRules(dir)
+		g.rules[dir] = rules
+	}
+	return rules
+}
+
+// parseGitignore parses the patterns of a .gitignore file.
+func parseGitignore(data string) []gitignoreRule {
+	var rules []gitignoreRule
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule gitignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern with a slash other than a trailing one is relative to
+		// the .gitignore's directory; others match at any depth
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(strings.ReplaceAll(line, `\ `, " "), "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Ignored reports whether a path is ignored. As in git, everything below an
+// ignored directory is ignored, whatever deeper patterns say. nil rules
+// ignore nothing.
+func (g *gitignore) Ignored(file string, isDir bool) bool {
+	if g == nil {
+		return false
+	}
+	abs, _ := filepath.Abs(file)
+	rel, err := filepath.Rel(g.root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(parts); i++ {
+		if g.matches(parts[:i], i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches applies the rules of every .gitignore from the root down to the
+// path's directory; the last matching pattern decides.
+func (g *gitignore) matches(parts []string, isDir bool) bool {
+	ignored := false
+	for depth := 0; depth < len(parts); depth++ {
+		for _, rule := range g.dirRules(strings.Join(parts[:depth], "/")) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if gitignoreMatch(rule.segments, parts[depth:]) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// gitignoreMatch is matchGlob without the shell's rule for dotfiles, which
+// .gitignore patterns do not have.
+func gitignoreMatch(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if gitignoreMatch(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(segments[0], parts[0]); !ok {
+		return false
+	}
+	return gitignoreMatch(segments[1:], parts[1:])
+}
+
+func validateRespectGitignore(op Operation, opType OperationType) error {
+	if op.RespectGitignore == nil || opType == DirOp || opType == TreeOp || (opType == FileOp && isGlobPattern(*op.File)) {
+		return nil
+	}
+	return fmt.Errorf("respect_gitignore applies only to dir, tree and glob file operations")
+}
+
+// ignoreRules returns the rules an operation expanding paths below dir
+// follows: the compile's .pcpignore, and the .gitignore files when the
+// operation's respect_gitignore, or else -respect-gitignore, says so.
+func (ctx *ProcessingContext) ignoreRules(op Operation, dir string) ignoreSet {
+	rules := ignoreSet{ctx.pcpignore}
+	respect := ctx.respectGitignore
+	if op.RespectGitignore != nil {
+		respect = *op.RespectGitignore
+	}
+	if respect {
+		rules = append(rules, newGitignore(dir))
+	}
+	return rules
+}
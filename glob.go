@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isGlobPattern reports whether a file operation's value is a glob rather
+// than a single path. Variable references are not wildcards.
+func isGlobPattern(value string) bool {
+	return strings.ContainsAny(varPattern.ReplaceAllString(value, ""), "*?[{")
+}
+
+// isGlobOperation reports whether a planned file operation is a glob to
+// expand. A file whose name only looks like a glob is included as is.
+func isGlobOperation(p PlannedOperation) bool {
+	return p.Type == FileOp && isGlobPattern(p.Value) && !fileExists(p.Path)
+}
+
+// expandBraces expands the first {a,b} alternation in pattern, recursively,
+// into one pattern per alternative.
+func expandBraces(pattern string) []string {
+	open := strings.IndexByte(pattern, '{')
+	if open < 0 {
+		return []string{pattern}
+	}
+	depth := 0
+	var alternatives []string
+	start := open + 1
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				alternatives = append(alternatives, pattern[start:i])
+				var expanded []string
+				for _, alternative := range alternatives {
+					expanded = append(expanded, expandBraces(pattern[:open]+alternative+pattern[i+1:])...)
+				}
+				return expanded
+			}
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[start:i])
+				start = i + 1
+			}
+		}
+	}
+	// An unclosed brace is literal
+	return []string{pattern}
+}
+
+// matchGlob reports whether the slash-separated path matches the pattern's
+// segments, where a ** segment matches any number of directories. As in the
+// shell, wildcards do not match names starting with a dot unless the
+// pattern segment does too.
+func matchGlob(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if i > 0 && strings.HasPrefix(parts[i-1], ".") {
+				return false
+			}
+			if matchGlob(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if strings.HasPrefix(parts[0], ".") && !strings.HasPrefix(segments[0], ".") {
+		return false
+	}
+	if ok, _ := path.Match(segments[0], parts[0]); !ok {
+		return false
+	}
+	return matchGlob(segments[1:], parts[1:])
+}
+
+// globFiles returns the files matching pattern, doublestar style, relative
+// to base and sorted. Each pattern is walked from its longest directory
+// prefix without wildcards, and the directories walked are returned too, so
+// watch mode notices files being added. Paths ignore ignores are left out.
+func globFiles(base, pattern string, ignore ignoreSet) (files, dirs []string, err error) {
+	seen := make(map[string]bool)
+	for _, expanded := range expandBraces(filepath.ToSlash(pattern)) {
+		segments := strings.Split(expanded, "/")
+		literal := 0
+		for literal < len(segments)-1 && !strings.ContainsAny(segments[literal], "*?[") {
+			literal++
+		}
+		for _, segment := range segments[literal:] {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+			}
+		}
+		prefix := strings.Join(segments[:literal], "/")
+		if prefix == "" && strings.HasPrefix(expanded, "/") {
+			prefix = "/"
+		}
+		root := resolvePath(base, filepath.FromSlash(prefix))
+
+		walkErr := filepath.WalkDir(root, func(walked string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if walked == root && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			rel, _ := filepath.Rel(root, walked)
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			if rel == "." {
+				parts = nil
+			}
+			if rel != "." && ignore.Ignored(walked, entry.IsDir()) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() {
+				// Hidden directories are only entered when the pattern names them
+				if rel != "." && strings.HasPrefix(entry.Name(), ".") && !strings.Contains(expanded, "/.") && !strings.HasPrefix(expanded, ".") {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, walked)
+				return nil
+			}
+			if matchGlob(segments[literal:], parts) && !seen[walked] {
+				seen[walked] = true
+				files = append(files, path.Join(prefix, filepath.ToSlash(rel)))
+			}
+			return nil
+		})
+		if walkErr != nil {
+			return nil, nil, walkErr
+		}
+	}
+	sortPaths(files)
+	return files, dirs, nil
+}
+
+// planGlob expands a file operation whose value is a glob into one file
+// operation per matching file, each with its own section. A pattern that
+// matches nothing fails like a missing file would.
+func planGlob(p PlannedOperation, ctx *ProcessingContext) ([]PlannedOperation, error) {
+	matches, dirs, err := globFiles(ctx.basePath, p.Value, ctx.ignoreRules(p.Op, ctx.basePath))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		ctx.AddDependency(dir)
+	}
+	values := make([]string, len(matches))
+	for i, match := range matches {
+		values[i] = filepath.FromSlash(match)
+	}
+	planned := planFileMatches(p, values, ctx)
+	if len(planned) == 0 {
+		return nil, fmt.Errorf("no files match %s", p.Value)
+	}
+	return planned, nil
+}
+
+// planFileMatches plans a copy of the file operation p for each of the
+// paths a glob or directory matched.
+func planFileMatches(p PlannedOperation, values []string, ctx *ProcessingContext) []PlannedOperation {
+	planned := make([]PlannedOperation, 0, len(values))
+	for _, value := range values {
+		op := p.Op
+		op.File = &value
+		m := p
+		m.Op, m.Value, m.Path = op, value, ctx.ResolvePath(value)
+		ctx.AddDependency(m.Path)
+		if ctx.IsVisited(m.Path) && !op.AllowSelf {
+			// Prompt files matched by a broad pattern are skipped rather
+			// than reported as including themselves
+			continue
+		}
+		planned = append(planned, m)
+	}
+	return planned
+}
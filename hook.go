@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies pre-commit hooks written by pcp, which pcp hook
+// install may replace without -force.
+const hookMarker = "# Installed by pcp hook install."
+
+// patternFlag collects repeated -pattern flags.
+type patternFlag struct {
+	patterns *[]string
+}
+
+func (f patternFlag) String() string {
+	if f.patterns == nil {
+		return ""
+	}
+	return strings.Join(*f.patterns, " ")
+}
+
+func (f patternFlag) Set(s string) error {
+	*f.patterns = append(*f.patterns, s)
+	return nil
+}
+
+func runHook(args []string) error {
+	if len(args) == 0 || args[0] != "install" {
+		fmt.Fprintf(os.Stderr, "Usage: pcp hook install -pattern <glob> [-pattern ...] [-dir <repository>] [-force]\n")
+		if len(args) == 0 {
+			return fmt.Errorf("missing hook command, expected install")
+		}
+		return fmt.Errorf("unknown hook command %q, expected install", args[0])
+	}
+
+	var patterns []string
+	fs := flag.NewFlagSet("hook install", flag.ContinueOnError)
+	fs.Var(patternFlag{&patterns}, "pattern", "Git pathspec of prompt files to check, e.g. 'prompts/*.yml' (repeatable)")
+	dir := fs.String("dir", ".", "Repository to install the hook in")
+	force := fs.Bool("force", false, "Replace an existing pre-commit hook not written by pcp")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp hook install -pattern <glob> [-pattern ...] [-dir <repository>] [-force]
+
+Writes a git pre-commit hook that runs pcp -check on every tracked prompt
+file matching the patterns, so a commit with a broken prompt file fails.
+The hook runs the pcp found on PATH when committing.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("at least one -pattern is required")
+	}
+
+	path, err := installPreCommitHook(*dir, patterns, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "pcp: installed pre-commit hook %s\n", path)
+	return nil
+}
+
+// installPreCommitHook writes the hook into the repository's hooks
+// directory, honouring core.hooksPath, and returns its path.
+func installPreCommitHook(dir string, patterns []string, force bool) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--git-path", "hooks")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a git repository: %w", dir, err)
+	}
+	hooksDir := strings.TrimSpace(string(output))
+	if !filepath.IsAbs(hooksDir) {
+		hooksDir = filepath.Join(dir, hooksDir)
+	}
+
+	path := filepath.Join(hooksDir, "pre-commit")
+	if existing, err := os.ReadFile(path); err == nil && !force && !strings.Contains(string(existing), hookMarker) {
+		return "", fmt.Errorf("%s already exists; use -force to replace it", path)
+	}
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", hooksDir, err)
+	}
+	if err := os.WriteFile(path, []byte(preCommitHook(patterns)), 0755); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// WriteFile keeps the mode of a file it replaces
+	if err := os.Chmod(path, 0755); err != nil {
+		return "", fmt.Errorf("failed to make %s executable: %w", path, err)
+	}
+	return path, nil
+}
+
+// preCommitHook renders the hook script. Every matching prompt file is
+// checked, not only staged ones, since a change to a nested prompt or an
+// included file can break the prompts that use it.
+func preCommitHook(patterns []string) string {
+	quoted := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		quoted[i] = shellQuote(pattern)
+	}
+	return fmt.Sprintf(`#!/bin/sh
+%s
+# Checks prompt files with pcp -check before each commit.
+git ls-files -- %s | {
+	status=0
+	while IFS= read -r file; do
+		pcp -f "$file" -check || status=1
+	done
+	exit $status
+}
+`, hookMarker, strings.Join(quoted, " "))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// htmlStyle keeps reports self-contained: they open offline and send
+// nothing anywhere, which matters when auditing what was sent to a model.
+const htmlStyle = `body { font-family: system-ui, sans-serif; margin: 2rem auto; max-width: 72rem; padding: 0 1rem; color: #1f2328; }
+h1 { font-size: 1.4rem; }
+details { border: 1px solid #d0d7de; border-radius: 6px; margin: 0.5rem 0; padding: 0.25rem 0.75rem; }
+details details { margin-left: 1rem; }
+summary { cursor: pointer; font-family: ui-monospace, monospace; padding: 0.25rem 0; }
+.size { color: #656d76; font-family: system-ui, sans-serif; font-size: 0.85em; margin-left: 0.5rem; }
+.exit { color: #9a6700; }
+pre { background: #f6f8fa; border-radius: 6px; overflow-x: auto; padding: 0.75rem; }
+.kw { color: #cf222e; }
+.str { color: #0a3069; }
+.com { color: #6e7781; font-style: italic; }
+.num { color: #0550ae; }
+`
+
+// compileHTML renders a report for humans auditing a compile: one
+// collapsible block per section with its size, and highlighted code.
+func compileHTML(content CompiledContent) string {
+	words, size := 0, 0
+	for _, section := range content.Sections {
+		words += sectionWords(section)
+		size += sectionBytes(section)
+	}
+
+	var result strings.Builder
+	result.WriteString("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>pcp report</title>\n")
+	fmt.Fprintf(&result, "<style>\n%s</style>\n</head>\n<body>\n", htmlStyle)
+	fmt.Fprintf(&result, "<h1>pcp report</h1>\n<p>%d sections, %s</p>\n", len(content.Sections), formatSize(words, size))
+	writeHTMLSections(&result, content.Sections)
+	result.WriteString("</body>\n</html>\n")
+	return result.String()
+}
+
+func writeHTMLSections(result *strings.Builder, sections []ContentSection) {
+	for _, section := range sections {
+		if section.ID != "" {
+			fmt.Fprintf(result, "<details open id=\"section-%s\">\n<summary>", section.ID)
+		} else {
+			result.WriteString("<details open>\n<summary>")
+		}
+		result.WriteString(html.EscapeString(section.Source))
+		if section.ExitCode != 0 {
+			fmt.Fprintf(result, " <span class=\"exit\">(exit status %d)</span>", section.ExitCode)
+		}
+		fmt.Fprintf(result, "<span class=\"size\">%s %s</span></summary>\n", section.Type, formatSize(sectionWords(section), sectionBytes(section)))
+
+		if section.Type == PromptOp {
+			writeHTMLSections(result, section.Children)
+		} else {
+			lang := ""
+			if section.Type == FileOp || section.Type == SymbolOp || section.Type == RelatedOp || section.Type == CoverageOp {
+				lang = strings.ToLower(sourceExtension(section))
+			}
+			fmt.Fprintf(result, "<pre><code>%s</code></pre>\n", highlightCode(section.Content, lang))
+		}
+		result.WriteString("</details>\n")
+	}
+}
+
+// sectionBytes is the size of a section's own content, like sectionWords.
+func sectionBytes(section ContentSection) int {
+	if section.Type != PromptOp {
+		return len(section.Content)
+	}
+	total := 0
+	for _, child := range section.Children {
+		total += sectionBytes(child)
+	}
+	return total
+}
+
+func formatSize(words, size int) string {
+	return fmt.Sprintf("%d words, %d bytes", words, size)
+}
+
+// codeSyntax describes just enough of a language to highlight comments,
+// strings, numbers and keywords.
+type codeSyntax struct {
+	lineComment  []string
+	blockComment [2]string
+	quotes       string
+	keywords     map[string]bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+var (
+	cSyntax = codeSyntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+		keywords:     keywordSet("auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while class namespace template typename public private protected virtual new delete this true false nullptr bool"),
+	}
+	jsSyntax = codeSyntax{
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords:     keywordSet("async await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new of return static super switch this throw try typeof var void while yield null undefined true false interface type enum implements"),
+	}
+	yamlSyntax = codeSyntax{
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords:    keywordSet("true false null yes no"),
+	}
+	shellSyntax = codeSyntax{
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords:    keywordSet("if then else elif fi for while until do done case esac in function return local export set"),
+	}
+)
+
+var syntaxByExtension = map[string]codeSyntax{
+	"go": {
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords:     keywordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+	},
+	"py": {
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords:    keywordSet("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+	},
+	"rs": {
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"",
+		keywords:     keywordSet("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+	},
+	"java": {
+		lineComment:  []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+		keywords:     keywordSet("abstract boolean break case catch class continue default do double else enum extends final finally float for if implements import instanceof int interface long new package private protected public return static super switch this throw throws try void while null true false"),
+	},
+	"rb": {
+		lineComment: []string{"#"},
+		quotes:      "\"'",
+		keywords:    keywordSet("begin break case class def do else elsif end ensure false for if in module next nil not or rescue return self super then true unless until when while yield"),
+	},
+	"js":   jsSyntax,
+	"jsx":  jsSyntax,
+	"ts":   jsSyntax,
+	"tsx":  jsSyntax,
+	"yaml": yamlSyntax,
+	"yml":  yamlSyntax,
+	"c":    cSyntax,
+	"h":    cSyntax,
+	"cc":   cSyntax,
+	"cpp":  cSyntax,
+	"hpp":  cSyntax,
+	"sh":   shellSyntax,
+	"bash": shellSyntax,
+	"zsh":  shellSyntax,
+}
+
+// highlightCode escapes content for HTML, wrapping comments, strings,
+// numbers and keywords in spans when the language is known.
+func highlightCode(content, lang string) string {
+	syntax, ok := syntaxByExtension[lang]
+	if !ok {
+		return html.EscapeString(content)
+	}
+
+	var result strings.Builder
+	span := func(class, text string) {
+		fmt.Fprintf(&result, "<span class=\"%s\">%s</span>", class, html.EscapeString(text))
+	}
+
+	for i := 0; i < len(content); {
+		rest := content[i:]
+		if end := syntax.commentEnd(rest); end > 0 {
+			span("com", rest[:end])
+			i += end
+			continue
+		}
+		c := rest[0]
+		switch {
+		case strings.IndexByte(syntax.quotes, c) >= 0:
+			end := stringEnd(rest)
+			span("str", rest[:end])
+			i += end
+		case isWordStart(c):
+			end := 1
+			for end < len(rest) && isWordByte(rest[end]) {
+				end++
+			}
+			word := rest[:end]
+			if syntax.keywords[word] {
+				span("kw", word)
+			} else {
+				result.WriteString(html.EscapeString(word))
+			}
+			i += end
+		case c >= '0' && c <= '9':
+			end := 1
+			for end < len(rest) && (isWordByte(rest[end]) || rest[end] == '.') {
+				end++
+			}
+			span("num", rest[:end])
+			i += end
+		default:
+			result.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return result.String()
+}
+
+// commentEnd returns the length of the comment starting s, or 0.
+func (syntax codeSyntax) commentEnd(s string) int {
+	for _, marker := range syntax.lineComment {
+		if strings.HasPrefix(s, marker) {
+			if end := strings.IndexByte(s, '\n'); end >= 0 {
+				return end
+			}
+			return len(s)
+		}
+	}
+	if open, closing := syntax.blockComment[0], syntax.blockComment[1]; open != "" && strings.HasPrefix(s, open) {
+		if end := strings.Index(s[len(open):], closing); end >= 0 {
+			return len(open) + end + len(closing)
+		}
+		return len(s)
+	}
+	return 0
+}
+
+// stringEnd returns the length of the string literal opening s, honouring
+// backslash escapes. Unterminated literals end at the line break.
+func stringEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			return i + 1
+		case s[i] == '\n' && quote != '`':
+			return i
+		}
+	}
+	return len(s)
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 0x80 || unicode.IsLetter(rune(c))
+}
+
+func isWordByte(c byte) bool {
+	return isWordStart(c) || (c >= '0' && c <= '9')
+}
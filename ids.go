@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sectionIDLength is the number of hex digits kept from the hash, enough to
+// keep IDs unique within any realistic compile.
+const sectionIDLength = 12
+
+// sectionID derives an ID from what an operation reads and the options
+// shaping its content, so it survives reordering and content changes.
+// Operations with identical inputs are numbered in order: abc123, abc123-2.
+func sectionID(p PlannedOperation, ctx *ProcessingContext) string {
+	source := p.Value
+	if p.Path != "" {
+		// Relative to the root prompt file, so checkouts in different places agree
+		if rel, err := filepath.Rel(ctx.rootDir, p.Path); err == nil {
+			source = rel
+		}
+		source = displayPath(source)
+	}
+	if p.Type == GitOp {
+		source += "@" + ctx.Expand(p.Op.Git.Ref)
+	}
+
+	// The options are encoded as YAML, which leaves out unset fields, so an
+	// option added to pcp later does not change the IDs of operations that
+	// do not use it
+	options, _ := yaml.Marshal(contentOptions(p.Op))
+	key := strings.Join([]string{p.Type.String(), source, string(options)}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	id := hex.EncodeToString(sum[:])[:sectionIDLength]
+
+	ctx.sectionIDs[id]++
+	if n := ctx.sectionIDs[id]; n > 1 {
+		id = fmt.Sprintf("%s-%d", id, n)
+	}
+	return id
+}
+
+// contentOptions is the operation without what the section's source
+// already names, such as its file path or command, and without the fields
+// that do not shape its content: where it is, whether and for which targets
+// it runs, and how it is cached, scheduled, budgeted or captured.
+func contentOptions(op Operation) Operation {
+	op.File, op.Prompt, op.Command, op.Text, op.Ref, op.Remote = nil, nil, nil, nil, nil, nil
+	op.Comment, op.BuildTargets, op.Dir, op.Tree = nil, nil, nil, nil
+	op.Line, op.keyLines = 0, nil
+	op.Disabled, op.Targets = false, nil
+	op.Cache, op.Serial, op.Limits, op.OkExitCodes = "", false, nil, nil
+	op.Weight, op.Charge = 0, false
+	op.CaptureAs, op.Suppress = "", false
+	op.IncludeOnce, op.AllowSelf, op.SHA256 = false, false, ""
+	return op
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// prefetchCommands runs the plan's commands up to jobs at a time before the
+// plan executes, so executePlan finds their output ready. A command marked
+// serial runs alone, after those before it have finished and before any
+// after it start. Commands that use a captured variable, are cached, or
+// whose program is missing are left for executePlan to handle in order.
+func prefetchCommands(plan *CompilePlan, jobs int, ctx *ProcessingContext) {
+	dir := ctx.workDir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	var batch []PlannedOperation
+	for _, p := range plan.Flatten() {
+		if !prefetchable(p, dir, ctx) {
+			continue
+		}
+		if p.Op.Serial {
+			ctx.runPrefetch(batch, jobs, dir)
+			ctx.runPrefetch([]PlannedOperation{p}, 1, dir)
+			batch = nil
+			continue
+		}
+		batch = append(batch, p)
+	}
+	ctx.runPrefetch(batch, jobs, dir)
+}
+
+func prefetchable(p PlannedOperation, dir string, ctx *ProcessingContext) bool {
+	if p.Type != CommandOp || capturedRef(p.Op.GetValue(), ctx) != "" {
+		return false
+	}
+	policy := ctx.cachePolicy
+	if p.Op.Cache != "" {
+		policy, _ = parseCachePolicy(p.Op.Cache)
+	}
+	if policy.Mode != "never" && ctx.results != nil {
+		if _, cached := ctx.results.load(cacheKey("command", p.Value, dir), policy.TTL); cached {
+			return false
+		}
+	}
+	if p.Args != nil {
+		return executableExists(p.Args[0], dir)
+	}
+	_, missing := missingExecutable(p.Value, dir)
+	return !missing
+}
+
+// runPrefetch runs ops at most jobs at a time and waits for all of them.
+func (ctx *ProcessingContext) runPrefetch(ops []PlannedOperation, jobs int, dir string) {
+	runs := make([]commandRun, len(ops))
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, p := range ops {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			runs[i] = runCommand(p.Value, p.Args, dir, ctx.workDir, p.Op.Limits)
+			<-slots
+		}()
+	}
+	wg.Wait()
+
+	for i, p := range ops {
+		key := cacheKey("command", p.Value, dir)
+		ctx.prefetched[key] = append(ctx.prefetched[key], runs[i])
+	}
+}
+
+// takePrefetched returns the next prefetched run of the command with key.
+// Repeated commands are prefetched once per occurrence, in plan order.
+func (ctx *ProcessingContext) takePrefetched(key string) (commandRun, bool) {
+	runs := ctx.prefetched[key]
+	if len(runs) == 0 {
+		return commandRun{}, false
+	}
+	ctx.prefetched[key] = runs[1:]
+	return runs[0], true
+}
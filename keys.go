@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// checkUnknownKeys reports the first mapping key in node that does not
+// correspond to a field of t, which decoding would otherwise silently drop.
+// Values decoded by their own UnmarshalYAML, and fields of type any, are not
+// checked.
+func checkUnknownKeys(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.DocumentNode {
+		for _, child := range node.Content {
+			if err := checkUnknownKeys(child, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, item := range node.Content {
+			if err := checkUnknownKeys(item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := checkUnknownKeys(node.Content[i], t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				if err := checkMergedKeys(value, t); err != nil {
+					return err
+				}
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				return ErrUnknownKey{Key: key.Value, Line: key.Line, Suggestion: suggestKey(key.Value, fields)}
+			}
+			if err := checkUnknownKeys(value, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkMergedKeys checks the mappings merged in with <<.
+func checkMergedKeys(value *yaml.Node, t reflect.Type) error {
+	if value.Kind == yaml.SequenceNode {
+		for _, item := range value.Content {
+			if err := checkUnknownKeys(item, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return checkUnknownKeys(value, t)
+}
+
+// yamlFields maps the YAML keys of a struct's fields to their types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// suggestKey returns the known key closest to key, if any is close enough
+// to be a likely typo.
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		distance := editDistance(key, name)
+		if distance < bestDistance || (distance == bestDistance && best != "" && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	if bestDistance > len(key)/2 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+type ErrUnknownKey struct {
+	Key        string
+	Line       int
+	Suggestion string
+}
+
+func (e ErrUnknownKey) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown key %q (did you mean %q?)", e.Key, e.Suggestion)
+	}
+	return fmt.Sprintf("unknown key %q", e.Key)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandLimits caps the resources of a command operation so a runaway
+// command cannot take down the machine compiling the prompt. Limits are set
+// with the shell's ulimit, that is setrlimit, in the process that runs the
+// command, and apply to everything it starts.
+type CommandLimits struct {
+	// Memory is the largest address space, such as "512MB" or "2GiB".
+	Memory string `yaml:"memory,omitempty"`
+	// CPUTime is the most CPU time, such as "30s", rounded up to seconds.
+	CPUTime string `yaml:"cpu_time,omitempty"`
+	// OpenFiles is the most file descriptors open at once.
+	OpenFiles int `yaml:"open_files,omitempty"`
+}
+
+var byteUnits = map[string]float64{
+	"": 1, "B": 1,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9,
+	"KIB": 1 << 10, "MIB": 1 << 20, "GIB": 1 << 30,
+}
+
+// parseByteSize parses a size such as "512MB", "1.5GiB" or "4096".
+func parseByteSize(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	number := strings.TrimRight(trimmed, "bBkKmMgGiI ")
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(trimmed[len(number):]))]
+	value, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional unit such as 512MB or 2GiB", s)
+	}
+	return int64(math.Ceil(value * unit)), nil
+}
+
+// ulimits returns the ulimit arguments for the limits, one call each.
+func (l CommandLimits) ulimits() ([][]string, error) {
+	var calls [][]string
+	if l.Memory != "" {
+		size, err := parseByteSize(l.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("limits.memory: %w", err)
+		}
+		calls = append(calls, []string{"-v", strconv.FormatInt((size+1023)/1024, 10)})
+	}
+	if l.CPUTime != "" {
+		cpu, err := time.ParseDuration(l.CPUTime)
+		if err != nil || cpu <= 0 {
+			return nil, fmt.Errorf("limits.cpu_time: invalid duration %q, expected a positive duration such as 30s", l.CPUTime)
+		}
+		calls = append(calls, []string{"-t", strconv.FormatInt(int64(math.Ceil(cpu.Seconds())), 10)})
+	}
+	if l.OpenFiles < 0 {
+		return nil, fmt.Errorf("limits.open_files must be positive")
+	}
+	if l.OpenFiles > 0 {
+		calls = append(calls, []string{"-n", strconv.Itoa(l.OpenFiles)})
+	}
+	return calls, nil
+}
+
+// validateLimits checks limits on an operation.
+func validateLimits(op Operation, opType OperationType) error {
+	if op.Limits == nil {
+		return nil
+	}
+	if opType != CommandOp {
+		return fmt.Errorf("limits apply only to command operations")
+	}
+	_, err := op.Limits.ulimits()
+	return err
+}
+
+// limitScript returns shell lines setting the limits, each exiting with
+// status 126 if the limit cannot be set, so the command never runs unlimited.
+func limitScript(limits *CommandLimits) (string, error) {
+	if limits == nil {
+		return "", nil
+	}
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("command limits are not supported on Windows")
+	}
+	calls, err := limits.ulimits()
+	if err != nil {
+		return "", err
+	}
+	var script strings.Builder
+	for _, args := range calls {
+		fmt.Fprintf(&script, "ulimit %s || exit 126\n", strings.Join(args, " "))
+	}
+	return script.String(), nil
+}
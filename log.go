@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LogSpec includes a log file trimmed for the budget: its last Tail lines,
+// with runs of identical lines collapsed when Dedup is set.
+type LogSpec struct {
+	File            string `yaml:"file"`
+	Tail            int    `yaml:"tail,omitempty"`
+	Dedup           bool   `yaml:"dedup,omitempty"`
+	StripTimestamps bool   `yaml:"strip_timestamps,omitempty"`
+}
+
+func validateLog(spec LogSpec) error {
+	if spec.File == "" {
+		return fmt.Errorf("log needs a file")
+	}
+	if spec.Tail < 0 {
+		return fmt.Errorf("log tail must not be negative")
+	}
+	return nil
+}
+
+// logTimestampPattern matches the timestamp commonly leading a log line:
+// ISO 8601 and RFC 3339, Go's log package, syslog, and bare times, each
+// optionally in brackets.
+var logTimestampPattern = regexp.MustCompile(`^\[?(?:` +
+	`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z| ?[+-]\d{2}:?\d{2})?` +
+	`|\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?` +
+	`|[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}` +
+	`|\d{2}:\d{2}:\d{2}(?:[.,]\d+)?` +
+	`)\]?\s+`)
+
+// processLogOperation reads the log when the operation runs, keeps its last
+// Tail lines, then strips timestamps and collapses repeats, so lines that
+// differ only in their timestamp collapse too.
+func processLogOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec := *p.Op.Log
+	if isBinaryFile(p.Path) {
+		return ContentSection{}, ErrBinaryFile{File: p.Path}
+	}
+	data, err := ctx.ReadFile(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), "\n")
+	if spec.Tail > 0 && len(lines) > spec.Tail {
+		lines = lines[len(lines)-spec.Tail:]
+	}
+	if spec.StripTimestamps {
+		for i, line := range lines {
+			lines[i] = logTimestampPattern.ReplaceAllString(line, "")
+		}
+	}
+	if spec.Dedup {
+		lines = dedupLines(lines)
+	}
+
+	return ContentSection{
+		Source:  displayPath(p.Value),
+		Content: normalizeContent(strings.Join(lines, "\n")),
+		Type:    LogOp,
+	}, nil
+}
+
+// dedupLines collapses each run of identical lines into its first line,
+// followed by a ×N count of the run's length.
+func dedupLines(lines []string) []string {
+	var result []string
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && lines[j] == lines[i] {
+			j++
+		}
+		if j-i > 1 {
+			result = append(result, fmt.Sprintf("%s (×%d)", lines[i], j-i))
+		} else {
+			result = append(result, lines[i])
+		}
+		i = j
+	}
+	return result
+}
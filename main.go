@@ -1,52 +1,239 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+var subcommands = map[string]func(args []string) error{
+	"demo":    func(args []string) error { return runDemo() },
+	"build":   runBuild,
+	"matrix":  runMatrix,
+	"daemon":  runDaemon,
+	"serve":   runServe,
+	"hook":    runHook,
+	"migrate": runMigrate,
+	"cat":     runCat,
+	"pick":    runPick,
+	"parse":   runParse,
+}
+
 func main() {
-	// Check for demo subcommand first
-	if len(os.Args) > 1 && os.Args[1] == "demo" {
-		if err := runDemo(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+	// Check for subcommands first
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(0)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
 		}
-		return
 	}
 
+	opts := Options{Vars: make(map[string]string)}
+	registerCompileFlags(flag.CommandLine, &opts)
+	flag.Var(varFlag(opts.Vars), "set", "Set a variable (name=value, repeatable)")
 	var (
-		promptFile     = flag.String("f", "", "Path to YAML prompt file (required)")
-		outputFile     = flag.String("o", "", "Output file path (default: stdout)")
-		maxWords       = flag.Int("max-words", 128000, "Maximum words in compiled output")
-		delimiterStyle = flag.String("delimiter-style", "xml", "Delimiter style: xml, minimal, none, full")
-		help           = flag.Bool("h", false, "Show help message")
-		helpLong       = flag.Bool("help", false, "Show help message")
+		help     = flag.Bool("h", false, "Show help message")
+		helpLong = flag.Bool("help", false, "Show help message")
 	)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `pcp: Prompt Composition Processor
 
 Usage: 
-  pcp -f <prompt-file> [-o <output-file>] [-max-words <limit>] [-delimiter-style <style>] [-h]
+  pcp -f <prompt-file> [-o <output-file>] [-max-words <limit>] [-delimiter-style <style>] [-format <format>] [-h]
+  pcp build -f <prompt-file> [flags] [target]
+  pcp matrix -f <prompt-file> -set name=v1,v2 [-o <template>] [flags]
+  pcp daemon [-socket <path>]
+  pcp serve [-addr <host:port>] [-dir <directory>]
+  pcp hook install -pattern <glob> [-pattern ...] [-force]
+  pcp migrate -f <prompt-file> [-w]
+  pcp cat [-emit-yaml <prompt-file>] [flags] <path>...
+  pcp pick [-dir <directory>] [-emit-yaml <prompt-file>] [flags]
+  pcp parse [-delimiter-style <style>] [-o <output-file>] [<compiled-file>]
   pcp demo
 
 Compiles content from multiple sources into a single text output for AI agents.
 
 Commands:
+  build       Compile the named targets from the prompt file's outputs map
+  matrix      Compile once per combination of variable values
+  daemon      Serve compile requests over a local socket with warm caches
+  serve       Serve compiled prompt files over HTTP for pcp_remote
+  hook        Install a git pre-commit hook that runs -check on prompt files
+  migrate     Upgrade a prompt file and convert its file-reading commands
+  cat         Compile files, directories and globs named on the command line
+  pick        Choose files on the terminal and compile them
+  parse       Split compiled text output back into sections, as JSON
   demo        Create and run a demonstration with sample files
 
 Flags:
   -f string
         Path to YAML prompt file (required)
   -o string
-        Output file path (default: stdout)
+        Output file path (default: stdout). A .tar.gz or .tgz path writes a
+        bundle of the output and a manifest.json
+  -compress string
+        Compress the -o output file: none, gzip, zstd (default: gzip for a
+        .gz name, zstd for .zst, else none). The format is inferred from the
+        name without .gz/.zst, e.g. context.md.gz
+  -bundle-sources
+        With -o context.tar.gz (or .tgz), also bundle copies of every prompt
+        file and file read, under sources/
+  -o-dir string
+        Write each section to its own numbered file in a directory, plus an
+        index.json listing files, sources, types and word counts
+  -route types=file
+        Write sections of the listed operation types to their own file, e.g.
+        -route command,script=dynamic.txt -route file,dir=static.txt. The
+        rest go to -o (or stdout). Repeatable
+  -output-mode mode
+        Octal permissions for output files, e.g. 0600. Existing files are
+        changed too (default: $PCP_OUTPUT_MODE, or 0644)
   -max-words int
-        Maximum words in compiled output (default: 128000)
+        Maximum words in compiled output (default: 128000, or from -model)
+  -model string
+        Set the budget from a model's context window, less a reserve for its
+        response, and estimate tokens with its tokenizer. -max-words, when
+        given, still sets the budget. Models: gpt-4o, gpt-4o-mini, gpt-4.1,
+        gpt-4-turbo, o3, claude-3-5-sonnet, claude-3-5-haiku,
+        claude-3-7-sonnet, claude-3-opus, gemini-1.5-pro, gemini-2.0-flash,
+        llama-3.1
+  -reserve-tokens int
+        Tokens left for the response, since input and output share the
+        context window: taken off -max-words, at the tokenizer estimate,
+        or off the -model window (default: 0, or the model's usual maximum
+        output)
   -delimiter-style string
         Delimiter style: xml, minimal, none, full (default: xml)
+  -section-separator string
+        Text written between sections of text output, in every delimiter
+        style including none. Go escapes are interpreted, e.g. '\n\n---\n\n'
+        (default: \n, a blank line before each header)
+  -set name=value
+        Set a variable referenced as ${name} in operations (repeatable).
+        Values are shell-quoted in commands; use ${name:raw} to splice as-is
+  -format string
+        Output format: text, markdown, json, html, records (default: inferred
+        from the -o extension: .md and .markdown give markdown, .json gives
+        json, .html and .htm give html, anything else gives text). records
+        ends each section with a NUL byte, for xargs -0 and awk pipelines
+  -exact-budget
+        Budget the assembled text output: section headers, nested headers
+        and separators count against -max-words along with the content
+        (-stats reports both counts either way)
+  -max-output-bytes int
+        Maximum size of the compiled output in bytes, in its -format, whatever
+        its word count, e.g. for minified code or one huge line. -overflow
+        applies: truncation cuts content by bytes (default: no limit)
+  -max-sections int
+        Fail while planning, before reading files or running commands, if
+        the prompt has more sections, e.g. a glob matching thousands of
+        files. A glob or dir over the limit reports how many files it
+        matched (default: no limit)
+  -overflow string
+        What to do when the output exceeds -max-words (default: error):
+          error                  fail the compile
+          truncate               keep sections in order, cutting off the tail
+          truncate-proportional  trim every section by its weight: (default 1)
+          recency                keep instructions and command output, then
+                                 files most recently changed in git first
+  -recency-lookback string
+        How far back in git history -overflow recency looks, as days (90d)
+        or a Go duration (720h). Older files rank last (default: 90d)
+  -jobs int
+        Number of commands to run at once (default: 1). Commands then start
+        before any file is read, and sections keep their prompt file order.
+        Mark a command serial: true to run it on its own
+  -cache string
+        Default cache policy for command output, overridden per operation
+        with cache: (default: never)
+          never           always run the command
+          content         reuse output while the command text and working
+                          directory are unchanged
+          ttl=<duration>  reuse output for the given time, e.g. ttl=5m
+  -cache-dir string
+        Directory for cached command output and remote sources
+        (default: user cache dir)
+  -no-cache
+        Fetch pcp_remote sources and https:// prompts afresh instead of
+        through the HTTP cache
+  -remote-cache-ttl duration
+        How long a cached remote response is used without asking the
+        server, e.g. 10m. Older responses are revalidated with their ETag or
+        Last-Modified (default: 0, always revalidate)
+  -registry string
+        Base URL that registry: prompts are fetched from, as
+        <url>/<name>/<version>.yml, and cached under -cache-dir
+        (default: $PCP_REGISTRY)
+  -verify-key string
+        Minisign public key, or the path of its .pub file, that registry:
+        and https:// prompts must be signed with. Signatures are fetched from the prompt's
+        URL plus .minisig (default: $PCP_VERIFY_KEY)
+  -allow-remote-commands
+        Let https:// prompts run command and script operations, and read
+        files by absolute path, without a signature checked by -verify-key
+  -watch
+        Keep running and recompile whenever the prompt file, a nested prompt
+        or an included file changes. The watch list follows the prompt tree
+        as it is edited.
+  -watch-interval duration
+        How often -watch polls for changes (default: 500ms)
+  -review
+        Before writing the output, list every section with its size on the
+        terminal and turn sections off by number, for a quick human pass
+        over sensitive or bloated content
+  -plan
+        Print the resolved, flattened list of operations (with resolved paths
+        and expanded commands) without reading files or running commands
+  -check
+        Validate the prompt file tree (syntax, nested prompts, cycles) and
+        that every included file exists, without reading file contents
+        or running commands. Prints nothing and exits 0 when all is well,
+        for pre-commit hooks
+  -print-commands
+        Print every command the compile would run, after variable expansion,
+        with its working directory, the environment variables pcp sets for
+        it and its limits, without running anything
+  -keep-going
+        Continue past failing operations, putting a placeholder with the
+        error in place of each, then write the output and exit nonzero with
+        a list of every failure
+  -quiet
+        Suppress warnings and progress messages on stderr (errors still print)
+  -strict
+        Treat warnings as errors: the compile fails and no output is written
+  -stats
+        Print compile statistics (sections, words, skipped operations) to stderr;
+        with -plan, estimate the compile's size from file sizes instead
+  -section-ids
+        Give each section a stable ID, derived from its source and options,
+        shown in headers (<!-- pcp-source: main.go id=3f2a9c1b7d4e -->),
+        JSON output, -o-dir indexes and bundle manifests
+  -keep-control-chars
+        Keep control characters and terminal escape sequences in content
+        (stripped by default, except newlines and tabs)
+  -respect-gitignore
+        Leave out files the repository's .gitignore files ignore when dir,
+        tree and glob operations expand (an operation's respect_gitignore
+        overrides it)
+  -merge-sources
+        Combine sections read from the same file (e.g. included directly and
+        via a nested prompt) into the first occurrence
+  -normalize string
+        Unicode normalization applied to the output: none, nfc (default: none)
+  -checksum
+        Append a "<!-- pcp-checksum: sha256=... sections=N -->" trailer line.
+        The hash covers everything before the trailer (not for json output)
   -h, -help
         Show this help message
 
@@ -60,11 +247,140 @@ Usage Patterns:
     $(pcp -f prompt.yml) | agent
 
 Prompt File Format:
+  - version: 2                     (optional; commands must then exit 0
+                                    unless they list ok_exit_codes)
   - prompt:
       - file: "relative/path/to/file.txt"
+      - file: "src/**/*.go"       (glob: one section per matching file)
+      - dir: "src"                (every file below src, binary ones as a stub;
+                                 extensions: [go] and max_depth: 2 optional)
+      - tree: "."                 (directory tree like tree -F; max_depth and
+                                 exclude: [node_modules] optional)
       - prompt: "nested-prompt.yml"
+      - prompt: "builtin:code-review"  (embedded fragment; also commit-message,
+                                        patch-output)
+      - prompt: "registry:org/code-review@v1"  (shared component, see -registry)
+        sha256: "<hex>"          (optional pin of its content)
+      - prompt: "https://example.com/shared/review.yml"  (remote prompt; its
+                                 relative paths resolve against the URL)
       - command: "ls -la"
+      - command: ["git", "log", "-5"]  (argv list, run without a shell)
+      - script: {command: "make test", pty: true}  (run in a terminal; output
+                                 rendered as the terminal showed it)
       - text: "Literal text content"
+      - ref: "#label"            (reuse a labeled operation's content)
+      - timestamp: {format: "2006-01-02 15:04 MST"}  (Go layout; utc: true optional)
+      - pcp_remote: "http://host:7777/compiled/arch"  (fetch from pcp serve)
+      - assert: {var: branch, matches: "^feature/"}  (or label:, contains:)
+      - comment: "note for authors"  (shown by -plan, never emitted)
+      - symbol: {file: "server.go", name: "handleLogin"}  (one Go function,
+                                 method (Type.Method) or type)
+      - related: {symbol: "handleLogin", dir: "auth", depth: 1}  (the function
+                                 with its callers and callees in the package)
+      - coverage: {profile: "cover.out", min: 0}  (Go files a test run executed;
+                                 functions: true for just the functions)
+      - stacktrace: {file: "panic.log", context: 10}  (source around the lines
+                                 a Go, Python or Java stack trace names)
+      - log: {file: "app.log", tail: 500, dedup: true}  (last lines of a log,
+                                 repeats collapsed; strip_timestamps: true)
+      - diff: {a: "prod.yml", b: "staging.yml"}  (unified diff of two files)
+      - diff: "main...HEAD"  (git diff of a range; also {staged: true},
+                                 paths: [...] and context: N)
+      - git: {path: "main.go", ref: "v1.2.0"}  (the file at a commit, tag or
+                                 branch)
+      - build_targets: "Makefile"  (targets with their docs; also Taskfile.yml
+                                 and justfile)
+      - sysinfo: true            (OS, arch, Go version, CPUs, cwd, git branch/commit)
+
+  Any operation can carry a label for later refs:
+      - command: "git log -5"
+        label: history
+      - ref: "#history"
+        charge: true             (count the words again; default: no)
+
+  Any operation can cap its own contribution (truncated with a marker):
+      - file: "server.log"
+        max_words: 2000          (or max_tokens: 4000)
+
+  A file op can include just the lines between two regex matches:
+      - file: "main.go"
+        from_pattern: "^func main\\("
+        to_pattern: "^}"
+
+  A file op can keep only the newest release of a changelog:
+      - file: "CHANGELOG.md"
+        latest_entry: true
+
+  A file op can drop YAML or TOML frontmatter from docs pages:
+      - file: "content/docs/install.md"
+        strip_frontmatter: true
+
+  A file op can condense an OpenAPI or .proto spec to its skeleton:
+      - file: "api/openapi.yml"
+        condense: true
+        description_limit: 100   (characters kept per description)
+
+  A file op can reduce go.mod, package.json or requirements.txt to the
+  direct dependencies and their versions:
+      - file: "go.mod"
+        deps_summary: true
+
+  A file op can bring its test file (foo_test.go, test_foo.py, ...) along:
+      - file: "auth/login.go"
+        with_tests: true
+
+  A file op can describe a binary file in one line (or skip it) instead of
+  failing:
+      - file: "assets/logo.png"
+        binary: stub             (or skip; default error)
+
+  Any operation can be switched off without deleting it:
+      - file: "big.log"
+        disabled: true
+
+  A command's output can be captured as a variable for later operations:
+      - command: "git rev-parse --abbrev-ref HEAD"
+        capture_as: branch
+        suppress: true           (leave the section out of the output)
+      - text: "Working on ${branch}"
+
+  A text op can be a Go template over the compile's metadata:
+      - text: "You have {{.FileCount}} files totaling {{.WordsUsed}} words"
+        template: true           (also .WordsRemaining, .SectionCount, .Files, .Vars)
+      - text: "Supported Go: {{include \"GO_VERSION\"}}"  (embed a small file inline)
+        template: true
+
+  A nested prompt shared by several branches can be emitted only once:
+      - prompt: "shared/standards.yml"
+        include_once: true
+
+  A file op may read a prompt file being processed only if it opts in:
+      - file: "prompt.yml"
+        allow_self: true
+
+  A command's resources can be capped (not on Windows):
+      - command: "npm test"
+        limits: {memory: 2GB, cpu_time: 60s, open_files: 1024}
+
+  A command that must not run alongside others under -jobs:
+      - command: "make generate"
+        serial: true
+
+  Commands may exit 0 or 1 (with a warning) unless given their own codes:
+      - command: "diff -u a b"
+        ok_exit_codes: [0, 1]
+
+  Commands whose program is not installed fail unless given a fallback:
+      - command: "tree -L 2"
+        fallback_text: "(tree not installed)"
+
+  Blocks can be defined once under definitions and reused with aliases; an
+  aliased list of operations is spliced into the prompt list:
+    definitions:
+      project: &project
+        - file: "README.md"
+    prompt:
+      - *project
 
 Text Field Special Characters:
   Multiline text using YAML literal block scalar:
@@ -90,83 +406,496 @@ Text Field Special Characters:
 		os.Exit(0)
 	}
 
-	if *promptFile == "" {
+	if opts.PromptFile == "" {
 		fmt.Fprintf(os.Stderr, "Error: -f flag is required\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Validate delimiter style
+	if err := validateOptions(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := runCompile(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// registerCompileFlags binds the flags shared by every compiling command.
+func registerCompileFlags(fs *flag.FlagSet, opts *Options) {
+	fs.StringVar(&opts.PromptFile, "f", "", "Path to YAML prompt file (required)")
+	fs.StringVar(&opts.OutputFile, "o", "", "Output file path (default: stdout)")
+	fs.Var(routeFlag{&opts.Routes}, "route", "Write sections of some types to their own file, as `types=file` (e.g. command,script=dynamic.txt; repeatable)")
+	fs.StringVar(&opts.OutputDir, "o-dir", "", "Write each section to a numbered file in this directory, with an index.json")
+	fs.StringVar(&opts.Compress, "compress", "", "Compress the -o output file: none, gzip, zstd (default: from a .gz or .zst -o name, else none)")
+	fs.BoolVar(&opts.BundleSources, "bundle-sources", false, "Include copies of every file read in a -o *.tar.gz bundle")
+	opts.OutputMode = envOutputMode()
+	fs.Var(fileModeFlag{&opts.OutputMode}, "output-mode", "Permission mode for output files (default: $PCP_OUTPUT_MODE or 0644)")
+	opts.MaxWords = 128000
+	fs.Var(maxWordsFlag{opts}, "max-words", "Maximum `words` in compiled output")
+	fs.StringVar(&opts.Model, "model", "", "Budget for a model's context window and tokenizer: "+strings.Join(modelNames(), ", "))
+	fs.IntVar(&opts.ReserveTokens, "reserve-tokens", 0, "Tokens left for the response, taken off -max-words or the -model window")
+	fs.StringVar(&opts.DelimiterStyle, "delimiter-style", "xml", "Delimiter style: xml, minimal, none, full")
+	fs.Var(separatorFlag{&opts.SectionSeparator}, "section-separator", "Text written between sections, with Go escapes (default: \\n)")
+	fs.StringVar(&opts.Format, "format", "", "Output format: text, markdown, json, html, records (default: from -o extension)")
+	fs.BoolVar(&opts.Stats, "stats", false, "Print compile statistics to stderr")
+	fs.BoolVar(&opts.KeepGoing, "keep-going", false, "Continue past failing operations and report them all at the end")
+	fs.BoolVar(&opts.Quiet, "quiet", false, "Do not print warnings or progress messages to stderr")
+	fs.BoolVar(&opts.Strict, "strict", false, "Fail the compile if any warning is reported")
+	fs.BoolVar(&opts.Plan, "plan", false, "Print the resolved operations without executing them")
+	fs.BoolVar(&opts.Check, "check", false, "Validate the prompt file tree and included paths without reading files or running commands")
+	fs.BoolVar(&opts.PrintCommands, "print-commands", false, "Print the commands that would run, with their directory and environment, without running them")
+	fs.StringVar(&opts.Normalize, "normalize", "none", "Unicode normalization of output: none, nfc")
+	fs.BoolVar(&opts.MergeSources, "merge-sources", false, "Combine sections read from the same file under the first one")
+	fs.BoolVar(&opts.Checksum, "checksum", false, "Append a trailer with the output sha256 and section count")
+	fs.BoolVar(&opts.KeepControlChars, "keep-control-chars", false, "Keep control characters and terminal escapes in section content")
+	fs.BoolVar(&opts.RespectGitignore, "respect-gitignore", false, "Leave files ignored by .gitignore out of dir, tree and glob operations")
+	fs.IntVar(&opts.Jobs, "jobs", 1, "Number of commands to run at once")
+	fs.IntVar(&opts.MaxOutputBytes, "max-output-bytes", 0, "Maximum size of the compiled output in bytes, in its format (default: no limit)")
+	fs.IntVar(&opts.MaxSections, "max-sections", 0, "Fail before anything runs if the prompt has more sections (default: no limit)")
+	fs.BoolVar(&opts.ExactBudget, "exact-budget", false, "Count headers and separators against -max-words, not just section content")
+	fs.BoolVar(&opts.SectionIDs, "section-ids", false, "Show a stable ID for each section in headers, JSON and manifests")
+	fs.StringVar(&opts.Overflow, "overflow", "error", "Over-budget policy: error, truncate, truncate-proportional, recency")
+	fs.StringVar(&opts.RecencyLookback, "recency-lookback", defaultRecencyLookback, "How far back -overflow recency looks in git history, e.g. 90d or 720h")
+	fs.StringVar(&opts.Cache, "cache", "never", "Default cache policy for commands: never, content, ttl=<duration>")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "Directory for cached command output and remote sources (default: user cache dir)")
+	fs.BoolVar(&opts.NoCache, "no-cache", false, "Fetch pcp_remote sources and https:// prompts afresh, without the HTTP cache")
+	fs.DurationVar(&opts.RemoteCacheTTL, "remote-cache-ttl", 0, "How long a cached remote response is used without revalidating it")
+	fs.StringVar(&opts.Registry, "registry", os.Getenv("PCP_REGISTRY"), "Base URL of the registry for registry: prompts (default: $PCP_REGISTRY)")
+	fs.StringVar(&opts.VerifyKey, "verify-key", os.Getenv("PCP_VERIFY_KEY"), "Minisign public key or key file that registry: and https:// prompts must be signed with (default: $PCP_VERIFY_KEY)")
+	fs.BoolVar(&opts.AllowRemoteCommands, "allow-remote-commands", false, "Let https:// prompts not checked with -verify-key run commands and scripts and read local files")
+	fs.BoolVar(&opts.Watch, "watch", false, "Recompile whenever the prompt file or anything it includes changes")
+	fs.DurationVar(&opts.WatchInterval, "watch-interval", 500*time.Millisecond, "How often -watch checks for changes")
+	fs.BoolVar(&opts.Review, "review", false, "List the sections on the terminal and turn some off before the output is written")
+}
+
+func validateOptions(opts Options) error {
 	validStyles := map[string]bool{
 		"xml":     true,
 		"minimal": true,
 		"none":    true,
 		"full":    true,
 	}
-	if !validStyles[*delimiterStyle] {
-		fmt.Fprintf(os.Stderr, "Error: invalid delimiter style '%s'. Must be one of: xml, minimal, none, full\n", *delimiterStyle)
-		flag.Usage()
-		os.Exit(1)
+	if !validStyles[opts.DelimiterStyle] {
+		return fmt.Errorf("invalid delimiter style '%s'. Must be one of: xml, minimal, none, full", opts.DelimiterStyle)
 	}
 
-	if err := processPromptFile(*promptFile, *outputFile, *maxWords, *delimiterStyle); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if opts.Overflow != "" && !validOverflowPolicies[opts.Overflow] {
+		return fmt.Errorf("invalid overflow policy '%s'. Must be one of: error, truncate, truncate-proportional, recency", opts.Overflow)
 	}
-}
 
-func processPromptFile(promptFile, outputFile string, maxWords int, delimiterStyle string) error {
-	ctx := NewProcessingContext(promptFile, maxWords, delimiterStyle)
+	if _, err := parseCachePolicy(opts.Cache); err != nil {
+		return err
+	}
+
+	if opts.Format != "" && !validFormats[opts.Format] {
+		return fmt.Errorf("invalid format '%s'. Must be one of: text, markdown, json, html, records", opts.Format)
+	}
+
+	if opts.Normalize != "" && !validNormalizations[opts.Normalize] {
+		return fmt.Errorf("invalid normalization '%s'. Must be one of: none, nfc", opts.Normalize)
+	}
+
+	modes := 0
+	for _, set := range []bool{opts.Plan, opts.PrintCommands, opts.Check} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("only one of -plan, -print-commands and -check can be used")
+	}
+
+	if opts.Review && opts.Watch {
+		return fmt.Errorf("-review cannot be used with -watch")
+	}
+
+	if opts.RecencyLookback != "" {
+		if _, err := parseLookback(opts.RecencyLookback); err != nil {
+			return err
+		}
+	}
+
+	if opts.Jobs < 0 {
+		return fmt.Errorf("-jobs must not be negative")
+	}
+
+	if opts.MaxOutputBytes < 0 {
+		return fmt.Errorf("-max-output-bytes must not be negative")
+	}
 
-	if err := validatePromptFileStructure(promptFile, ctx); err != nil {
+	if opts.MaxSections < 0 {
+		return fmt.Errorf("-max-sections must not be negative")
+	}
+	if err := validateModel(opts); err != nil {
 		return err
 	}
+	if opts.RemoteCacheTTL < 0 {
+		return fmt.Errorf("-remote-cache-ttl must not be negative")
+	}
 
-	ctx = NewProcessingContext(promptFile, maxWords, delimiterStyle)
+	if opts.OutputDir != "" && opts.OutputFile != "" {
+		return fmt.Errorf("-o and -o-dir cannot be used together")
+	}
 
-	pf, err := parsePromptFile(promptFile)
-	if err != nil {
+	if err := validateRoutes(opts); err != nil {
 		return err
 	}
 
-	var compiledContent CompiledContent
-	for _, op := range pf.Prompt {
-		section, err := processOperation(op, ctx)
+	if opts.Compress != "" && !validCompressions[opts.Compress] {
+		return fmt.Errorf("invalid compression '%s'. Must be one of: none, gzip, zstd", opts.Compress)
+	}
+
+	if opts.Compress != "" && opts.Compress != "none" && (opts.OutputFile == "" || isBundlePath(opts.OutputFile)) {
+		return fmt.Errorf("-compress requires -o with a plain output file")
+	}
+
+	if opts.BundleSources && !isBundlePath(opts.OutputFile) {
+		return fmt.Errorf("-bundle-sources requires -o with a .tar.gz or .tgz path")
+	}
+
+	if opts.Checksum && opts.OutputDir != "" {
+		return fmt.Errorf("-checksum cannot be used with -o-dir")
+	}
+
+	if opts.Checksum && resolveFormat(opts.Format, opts.OutputFile) == "json" {
+		return fmt.Errorf("-checksum cannot be used with json output, which must stay valid JSON")
+	}
+
+	if opts.Checksum && resolveFormat(opts.Format, opts.OutputFile) == "records" {
+		return fmt.Errorf("-checksum cannot be used with records output, where the trailer would read as a record")
+	}
+
+	return nil
+}
+
+func processPromptFile(promptFile, outputFile string, maxWords int, delimiterStyle string) error {
+	return runCompile(Options{
+		PromptFile:     promptFile,
+		OutputFile:     outputFile,
+		MaxWords:       maxWords,
+		DelimiterStyle: delimiterStyle,
+	})
+}
+
+func runCompile(opts Options) error {
+	if opts.Plan {
+		plan, err := resolvePlan(opts)
+		if err != nil {
+			return err
+		}
+		printPlan(os.Stdout, plan)
+		if opts.Stats {
+			printEstimate(os.Stderr, plan, opts.wordBudget(), opts.charsPerToken())
+		}
+		return nil
+	}
+	if opts.Check {
+		ctx, err := newCompileContext(opts)
+		if err != nil {
+			return err
+		}
+		return checkPromptFile(opts.PromptFile, ctx)
+	}
+	if opts.PrintCommands {
+		ctx, err := newCompileContext(opts)
 		if err != nil {
 			return err
 		}
-		compiledContent.Sections = append(compiledContent.Sections, section)
+		plan, err := buildPlan(opts.PromptFile, ctx)
+		if err != nil {
+			return err
+		}
+		workDir := opts.WorkDir
+		if workDir == "" {
+			workDir = "."
+		}
+		printCommands(os.Stdout, plan, workDir, ctx)
+		return nil
+	}
+	if opts.Watch {
+		return watchAndCompile(opts, nil)
 	}
+	_, err := compileAndWrite(opts)
+	return err
+}
 
-	output, err := compileOutput(compiledContent, delimiterStyle)
+// compileAndWrite compiles the prompt file and writes the rendered output to
+// the output file or stdout, less the sections -route sends elsewhere.
+func compileAndWrite(opts Options) (CompiledContent, error) {
+	compiledContent, err := compilePromptFile(opts)
 	if err != nil {
-		return err
+		return CompiledContent{}, err
 	}
 
-	if outputFile == "" {
+	if opts.Stats {
+		printStats(os.Stderr, compiledContent.Stats)
+	}
+
+	if opts.OutputDir != "" {
+		if err := writeOutputDir(opts.OutputDir, compiledContent, opts); err != nil {
+			return CompiledContent{}, err
+		}
+		return compiledContent, failuresError(compiledContent.Stats)
+	}
+
+	mainContent := compiledContent
+	var routes []routeOutput
+	if len(opts.Routes) > 0 {
+		if routes, mainContent, err = renderRoutes(compiledContent, opts); err != nil {
+			return CompiledContent{}, err
+		}
+	}
+
+	output, err := renderCompiled(mainContent, opts)
+	if err != nil {
+		return CompiledContent{}, err
+	}
+	var data []byte
+	if opts.OutputFile != "" && !isBundlePath(opts.OutputFile) {
+		if data, err = compressOutput([]byte(output), resolveCompression(opts.Compress, opts.OutputFile)); err != nil {
+			return CompiledContent{}, err
+		}
+	}
+
+	// Every output has rendered, so a failure cannot leave some written
+	if err := writeRoutes(routes, opts); err != nil {
+		return CompiledContent{}, err
+	}
+	if opts.OutputFile == "" {
 		fmt.Print(output)
+	} else if isBundlePath(opts.OutputFile) {
+		if err := writeBundle(opts.OutputFile, output, compiledContent, opts); err != nil {
+			return CompiledContent{}, fmt.Errorf("failed to write bundle %s: %w", opts.OutputFile, err)
+		}
 	} else {
-		if err := os.WriteFile(outputFile, []byte(output), 0644); err != nil {
-			return fmt.Errorf("failed to write output file %s: %w", outputFile, err)
+		if err := writeOutputFile(opts.OutputFile, data, opts.OutputMode); err != nil {
+			return CompiledContent{}, fmt.Errorf("failed to write output file %s: %w", opts.OutputFile, err)
 		}
 	}
 
-	return nil
+	return compiledContent, failuresError(compiledContent.Stats)
+}
+
+// renderCompiled renders the output as it is written to -o or stdout: in
+// the format -format or the -o extension chooses, normalized, and with the
+// -checksum trailer.
+func renderCompiled(content CompiledContent, opts Options) (string, error) {
+	output, err := renderOutput(content, resolveFormat(opts.Format, opts.OutputFile), opts.DelimiterStyle, opts.sectionSeparator())
+	if err != nil {
+		return "", err
+	}
+	output = normalizeUnicode(output, opts.Normalize)
+	if opts.Checksum {
+		output = appendChecksum(output, len(content.Sections))
+	}
+	return output, nil
 }
 
-func compileOutput(content CompiledContent, delimiterStyle string) (string, error) {
+// failuresError reports the operations that failed under -keep-going.
+func failuresError(stats CompileStats) error {
+	if len(stats.Failures) == 0 {
+		return nil
+	}
+	return ErrOperationsFailed{Failures: stats.Failures}
+}
+
+// newCompileContext sets up the processing context for a compile.
+func newCompileContext(opts Options) (*ProcessingContext, error) {
+	ctx := NewProcessingContext(opts.PromptFile, opts.wordBudget(), opts.DelimiterStyle)
+	ctx.charsPerToken = opts.charsPerToken()
+	ctx.target = opts.Target
+	ctx.overflow = opts.Overflow
+	ctx.workDir = opts.WorkDir
+	ctx.keepGoing = opts.KeepGoing
+	ctx.keepControlChars = opts.KeepControlChars
+	ctx.exactBudget = opts.ExactBudget
+	ctx.respectGitignore = opts.RespectGitignore
+	ctx.maxSections = opts.MaxSections
+	if ctx.pcpignore = loadPcpignore(ctx.rootDir); ctx.pcpignore != nil {
+		ctx.AddDependency(filepath.Join(ctx.rootDir, pcpignoreName))
+	}
+	if opts.SectionIDs {
+		ctx.sectionIDs = make(map[string]int)
+	}
+	ctx.quiet = opts.Quiet
+	ctx.strict = opts.Strict
+	ctx.cache = opts.cache
+	ctx.SetVars(opts.Vars)
+	policy, err := parseCachePolicy(opts.Cache)
+	if err != nil {
+		return nil, err
+	}
+	ctx.cachePolicy = policy
+	ctx.results = &resultCache{dir: opts.CacheDir}
+	if opts.CacheDir == "" {
+		ctx.results.dir = defaultCacheDir()
+	}
+	ctx.noCache = opts.NoCache
+	ctx.remoteCacheTTL = opts.RemoteCacheTTL
+	ctx.registry = opts.Registry
+	ctx.allowRemoteCommands = opts.AllowRemoteCommands
+	if opts.VerifyKey != "" {
+		if ctx.verifyKey, err = parseMinisignKey(opts.VerifyKey); err != nil {
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
+
+// resolvePlan resolves the compile plan for opts without executing it.
+func resolvePlan(opts Options) (*CompilePlan, error) {
+	ctx, err := newCompileContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	return buildPlan(opts.PromptFile, ctx)
+}
+
+func compilePromptFile(opts Options) (CompiledContent, error) {
+	ctx, err := newCompileContext(opts)
+	if err != nil {
+		return CompiledContent{}, err
+	}
+
+	plan, err := buildPlan(opts.PromptFile, ctx)
+	if err != nil {
+		return CompiledContent{}, err
+	}
+
+	prefetchRemoteOperations(plan, ctx)
+	if opts.Jobs > 1 {
+		prefetchCommands(plan, opts.Jobs, ctx)
+	}
+	sections, err := executePlan(plan.Operations, ctx)
+	if err != nil {
+		return CompiledContent{}, err
+	}
+	if sections, err = renderTemplates(sections, ctx); err != nil {
+		return CompiledContent{}, err
+	}
+
+	if opts.MergeSources {
+		sections, ctx.stats.MergedSections = mergeSources(sections, ctx.delimiterStyle)
+	}
+	if opts.Review {
+		if sections, err = reviewOnTerminal(sections, ctx); err != nil {
+			return CompiledContent{}, err
+		}
+	}
+
+	ctx.stats.Duplicates = findDuplicates(sections)
+	warnDuplicates(ctx.stats.Duplicates, ctx)
+
+	overhead := 0
+	if opts.ExactBudget {
+		overhead = outputOverhead(sections, opts)
+	}
+	if ctx.overflow == "recency" {
+		lookback, _ := parseLookback(defaultRecencyLookback)
+		if opts.RecencyLookback != "" {
+			lookback, _ = parseLookback(opts.RecencyLookback)
+		}
+		changed, err := gitRecency(ctx.rootDir, lookback)
+		if err != nil {
+			ctx.Warn("-overflow recency: %v; files are trimmed in prompt order", err)
+		}
+		markRecency(sections, changed)
+	}
+	if ctx.overflow != "" && ctx.overflow != "error" {
+		sections, ctx.stats.TruncatedWords = applyOverflow(sections, max(ctx.maxWords-overhead, 0), ctx.overflow, ctx.delimiterStyle)
+	} else if opts.ExactBudget {
+		// Charging headers as sections ran is close, but only the assembled
+		// output is exact, for example with a separator made of words
+		if words := contentWords(sections) + overhead; words > ctx.maxWords {
+			return CompiledContent{}, ErrWordLimitExceeded{Current: words, Limit: ctx.maxWords}
+		}
+	}
+
+	if opts.MaxOutputBytes > 0 {
+		if ctx.overflow != "" && ctx.overflow != "error" {
+			// Escaping in json and html output grows with the content, so
+			// the cut is repeated with a smaller budget until the output fits
+			original := sections
+			budget := max(opts.MaxOutputBytes-outputBytesOverhead(original, opts), 0)
+			for attempt := 1; ; attempt++ {
+				sections, ctx.stats.TruncatedBytes = applyByteOverflow(original, budget, ctx.overflow, ctx.delimiterStyle)
+				excess := outputBytes(sections, opts) - opts.MaxOutputBytes
+				if excess <= 0 || budget == 0 || attempt == maxByteOverflowAttempts {
+					break
+				}
+				budget = max(budget-excess, 0)
+			}
+		}
+		if size := outputBytes(sections, opts); size > opts.MaxOutputBytes {
+			return CompiledContent{}, ErrByteLimitExceeded{Current: size, Limit: opts.MaxOutputBytes}
+		}
+	}
+
+	if ctx.strict && len(ctx.stats.Warnings) > 0 {
+		return CompiledContent{}, ErrStrictWarnings{Warnings: ctx.stats.Warnings}
+	}
+
+	ctx.stats.Sections = len(sections)
+	ctx.stats.Words = contentWords(sections)
+	if opts.Stats || opts.ExactBudget {
+		ctx.stats.ContentWords = ctx.stats.Words
+		ctx.stats.OutputWords = ctx.stats.Words + outputOverhead(sections, opts)
+	}
+	if opts.ExactBudget {
+		ctx.stats.Words = ctx.stats.OutputWords
+		ctx.stats.ExactBudget = true
+	}
+	return CompiledContent{Sections: sections, Stats: ctx.stats, Dependencies: ctx.Dependencies()}, nil
+}
+
+func contentWords(sections []ContentSection) int {
+	total := 0
+	for _, section := range sections {
+		total += sectionWords(section)
+	}
+	return total
+}
+
+// outputOverhead counts the words text output adds around section content:
+// headers, nested headers and separators.
+func outputOverhead(sections []ContentSection, opts Options) int {
+	output, _ := compileOutput(CompiledContent{Sections: sections}, opts.DelimiterStyle, opts.sectionSeparator())
+	return max(countWords(output)-contentWords(sections), 0)
+}
+
+// maxByteOverflowAttempts bounds how often -max-output-bytes cuts again
+// when escaping made the output larger than the budget allowed for.
+const maxByteOverflowAttempts = 8
+
+// outputBytes is the size of the output as renderCompiled writes it, which
+// -max-output-bytes limits.
+func outputBytes(sections []ContentSection, opts Options) int {
+	output, _ := renderCompiled(CompiledContent{Sections: sections}, opts)
+	return len(output)
+}
+
+// outputBytesOverhead is what the output adds to the size of the section
+// content: headers and separators, or the markup and escaping of the
+// format.
+func outputBytesOverhead(sections []ContentSection, opts Options) int {
+	return max(outputBytes(sections, opts)-contentBytes(sections), 0)
+}
+
+// compileOutput renders text output: each section under its header, with
+// separator between sections whatever the delimiter style.
+func compileOutput(content CompiledContent, delimiterStyle, separator string) (string, error) {
 	var result strings.Builder
 
 	for i, section := range content.Sections {
-		// Add section header (if any)
-		if delimiterStyle != "none" {
-			if i == 0 {
-				// First section: remove leading newline from delimiter
-				result.WriteString(strings.TrimLeft(formatSectionHeader(section.Source, delimiterStyle), "\n"))
-			} else {
-				result.WriteString(formatSectionHeader(section.Source, delimiterStyle))
-			}
+		if i > 0 {
+			result.WriteString(separator)
 		}
+		// The separator, not the header, provides the leading spacing
+		result.WriteString(strings.TrimLeft(formatSectionHeader(sectionLabel(section), delimiterStyle), "\n"))
 
 		// Add the normalized content (always ends with exactly one newline)
 		result.WriteString(section.Content)
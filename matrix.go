@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// matrixDimension is one -set flag of a matrix build: a variable and every
+// value it takes.
+type matrixDimension struct {
+	Name   string
+	Values []string
+}
+
+// matrixFlag collects repeated -set name=v1,v2 flags, preserving their order
+// so combinations are produced deterministically.
+type matrixFlag struct {
+	dims *[]matrixDimension
+}
+
+func (m matrixFlag) String() string {
+	if m.dims == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*m.dims))
+	for _, dim := range *m.dims {
+		parts = append(parts, dim.Name+"="+strings.Join(dim.Values, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m matrixFlag) Set(s string) error {
+	name, value, err := splitVarAssignment(s)
+	if err != nil {
+		return err
+	}
+	for _, dim := range *m.dims {
+		if dim.Name == name {
+			return fmt.Errorf("variable %s is set more than once", name)
+		}
+	}
+	*m.dims = append(*m.dims, matrixDimension{Name: name, Values: strings.Split(value, ",")})
+	return nil
+}
+
+func runMatrix(args []string) error {
+	var opts Options
+	var dims []matrixDimension
+	fs := flag.NewFlagSet("matrix", flag.ContinueOnError)
+	registerCompileFlags(fs, &opts)
+	fs.Var(matrixFlag{dims: &dims}, "set", "Variable values to combine (name=v1,v2, repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp matrix -f <prompt-file> -set name=v1,v2 [-set ...] [-o <template>] [flags]
+
+Compiles the prompt once per combination of variable values. The -o path is a
+template: ${name} is replaced by the combination's value, e.g.
+  pcp matrix -f prompt.yml -set lang=go,py -set level=junior,senior -o 'out/${lang}-${level}.txt'
+Without -o, outputs are written to <prompt-name>-<value>-<value>.txt.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.PromptFile == "" {
+		return fmt.Errorf("-f flag is required")
+	}
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	if len(dims) == 0 {
+		return fmt.Errorf("matrix requires at least one -set name=v1,v2 flag")
+	}
+
+	outputTemplate := opts.OutputFile
+	if outputTemplate == "" {
+		base := strings.TrimSuffix(filepath.Base(opts.PromptFile), filepath.Ext(opts.PromptFile))
+		parts := []string{base}
+		for _, dim := range dims {
+			parts = append(parts, "${"+dim.Name+"}")
+		}
+		outputTemplate = strings.Join(parts, "-") + ".txt"
+	}
+
+	combinations := matrixCombinations(dims)
+	seen := make(map[string]bool, len(combinations))
+	for _, vars := range combinations {
+		outputFile := expandVars(outputTemplate, vars)
+		if seen[outputFile] {
+			return fmt.Errorf("output template %s does not distinguish every combination (%s repeats)", outputTemplate, outputFile)
+		}
+		seen[outputFile] = true
+	}
+
+	for _, vars := range combinations {
+		combo := opts
+		combo.Vars = vars
+		combo.OutputFile = expandVars(outputTemplate, vars)
+		if err := runCompile(combo); err != nil {
+			return fmt.Errorf("building %s: %w", combo.OutputFile, err)
+		}
+		if !combo.Quiet {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", combo.OutputFile)
+		}
+	}
+
+	return nil
+}
+
+// matrixCombinations returns the cartesian product of the dimensions, with
+// the last dimension varying fastest.
+func matrixCombinations(dims []matrixDimension) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, dim := range dims {
+		var next []map[string]string
+		for _, combo := range combinations {
+			for _, value := range dim.Values {
+				vars := make(map[string]string, len(combo)+1)
+				for name, v := range combo {
+					vars[name] = v
+				}
+				vars[dim.Name] = value
+				next = append(next, vars)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
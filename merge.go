@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// mergeSources combines file sections read from the same path, wherever they
+// appear in the tree, into the first of them. Later occurrences are removed
+// and any content they hold that the first does not (for example because of
+// different caps) is appended to it. Refs repeat content on purpose and are
+// left alone.
+func mergeSources(sections []ContentSection, delimiterStyle string) ([]ContentSection, int) {
+	contents := make(map[string][]string)
+	collectSourceContents(sections, contents)
+
+	seen := make(map[string]bool)
+	merged := 0
+	var rebuild func([]ContentSection) []ContentSection
+	rebuild = func(sections []ContentSection) []ContentSection {
+		kept := make([]ContentSection, 0, len(sections))
+		for _, section := range sections {
+			switch {
+			case strings.HasPrefix(section.Source, "#"):
+			case section.Type == PromptOp:
+				section.Children = rebuild(section.Children)
+				section.Content = renderNestedContent(section.Source, section.Children, delimiterStyle)
+			case section.Path != "":
+				if seen[section.Path] {
+					merged++
+					continue
+				}
+				seen[section.Path] = true
+				section.Content = normalizeContent(strings.Join(contents[section.Path], "\n"))
+			}
+			kept = append(kept, section)
+		}
+		return kept
+	}
+	return rebuild(sections), merged
+}
+
+func collectSourceContents(sections []ContentSection, contents map[string][]string) {
+	for _, section := range sections {
+		switch {
+		case strings.HasPrefix(section.Source, "#"):
+		case section.Type == PromptOp:
+			collectSourceContents(section.Children, contents)
+		case section.Path != "":
+			if !slices.Contains(contents[section.Path], section.Content) {
+				contents[section.Path] = append(contents[section.Path], section.Content)
+			}
+		}
+	}
+}
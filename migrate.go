@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	promptFile := fs.String("f", "", "Prompt file to migrate (required)")
+	write := fs.Bool("w", false, "Rewrite the file in place instead of printing a diff")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp migrate -f <prompt-file> [-w]
+
+Rewrites a prompt file to the newest format version (%d) without changing
+what it compiles to, and prints the change as a unified diff. With -w the
+file is rewritten in place. Nested prompt files keep their own version and
+are migrated separately.
+
+Commands that only read files, such as "cat src/*.go" or
+"find src -name '*.go' | xargs cat", become native file globs and dir
+operations, so each file gets its own section. Their paths then resolve
+against the prompt file rather than the working directory.
+
+Flags:
+`, latestVersion)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *promptFile == "" {
+		return fmt.Errorf("-f flag is required")
+	}
+
+	data, err := os.ReadFile(*promptFile)
+	if err != nil {
+		return ErrFileNotFound{File: *promptFile}
+	}
+	migrated, err := migratePromptFile(data)
+	if err != nil {
+		return ErrInvalidYAML{File: *promptFile, Err: err}
+	}
+	if bytes.Equal(migrated, data) {
+		fmt.Fprintf(os.Stderr, "pcp: %s is already up to date (version %d)\n", *promptFile, latestVersion)
+		return nil
+	}
+
+	if !*write {
+		fmt.Print(unifiedDiff(*promptFile, *promptFile, string(data), string(migrated)))
+		return nil
+	}
+	info, err := os.Stat(*promptFile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*promptFile, migrated, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *promptFile, err)
+	}
+	fmt.Fprintf(os.Stderr, "pcp: migrated %s\n", *promptFile)
+	return nil
+}
+
+// migrations[v] rewrites the prompt list of a version v file so that it
+// compiles the same under version v+1.
+var migrations = map[int]func(prompt *yaml.Node){
+	1: migrateToVersion2,
+}
+
+// migratePromptFile upgrades a prompt file to latestVersion and converts
+// its file-reading commands, keeping its comments and layout. Files with
+// nothing to change are returned as-is.
+func migratePromptFile(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("prompt file must be a mapping")
+	}
+	root := doc.Content[0]
+
+	version, versionNode := 1, mappingValue(root, "version")
+	if versionNode != nil {
+		v, err := strconv.Atoi(versionNode.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid version %q", versionNode.Line, versionNode.Value)
+		}
+		version = v
+	}
+	prompt := mappingValue(root, "prompt")
+	// Converted commands are no longer commands, so this goes first and the
+	// version migrations leave them alone.
+	converted := prompt != nil && convertFileCommands(prompt)
+	if version >= latestVersion && !converted {
+		return data, nil
+	}
+
+	for v := version; v < latestVersion; v++ {
+		if prompt != nil {
+			migrations[v](prompt)
+		}
+	}
+
+	switch {
+	case version >= latestVersion:
+	case versionNode != nil:
+		versionNode.Value = strconv.Itoa(latestVersion)
+	default:
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(latestVersion)}
+		// Keep a leading comment at the top of the file
+		if len(root.Content) > 0 {
+			key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+		}
+		root.Content = append([]*yaml.Node{key, value}, root.Content...)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// migrateToVersion2 keeps version 1's tolerance of exit status 1 by giving
+// commands without ok_exit_codes an explicit [0, 1].
+func migrateToVersion2(prompt *yaml.Node) {
+	for _, op := range promptOperations(prompt, make(map[*yaml.Node]bool)) {
+		if mappingValue(op, "command") == nil || mappingValue(op, "ok_exit_codes") != nil {
+			continue
+		}
+		codes := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!int", Value: "0"},
+			{Kind: yaml.ScalarNode, Tag: "!!int", Value: "1"},
+		}}
+		op.Content = append(op.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "ok_exit_codes"}, codes)
+	}
+}
+
+var catArgument = regexp.MustCompile(`^[A-Za-z0-9_./*?\[\]][A-Za-z0-9_./*?\[\]-]*$`)
+
+// convertFileCommands replaces the commands of a prompt list that only
+// read files with the file and dir operations that read them natively:
+// "cat a b" becomes one file operation per argument, and
+// "find dir [-type f] [-name pattern] | xargs cat" (or -exec cat {} +)
+// becomes a dir/**/pattern glob, or a dir operation without -name. Only
+// commands with no other settings are converted, since their capture,
+// cache and exit status options have no file counterpart. It reports
+// whether anything changed.
+func convertFileCommands(list *yaml.Node) bool {
+	changed := false
+	var items []*yaml.Node
+	for _, item := range list.Content {
+		if item.Kind == yaml.SequenceNode {
+			changed = convertFileCommands(item) || changed
+		}
+		replacements := fileCommandOperations(item)
+		if replacements == nil {
+			items = append(items, item)
+			continue
+		}
+		// Comments on the command stay with the first operation
+		replacements[0].HeadComment, replacements[0].LineComment, replacements[0].FootComment = item.HeadComment, item.LineComment, item.FootComment
+		replacements[0].Content[0].HeadComment = item.Content[0].HeadComment
+		replacements[0].Content[1].LineComment = item.Content[1].LineComment
+		items = append(items, replacements...)
+		changed = true
+	}
+	list.Content = items
+	return changed
+}
+
+// fileCommandOperations returns the file or dir operations that read what
+// op's command does, or nil if op is not a plain file-reading command.
+// Shells do not expand ** and brace alternatives the way globs do, nor do
+// quoted patterns expand at all, so cat arguments using them are left as
+// commands.
+func fileCommandOperations(op *yaml.Node) []*yaml.Node {
+	if op.Kind != yaml.MappingNode || len(op.Content) != 2 || op.Content[0].Value != "command" || op.Content[1].Kind != yaml.ScalarNode {
+		return nil
+	}
+	fields := strings.Fields(op.Content[1].Value)
+	if len(fields) < 2 {
+		return nil
+	}
+
+	operation := func(key, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: value},
+		}}
+	}
+
+	switch fields[0] {
+	case "cat":
+		var ops []*yaml.Node
+		for _, arg := range fields[1:] {
+			if !catArgument.MatchString(arg) || strings.Contains(arg, "**") {
+				return nil
+			}
+			ops = append(ops, operation("file", arg))
+		}
+		return ops
+	case "find":
+		dir := fields[1]
+		if !catArgument.MatchString(dir) || strings.ContainsAny(dir, "*?[") {
+			return nil
+		}
+		name := ""
+		rest := fields[2:]
+		for len(rest) >= 2 {
+			if rest[0] == "-type" && rest[1] == "f" {
+				rest = rest[2:]
+				continue
+			}
+			if rest[0] != "-name" || name != "" {
+				break
+			}
+			name = rest[1]
+			if len(name) >= 2 && (name[0] == '\'' || name[0] == '"') && name[len(name)-1] == name[0] {
+				name = name[1 : len(name)-1]
+			}
+			if !catArgument.MatchString(name) || strings.Contains(name, "/") {
+				return nil
+			}
+			rest = rest[2:]
+		}
+		switch strings.Join(rest, " ") {
+		case "| xargs cat", "-exec cat {} +", "-exec cat {} \\;":
+		default:
+			return nil
+		}
+		dir = path.Clean(dir)
+		if name == "" {
+			return []*yaml.Node{operation("dir", dir)}
+		}
+		if dir == "." {
+			return []*yaml.Node{operation("file", "**/"+name)}
+		}
+		return []*yaml.Node{operation("file", dir+"/**/"+name)}
+	}
+	return nil
+}
+
+// promptOperations returns the operation mappings of a prompt list,
+// following aliases, including lists spliced in, and visiting each anchored
+// operation once.
+func promptOperations(list *yaml.Node, seen map[*yaml.Node]bool) []*yaml.Node {
+	var ops []*yaml.Node
+	for _, item := range list.Content {
+		for item.Kind == yaml.AliasNode {
+			item = item.Alias
+		}
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+		switch item.Kind {
+		case yaml.MappingNode:
+			ops = append(ops, item)
+		case yaml.SequenceNode:
+			ops = append(ops, promptOperations(item, seen)...)
+		}
+	}
+	return ops
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is a minisign public key, which verifies the detached
+// .minisig signatures of shared prompt files.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey reads a public key given either as the base64 key
+// itself, as printed by minisign -G, or as the path of a minisign .pub file.
+func parseMinisignKey(value string) (*minisignKey, error) {
+	encoded := value
+	if raw, err := base64.StdEncoding.DecodeString(value); err != nil || len(raw) != 42 {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify key %q: not a minisign public key or a readable key file", value)
+		}
+		encoded = lastLine(string(data))
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid verify key %q: not a minisign public key", value)
+	}
+	key := &minisignKey{key: ed25519.PublicKey(raw[10:])}
+	copy(key.id[:], raw[2:10])
+	return key, nil
+}
+
+// verify checks a minisign signature file against data: the signature of
+// the content, and the global signature covering the trusted comment.
+func (k *minisignKey) verify(data, signature []byte) error {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(signature), "\r\n", "\n"), "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], k.id[:]) {
+		return fmt.Errorf("signed with key %X, not the verify key %X", reverseBytes(sig[2:10]), reverseBytes(k.id[:]))
+	}
+
+	// "ED" signatures, the default since minisign 0.10, sign the BLAKE2b-512
+	// hash of the content; legacy "Ed" signatures sign the content itself
+	message := data
+	switch string(sig[:2]) {
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	case "Ed":
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(k.key, message, sig[10:]) {
+		return fmt.Errorf("signature does not match the content")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(k.key, append(sig[10:74:74], trusted...), global) {
+		return fmt.Errorf("trusted comment signature does not match")
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// reverseBytes renders a key ID the way minisign prints it, little-endian.
+func reverseBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
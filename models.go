@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultCharsPerToken is the tokenizer estimate without -model: the usual
+// rule of thumb for English text and code.
+const defaultCharsPerToken = 4.0
+
+// modelPreset is what -model knows about a model: its context window, how
+// much of it is left for the response by default, and how many characters
+// its tokenizer averages per token.
+type modelPreset struct {
+	ContextTokens int
+	ReserveTokens int
+	CharsPerToken float64
+}
+
+// modelPresets are the models -model accepts. Claude's tokenizer splits
+// text into more tokens than OpenAI's o200k and cl100k, so fewer words fit
+// in the same window.
+var modelPresets = map[string]modelPreset{
+	"gpt-4o":            {ContextTokens: 128000, ReserveTokens: 16384, CharsPerToken: 4.0},
+	"gpt-4o-mini":       {ContextTokens: 128000, ReserveTokens: 16384, CharsPerToken: 4.0},
+	"gpt-4.1":           {ContextTokens: 1047576, ReserveTokens: 32768, CharsPerToken: 4.0},
+	"gpt-4-turbo":       {ContextTokens: 128000, ReserveTokens: 4096, CharsPerToken: 4.0},
+	"o3":                {ContextTokens: 200000, ReserveTokens: 100000, CharsPerToken: 4.0},
+	"claude-3-5-sonnet": {ContextTokens: 200000, ReserveTokens: 8192, CharsPerToken: 3.5},
+	"claude-3-5-haiku":  {ContextTokens: 200000, ReserveTokens: 8192, CharsPerToken: 3.5},
+	"claude-3-7-sonnet": {ContextTokens: 200000, ReserveTokens: 64000, CharsPerToken: 3.5},
+	"claude-3-opus":     {ContextTokens: 200000, ReserveTokens: 4096, CharsPerToken: 3.5},
+	"gemini-1.5-pro":    {ContextTokens: 2097152, ReserveTokens: 8192, CharsPerToken: 4.0},
+	"gemini-2.0-flash":  {ContextTokens: 1048576, ReserveTokens: 8192, CharsPerToken: 4.0},
+	"llama-3.1":         {ContextTokens: 131072, ReserveTokens: 4096, CharsPerToken: 4.0},
+}
+
+func modelNames() []string {
+	names := make([]string, 0, len(modelPresets))
+	for name := range modelPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateModel(opts Options) error {
+	if opts.ReserveTokens < 0 {
+		return fmt.Errorf("-reserve-tokens must not be negative")
+	}
+	if opts.Model == "" || opts.maxWordsSet {
+		if opts.ReserveTokens > 0 && opts.wordBudget() <= 0 {
+			return fmt.Errorf("-reserve-tokens %d leaves no room within -max-words %d", opts.ReserveTokens, opts.MaxWords)
+		}
+	}
+	if opts.Model == "" {
+		return nil
+	}
+	preset, ok := modelPresets[opts.Model]
+	if !ok {
+		return fmt.Errorf("unknown model '%s'. Must be one of: %s", opts.Model, strings.Join(modelNames(), ", "))
+	}
+	if opts.ReserveTokens >= preset.ContextTokens {
+		return fmt.Errorf("-reserve-tokens must be less than the %d tokens of %s", preset.ContextTokens, opts.Model)
+	}
+	return nil
+}
+
+// wordBudget is the budget sections are charged against: with -model and
+// no -max-words, the model's context window less the reserve for the
+// response, and otherwise -max-words less -reserve-tokens. Tokens become
+// words at the tokenizer's characters per token and estimateBytesPerWord
+// characters a word.
+func (opts Options) wordBudget() int {
+	preset, ok := modelPresets[opts.Model]
+	if !ok || opts.maxWordsSet {
+		return opts.MaxWords - tokensToWords(opts.ReserveTokens, opts.charsPerToken())
+	}
+	reserve := preset.ReserveTokens
+	if opts.ReserveTokens > 0 {
+		reserve = opts.ReserveTokens
+	}
+	return tokensToWords(preset.ContextTokens-reserve, preset.CharsPerToken)
+}
+
+func tokensToWords(tokens int, charsPerToken float64) int {
+	return int(float64(tokens) * charsPerToken / estimateBytesPerWord)
+}
+
+// charsPerToken is the tokenizer estimate of -model, or the default.
+func (opts Options) charsPerToken() float64 {
+	if preset, ok := modelPresets[opts.Model]; ok {
+		return preset.CharsPerToken
+	}
+	return defaultCharsPerToken
+}
+
+// estimateTokens approximates a token count from the characters per token
+// of the model's tokenizer.
+func estimateTokens(text string, charsPerToken float64) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / charsPerToken))
+}
+
+// maxWordsFlag is -max-words, recording that it was given so that it wins
+// over the budget of -model.
+type maxWordsFlag struct {
+	opts *Options
+}
+
+func (f maxWordsFlag) String() string {
+	if f.opts == nil {
+		return ""
+	}
+	return strconv.Itoa(f.opts.MaxWords)
+}
+
+func (f maxWordsFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid -max-words %q: expected a number of words", s)
+	}
+	f.opts.MaxWords = n
+	f.opts.maxWordsSet = true
+	return nil
+}
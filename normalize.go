@@ -0,0 +1,18 @@
+package main
+
+import "golang.org/x/text/unicode/norm"
+
+var validNormalizations = map[string]bool{
+	"none": true,
+	"nfc":  true,
+}
+
+// normalizeUnicode applies the -normalize form to compiled output, so text
+// that looks identical is also byte-identical regardless of how its sources
+// composed accented characters.
+func normalizeUnicode(output, form string) string {
+	if form == "nfc" {
+		return norm.NFC.String(output)
+	}
+	return output
+}
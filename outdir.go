@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// dirIndex is written as index.json by -o-dir, listing the section files in
+// order.
+type dirIndex struct {
+	Sections []dirIndexEntry `json:"sections"`
+}
+
+type dirIndexEntry struct {
+	File   string `json:"file,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	Words  int    `json:"words"`
+
+	// ExitCode records a command section's tolerated nonzero exit status.
+	ExitCode int `json:"exit_code,omitempty"`
+}
+
+const dirIndexName = "index.json"
+
+var formatExtensions = map[string]string{
+	"text":     ".txt",
+	"markdown": ".md",
+	"json":     ".json",
+	"html":     ".html",
+	"records":  ".rec",
+}
+
+// writeOutputDir writes each top-level section to its own numbered file in
+// dir, rendered in the output format, plus an index.json. Files listed in a
+// previous index are removed first so sections that no longer exist do not
+// linger.
+func writeOutputDir(dir string, content CompiledContent, opts Options) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %s: %w", dir, err)
+	}
+	removeIndexedFiles(dir)
+
+	format := resolveFormat(opts.Format, "")
+	index := dirIndex{Sections: make([]dirIndexEntry, 0, len(content.Sections))}
+	for i, section := range content.Sections {
+		output, err := renderOutput(CompiledContent{Sections: []ContentSection{section}}, format, opts.DelimiterStyle, opts.sectionSeparator())
+		if err != nil {
+			return err
+		}
+		output = normalizeUnicode(output, opts.Normalize)
+
+		name := fmt.Sprintf("%03d-%s%s", i+1, sectionSlug(section.Source), formatExtensions[format])
+		if err := writeOutputFile(filepath.Join(dir, name), []byte(output), opts.OutputMode); err != nil {
+			return fmt.Errorf("failed to write output file %s: %w", name, err)
+		}
+		index.Sections = append(index.Sections, dirIndexEntry{
+			File:     name,
+			ID:       section.ID,
+			Source:   section.Source,
+			Type:     section.Type.String(),
+			Words:    sectionWords(section),
+			ExitCode: section.ExitCode,
+		})
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutputFile(filepath.Join(dir, dirIndexName), append(data, '\n'), opts.OutputMode)
+}
+
+func removeIndexedFiles(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, dirIndexName))
+	if err != nil {
+		return
+	}
+	var index dirIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return
+	}
+	for _, entry := range index.Sections {
+		// Only remove plain names, never paths that reach outside dir
+		if entry.File == filepath.Base(entry.File) {
+			os.Remove(filepath.Join(dir, entry.File))
+		}
+	}
+}
+
+// sectionSlug turns a section source into a short file name fragment.
+func sectionSlug(source string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(source) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			slug.WriteRune(r)
+			dash = false
+		} else if !dash && slug.Len() > 0 {
+			slug.WriteByte('-')
+			dash = true
+		}
+		if slug.Len() >= 40 {
+			break
+		}
+	}
+	result := strings.Trim(slug.String(), "-")
+	if result == "" {
+		return "section"
+	}
+	return result
+}
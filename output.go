@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// defaultOutputMode is the permission mode for output files unless
+// PCP_OUTPUT_MODE or -output-mode says otherwise.
+const defaultOutputMode os.FileMode = 0644
+
+// fileModeFlag parses an octal permission mode such as 0600.
+type fileModeFlag struct {
+	mode *os.FileMode
+}
+
+func (f fileModeFlag) String() string {
+	if f.mode == nil {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*f.mode))
+}
+
+func (f fileModeFlag) Set(s string) error {
+	mode, err := parseFileMode(s)
+	if err != nil {
+		return err
+	}
+	*f.mode = mode
+	return nil
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected octal permissions such as 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// envOutputMode returns the mode from PCP_OUTPUT_MODE, falling back to
+// defaultOutputMode when it is unset or invalid.
+func envOutputMode() os.FileMode {
+	value := os.Getenv("PCP_OUTPUT_MODE")
+	if value == "" {
+		return defaultOutputMode
+	}
+	mode, err := parseFileMode(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring PCP_OUTPUT_MODE: %v\n", err)
+		return defaultOutputMode
+	}
+	return mode
+}
+
+// writeOutputFile writes data with the given mode, also applying the mode
+// when the file already exists. A zero mode means defaultOutputMode.
+func writeOutputFile(path string, data []byte, mode os.FileMode) error {
+	if mode == 0 {
+		mode = defaultOutputMode
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fullDelimiterRule is the line around the BEGIN line of full headers.
+const fullDelimiterRule = "----------------------------------"
+
+var (
+	headerPatterns = map[string]*regexp.Regexp{
+		"xml":     regexp.MustCompile(`^<!-- pcp-source: (.*) -->$`),
+		"minimal": regexp.MustCompile(`^=== PCP SOURCE: (.*) ===$`),
+		"full":    regexp.MustCompile(`^BEGIN: (.*)$`),
+	}
+	checksumTrailer = regexp.MustCompile(`(?m)^<!-- pcp-checksum: sha256=([0-9a-f]{64}) sections=\d+ -->\n?\z`)
+	labelID         = regexp.MustCompile(` id=([0-9a-f]+)$`)
+	labelExitStatus = regexp.MustCompile(` \(exit status (-?\d+)\)$`)
+)
+
+type parsedSection struct {
+	Source   string `json:"source"`
+	ID       string `json:"id,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Content  string `json:"content"`
+}
+
+type parsedOutput struct {
+	DelimiterStyle string          `json:"delimiter_style"`
+	Sections       []parsedSection `json:"sections"`
+	WordCount      int             `json:"word_count"`
+}
+
+func runParse(args []string) error {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	outputFile := fs.String("o", "", "Output file path (default: stdout)")
+	format := fs.String("format", "json", "Output format: json")
+	delimiterStyle := fs.String("delimiter-style", "auto", "Delimiter style the output was compiled with: auto, xml, minimal, full")
+	var separator *string
+	fs.Var(separatorFlag{&separator}, "section-separator", "Section separator the output was compiled with, with Go escapes (default: \\n)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp parse [-delimiter-style <style>] [-o <output-file>] [<compiled-file>]
+
+Splits text output compiled earlier back into its sections, by the headers
+of its delimiter style, and writes them as JSON. With no file, or -, the
+output is read from stdin. A -checksum trailer is verified and removed.
+Nested prompts come out as a section with no content followed by their own
+sections, since text output does not record nesting. Output compiled with
+-delimiter-style none has no headers and cannot be parsed.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" {
+		return fmt.Errorf("invalid format '%s'. parse writes json", *format)
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("parse accepts at most one file, got %d", fs.NArg())
+	}
+
+	var data []byte
+	var err error
+	name := fs.Arg(0)
+	if name == "" || name == "-" {
+		name = "stdin"
+		data, err = io.ReadAll(os.Stdin)
+	} else if data, err = os.ReadFile(name); err != nil {
+		return ErrFileNotFound{File: name}
+	}
+	if err != nil {
+		return err
+	}
+
+	if separator == nil {
+		separator = new(string)
+		*separator = defaultSectionSeparator
+	}
+	parsed, err := parseCompiledOutput(string(data), *delimiterStyle, *separator)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	encoded, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON output: %w", err)
+	}
+	encoded = append(encoded, '\n')
+	if *outputFile == "" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	return writeOutputFile(*outputFile, encoded, 0)
+}
+
+// parseCompiledOutput splits text output into its sections. With style
+// auto, the style is the one whose header the output starts with.
+func parseCompiledOutput(output, delimiterStyle, separator string) (parsedOutput, error) {
+	if match := checksumTrailer.FindStringSubmatchIndex(output); match != nil {
+		body := output[:match[0]]
+		sum := sha256.Sum256([]byte(body))
+		if hex.EncodeToString(sum[:]) != output[match[2]:match[3]] {
+			return parsedOutput{}, fmt.Errorf("checksum mismatch: the output was changed after it was compiled")
+		}
+		output = body
+	}
+
+	lines := strings.SplitAfter(output, "\n")
+	if delimiterStyle == "auto" {
+		delimiterStyle = detectDelimiterStyle(lines)
+		if delimiterStyle == "" {
+			return parsedOutput{}, fmt.Errorf("no pcp section headers found; output compiled with -delimiter-style none cannot be parsed")
+		}
+	}
+	pattern, ok := headerPatterns[delimiterStyle]
+	if !ok {
+		return parsedOutput{}, fmt.Errorf("invalid delimiter style '%s'. Must be one of: auto, xml, minimal, full", delimiterStyle)
+	}
+
+	result := parsedOutput{DelimiterStyle: delimiterStyle, Sections: []parsedSection{}}
+	var content strings.Builder
+	finish := func() {
+		if len(result.Sections) == 0 {
+			return
+		}
+		section := &result.Sections[len(result.Sections)-1]
+		text := strings.TrimSuffix(content.String(), separator)
+		if strings.TrimSpace(text) != "" {
+			section.Content = normalizeContent(text)
+		}
+		result.WordCount += countWords(section.Content)
+		content.Reset()
+	}
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		header := headerLine(lines, i, delimiterStyle, pattern)
+		if header == nil {
+			if len(result.Sections) == 0 && strings.TrimSpace(line) != "" {
+				return parsedOutput{}, fmt.Errorf("line %d: expected a %s section header", i+1, delimiterStyle)
+			}
+			content.WriteString(lines[i])
+			continue
+		}
+		finish()
+		result.Sections = append(result.Sections, parseSectionLabel(header[1]))
+		if delimiterStyle == "full" {
+			i += 2
+		}
+	}
+	finish()
+	if len(result.Sections) == 0 {
+		return parsedOutput{}, fmt.Errorf("no %s section headers found", delimiterStyle)
+	}
+	return result, nil
+}
+
+// headerLine returns the submatches of the header starting at line i, or
+// nil. Full headers span three lines: the label between two rules.
+func headerLine(lines []string, i int, delimiterStyle string, pattern *regexp.Regexp) []string {
+	if delimiterStyle != "full" {
+		return pattern.FindStringSubmatch(strings.TrimSuffix(lines[i], "\n"))
+	}
+	if i+2 >= len(lines) || strings.TrimSuffix(lines[i], "\n") != fullDelimiterRule || strings.TrimSuffix(lines[i+2], "\n") != fullDelimiterRule {
+		return nil
+	}
+	return pattern.FindStringSubmatch(strings.TrimSuffix(lines[i+1], "\n"))
+}
+
+func detectDelimiterStyle(lines []string) string {
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		for _, style := range []string{"xml", "minimal", "full"} {
+			if headerLine(lines, i, style, headerPatterns[style]) != nil {
+				return style
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// parseSectionLabel undoes sectionLabel, splitting the exit status and ID
+// off the source.
+func parseSectionLabel(label string) parsedSection {
+	var section parsedSection
+	if match := labelID.FindStringSubmatch(label); match != nil {
+		section.ID = match[1]
+		label = strings.TrimSuffix(label, match[0])
+	}
+	if match := labelExitStatus.FindStringSubmatch(label); match != nil {
+		section.ExitCode, _ = strconv.Atoi(match[1])
+		label = strings.TrimSuffix(label, match[0])
+	}
+	section.Source = label
+	return section
+}
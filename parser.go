@@ -1,45 +1,255 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 
 	"gopkg.in/yaml.v3"
 )
 
 func parsePromptFile(filePath string) (*PromptFile, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
+	var data []byte
+	var err error
+	if isBuiltinPrompt(filePath) {
+		if data, err = readBuiltinPrompt(filePath); err != nil {
+			return nil, err
+		}
+	} else if data, err = os.ReadFile(filePath); err != nil {
 		return nil, ErrFileNotFound{File: filePath}
 	}
 
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, ErrInvalidYAML{File: filePath, Err: err}
+	}
+	if err := expandAliases(&doc); err != nil {
+		return nil, ErrInvalidYAML{File: filePath, Err: err}
+	}
+
+	if err := checkUnknownKeys(&doc, reflect.TypeOf(PromptFile{})); err != nil {
+		var unknown ErrUnknownKey
+		if errors.As(err, &unknown) {
+			return nil, ErrAtLocation{File: filePath, Line: unknown.Line, Err: err}
+		}
+		return nil, err
+	}
+
 	var promptFile PromptFile
-	if err := yaml.Unmarshal(data, &promptFile); err != nil {
+	if err := doc.Decode(&promptFile); err != nil {
+		// Values with their own UnmarshalYAML check their keys as they decode
+		var unknown ErrUnknownKey
+		if errors.As(err, &unknown) {
+			return nil, ErrAtLocation{File: filePath, Line: unknown.Line, Err: unknown}
+		}
 		return nil, ErrInvalidYAML{File: filePath, Err: err}
 	}
 
-	if err := validatePromptFile(&promptFile); err != nil {
-		return nil, fmt.Errorf("validation failed for %s: %w", filePath, err)
+	setOperationLines(&doc, &promptFile)
+
+	if err := validatePromptFile(&promptFile, filePath); err != nil {
+		return nil, err
 	}
 
 	return &promptFile, nil
 }
 
-func validatePromptFile(pf *PromptFile) error {
+func validatePromptFile(pf *PromptFile, filePath string) error {
 	if pf.Prompt == nil {
-		return fmt.Errorf("missing required 'prompt' key")
+		return fmt.Errorf("%s: missing required 'prompt' key", displayPath(filePath))
+	}
+	if pf.Version < 0 || pf.Version > latestVersion {
+		return fmt.Errorf("%s: prompt file version %d is not supported by this pcp (versions 1 to %d)", displayPath(filePath), pf.Version, latestVersion)
 	}
 
 	for i, op := range pf.Prompt {
-		if _, err := op.GetType(); err != nil {
-			return fmt.Errorf("operation %d: %w", i, err)
+		if err := validateOperation(op); err != nil {
+			return ErrAtLocation{File: filePath, Line: op.Line, Index: i, Err: err}
 		}
 	}
 
 	return nil
 }
 
+func validateOperation(op Operation) error {
+	opType, err := op.GetType()
+	if errors.Is(err, ErrOperationMultiple) {
+		return multipleKeysError(op)
+	}
+	if err != nil {
+		return err
+	}
+	if opType == SysinfoOp && !*op.Sysinfo {
+		return fmt.Errorf("sysinfo must be true (use disabled: true to turn it off)")
+	}
+	if _, err := parseCachePolicy(op.Cache); err != nil {
+		return err
+	}
+	if opType == CommentOp && op.Label != "" {
+		return fmt.Errorf("comment operations cannot be labeled")
+	}
+	if opType == AssertOp {
+		if err := validateAssert(*op.Assert); err != nil {
+			return err
+		}
+	}
+	if opType == SymbolOp {
+		if err := validateSymbol(*op.Symbol); err != nil {
+			return err
+		}
+	}
+	if opType == RelatedOp {
+		if err := validateRelated(*op.Related); err != nil {
+			return err
+		}
+	}
+	if opType == CoverageOp {
+		if err := validateCoverage(*op.Coverage); err != nil {
+			return err
+		}
+	}
+	if opType == StacktraceOp {
+		if err := validateStacktrace(*op.Stacktrace); err != nil {
+			return err
+		}
+	}
+	if opType == LogOp {
+		if err := validateLog(*op.Log); err != nil {
+			return err
+		}
+	}
+	if opType == DiffOp {
+		if err := validateDiff(*op.Diff); err != nil {
+			return err
+		}
+	}
+	if opType == ScriptOp {
+		if err := validateScript(*op.Script); err != nil {
+			return err
+		}
+	}
+	if opType == GitOp {
+		if err := validateGit(*op.Git); err != nil {
+			return err
+		}
+	}
+	if err := validateTemplate(op, opType); err != nil {
+		return err
+	}
+	if err := validateCapture(op, opType); err != nil {
+		return err
+	}
+	if err := validateBinaryPolicy(op, opType); err != nil {
+		return err
+	}
+	if err := validateRegistryPin(op, opType); err != nil {
+		return err
+	}
+	if err := validateLimits(op, opType); err != nil {
+		return err
+	}
+	if op.Serial && opType != CommandOp {
+		return fmt.Errorf("serial applies only to command operations")
+	}
+	// Scripts run outside the command cache and executable checks
+	if (op.Cache != "" || op.FallbackText != nil) && opType != CommandOp {
+		return fmt.Errorf("cache and fallback_text apply only to command operations")
+	}
+	if opType == FileOp && isGlobPattern(*op.File) && (op.Label != "" || op.CaptureAs != "") {
+		return fmt.Errorf("label and capture_as cannot be used with a glob, which may match several files")
+	}
+	if opType == DirOp && op.Label != "" {
+		return fmt.Errorf("dir operations cannot be labeled, since they include several files")
+	}
+	if err := validateDirOptions(op, opType); err != nil {
+		return err
+	}
+	if err := validateExclude(op, opType); err != nil {
+		return err
+	}
+	if err := validateRespectGitignore(op, opType); err != nil {
+		return err
+	}
+	if op.WithTests && opType != FileOp {
+		return fmt.Errorf("with_tests applies only to file operations")
+	}
+	if op.IncludeOnce && opType != PromptOp {
+		return fmt.Errorf("include_once applies only to prompt operations")
+	}
+	return validateFileFilters(op, opType)
+}
+
+// multipleKeysError lists the operation keys an operation has, with their
+// lines. Usually a missing "- " has merged two operations into one mapping.
+func multipleKeysError(op Operation) error {
+	present := map[string]bool{
+		"file":          op.File != nil,
+		"prompt":        op.Prompt != nil,
+		"command":       op.Command != nil,
+		"text":          op.Text != nil,
+		"ref":           op.Ref != nil,
+		"sysinfo":       op.Sysinfo != nil,
+		"timestamp":     op.Timestamp != nil,
+		"pcp_remote":    op.Remote != nil,
+		"assert":        op.Assert != nil,
+		"comment":       op.Comment != nil,
+		"symbol":        op.Symbol != nil,
+		"related":       op.Related != nil,
+		"coverage":      op.Coverage != nil,
+		"stacktrace":    op.Stacktrace != nil,
+		"log":           op.Log != nil,
+		"diff":          op.Diff != nil,
+		"build_targets": op.BuildTargets != nil,
+		"script":        op.Script != nil,
+		"dir":           op.Dir != nil,
+		"tree":          op.Tree != nil,
+		"git":           op.Git != nil,
+	}
+	var keys []operationKey
+	for name, set := range present {
+		if set {
+			keys = append(keys, operationKey{Name: name, Line: op.keyLines[name]})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Line != keys[j].Line {
+			return keys[i].Line < keys[j].Line
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return ErrMultipleOperationKeys{Keys: keys}
+}
+
+// setOperationLines records where each operation of the prompt list starts,
+// so errors can point at the line instead of the operation's index.
+func setOperationLines(doc *yaml.Node, pf *PromptFile) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "prompt" {
+			continue
+		}
+		items := root.Content[i+1]
+		if items.Kind == yaml.SequenceNode && len(items.Content) == len(pf.Prompt) {
+			for j, item := range items.Content {
+				pf.Prompt[j].Line = item.Line
+				if item.Kind != yaml.MappingNode {
+					continue
+				}
+				pf.Prompt[j].keyLines = make(map[string]int)
+				for k := 0; k+1 < len(item.Content); k += 2 {
+					pf.Prompt[j].keyLines[item.Content[k].Value] = item.Content[k].Line
+				}
+			}
+		}
+	}
+}
+
 func isBinaryFile(filePath string) bool {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -62,40 +272,45 @@ func isBinaryFile(filePath string) bool {
 	return false
 }
 
+// validatePromptFileStructure resolves the prompt file tree without
+// executing anything, reporting the first structural error.
 func validatePromptFileStructure(filePath string, ctx *ProcessingContext) error {
-	absPath, _ := filepath.Abs(filePath)
-
-	if ctx.IsVisited(absPath) {
-		return ErrCircularReference{File: filePath, Path: getVisitedPaths(ctx)}
-	}
-
-	ctx.MarkVisited(absPath)
-	defer func() {
-		delete(ctx.visitedFiles, absPath)
-	}()
+	_, err := buildPlan(filePath, ctx)
+	return err
+}
 
-	pf, err := parsePromptFile(filePath)
+// checkPromptFile is -check: it validates the prompt file tree and that
+// every file it includes exists, without reading file contents or running
+// commands. Paths that use a captured variable are only known at run time
+// and are not checked.
+func checkPromptFile(filePath string, ctx *ProcessingContext) error {
+	plan, err := buildPlan(filePath, ctx)
 	if err != nil {
 		return err
 	}
-
-	for _, op := range pf.Prompt {
-		opType, _ := op.GetType()
-		if opType == PromptOp {
-			nestedPath := ctx.ResolvePath(op.GetValue())
-			if err := validatePromptFileStructure(nestedPath, ctx); err != nil {
-				return err
+	for _, p := range plan.Flatten() {
+		if (p.Type != FileOp && p.Type != SymbolOp && p.Type != RelatedOp && p.Type != DiffOp && p.Type != BuildTargetsOp && p.Type != TreeOp) || capturedRef(p.Value, ctx) != "" || (p.Type == DiffOp && p.Op.Diff.isGit()) {
+			continue
+		}
+		info, err := os.Stat(p.Path)
+		if err != nil {
+			return locateError(p.File, p.Index, p.Op, ErrFileNotFound{File: p.Path})
+		}
+		if p.Type == DiffOp && capturedRef(p.Op.Diff.B, ctx) == "" {
+			promptDir, _ := filepath.Abs(filepath.Dir(p.File))
+			if pathB := resolvePath(promptDir, ctx.Expand(p.Op.Diff.B)); !fileExists(pathB) {
+				return locateError(p.File, p.Index, p.Op, ErrFileNotFound{File: pathB})
+			}
+		}
+		if p.Type == RelatedOp || p.Type == TreeOp {
+			if !info.IsDir() {
+				return locateError(p.File, p.Index, p.Op, fmt.Errorf("%s is not a directory", p.Path))
 			}
+			continue
+		}
+		if info.IsDir() {
+			return locateError(p.File, p.Index, p.Op, fmt.Errorf("%s is a directory", p.Path))
 		}
 	}
-
 	return nil
 }
-
-func getVisitedPaths(ctx *ProcessingContext) []string {
-	paths := make([]string, 0, len(ctx.visitedFiles))
-	for path := range ctx.visitedFiles {
-		paths = append(paths, path)
-	}
-	return paths
-}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// resolvePath resolves a path from a prompt file against base. Besides plain
+// relative and absolute paths this covers the Windows forms that are neither:
+// drive-relative paths (C:notes.txt) are left for the OS to resolve against
+// that drive, and rooted paths without a drive (\notes.txt) land on base's
+// drive. UNC paths (\\server\share\notes.txt) are absolute.
+func resolvePath(base, path string) string {
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return filepath.Clean(path)
+	}
+	if path != "" && os.IsPathSeparator(path[0]) {
+		return filepath.Join(filepath.VolumeName(base), path)
+	}
+	return filepath.Join(base, path)
+}
+
+// displayPath renders a path for section headers with forward slashes, so
+// output is the same whichever OS compiled it.
+func displayPath(path string) string {
+	return filepath.ToSlash(path)
+}
+
+// sortPaths sorts paths bytewise on their slash-separated form, so files
+// expand in the same order on every platform, whatever order the file
+// system lists them in: "B.go" before "a.go", and "a.txt" before "a/b".
+func sortPaths(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return filepath.ToSlash(paths[i]) < filepath.ToSlash(paths[j])
+	})
+}
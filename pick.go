@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrPickAborted is returned when pcp pick is quit without a selection.
+var ErrPickAborted = errors.New("pick aborted; nothing was written")
+
+// pickShown is how many of the best matches the picker lists at once.
+const pickShown = 20
+
+func runPick(args []string) error {
+	opts := Options{Vars: make(map[string]string)}
+	fs := flag.NewFlagSet("pick", flag.ContinueOnError)
+	registerCompileFlags(fs, &opts)
+	fs.Var(varFlag(opts.Vars), "set", "Set a variable (name=value, repeatable)")
+	root := fs.String("dir", ".", "Directory to pick files from")
+	emit := fs.String("emit-yaml", "", "Write the selection as a prompt file instead of compiling it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp pick [-dir <directory>] [-emit-yaml <prompt-file>] [flags]
+
+Lists the text files below the directory on the terminal, narrowed by a fuzzy
+search, and compiles the files you select as if each were a file operation.
+With -emit-yaml the selection is written as a prompt file instead, to edit
+or compile later. Hidden and binary files, and those .gitignore ignores,
+are not offered.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.PromptFile != "" {
+		return fmt.Errorf("pick builds its own prompt file; use -emit-yaml to keep it")
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("pick takes no arguments, got %q", fs.Arg(0))
+	}
+
+	files, err := pickCandidates(*root)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no text files found in %s", *root)
+	}
+	in, out, err := openTerminal("pick")
+	if err != nil {
+		return err
+	}
+	selected, err := pickFiles(files, in, out)
+	in.Close()
+	out.Close()
+	if err != nil {
+		return err
+	}
+	return compileAdHoc(opts, *root, selected, *emit)
+}
+
+// pickCandidates lists the files pcp pick offers: the text files below
+// root, relative to it, skipping what a dir operation would skip and what
+// .gitignore ignores.
+func pickCandidates(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, ErrFileNotFound{File: root}
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	files, _, err := dirFiles(root, nil, 0, ignoreSet{newGitignore(root), loadPcpignore(root)})
+	if err != nil {
+		return nil, err
+	}
+	var text []string
+	for _, file := range files {
+		if !isBinaryFile(filepath.Join(root, file)) {
+			text = append(text, filepath.ToSlash(file))
+		}
+	}
+	return text, nil
+}
+
+// pickFiles narrows files with fuzzy queries and toggles them by number
+// until the selection is accepted. The selection is kept across queries
+// and returned in the order of files.
+func pickFiles(files []string, in io.Reader, out io.Writer) ([]string, error) {
+	selected := make(map[string]bool)
+	query := ""
+	matches := files
+
+	scanner := bufio.NewScanner(in)
+	for {
+		shown := matches
+		if len(shown) > pickShown {
+			shown = shown[:pickShown]
+		}
+		width := len(strconv.Itoa(len(shown)))
+		fmt.Fprintf(out, "pcp: %d of %d files match %q, %d selected\n", len(matches), len(files), query, len(selected))
+		for i, file := range shown {
+			mark := " "
+			if selected[file] {
+				mark = "x"
+			}
+			fmt.Fprintf(out, "  [%s] %*d  %s\n", mark, width, i+1, file)
+		}
+		if len(matches) > len(shown) {
+			fmt.Fprintf(out, "  ... %d more; narrow the search to see them\n", len(matches)-len(shown))
+		}
+		fmt.Fprint(out, "Search, or toggle by number or range (2 4-6), a: all matches, n: none, q: quit, Enter: accept> ")
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return nil, ErrPickAborted
+		}
+		answer := strings.TrimSpace(scanner.Text())
+		switch answer {
+		case "":
+			if len(selected) == 0 {
+				fmt.Fprintln(out, "pcp: nothing is selected")
+				continue
+			}
+			var picked []string
+			for _, file := range files {
+				if selected[file] {
+					picked = append(picked, file)
+				}
+			}
+			return picked, nil
+		case "q":
+			return nil, ErrPickAborted
+		case "a":
+			for _, file := range matches {
+				selected[file] = true
+			}
+			continue
+		case "n":
+			clear(selected)
+			continue
+		}
+		// A leading slash searches for text that would otherwise read as
+		// numbers or a command
+		if !strings.HasPrefix(answer, "/") {
+			if toggles, err := parseSectionNumbers(answer, len(shown)); err == nil {
+				for _, n := range toggles {
+					if file := shown[n-1]; selected[file] {
+						delete(selected, file)
+					} else {
+						selected[file] = true
+					}
+				}
+				continue
+			}
+		}
+		query = strings.TrimPrefix(answer, "/")
+		matches = fuzzyMatches(files, query)
+	}
+}
+
+// fuzzyMatches returns the files containing the query's characters in
+// order, ignoring case, best matches first.
+func fuzzyMatches(files []string, query string) []string {
+	type match struct {
+		file  string
+		score int
+	}
+	var matches []match
+	for _, file := range files {
+		if score, ok := fuzzyScore(file, query); ok {
+			matches = append(matches, match{file, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	result := make([]string, len(matches))
+	for i, m := range matches {
+		result[i] = m.file
+	}
+	return result
+}
+
+// fuzzyScore reports whether query is a subsequence of path, and how well
+// it matches: runs of consecutive characters and matches at the start of a
+// path element or in the file name score higher, gaps score lower.
+func fuzzyScore(path, query string) (int, bool) {
+	candidate := []rune(strings.ToLower(path))
+	base := len([]rune(path)) - len([]rune(filepath.Base(path)))
+	score, last := 0, -1
+	for _, q := range strings.ToLower(query) {
+		if q == ' ' {
+			continue
+		}
+		i := last + 1
+		for i < len(candidate) && candidate[i] != q {
+			i++
+		}
+		if i == len(candidate) {
+			return 0, false
+		}
+		switch {
+		case i == last+1 && last >= 0:
+			score += 5
+		case i == 0 || candidate[i-1] == '/' || candidate[i-1] == '_' || candidate[i-1] == '-' || candidate[i-1] == '.':
+			score += 3
+		default:
+			score -= min(i-last-1, 3)
+		}
+		if i >= base {
+			score++
+		}
+		last = i
+	}
+	return score, true
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlannedOperation is an operation resolved against the prompt file that
+// contains it: variables are expanded, paths resolved and nested prompts
+// parsed, so executing it needs no further lookups.
+type PlannedOperation struct {
+	Op    Operation
+	Type  OperationType
+	File  string // prompt file containing the operation
+	Index int    // position of the operation in File
+
+	// Value is the expanded operation value. For commands written as a
+	// list it is the shell-quoted argv, which is expanded into Args.
+	Value string
+	Args  []string
+
+	// Path is the resolved path of file and prompt operations.
+	Path string
+
+	// Children are the planned operations of a nested prompt.
+	Children []PlannedOperation
+}
+
+// CompilePlan is the resolved tree of operations a compile will execute.
+type CompilePlan struct {
+	PromptFile string
+	Operations []PlannedOperation
+}
+
+// buildPlan parses the prompt file tree once, resolving every operation
+// that will run. Disabled operations are recorded in the context's stats
+// and operations for other targets are left out. Cycles and self-inclusion
+// are reported here, before anything executes.
+func buildPlan(promptFile string, ctx *ProcessingContext) (*CompilePlan, error) {
+	ops, err := planPromptFile(promptFile, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &CompilePlan{PromptFile: promptFile, Operations: ops}, nil
+}
+
+func planPromptFile(promptFile string, ctx *ProcessingContext) ([]PlannedOperation, error) {
+	absPath, _ := filepath.Abs(promptFile)
+	if ctx.IsVisited(absPath) {
+		return nil, ErrCircularReference{File: absPath, Path: ctx.IncludeChain()}
+	}
+
+	pf, err := ctx.ParsePromptFile(promptFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx.AddVarDefaults(pf.Vars)
+
+	ctx.MarkVisited(absPath)
+	oldBasePath, oldRemoteBase := ctx.basePath, ctx.remoteBase
+	// Builtin prompts resolve paths like the prompt that includes them
+	if !isBuiltinPrompt(promptFile) {
+		ctx.basePath = filepath.Dir(absPath)
+		ctx.remoteBase = ctx.remotePrompts[absPath]
+	}
+	defer func() {
+		ctx.Unvisit(absPath)
+		ctx.basePath, ctx.remoteBase = oldBasePath, oldRemoteBase
+	}()
+
+	ctx.prefetchURLs(ctx.promptRequests(pf.Prompt))
+	var planned []PlannedOperation
+	for i, op := range pf.Prompt {
+		if !ctx.Includes(op) {
+			continue
+		}
+		if op.Disabled {
+			ctx.stats.Skipped = append(ctx.stats.Skipped, SkippedOperation{File: promptFile, Index: i, Description: describeOperation(op)})
+			continue
+		}
+		if op.IncludeOnce && op.Prompt != nil && ctx.includedPrompts[ctx.ResolvePromptPath(ctx.Expand(*op.Prompt))] {
+			ctx.stats.Skipped = append(ctx.stats.Skipped, SkippedOperation{File: promptFile, Index: i, Description: describeOperation(op) + ", already included"})
+			continue
+		}
+		p, err := planOperation(upgradeOperation(op, pf.Version), promptFile, i, ctx)
+		if err != nil {
+			return nil, locateError(promptFile, i, op, err)
+		}
+		files := []PlannedOperation{p}
+		switch {
+		case isGlobOperation(p):
+			files, err = planGlob(p, ctx)
+		case p.Type == DirOp:
+			files, err = planDir(p, ctx)
+		}
+		if err != nil {
+			return nil, locateError(promptFile, i, op, err)
+		}
+		if ctx.maxSections > 0 && len(files) > ctx.maxSections {
+			return nil, locateError(promptFile, i, op, fmt.Errorf("%s matches %d files, more than -max-sections %d", p.Value, len(files), ctx.maxSections))
+		}
+		matched := make(map[string]bool, len(files))
+		for _, file := range files {
+			matched[file.Path] = true
+		}
+		start := len(planned)
+		for _, file := range files {
+			planned = append(planned, file)
+			if op.WithTests && capturedRef(file.Value, ctx) == "" {
+				// A glob may already have matched the test files
+				for _, test := range planTestFiles(file, ctx) {
+					if !matched[test.Path] {
+						planned = append(planned, test)
+					}
+				}
+			}
+		}
+		if err := ctx.countSections(planned[start:]); err != nil {
+			return nil, locateError(promptFile, i, op, err)
+		}
+	}
+	return planned, nil
+}
+
+// countSections counts planned operations against -max-sections. Nested
+// prompts are counted by their own operations, and comments and asserts
+// add no section.
+func (ctx *ProcessingContext) countSections(ops []PlannedOperation) error {
+	for _, p := range ops {
+		if p.Type != PromptOp && p.Type != CommentOp && p.Type != AssertOp {
+			ctx.plannedSections++
+		}
+	}
+	if ctx.maxSections > 0 && ctx.plannedSections > ctx.maxSections {
+		return fmt.Errorf("the prompt has more than -max-sections %d sections", ctx.maxSections)
+	}
+	return nil
+}
+
+func planOperation(op Operation, promptFile string, index int, ctx *ProcessingContext) (PlannedOperation, error) {
+	opType, err := op.GetType()
+	if err != nil {
+		return PlannedOperation{}, err
+	}
+
+	p := PlannedOperation{Op: op, Type: opType, File: promptFile, Index: index, Value: ctx.Expand(op.GetValue())}
+	if err := checkCapturedRefs(p, ctx); err != nil {
+		return PlannedOperation{}, err
+	}
+	if err := checkRemotePaths(p, ctx); err != nil {
+		return PlannedOperation{}, err
+	}
+	switch opType {
+	case FileOp:
+		p.Path = ctx.ResolvePath(p.Value)
+		if isGlobOperation(p) {
+			// Expanded into one operation per file by planPromptFile
+			break
+		}
+		if u := ctx.remoteURL(p.Value, false); u != nil {
+			if p.Path, err = ctx.fetchRemote(u, false); err != nil {
+				return PlannedOperation{}, err
+			}
+		}
+		ctx.AddDependency(p.Path)
+		if ctx.pcpignore.Ignored(p.Path, false) {
+			return PlannedOperation{}, fmt.Errorf("%s is excluded by %s", displayPath(p.Value), pcpignoreName)
+		}
+		// Reading a prompt file that is being processed is almost always a
+		// mistake, such as a path that matches the prompt file itself
+		if ctx.IsVisited(p.Path) && !op.AllowSelf {
+			return PlannedOperation{}, ErrCircularReference{File: p.Path, Path: ctx.IncludeChain()}
+		}
+	case SymbolOp, RelatedOp:
+		file, _ := splitSymbol(p.Value)
+		p.Path = ctx.ResolvePath(file)
+		ctx.AddDependency(p.Path)
+	case DirOp, GitOp:
+		p.Path = ctx.ResolvePath(p.Value)
+	case CoverageOp, StacktraceOp, LogOp, DiffOp, BuildTargetsOp, TreeOp:
+		// git diffs read the repository, not a path
+		if opType == DiffOp && op.Diff.isGit() {
+			break
+		}
+		p.Path = ctx.ResolvePath(p.Value)
+		ctx.AddDependency(p.Path)
+	case PromptOp:
+		p.Path = ctx.ResolvePromptPath(p.Value)
+		ctx.includedPrompts[p.Path] = true
+		if isRegistryPrompt(p.Value) {
+			if p.Path, err = ctx.fetchRegistryPrompt(p.Value, op.SHA256); err != nil {
+				return PlannedOperation{}, err
+			}
+		} else if u := ctx.remoteURL(p.Value, true); u != nil {
+			if p.Path, err = ctx.fetchRemote(u, true); err != nil {
+				return PlannedOperation{}, err
+			}
+		} else if strings.HasPrefix(p.Value, "http://") {
+			return PlannedOperation{}, fmt.Errorf("remote prompt %s: only https URLs are supported", p.Value)
+		}
+		p.Children, err = planPromptFile(p.Path, ctx)
+		if err != nil {
+			return PlannedOperation{}, err
+		}
+	case CommandOp:
+		// The argv form runs without a shell, so variables expand inside each
+		// argument and can never split into extra arguments or commands.
+		if op.Command.Args != nil {
+			for _, arg := range op.Command.Args {
+				p.Args = append(p.Args, ctx.Expand(arg))
+			}
+			p.Value = shellJoin(p.Args)
+		} else {
+			p.Value = ctx.ExpandShell(op.GetValue())
+		}
+	case ScriptOp:
+		p.Value = ctx.ExpandShell(op.GetValue())
+	}
+	if op.CaptureAs != "" {
+		planCapture(op.CaptureAs, ctx)
+	}
+	return p, nil
+}
+
+// Flatten returns the plan's concrete operations in execution order, with
+// nested prompts replaced by their operations.
+func (plan *CompilePlan) Flatten() []PlannedOperation {
+	var flat []PlannedOperation
+	var walk func([]PlannedOperation)
+	walk = func(ops []PlannedOperation) {
+		for _, p := range ops {
+			if p.Type == PromptOp {
+				walk(p.Children)
+				continue
+			}
+			flat = append(flat, p)
+		}
+	}
+	walk(plan.Operations)
+	return flat
+}
+
+// printPlan lists the plan's concrete operations, one per line, as
+// "<prompt file>:<index> <type> <value>". Prompt files are shown relative to
+// the root prompt file, and file operations show their resolved path.
+func printPlan(w io.Writer, plan *CompilePlan) {
+	rootDir, _ := filepath.Abs(filepath.Dir(plan.PromptFile))
+	for _, p := range plan.Flatten() {
+		file, _ := filepath.Abs(p.File)
+		if rel, err := filepath.Rel(rootDir, file); err == nil {
+			file = rel
+		}
+
+		value := p.Value
+		switch p.Type {
+		case FileOp, CoverageOp, StacktraceOp, LogOp, DiffOp, BuildTargetsOp, TreeOp:
+			value = p.Path
+		case SymbolOp, RelatedOp:
+			_, name := splitSymbol(p.Value)
+			value = p.Path + "#" + name
+		case GitOp:
+			value = p.Path + "@" + p.Op.Git.Ref
+		}
+		if p.Type == DiffOp && p.Op.Diff.isGit() {
+			value = p.Value
+		}
+		value, _, _ = strings.Cut(value, "\n")
+		fmt.Fprintf(w, "%s:%d %s %s\n", displayPath(file), p.Index, p.Type, value)
+	}
+}
+
+// printCommands lists every command the plan would run, as
+// "<prompt file>:<index> $ <command>", followed by the directory it runs in,
+// the environment variables pcp sets or changes for it, and its limits.
+func printCommands(w io.Writer, plan *CompilePlan, workDir string, ctx *ProcessingContext) {
+	dir, _ := filepath.Abs(workDir)
+	env := envChanges(os.Environ(), commandEnv())
+	rootDir, _ := filepath.Abs(filepath.Dir(plan.PromptFile))
+	for _, p := range plan.Flatten() {
+		if p.Type != CommandOp && p.Type != ScriptOp {
+			continue
+		}
+		file, _ := filepath.Abs(p.File)
+		if rel, err := filepath.Rel(rootDir, file); err == nil {
+			file = rel
+		}
+
+		fmt.Fprintf(w, "%s:%d $ %s\n", displayPath(file), p.Index, p.Value)
+		fmt.Fprintf(w, "    cwd: %s\n", dir)
+		for _, entry := range env {
+			fmt.Fprintf(w, "    env: %s\n", entry)
+		}
+		if limits := p.Op.Limits; limits != nil {
+			calls, _ := limits.ulimits()
+			for _, args := range calls {
+				fmt.Fprintf(w, "    ulimit %s\n", strings.Join(args, " "))
+			}
+		}
+		if name := capturedRef(p.Op.GetValue(), ctx); name != "" {
+			fmt.Fprintf(w, "    (${%s} is captured when the prompt runs)\n", name)
+		}
+	}
+}
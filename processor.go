@@ -1,145 +1,352 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func processOperation(op Operation, ctx *ProcessingContext) (ContentSection, error) {
-	opType, err := op.GetType()
-	if err != nil {
-		return ContentSection{}, err
+// executePlan runs planned operations in order, producing one section each
+// except for suppressed captures, assertions, comments and skipped binary
+// files.
+func executePlan(ops []PlannedOperation, ctx *ProcessingContext) ([]ContentSection, error) {
+	var sections []ContentSection
+	for _, p := range ops {
+		section, err := processOperation(p, ctx)
+		if err != nil {
+			if !ctx.keepGoing || errors.As(err, new(ErrWordLimitExceeded)) {
+				return nil, locateError(p.File, p.Index, p.Op, err)
+			}
+			section = failedSection(p, err, ctx)
+		}
+		if p.Op.Suppress || p.Type == AssertOp || p.Type == CommentOp || section.skipped {
+			continue
+		}
+		sections = append(sections, section)
 	}
+	return sections, nil
+}
 
-	value := op.GetValue()
+// failedSection records a failed operation under -keep-going and returns
+// a placeholder section in its place.
+func failedSection(p PlannedOperation, err error, ctx *ProcessingContext) ContentSection {
+	ctx.stats.Failures = append(ctx.stats.Failures, OperationFailure{
+		File:        p.File,
+		Line:        p.Op.Line,
+		Index:       p.Index,
+		Description: describeOperation(p.Op),
+		Err:         err,
+	})
 
+	source := p.Value
+	if p.Type == FileOp || p.Type == PromptOp || p.Type == SymbolOp || p.Type == RelatedOp || p.Type == CoverageOp || p.Type == StacktraceOp || p.Type == LogOp || p.Type == DiffOp || p.Type == BuildTargetsOp || p.Type == TreeOp {
+		source = displayPath(p.Value)
+	}
+	if p.Type == GitOp {
+		source = gitSource(p, ctx)
+	}
+	return ContentSection{
+		Source:  source,
+		Content: normalizeContent(fmt.Sprintf("[pcp: operation failed: %v]", err)),
+		Type:    p.Type,
+	}
+}
+
+func processOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	p = expandCaptured(p, ctx)
+	op, opType := p.Op, p.Type
+	if op.Label != "" {
+		if _, exists := ctx.labels[op.Label]; exists {
+			return ContentSection{}, ErrDuplicateLabel{Label: op.Label}
+		}
+	}
+
+	switch opType {
+	case AssertOp:
+		return ContentSection{}, processAssertOperation(*op.Assert, ctx)
+	case CommentOp:
+		return ContentSection{}, nil
+	}
+
+	var err error
+	var section ContentSection
 	switch opType {
 	case FileOp:
-		return processFileOperation(value, ctx)
+		section, err = processFileOperation(p, ctx)
 	case PromptOp:
-		return processPromptOperation(value, ctx)
+		section, err = processPromptOperation(p, ctx)
 	case CommandOp:
-		return processCommandOperation(value, ctx)
+		section, err = processCommandOperation(p, ctx)
 	case TextOp:
-		return processTextOperation(value, ctx)
+		section, err = processTextOperation(p.Value, ctx)
+	case RefOp:
+		section, err = processRefOperation(p.Value, ctx)
+	case SysinfoOp:
+		section, err = processSysinfoOperation(ctx)
+	case TimestampOp:
+		section, err = processTimestampOperation(*op.Timestamp)
+	case RemoteOp:
+		section, err = processRemoteOperation(p.Value, ctx)
+	case SymbolOp:
+		section, err = processSymbolOperation(p, ctx)
+	case RelatedOp:
+		section, err = processRelatedOperation(p, ctx)
+	case CoverageOp:
+		section, err = processCoverageOperation(p, ctx)
+	case StacktraceOp:
+		section, err = processStacktraceOperation(p, ctx)
+	case LogOp:
+		section, err = processLogOperation(p, ctx)
+	case DiffOp:
+		section, err = processDiffOperation(p, ctx)
+	case BuildTargetsOp:
+		section, err = processBuildTargetsOperation(p, ctx)
+	case TreeOp:
+		section, err = processTreeOperation(p, ctx)
+	case ScriptOp:
+		section, err = processScriptOperation(p, ctx)
+	case GitOp:
+		section, err = processGitOperation(p, ctx)
 	default:
 		return ContentSection{}, fmt.Errorf("unknown operation type")
 	}
+	if err != nil {
+		return ContentSection{}, err
+	}
+	if section.skipped {
+		return section, nil
+	}
+
+	// Nested prompts are built from sections that were already sanitized
+	if !ctx.keepControlChars && opType != PromptOp && opType != RefOp {
+		section.Content = normalizeContent(stripControlChars(section.Content))
+	}
+
+	// An empty file or command output usually means a wrong path or a
+	// broken command, even though nothing failed
+	if (opType == FileOp || opType == CommandOp || opType == ScriptOp) && countWords(section.Content) == 0 {
+		ctx.stats.EmptySections = append(ctx.stats.EmptySections, section.Source)
+		ctx.Warn("section %s is empty", section.Source)
+	}
+
+	if op.CaptureAs != "" {
+		captureSection(op.CaptureAs, section, ctx)
+		if op.Suppress {
+			return section, nil
+		}
+	}
+
+	if op.Template {
+		// Rendered and charged once the whole compile is known
+		section.template = true
+		section.templateDir, _ = filepath.Abs(filepath.Dir(p.File))
+		if file, _ := filepath.Abs(p.File); ctx.remotePrompts[file] != nil && !ctx.trustsRemotePrompts() {
+			section.templateConfined = true
+		}
+	} else if section, err = chargeSection(section, op, opType, ctx); err != nil {
+		return ContentSection{}, err
+	}
+
+	section.Weight = op.Weight
+	if ctx.sectionIDs != nil {
+		section.ID = sectionID(p, ctx)
+	}
+	if op.Label != "" {
+		ctx.labels[op.Label] = section
+	}
+	return section, nil
 }
 
-func processFileOperation(filePath string, ctx *ProcessingContext) (ContentSection, error) {
-	resolvedPath := ctx.ResolvePath(filePath)
+func processFileOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	resolvedPath := p.Path
 
-	if _, err := os.Stat(resolvedPath); os.IsNotExist(err) {
+	info, err := os.Stat(resolvedPath)
+	if os.IsNotExist(err) {
 		return ContentSection{}, ErrFileNotFound{File: resolvedPath}
 	}
 
 	if isBinaryFile(resolvedPath) {
+		absPath, _ := filepath.Abs(resolvedPath)
+		switch p.Op.Binary {
+		case "stub":
+			return ContentSection{
+				Source:  displayPath(p.Value),
+				Content: normalizeContent(binaryStub(resolvedPath, displayPath(p.Value), info.Size())),
+				Type:    FileOp,
+				Path:    absPath,
+			}, nil
+		case "skip":
+			ctx.stats.Skipped = append(ctx.stats.Skipped, SkippedOperation{File: p.File, Index: p.Index, Description: describeOperation(p.Op) + ", binary file"})
+			return ContentSection{Source: displayPath(p.Value), Type: FileOp, Path: absPath, skipped: true}, nil
+		}
 		return ContentSection{}, ErrBinaryFile{File: resolvedPath}
 	}
 
-	content, err := os.ReadFile(resolvedPath)
+	content, err := ctx.ReadFile(resolvedPath)
 	if err != nil {
 		return ContentSection{}, fmt.Errorf("failed to read file %s: %w", resolvedPath, err)
 	}
 
-	contentStr := string(content)
-	wordCount := countWords(contentStr)
-	if err := ctx.AddWords(wordCount); err != nil {
+	contentStr, err := applyFileFilters(string(content), p.Op, displayPath(p.Value))
+	if err != nil {
 		return ContentSection{}, err
 	}
+	absPath, _ := filepath.Abs(resolvedPath)
 
 	return ContentSection{
-		Source:  filePath,
+		Source:  displayPath(p.Value),
 		Content: normalizeContent(contentStr),
 		Type:    FileOp,
+		Path:    absPath,
 	}, nil
 }
 
-func processPromptOperation(promptPath string, ctx *ProcessingContext) (ContentSection, error) {
-	resolvedPath := ctx.ResolvePath(promptPath)
-
-	if ctx.IsVisited(resolvedPath) {
-		return ContentSection{}, ErrCircularReference{File: resolvedPath, Path: getVisitedPaths(ctx)}
-	}
-
-	pf, err := parsePromptFile(resolvedPath)
+func processPromptOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	children, err := executePlan(p.Children, ctx)
 	if err != nil {
 		return ContentSection{}, err
 	}
 
-	oldBasePath := ctx.basePath
-	ctx.basePath = filepath.Dir(resolvedPath)
-	ctx.MarkVisited(resolvedPath)
-
-	var allSections []ContentSection
-	for _, op := range pf.Prompt {
-		section, err := processOperation(op, ctx)
-		if err != nil {
-			return ContentSection{}, err
-		}
-		allSections = append(allSections, section)
-	}
-
-	delete(ctx.visitedFiles, resolvedPath)
-	ctx.basePath = oldBasePath
+	source := displayPath(p.Value)
+	return ContentSection{
+		Source:   source,
+		Content:  renderNestedContent(source, children, ctx.delimiterStyle),
+		Type:     PromptOp,
+		Children: children,
+	}, nil
+}
 
+// renderNestedContent renders the sections of a nested prompt as a single
+// block, each child headed by its source qualified with the prompt path.
+func renderNestedContent(promptPath string, children []ContentSection, delimiterStyle string) string {
 	var combinedContent strings.Builder
-	for i, section := range allSections {
+	for i, section := range children {
 		if i > 0 {
 			combinedContent.WriteString("\n")
 		}
-		combinedContent.WriteString(formatSectionHeader(promptPath+"->"+section.Source, ctx.delimiterStyle))
+		combinedContent.WriteString(formatSectionHeader(promptPath+"->"+sectionLabel(section), delimiterStyle))
 		combinedContent.WriteString(section.Content)
 	}
+	return normalizeContent(combinedContent.String())
+}
 
-	wordCount := countWords(combinedContent.String())
-	if err := ctx.AddWords(wordCount); err != nil {
-		return ContentSection{}, err
+func processCommandOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	command, args, op := p.Value, p.Args, p.Op
+	policy := ctx.cachePolicy
+	if op.Cache != "" {
+		policy, _ = parseCachePolicy(op.Cache)
 	}
 
-	return ContentSection{
-		Source:  promptPath,
-		Content: normalizeContent(combinedContent.String()),
-		Type:    PromptOp,
-	}, nil
-}
+	dir := ctx.workDir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	key := cacheKey("command", command, dir)
 
-func processCommandOperation(command string, ctx *ProcessingContext) (ContentSection, error) {
-	cmd := exec.Command("sh", "-c", command)
-	output, err := cmd.CombinedOutput()
+	var outputStr string
+	var exitCode int
+	result, cached := cachedResult{}, false
+	if policy.Mode != "never" && ctx.results != nil {
+		result, cached = ctx.results.load(key, policy.TTL)
+	}
 
-	outputStr := string(output)
+	if cached {
+		outputStr, exitCode = result.Output, result.ExitCode
+	} else {
+		name, missing := missingExecutable(command, dir)
+		if args != nil {
+			name, missing = args[0], !executableExists(args[0], dir)
+		}
+		if missing {
+			if op.FallbackText != nil {
+				return ContentSection{
+					Source:  command,
+					Content: normalizeContent(*op.FallbackText),
+					Type:    CommandOp,
+				}, nil
+			}
+			return ContentSection{}, ErrCommandFailed{Command: command, Err: ErrExecutableNotFound{Name: name}}
+		}
 
-	if err != nil {
-		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 1 {
-			fmt.Fprintf(os.Stderr, "Warning: command '%s' exited with status 1 but continuing processing\n", command)
-		} else {
-			return ContentSection{}, ErrCommandFailed{Command: command, Err: err}
+		run, ok := ctx.takePrefetched(key)
+		if !ok {
+			run = runCommand(command, args, dir, ctx.workDir, op.Limits)
+		}
+		outputStr = run.output
+		if run.err != nil {
+			if !run.exited || !exitCodeAllowed(run.exitCode, op.OkExitCodes) {
+				return ContentSection{}, ErrCommandFailed{Command: command, Err: run.err}
+			}
+			exitCode = run.exitCode
+		}
+
+		if policy.Mode != "never" && ctx.results != nil {
+			result := cachedResult{Command: command, Dir: dir, Output: outputStr, ExitCode: exitCode, Created: time.Now()}
+			if err := ctx.results.store(key, result); err != nil {
+				ctx.Warn("failed to cache output of command '%s': %v", command, err)
+			}
 		}
 	}
 
-	wordCount := countWords(outputStr)
-	if err := ctx.AddWords(wordCount); err != nil {
-		return ContentSection{}, err
+	// Codes listed in ok_exit_codes are expected, so only the implicit
+	// tolerance of status 1 is worth a warning
+	if exitCode != 0 && op.OkExitCodes == nil {
+		ctx.Warn("command '%s' exited with status %d but continuing processing", command, exitCode)
 	}
 
 	return ContentSection{
-		Source:  command,
-		Content: normalizeContent(outputStr),
-		Type:    CommandOp,
+		Source:   command,
+		Content:  normalizeContent(outputStr),
+		Type:     CommandOp,
+		ExitCode: exitCode,
 	}, nil
 }
 
-func processTextOperation(text string, ctx *ProcessingContext) (ContentSection, error) {
-	wordCount := countWords(text)
-	if err := ctx.AddWords(wordCount); err != nil {
-		return ContentSection{}, err
+// commandRun is the result of running a command. exited reports whether it
+// ran to completion, so that exitCode is meaningful.
+type commandRun struct {
+	output   string
+	exitCode int
+	exited   bool
+	err      error
+}
+
+// runCommand runs a command in workDir, through sh unless args is set.
+// Relative program paths in args resolve against dir. Commands with limits
+// always run through sh, which sets them before starting the command.
+func runCommand(command string, args []string, dir, workDir string, limits *CommandLimits) commandRun {
+	script, err := limitScript(limits)
+	if err != nil {
+		return commandRun{err: err}
 	}
 
+	cmd := exec.Command("sh", "-c", script+command)
+	if args != nil {
+		program := args[0]
+		if strings.Contains(program, "/") && !filepath.IsAbs(program) {
+			program = filepath.Join(dir, program)
+		}
+		if script == "" {
+			cmd = exec.Command(program, args[1:]...)
+		} else {
+			cmd = exec.Command("sh", append([]string{"-c", script + `exec "$@"`, "sh", program}, args[1:]...)...)
+		}
+	}
+	cmd.Dir = workDir
+	cmd.Env = commandEnv()
+	output, err := cmd.CombinedOutput()
+	run := commandRun{output: strings.ToValidUTF8(string(output), "\uFFFD"), err: err}
+	if cmd.ProcessState != nil {
+		run.exitCode, run.exited = cmd.ProcessState.ExitCode(), true
+	}
+	return run
+}
+
+func processTextOperation(text string, ctx *ProcessingContext) (ContentSection, error) {
 	return ContentSection{
 		Source:  "text",
 		Content: normalizeContent(text),
@@ -147,6 +354,63 @@ func processTextOperation(text string, ctx *ProcessingContext) (ContentSection,
 	}, nil
 }
 
+// processRefOperation reuses the content of a previously labeled operation
+// without rereading or re-running it.
+func processRefOperation(ref string, ctx *ProcessingContext) (ContentSection, error) {
+	label := strings.TrimPrefix(ref, "#")
+	original, ok := ctx.labels[label]
+	if !ok {
+		return ContentSection{}, ErrUnknownLabel{Label: label}
+	}
+
+	section := original
+	section.Source = "#" + label
+	return section, nil
+}
+
+// chargeSection applies the operation's own caps and then counts the
+// section against the word budget. Nested prompt sections are charged by
+// their children as they are processed, and refs only when they set charge,
+// so no content is counted twice.
+func chargeSection(section ContentSection, op Operation, opType OperationType, ctx *ProcessingContext) (ContentSection, error) {
+	before := sectionWords(section)
+	section = capSection(section, op.MaxWords, op.MaxTokens, ctx.charsPerToken, ctx.delimiterStyle)
+	removed := before - sectionWords(section)
+
+	// Headers are part of the output whether or not the content is charged
+	if ctx.exactBudget {
+		if err := ctx.AddWords(countWords(formatSectionHeader(sectionLabel(section), ctx.delimiterStyle))); err != nil {
+			return ContentSection{}, err
+		}
+	}
+
+	switch {
+	case opType == PromptOp:
+		ctx.wordCount -= removed
+		return section, nil
+	case opType == RefOp && !op.Charge:
+		return section, nil
+	}
+
+	if err := ctx.AddWords(sectionWords(section)); err != nil {
+		return ContentSection{}, err
+	}
+	return section, nil
+}
+
+// sectionLabel is the source shown in a section's header, noting a
+// tolerated nonzero exit status and the section's ID when it has one.
+func sectionLabel(section ContentSection) string {
+	label := section.Source
+	if section.ExitCode != 0 {
+		label = fmt.Sprintf("%s (exit status %d)", label, section.ExitCode)
+	}
+	if section.ID != "" {
+		label += " id=" + section.ID
+	}
+	return label
+}
+
 func formatSectionHeader(source, delimiterStyle string) string {
 	switch delimiterStyle {
 	case "xml":
@@ -154,7 +418,7 @@ func formatSectionHeader(source, delimiterStyle string) string {
 	case "minimal":
 		return fmt.Sprintf("\n=== PCP SOURCE: %s ===\n", source)
 	case "none":
-		return "" // No delimiters, content will flow together with their normalized newlines
+		return "" // No delimiters; only the section separator sits between sections
 	case "full":
 		return fmt.Sprintf("\n----------------------------------\nBEGIN: %s\n----------------------------------\n", source)
 	default:
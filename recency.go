@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRecencyLookback is how far back -overflow recency looks in git
+// history.
+const defaultRecencyLookback = "90d"
+
+// parseLookback parses a -recency-lookback value: a Go duration such as
+// 720h, or a number of days such as 90d.
+func parseLookback(s string) (time.Duration, error) {
+	var lookback time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		lookback = time.Duration(n) * 24 * time.Hour
+	} else {
+		lookback, err = time.ParseDuration(s)
+	}
+	if err != nil || lookback <= 0 {
+		return 0, fmt.Errorf("invalid recency lookback %q: expected a positive duration such as 90d or 720h", s)
+	}
+	return lookback, nil
+}
+
+// gitRecency maps the absolute paths of files in the git repository at dir
+// to when they last changed: their latest commit within lookback, or now
+// for files with uncommitted changes.
+func gitRecency(dir string, lookback time.Duration) (map[string]time.Time, error) {
+	top, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+
+	since := time.Now().Add(-lookback).Format(time.RFC3339)
+	log, err := gitOutput(dir, "log", "--since="+since, "--format=%x00%ct", "--name-only", "--no-renames")
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]time.Time)
+	var commitTime time.Time
+	for _, line := range strings.Split(log, "\n") {
+		if stamp, ok := strings.CutPrefix(line, "\x00"); ok {
+			seconds, _ := strconv.ParseInt(stamp, 10, 64)
+			commitTime = time.Unix(seconds, 0)
+			continue
+		}
+		path := filepath.Join(top, filepath.FromSlash(line))
+		// The log lists the newest commits first
+		if _, seen := changed[path]; line != "" && !seen {
+			changed[path] = commitTime
+		}
+	}
+
+	status, err := gitOutput(dir, "status", "--porcelain", "-z", "--no-renames", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, entry := range strings.Split(status, "\x00") {
+		if len(entry) > 3 {
+			changed[filepath.Join(top, filepath.FromSlash(entry[3:]))] = now
+		}
+	}
+	return changed, nil
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], message)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(output), nil
+}
+
+// markRecency records when each file section last changed, for the
+// recency overflow policy.
+func markRecency(sections []ContentSection, changed map[string]time.Time) {
+	for i := range sections {
+		section := &sections[i]
+		switch section.Type {
+		case PromptOp:
+			markRecency(section.Children, changed)
+		case FileOp:
+			path := section.Path
+			if resolved, err := filepath.EvalSymlinks(path); err == nil {
+				path = resolved
+			}
+			section.modified = changed[path]
+		}
+	}
+}
+
+// sectionRecency returns when a section last changed and whether it holds
+// files at all. A nested prompt changed when its newest file did.
+func sectionRecency(section ContentSection) (time.Time, bool) {
+	switch section.Type {
+	case FileOp:
+		return section.modified, true
+	case PromptOp:
+		var newest time.Time
+		hasFiles := false
+		for _, child := range section.Children {
+			if modified, isFile := sectionRecency(child); isFile {
+				hasFiles = true
+				if modified.After(newest) {
+					newest = modified
+				}
+			}
+		}
+		return newest, hasFiles
+	}
+	return time.Time{}, false
+}
+
+// recencyAllowances spends the budget on sections other than files first,
+// such as instructions and command output, then on files from the most
+// recently changed down. Files that did not change within the lookback
+// come last, in prompt order.
+func recencyAllowances(sections []ContentSection, budget int, size func(ContentSection) int) []int {
+	order := make([]int, len(sections))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		timeA, fileA := sectionRecency(sections[order[a]])
+		timeB, fileB := sectionRecency(sections[order[b]])
+		if fileA != fileB {
+			return !fileA
+		}
+		return timeA.After(timeB)
+	})
+
+	allowances := make([]int, len(sections))
+	for _, i := range order {
+		allowances[i] = min(size(sections[i]), budget)
+		budget -= allowances[i]
+	}
+	return allowances
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// registryPrefix marks a prompt path as a shared component fetched from the
+// prompt registry, such as "registry:org/code-review@v1".
+const registryPrefix = "registry:"
+
+var (
+	registryNamePattern    = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+	registryVersionPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	sha256Pattern          = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+func isRegistryPrompt(filePath string) bool {
+	return strings.HasPrefix(filePath, registryPrefix)
+}
+
+// parseRegistryRef splits "registry:<name>@<version>" into its parts.
+func parseRegistryRef(ref string) (name, version string, err error) {
+	name, version, ok := strings.Cut(strings.TrimPrefix(ref, registryPrefix), "@")
+	if !ok || version == "" {
+		return "", "", fmt.Errorf("registry prompt %q needs a version, as in registry:org/name@v1", ref)
+	}
+	if !registryNamePattern.MatchString(name) || !registryVersionPattern.MatchString(version) {
+		return "", "", fmt.Errorf("invalid registry prompt %q", ref)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "." || part == ".." {
+			return "", "", fmt.Errorf("invalid registry prompt %q", ref)
+		}
+	}
+	if version == "." || version == ".." {
+		return "", "", fmt.Errorf("invalid registry prompt %q", ref)
+	}
+	return name, version, nil
+}
+
+// fetchRegistryPrompt returns the local path of a registry prompt. Published
+// versions are treated as immutable: each is fetched once, from
+// <registry>/<name>/<version>.yml, and read from the cache afterwards. A
+// non-empty pin is the sha256 the prompt file must have. With a verify key,
+// the prompt must also have a valid signature at the same URL plus .minisig,
+// checked on every use since prompt files can run commands.
+func (ctx *ProcessingContext) fetchRegistryPrompt(ref, pin string) (string, error) {
+	cached, rawURL, err := ctx.registryLocation(ref)
+	if err != nil {
+		return "", err
+	}
+	fetch := func(suffix string) ([]byte, error) {
+		if ctx.registry == "" {
+			return nil, fmt.Errorf("no prompt registry configured for %s (set -registry or PCP_REGISTRY)", ref)
+		}
+		if rawURL == "" {
+			return nil, fmt.Errorf("invalid registry %q: not an http or https URL", ctx.registry)
+		}
+		data, err := ctx.fetchURLOnce(rawURL + suffix)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(cached), 0700); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	data, err := os.ReadFile(cached)
+	fetched := err != nil
+	if fetched {
+		if data, err = fetch(""); err != nil {
+			return "", err
+		}
+	}
+	if err := checkPin(ref, data, pin); err != nil {
+		return "", err
+	}
+
+	if ctx.verifyKey != nil {
+		// A cached prompt may predate the verify key, so fetch its signature
+		// if it was never stored
+		signature, err := os.ReadFile(cached + ".minisig")
+		if err != nil {
+			if signature, err = fetch(".minisig"); err != nil {
+				return "", fmt.Errorf("%s has no signature: %w", ref, err)
+			}
+			if err := os.WriteFile(cached+".minisig", signature, 0600); err != nil {
+				return "", err
+			}
+		}
+		if err := ctx.verifyKey.verify(data, signature); err != nil {
+			return "", fmt.Errorf("%s failed signature verification: %w", ref, err)
+		}
+	}
+
+	if fetched {
+		if err := os.WriteFile(cached, data, 0600); err != nil {
+			return "", err
+		}
+	}
+	return cached, nil
+}
+
+// registryLocation returns where a registry prompt is cached and the URL it
+// is fetched from, which is empty when no valid registry is configured.
+func (ctx *ProcessingContext) registryLocation(ref string) (cached, rawURL string, err error) {
+	name, version, err := parseRegistryRef(ref)
+	if err != nil {
+		return "", "", err
+	}
+	cacheDir := defaultCacheDir()
+	if ctx.results != nil {
+		cacheDir = ctx.results.dir
+	}
+	cached = filepath.Join(cacheDir, "registry", filepath.FromSlash(name), version+".yml")
+	if u, err := url.Parse(ctx.registry); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		rawURL = strings.TrimSuffix(ctx.registry, "/") + "/" + name + "/" + version + ".yml"
+	}
+	return cached, rawURL, nil
+}
+
+func checkPin(ref string, data []byte, pin string) error {
+	if pin == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != pin {
+		return fmt.Errorf("%s has sha256 %s, but sha256 pins %s", ref, got, pin)
+	}
+	return nil
+}
+
+func validateRegistryPin(op Operation, opType OperationType) error {
+	if op.SHA256 == "" {
+		return nil
+	}
+	if opType != PromptOp || !isRegistryPrompt(*op.Prompt) {
+		return fmt.Errorf("sha256 applies only to registry: prompt operations")
+	}
+	if !sha256Pattern.MatchString(op.SHA256) {
+		return fmt.Errorf("invalid sha256 %q: expected 64 lowercase hex digits", op.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RelatedSpec selects a Go function or method together with its callers
+// and callees in the same package, up to depth calls away.
+type RelatedSpec struct {
+	Symbol string `yaml:"symbol"`
+	Dir    string `yaml:"dir,omitempty"`
+	Depth  int    `yaml:"depth,omitempty"`
+}
+
+// String renders the operation's value as "dir#symbol", like a symbol
+// operation's "file#name".
+func (s RelatedSpec) String() string {
+	dir := s.Dir
+	if dir == "" {
+		dir = "."
+	}
+	return dir + "#" + s.Symbol
+}
+
+func (s RelatedSpec) depth() int {
+	if s.Depth == 0 {
+		return 1
+	}
+	return s.Depth
+}
+
+func validateRelated(spec RelatedSpec) error {
+	if spec.Symbol == "" {
+		return fmt.Errorf("related needs a symbol")
+	}
+	if spec.Depth < 0 {
+		return fmt.Errorf("related depth must not be negative")
+	}
+	return nil
+}
+
+// processRelatedOperation includes a function with the functions it calls
+// and the functions that call it, found by reading the package's non-test
+// files. Calls are matched by name, so a method called on anything other
+// than the receiver matches every method of that name in the package.
+func processRelatedOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	dir, name := splitSymbol(p.Value)
+	entries, err := os.ReadDir(p.Path)
+	if err != nil {
+		return ContentSection{}, fmt.Errorf("failed to read package directory %s: %w", p.Path, err)
+	}
+
+	var decls []goDecl
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go") || strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+		path := filepath.Join(p.Path, entry.Name())
+		ctx.AddDependency(path)
+		content, err := ctx.ReadFile(path)
+		if err != nil {
+			return ContentSection{}, fmt.Errorf("failed to read file %s: %w", path, err)
+		}
+		fileDecls, err := parseGoDecls(path, content)
+		if err != nil {
+			return ContentSection{}, err
+		}
+		decls = append(decls, fileDecls...)
+	}
+
+	target, err := findGoDecl(decls, name, displayPath(dir))
+	if err != nil {
+		return ContentSection{}, err
+	}
+	if !target.isFunc {
+		return ContentSection{}, fmt.Errorf("symbol %s is a type; related needs a function or method", name)
+	}
+
+	callees := make(map[int][]int)
+	callers := make(map[int][]int)
+	for i, decl := range decls {
+		for _, call := range decl.calls {
+			for _, j := range resolveGoCall(decls, call) {
+				callees[i] = append(callees[i], j)
+				callers[j] = append(callers[j], i)
+			}
+		}
+	}
+	start := 0
+	for i, decl := range decls {
+		if decl.name == target.name {
+			start = i
+		}
+	}
+	included := map[int]bool{start: true}
+	for _, edges := range []map[int][]int{callees, callers} {
+		frontier := []int{start}
+		for level := 0; level < p.Op.Related.depth() && len(frontier) > 0; level++ {
+			var next []int
+			for _, i := range frontier {
+				for _, j := range edges[i] {
+					if !included[j] {
+						included[j] = true
+						next = append(next, j)
+					}
+				}
+			}
+			frontier = next
+		}
+	}
+
+	// The target comes first, then the rest in source order
+	order := make([]int, 0, len(included))
+	for i := range included {
+		if i != start {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool {
+		if decls[order[a]].file != decls[order[b]].file {
+			return decls[order[a]].file < decls[order[b]].file
+		}
+		return decls[order[a]].offset < decls[order[b]].offset
+	})
+	blocks := make([]string, 0, len(included))
+	for _, i := range append([]int{start}, order...) {
+		blocks = append(blocks, "// "+filepath.Base(decls[i].file)+"\n"+decls[i].code)
+	}
+
+	source := name
+	if dir != "." {
+		source = displayPath(dir) + "#" + name
+	}
+	return ContentSection{
+		Source:  source,
+		Content: normalizeContent(strings.Join(blocks, "\n\n")),
+		Type:    RelatedOp,
+	}, nil
+}
+
+// resolveGoCall returns the functions and methods a call found by goCalls
+// may refer to.
+func resolveGoCall(decls []goDecl, call string) []int {
+	var matches []int
+	for i, decl := range decls {
+		if !decl.isFunc {
+			continue
+		}
+		if method, ok := strings.CutPrefix(call, "."); ok && decl.method == method || decl.name == call {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteTimeout bounds a single pcp_remote request, including reading the body.
+const remoteTimeout = 30 * time.Second
+
+// maxRemoteBytes caps how much of a response is read, so a misconfigured
+// server cannot exhaust memory.
+const maxRemoteBytes = 64 << 20
+
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+// cachedResponse is a fetched URL kept under -cache-dir, with the
+// validators the server sent so the next fetch can ask whether it changed.
+type cachedResponse struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Body         []byte    `json:"body"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// processRemoteOperation fetches content compiled by another pcp instance,
+// typically `pcp serve`, over HTTP.
+func processRemoteOperation(rawURL string, ctx *ProcessingContext) (ContentSection, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ContentSection{}, ErrRemoteFetch{URL: rawURL, Err: fmt.Errorf("not an http or https URL")}
+	}
+
+	body, err := ctx.fetchCachedURL(rawURL)
+	if err != nil {
+		return ContentSection{}, err
+	}
+
+	return ContentSection{
+		Source:  rawURL,
+		Content: normalizeContent(strings.ToValidUTF8(string(body), "�")),
+		Type:    RemoteOp,
+	}, nil
+}
+
+// fetchURL reads the body of a successful GET of rawURL, up to
+// maxRemoteBytes.
+func fetchURL(rawURL string) ([]byte, error) {
+	response, err := getURL(rawURL, nil)
+	return response.Body, err
+}
+
+// getURL is fetchURL returning the response's validators. Given a cached
+// response it makes the request conditional, and returns the cached one
+// when the server answers 304 Not Modified.
+func getURL(rawURL string, cached *cachedResponse) (cachedResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: err}
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		response := *cached
+		response.Fetched = time.Now()
+		return response, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBytes+1))
+	if err != nil {
+		return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: fmt.Errorf("server returned %s", resp.Status)}
+		}
+		return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: fmt.Errorf("server returned %s: %s", resp.Status, message)}
+	}
+	if len(body) > maxRemoteBytes {
+		return cachedResponse{}, ErrRemoteFetch{URL: rawURL, Err: fmt.Errorf("response exceeds %d bytes", maxRemoteBytes)}
+	}
+	return cachedResponse{
+		URL:          rawURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+		Fetched:      time.Now(),
+	}, nil
+}
+
+// fetchCachedURL is fetchURL through the HTTP cache. A response younger
+// than -remote-cache-ttl is used without asking the server; an older one
+// is revalidated with its ETag or Last-Modified, so an unchanged source is
+// not downloaded again. Responses without either are fetched every time.
+// -no-cache skips the cache entirely.
+func (ctx *ProcessingContext) fetchCachedURL(rawURL string) ([]byte, error) {
+	fetch, ok := ctx.takePrefetchedURL(remoteRequest{URL: rawURL})
+	if !ok {
+		fetch = ctx.getCachedURL(rawURL)
+	}
+	if fetch.cacheErr != nil {
+		ctx.Warn("failed to cache response of %s: %v", rawURL, fetch.cacheErr)
+	}
+	return fetch.body, fetch.err
+}
+
+// fetchURLOnce is fetchURL, using the response prefetched for rawURL if
+// there is one.
+func (ctx *ProcessingContext) fetchURLOnce(rawURL string) ([]byte, error) {
+	if fetch, ok := ctx.takePrefetchedURL(remoteRequest{URL: rawURL, Direct: true}); ok {
+		return fetch.body, fetch.err
+	}
+	return fetchURL(rawURL)
+}
+
+// getCachedURL does the work of fetchCachedURL. It only reads the context,
+// so prefetches can run it at once; a failure to store the response is
+// returned for the caller to warn about.
+func (ctx *ProcessingContext) getCachedURL(rawURL string) remoteFetch {
+	if ctx.noCache || ctx.results == nil {
+		body, err := fetchURL(rawURL)
+		return remoteFetch{body: body, err: err}
+	}
+	path := ctx.results.responsePath(rawURL)
+	var cached *cachedResponse
+	if data, err := os.ReadFile(path); err == nil {
+		var response cachedResponse
+		if json.Unmarshal(data, &response) == nil && response.URL == rawURL {
+			cached = &response
+		}
+	}
+	if cached != nil && ctx.remoteCacheTTL > 0 && time.Since(cached.Fetched) < ctx.remoteCacheTTL {
+		return remoteFetch{body: cached.Body}
+	}
+
+	response, err := getURL(rawURL, cached)
+	if err != nil {
+		return remoteFetch{err: err}
+	}
+	if response.ETag == "" && response.LastModified == "" && ctx.remoteCacheTTL == 0 {
+		return remoteFetch{body: response.Body}
+	}
+	data, err := json.Marshal(response)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			err = os.WriteFile(path, data, 0600)
+		}
+	}
+	return remoteFetch{body: response.Body, cacheErr: err}
+}
+
+// maxPrefetchedURLs is how many URLs are fetched at once.
+const maxPrefetchedURLs = 8
+
+// remoteRequest is a URL to fetch ahead of time: through the HTTP cache,
+// or with Direct set, as registry prompts are, without it.
+type remoteRequest struct {
+	URL    string
+	Direct bool
+}
+
+// remoteFetch is the outcome of fetching a URL.
+type remoteFetch struct {
+	body     []byte
+	err      error
+	cacheErr error
+}
+
+// prefetchURLs fetches requests at once and waits for them all, so the
+// latency of remote sources is not added up when they are then used one
+// after another, in order. Each result is kept for the first use of its
+// URL; later uses fetch again, through the cache.
+func (ctx *ProcessingContext) prefetchURLs(requests []remoteRequest) {
+	var pending []remoteRequest
+	for _, request := range requests {
+		if _, done := ctx.prefetchedURLs[request]; !done && !slices.Contains(pending, request) {
+			pending = append(pending, request)
+		}
+	}
+	// A single fetch gains nothing from starting early
+	if len(pending) < 2 {
+		return
+	}
+
+	fetches := make([]remoteFetch, len(pending))
+	slots := make(chan struct{}, maxPrefetchedURLs)
+	var wg sync.WaitGroup
+	for i, request := range pending {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			if request.Direct {
+				body, err := fetchURL(request.URL)
+				fetches[i] = remoteFetch{body: body, err: err}
+			} else {
+				fetches[i] = ctx.getCachedURL(request.URL)
+			}
+			<-slots
+		}()
+	}
+	wg.Wait()
+	for i, request := range pending {
+		ctx.prefetchedURLs[request] = fetches[i]
+	}
+}
+
+func (ctx *ProcessingContext) takePrefetchedURL(request remoteRequest) (remoteFetch, bool) {
+	fetch, ok := ctx.prefetchedURLs[request]
+	delete(ctx.prefetchedURLs, request)
+	return fetch, ok
+}
+
+// promptRequests lists what planning a prompt file's operations will
+// fetch: its https:// and registry prompts, with their signatures under
+// -verify-key, and the files of a remote prompt. Paths that still hold a
+// variable, such as one captured by an earlier operation, are left out.
+func (ctx *ProcessingContext) promptRequests(ops []Operation) []remoteRequest {
+	var requests []remoteRequest
+	for _, op := range ops {
+		if !ctx.Includes(op) || op.Disabled {
+			continue
+		}
+		switch {
+		case op.Prompt != nil:
+			value := ctx.Expand(*op.Prompt)
+			if varPattern.MatchString(value) {
+				continue
+			}
+			if isRegistryPrompt(value) {
+				cached, rawURL, err := ctx.registryLocation(value)
+				if err != nil || rawURL == "" {
+					continue
+				}
+				if !fileExists(cached) {
+					requests = append(requests, remoteRequest{URL: rawURL, Direct: true})
+				}
+				if ctx.verifyKey != nil && !fileExists(cached+".minisig") {
+					requests = append(requests, remoteRequest{URL: rawURL + ".minisig", Direct: true})
+				}
+			} else if u := ctx.remoteURL(value, true); u != nil && u.Scheme == "https" && u.Host != "" {
+				requests = append(requests, remoteRequest{URL: u.String()})
+				if ctx.verifyKey != nil {
+					requests = append(requests, remoteRequest{URL: u.String() + ".minisig"})
+				}
+			}
+		case op.File != nil && ctx.remoteBase != nil:
+			value := ctx.Expand(*op.File)
+			if varPattern.MatchString(value) || isGlobPattern(value) {
+				continue
+			}
+			if u := ctx.remoteURL(value, false); u != nil {
+				requests = append(requests, remoteRequest{URL: u.String()})
+			}
+		}
+	}
+	return requests
+}
+
+// prefetchRemoteOperations fetches the plan's pcp_remote sources at once
+// before the plan executes.
+func prefetchRemoteOperations(plan *CompilePlan, ctx *ProcessingContext) {
+	var requests []remoteRequest
+	for _, p := range plan.Flatten() {
+		if p.Type == RemoteOp && capturedRef(p.Op.GetValue(), ctx) == "" {
+			if u, err := url.Parse(p.Value); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+				requests = append(requests, remoteRequest{URL: p.Value})
+			}
+		}
+	}
+	ctx.prefetchURLs(requests)
+}
+
+// isRemotePrompt reports whether a prompt path is an https:// URL.
+func isRemotePrompt(filePath string) bool {
+	return strings.HasPrefix(filePath, "https://")
+}
+
+// remoteURL returns the URL a path of a prompt operation, or with prompt
+// set of a file operation, refers to: the path itself for an https://
+// prompt, or a relative path resolved against the URL of the remote prompt
+// being planned. Local paths return nil.
+func (ctx *ProcessingContext) remoteURL(filePath string, prompt bool) *url.URL {
+	if prompt && isRemotePrompt(filePath) {
+		u, err := url.Parse(filePath)
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+	if ctx.remoteBase == nil || filepath.IsAbs(filePath) || filepath.VolumeName(filePath) != "" || isBuiltinPrompt(filePath) || isRegistryPrompt(filePath) {
+		return nil
+	}
+	return ctx.remoteBase.ResolveReference(&url.URL{Path: filepath.ToSlash(filePath)})
+}
+
+// remoteMirror is where a remote prompt, or a file it includes, is kept
+// under -cache-dir, laid out like the server so relative paths between
+// them still work.
+func (ctx *ProcessingContext) remoteMirror(u *url.URL) string {
+	cacheDir := defaultCacheDir()
+	if ctx.results != nil {
+		cacheDir = ctx.results.dir
+	}
+	host := strings.ReplaceAll(u.Host, ":", "_")
+	return filepath.Join(cacheDir, "remote", host, filepath.FromSlash(path.Clean("/"+u.Path)))
+}
+
+// fetchRemote downloads a remote prompt, or a file it includes, into its
+// mirror through the HTTP cache, and returns the mirror's path. With
+// -verify-key, prompts must have a valid signature at their URL plus
+// .minisig, since prompt files can run commands.
+func (ctx *ProcessingContext) fetchRemote(u *url.URL, prompt bool) (string, error) {
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("remote prompt %s: only https URLs are supported", u)
+	}
+	data, err := ctx.fetchCachedURL(u.String())
+	if err != nil {
+		return "", err
+	}
+	if prompt && ctx.verifyKey != nil {
+		signature, err := ctx.fetchCachedURL(u.String() + ".minisig")
+		if err != nil {
+			return "", fmt.Errorf("%s has no signature: %w", u, err)
+		}
+		if err := ctx.verifyKey.verify(data, signature); err != nil {
+			return "", fmt.Errorf("%s failed signature verification: %w", u, err)
+		}
+	}
+
+	mirror := ctx.remoteMirror(u)
+	if err := os.MkdirAll(filepath.Dir(mirror), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(mirror, data, 0600); err != nil {
+		return "", err
+	}
+	if prompt {
+		ctx.remotePrompts[mirror] = u
+	}
+	return mirror, nil
+}
+
+// trustsRemotePrompts reports whether remote prompts may run commands and
+// read local files: with -verify-key they were signed by a trusted key.
+func (ctx *ProcessingContext) trustsRemotePrompts() bool {
+	return ctx.verifyKey != nil || ctx.allowRemoteCommands
+}
+
+// checkRemotePaths rejects operations of a remote prompt that would need
+// to list or inspect a directory on the server: only single files and
+// prompts can be fetched. Unless remote prompts are trusted, it also
+// rejects commands and the absolute paths that would read local files.
+func checkRemotePaths(p PlannedOperation, ctx *ProcessingContext) error {
+	if ctx.remoteBase == nil {
+		return nil
+	}
+	switch p.Type {
+	case CommandOp, ScriptOp:
+		if !ctx.trustsRemotePrompts() {
+			return fmt.Errorf("%s operations in a remote prompt run on this machine; sign the prompt and pass -verify-key, or pass -allow-remote-commands", p.Type)
+		}
+		return nil
+	case PromptOp, FileOp, SymbolOp, RelatedOp, DirOp, CoverageOp, StacktraceOp, LogOp, DiffOp, BuildTargetsOp, TreeOp, GitOp:
+		if err := checkRemoteLocalPaths(p, ctx); err != nil {
+			return err
+		}
+	}
+
+	switch p.Type {
+	case FileOp:
+		if !isGlobOperation(p) {
+			return nil
+		}
+	case SymbolOp, RelatedOp, DirOp, CoverageOp, StacktraceOp, LogOp, DiffOp, BuildTargetsOp, TreeOp, GitOp:
+	default:
+		return nil
+	}
+	file := p.Value
+	if p.Type == SymbolOp || p.Type == RelatedOp {
+		file, _ = splitSymbol(p.Value)
+	}
+	if ctx.remoteURL(file, false) == nil {
+		return nil
+	}
+	if p.Type == FileOp {
+		return fmt.Errorf("globs cannot be used in a remote prompt, since the server's files cannot be listed")
+	}
+	if p.Type == DiffOp && p.Op.Diff.isGit() {
+		return fmt.Errorf("git diffs cannot be used in a remote prompt, since the server's repository cannot be read")
+	}
+	return fmt.Errorf("%s operations with relative paths cannot be used in a remote prompt; only file and prompt paths are fetched", p.Type)
+}
+
+// checkRemoteLocalPaths rejects the paths of a remote prompt's operation
+// that are read from this machine instead of fetched, unless remote prompts
+// are trusted. Relative paths are always fetched, .. included, since they
+// resolve against the prompt's URL.
+func checkRemoteLocalPaths(p PlannedOperation, ctx *ProcessingContext) error {
+	if ctx.trustsRemotePrompts() {
+		return nil
+	}
+	paths := []string{p.Value}
+	switch {
+	case p.Type == SymbolOp || p.Type == RelatedOp:
+		paths[0], _ = splitSymbol(p.Value)
+	case p.Type == DiffOp && !p.Op.Diff.isGit():
+		paths = append(paths, ctx.Expand(p.Op.Diff.B))
+	case p.Type == DiffOp:
+		return nil
+	}
+	for _, path := range paths {
+		if p.Type == PromptOp && (isBuiltinPrompt(path) || isRegistryPrompt(path)) {
+			continue
+		}
+		if ctx.remoteURL(path, p.Type == PromptOp) == nil {
+			return fmt.Errorf("%s operations in a remote prompt cannot read %s from this machine; sign the prompt and pass -verify-key, or pass -allow-remote-commands", p.Type, displayPath(path))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ErrReviewAborted is returned when -review is quit without accepting.
+var ErrReviewAborted = errors.New("review aborted; nothing was written")
+
+// openTerminal opens the controlling terminal for -review and pcp pick,
+// named by feature in errors. Stdin and stdout may be piped, so they talk
+// to the terminal directly.
+func openTerminal(feature string) (*os.File, *os.File, error) {
+	inName, outName := "/dev/tty", "/dev/tty"
+	if runtime.GOOS == "windows" {
+		inName, outName = "CONIN$", "CONOUT$"
+	}
+	in, err := os.Open(inName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s needs a terminal: %w", feature, err)
+	}
+	out, err := os.OpenFile(outName, os.O_WRONLY, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, fmt.Errorf("%s needs a terminal: %w", feature, err)
+	}
+	return in, out, nil
+}
+
+// reviewOnTerminal runs reviewSections on the controlling terminal.
+func reviewOnTerminal(sections []ContentSection, ctx *ProcessingContext) ([]ContentSection, error) {
+	in, out, err := openTerminal("-review")
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	defer out.Close()
+	return reviewSections(sections, in, out, ctx)
+}
+
+// reviewSections lists every section, nested prompts' sections included,
+// with its size and lets the user toggle sections off before the output is
+// assembled. Removed sections are recorded in the stats.
+func reviewSections(sections []ContentSection, in io.Reader, out io.Writer, ctx *ProcessingContext) ([]ContentSection, error) {
+	leaves := leafSections(sections)
+	keep := make([]bool, len(leaves))
+	for i := range keep {
+		keep[i] = true
+	}
+	width := len(strconv.Itoa(len(leaves)))
+
+	scanner := bufio.NewScanner(in)
+	for {
+		words := 0
+		for i, section := range leaves {
+			if keep[i] {
+				words += sectionWords(section)
+			}
+		}
+		fmt.Fprintf(out, "pcp: review %d sections (%d words kept)\n", len(leaves), words)
+		for i, section := range leaves {
+			mark := "x"
+			if !keep[i] {
+				mark = " "
+			}
+			fmt.Fprintf(out, "  [%s] %*d  %s %s (%s)\n", mark, width, i+1, section.Type, section.Source, formatSize(sectionWords(section), sectionBytes(section)))
+		}
+		fmt.Fprint(out, "Toggle sections by number or range (2 4-6), a: all, n: none, q: quit, Enter: accept> ")
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return nil, ErrReviewAborted
+		}
+		answer := strings.TrimSpace(scanner.Text())
+		switch answer {
+		case "":
+			return removeReviewed(sections, keep, ctx), nil
+		case "q":
+			return nil, ErrReviewAborted
+		case "a", "n":
+			for i := range keep {
+				keep[i] = answer == "a"
+			}
+			continue
+		}
+		toggles, err := parseSectionNumbers(answer, len(leaves))
+		if err != nil {
+			fmt.Fprintf(out, "pcp: %v\n", err)
+			continue
+		}
+		for _, n := range toggles {
+			keep[n-1] = !keep[n-1]
+		}
+	}
+}
+
+// parseSectionNumbers parses section numbers and ranges such as "2 4-6",
+// separated by spaces or commas, each between 1 and count.
+func parseSectionNumbers(answer string, count int) ([]int, error) {
+	var numbers []int
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ' ' || r == ',' }) {
+		from, to, isRange := strings.Cut(field, "-")
+		if !isRange {
+			to = from
+		}
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || first < 1 || last > count || first > last {
+			return nil, fmt.Errorf("%q is not a section number or range between 1 and %d", field, count)
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers, nil
+}
+
+// removeReviewed drops the sections the review turned off, numbered in
+// leafSections order, and nested prompts that are left empty.
+func removeReviewed(sections []ContentSection, keep []bool, ctx *ProcessingContext) []ContentSection {
+	next := 0
+	var filter func([]ContentSection) []ContentSection
+	filter = func(sections []ContentSection) []ContentSection {
+		var kept []ContentSection
+		for _, section := range sections {
+			if section.Type == PromptOp {
+				children := filter(section.Children)
+				if len(children) > 0 || len(section.Children) == 0 {
+					section.Children = children
+					kept = append(kept, section)
+				}
+				continue
+			}
+			if keep[next] {
+				kept = append(kept, section)
+			} else {
+				ctx.stats.Reviewed = append(ctx.stats.Reviewed, section.Source)
+			}
+			next++
+		}
+		return kept
+	}
+	return filter(sections)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// outputRoute is one -route rule: sections of the listed operation types
+// are written to File instead of the main output.
+type outputRoute struct {
+	Types []OperationType
+	File  string
+}
+
+// routeFlag collects repeated -route types=file flags.
+type routeFlag struct {
+	routes *[]outputRoute
+}
+
+func (f routeFlag) String() string {
+	if f.routes == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(*f.routes))
+	for _, route := range *f.routes {
+		names := make([]string, 0, len(route.Types))
+		for _, t := range route.Types {
+			names = append(names, t.String())
+		}
+		rules = append(rules, strings.Join(names, ",")+"="+route.File)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (f routeFlag) Set(s string) error {
+	types, file, ok := strings.Cut(s, "=")
+	if !ok || types == "" || file == "" {
+		return fmt.Errorf("invalid route %q, expected types=file, as in command,script=dynamic.txt", s)
+	}
+	route := outputRoute{File: file}
+	for _, name := range strings.Split(types, ",") {
+		t, ok := operationTypeNamed(strings.TrimSpace(name))
+		if !ok {
+			return fmt.Errorf("invalid route %q: unknown section type %q", s, name)
+		}
+		route.Types = append(route.Types, t)
+	}
+	*f.routes = append(*f.routes, route)
+	return nil
+}
+
+// operationTypeNamed is the operation type whose String is name.
+func operationTypeNamed(name string) (OperationType, bool) {
+	for t := FileOp; t.String() != "unknown"; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func validateRoutes(opts Options) error {
+	if len(opts.Routes) == 0 {
+		return nil
+	}
+	if opts.OutputDir != "" {
+		return fmt.Errorf("-route cannot be used with -o-dir")
+	}
+	if isBundlePath(opts.OutputFile) {
+		return fmt.Errorf("-route cannot be used with a -o bundle")
+	}
+	routed := make(map[OperationType]string)
+	for _, route := range opts.Routes {
+		if opts.OutputFile != "" && routePath(route.File) == routePath(opts.OutputFile) {
+			return fmt.Errorf("-route file %s is also the -o output", route.File)
+		}
+		if format := resolveFormat(opts.Format, route.File); opts.Checksum && (format == "json" || format == "records") {
+			return fmt.Errorf("-checksum cannot be used with -route file %s, which is %s output", route.File, format)
+		}
+		for _, t := range route.Types {
+			if file, ok := routed[t]; ok {
+				return fmt.Errorf("%s sections are routed to both %s and %s", t, file, route.File)
+			}
+			routed[t] = route.File
+		}
+	}
+	return nil
+}
+
+// routeSections splits sections by the file their type is routed to; the
+// sections of unrouted types are under "". A nested prompt is routed whole
+// only if prompt is a routed type. Otherwise its sections are routed one
+// by one, and it appears in each output that receives some of them,
+// holding only those.
+func routeSections(sections []ContentSection, routes map[OperationType]string, delimiterStyle string) map[string][]ContentSection {
+	routed := make(map[string][]ContentSection)
+	for _, section := range sections {
+		file, ok := routes[section.Type]
+		if section.Type == PromptOp && !ok && len(section.Children) > 0 {
+			for file, children := range routeSections(section.Children, routes, delimiterStyle) {
+				nested := section
+				nested.Children = children
+				nested.Content = renderNestedContent(section.Source, children, delimiterStyle)
+				routed[file] = append(routed[file], nested)
+			}
+			continue
+		}
+		routed[file] = append(routed[file], section)
+	}
+	return routed
+}
+
+// routePath is the form -route and -o files are compared in, so that
+// out.txt and ./out.txt are the same file.
+func routePath(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+	return filepath.Clean(file)
+}
+
+// routeOutput is a rendered -route file, waiting to be written.
+type routeOutput struct {
+	File string
+	Data []byte
+}
+
+// renderRoutes renders each -route file, in the format of its extension
+// unless -format is given and compressed if its name ends in .gz or .zst,
+// and returns the content left for the main
+// output. A route that no section took is still rendered, empty, so a
+// stale file from an earlier compile does not linger.
+func renderRoutes(content CompiledContent, opts Options) ([]routeOutput, CompiledContent, error) {
+	targets := make(map[OperationType]string)
+	for _, route := range opts.Routes {
+		for _, t := range route.Types {
+			targets[t] = routePath(route.File)
+		}
+	}
+	routed := routeSections(content.Sections, targets, opts.DelimiterStyle)
+
+	var outputs []routeOutput
+	rendered := make(map[string]bool)
+	for _, route := range opts.Routes {
+		file := routePath(route.File)
+		if rendered[file] {
+			continue
+		}
+		rendered[file] = true
+		routeContent := content
+		routeContent.Sections = routed[file]
+		output, err := renderOutput(routeContent, resolveFormat(opts.Format, route.File), opts.DelimiterStyle, opts.sectionSeparator())
+		if err != nil {
+			return nil, CompiledContent{}, err
+		}
+		output = normalizeUnicode(output, opts.Normalize)
+		if opts.Checksum {
+			output = appendChecksum(output, len(routeContent.Sections))
+		}
+		// -compress is for -o, so a route is compressed only by its name
+		data, err := compressOutput([]byte(output), resolveCompression("", route.File))
+		if err != nil {
+			return nil, CompiledContent{}, err
+		}
+		outputs = append(outputs, routeOutput{File: route.File, Data: data})
+	}
+
+	content.Sections = routed[""]
+	return outputs, content, nil
+}
+
+// writeRoutes writes the rendered -route files.
+func writeRoutes(outputs []routeOutput, opts Options) error {
+	for _, route := range outputs {
+		if err := writeOutputFile(route.File, route.Data, opts.OutputMode); err != nil {
+			return fmt.Errorf("failed to write output file %s: %w", route.File, err)
+		}
+	}
+	return nil
+}
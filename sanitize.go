@@ -0,0 +1,28 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ansiPattern matches terminal escape sequences: CSI sequences such as
+// colours and cursor movement, OSC sequences such as window titles and
+// hyperlinks, and two-character escapes.
+var ansiPattern = regexp.MustCompile("\x1b(?:\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|[@-Z\\\\-_])")
+
+// stripControlChars removes terminal escape sequences and non-printable
+// control characters other than newline and tab. CRLF line endings become
+// LF.
+func stripControlChars(s string) string {
+	s = ansiPattern.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r <= 0x9f) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultTerminalWidth is the width of the terminal a pty script runs in.
+const defaultTerminalWidth = 120
+
+// ScriptSpec runs a command as if in a terminal session. With Pty set it
+// runs under a pseudo-terminal, so tools that check for a terminal show
+// their progress bars, colours and prompts as they would to a person.
+type ScriptSpec struct {
+	Command string `yaml:"command"`
+	Pty     bool   `yaml:"pty,omitempty"`
+	Width   int    `yaml:"width,omitempty"`
+}
+
+func (s ScriptSpec) width() int {
+	if s.Width == 0 {
+		return defaultTerminalWidth
+	}
+	return s.Width
+}
+
+func validateScript(spec ScriptSpec) error {
+	if spec.Command == "" {
+		return fmt.Errorf("script needs a command")
+	}
+	if spec.Width < 0 {
+		return fmt.Errorf("script width must not be negative")
+	}
+	if spec.Width != 0 && !spec.Pty {
+		return fmt.Errorf("script width applies only with pty: true")
+	}
+	return nil
+}
+
+// scriptCommand builds the command running a shell command under a
+// pseudo-terminal, using script(1), whose flags differ between util-linux
+// and the BSDs.
+func scriptCommand(command string, width int) (*exec.Cmd, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("pty scripts are not supported on Windows")
+	}
+	if _, err := exec.LookPath("script"); err != nil {
+		return nil, fmt.Errorf("pty scripts need the script utility: %w", err)
+	}
+	command = fmt.Sprintf("stty cols %d 2>/dev/null; %s", width, command)
+	if runtime.GOOS == "linux" {
+		return exec.Command("script", "-qefc", command, "/dev/null"), nil
+	}
+	return exec.Command("script", "-q", "/dev/null", "sh", "-c", command), nil
+}
+
+// processScriptOperation runs the script and renders its output the way a
+// terminal would have shown it. Unlike a command, a script fails on any
+// exit status other than zero unless ok_exit_codes lists it.
+func processScriptOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec, command, dir := *p.Op.Script, p.Value, ctx.workDir
+	if name, missing := missingExecutable(command, dir); missing {
+		return ContentSection{}, ErrCommandFailed{Command: command, Err: ErrExecutableNotFound{Name: name}}
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	env := commandEnv()
+	if spec.Pty {
+		var err error
+		if cmd, err = scriptCommand(command, spec.width()); err != nil {
+			return ContentSection{}, ErrCommandFailed{Command: command, Err: err}
+		}
+		env = append(env, "TERM=xterm-256color", "COLUMNS="+strconv.Itoa(spec.width()))
+	}
+	// Input stays detached, so script(1) never takes over pcp's terminal
+	// and prompts see end of input instead of waiting
+	cmd.Dir = dir
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+
+	exitCode := 0
+	if err != nil {
+		okCodes := p.Op.OkExitCodes
+		if okCodes == nil {
+			okCodes = []int{}
+		}
+		if cmd.ProcessState == nil || !exitCodeAllowed(cmd.ProcessState.ExitCode(), okCodes) {
+			return ContentSection{}, ErrCommandFailed{Command: command, Err: err}
+		}
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	return ContentSection{
+		Source:   command,
+		Content:  normalizeContent(renderTerminal(strings.ToValidUTF8(string(output), "\uFFFD"))),
+		Type:     ScriptOp,
+		ExitCode: exitCode,
+	}, nil
+}
+
+// csiPattern matches a CSI escape sequence, capturing its parameters and
+// final byte.
+var csiPattern = regexp.MustCompile(`^\x1b\[([0-?]*)[ -/]*([@-~])`)
+
+// renderTerminal replays terminal output onto lines the way a terminal
+// displays it: carriage returns and backspaces move the cursor so that
+// progress bars leave only their final state, erase-line sequences clear,
+// and every other escape sequence and control character is dropped.
+func renderTerminal(output string) string {
+	var lines []string
+	var line []rune
+	col := 0
+	write := func(r rune) {
+		if col < len(line) {
+			line[col] = r
+		} else {
+			for len(line) < col {
+				line = append(line, ' ')
+			}
+			line = append(line, r)
+		}
+		col++
+	}
+
+	for i := 0; i < len(output); {
+		if output[i] == '\x1b' {
+			if m := csiPattern.FindStringSubmatch(output[i:]); m != nil {
+				n, _ := strconv.Atoi(strings.SplitN(m[1], ";", 2)[0])
+				switch m[2] {
+				case "K":
+					switch n {
+					case 0:
+						line = line[:min(col, len(line))]
+					case 1:
+						for j := 0; j < min(col, len(line)); j++ {
+							line[j] = ' '
+						}
+					case 2:
+						line = line[:0]
+					}
+				case "G":
+					col = max(n-1, 0)
+				case "C":
+					col += max(n, 1)
+				case "D":
+					col = max(col-max(n, 1), 0)
+				}
+				i += len(m[0])
+				continue
+			}
+			if loc := ansiPattern.FindStringIndex(output[i:]); loc != nil && loc[0] == 0 {
+				i += loc[1]
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(output[i:])
+		i += size
+		switch {
+		case r == '\n':
+			lines = append(lines, strings.TrimRight(string(line), " "))
+			line, col = line[:0], 0
+		case r == '\r':
+			col = 0
+		case r == '\b':
+			col = max(col-1, 0)
+		case r == '\t':
+			write(r)
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r <= 0x9f):
+		default:
+			write(r)
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, strings.TrimRight(string(line), " "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:7777", "Address to listen on")
+	dir := fs.String("dir", ".", "Directory of prompt files to serve")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: pcp serve [-addr <host:port>] [-dir <directory>]
+
+Serves freshly compiled prompt files over HTTP so other pcp instances can
+include them with pcp_remote. GET /compiled/<name> compiles <name>.yml (or
+<name>.yaml) under -dir on every request. The format and target query
+parameters select the output format and target:
+
+  curl http://localhost:7777/compiled/arch?format=markdown
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(*dir)
+	if err != nil {
+		return fmt.Errorf("invalid -dir %s: %w", *dir, err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("-dir %s is not a directory", *dir)
+	}
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           serveHandler(root, newSourceCache()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "pcp serve listening on http://%s/compiled/\n", *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve on %s: %w", *addr, err)
+	}
+	return nil
+}
+
+// serveHandler compiles prompt files under root on request, sharing a warm
+// cache between requests like the daemon does.
+func serveHandler(root string, cache *sourceCache) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /compiled/", func(w http.ResponseWriter, r *http.Request) {
+		// Cleaning against "/" keeps the name inside root
+		name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/compiled/")), "/")
+		promptFile := servedPromptFile(root, name)
+		if promptFile == "" {
+			http.Error(w, fmt.Sprintf("no prompt file named %s", name), http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		output, err := compileDaemonRequest(daemonRequest{
+			PromptFile: promptFile,
+			Dir:        root,
+			Format:     query.Get("format"),
+			Target:     query.Get("target"),
+		}, cache)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, output)
+	})
+	return mux
+}
+
+// servedPromptFile finds the prompt file a served name refers to, or "".
+func servedPromptFile(root, name string) string {
+	if name == "" {
+		return ""
+	}
+	for _, ext := range []string{".yml", ".yaml"} {
+		candidate := filepath.Join(root, filepath.FromSlash(name)+ext)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultTraceContext is how many lines around each implicated line a
+// stacktrace operation shows.
+const defaultTraceContext = 10
+
+// StacktraceSpec includes the source around the lines a stack trace
+// points at. Dir is the source tree the trace's files are looked up in.
+type StacktraceSpec struct {
+	File    string `yaml:"file"`
+	Dir     string `yaml:"dir,omitempty"`
+	Context int    `yaml:"context,omitempty"`
+}
+
+func (s StacktraceSpec) context() int {
+	if s.Context == 0 {
+		return defaultTraceContext
+	}
+	return s.Context
+}
+
+func validateStacktrace(spec StacktraceSpec) error {
+	if spec.File == "" {
+		return fmt.Errorf("stacktrace needs a file")
+	}
+	if spec.Context < 0 {
+		return fmt.Errorf("stacktrace context must not be negative")
+	}
+	return nil
+}
+
+var (
+	// Go panics and test failures: "\t/src/app/main.go:42 +0x1d", "main_test.go:12:"
+	goFramePattern = regexp.MustCompile(`([^\s:"'()]+\.go):(\d+)`)
+	// Python: `  File "/src/app/main.py", line 42, in handler`
+	pythonFramePattern = regexp.MustCompile(`File "([^"<>]+\.py)", line (\d+)`)
+	// Java and Kotlin: "\tat com.example.Server.handle(Server.java:42)"
+	javaFramePattern = regexp.MustCompile(`at (?:[\w.]+/)?([\w.$]+)\.[\w$<>]+\(([\w$]+\.(?:java|kt)):(\d+)\)`)
+)
+
+// traceFrame is a source location named in a stack trace. For Java frames
+// file is the package path the class's source should be found at.
+type traceFrame struct {
+	file string
+	line int
+	java bool
+}
+
+// parseStackTrace returns the frames of Go, Python and Java stack traces in
+// the text, in order.
+func parseStackTrace(text string) []traceFrame {
+	var frames []traceFrame
+	for _, line := range strings.Split(text, "\n") {
+		if m := pythonFramePattern.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			frames = append(frames, traceFrame{file: m[1], line: n})
+			continue
+		}
+		if m := javaFramePattern.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[3])
+			pkg := ""
+			if i := strings.LastIndex(m[1], "."); i >= 0 {
+				pkg = strings.ReplaceAll(m[1][:i], ".", "/") + "/"
+			}
+			frames = append(frames, traceFrame{file: pkg + m[2], line: n, java: true})
+			continue
+		}
+		for _, m := range goFramePattern.FindAllStringSubmatch(line, -1) {
+			n, _ := strconv.Atoi(m[2])
+			frames = append(frames, traceFrame{file: m[1], line: n})
+		}
+	}
+	return frames
+}
+
+// resolveTraceFile finds a trace's file in the source tree at root. Traces
+// often come from another machine, so leading directories are dropped
+// until the rest of the path exists under root. Files outside root, such
+// as the standard library, are not found.
+func resolveTraceFile(root string, frame traceFrame, javaSources map[string][]string) (string, bool) {
+	if frame.java {
+		candidates := javaSources[filepath.Base(frame.file)]
+		for _, candidate := range candidates {
+			if strings.HasSuffix(filepath.ToSlash(candidate), "/"+frame.file) {
+				return candidate, true
+			}
+		}
+		if len(candidates) == 1 {
+			return candidates[0], true
+		}
+		return "", false
+	}
+
+	path := filepath.ToSlash(frame.file)
+	if filepath.IsAbs(frame.file) {
+		if rel, err := filepath.Rel(root, frame.file); err == nil && !strings.HasPrefix(rel, "..") {
+			return frame.file, fileExists(frame.file)
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := range parts {
+		candidate := filepath.Join(root, filepath.FromSlash(strings.Join(parts[i:], "/")))
+		if fileExists(candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// javaSourceFiles indexes the .java and .kt files below root by name,
+// skipping hidden and dependency directories.
+func javaSourceFiles(root string) map[string][]string {
+	sources := make(map[string][]string)
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if path != root && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == "node_modules" || entry.Name() == "build" || entry.Name() == "target") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext == ".java" || ext == ".kt" {
+			sources[entry.Name()] = append(sources[entry.Name()], path)
+		}
+		return nil
+	})
+	return sources
+}
+
+// processStacktraceOperation reads the trace when the operation runs, so a
+// command earlier in the prompt can produce it, and shows each implicated
+// file once, in the order the trace first names it, with the implicated
+// lines marked.
+func processStacktraceOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	spec := *p.Op.Stacktrace
+	data, err := ctx.ReadFile(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+	promptDir, _ := filepath.Abs(filepath.Dir(p.File))
+	root := resolvePath(promptDir, spec.Dir)
+
+	frames := parseStackTrace(string(data))
+	var javaSources map[string][]string
+	var files []string
+	lines := make(map[string][]int)
+	for _, frame := range frames {
+		if frame.java && javaSources == nil {
+			javaSources = javaSourceFiles(root)
+		}
+		path, ok := resolveTraceFile(root, frame, javaSources)
+		if !ok {
+			continue
+		}
+		if _, seen := lines[path]; !seen {
+			files = append(files, path)
+		}
+		lines[path] = append(lines[path], frame.line)
+	}
+	if len(files) == 0 {
+		ctx.Warn("stack trace %s names no files under %s", displayPath(p.Value), displayPath(root))
+	}
+
+	var blocks []string
+	for _, path := range files {
+		ctx.AddDependency(path)
+		content, err := ctx.ReadFile(path)
+		if err != nil {
+			return ContentSection{}, fmt.Errorf("failed to read file %s: %w", path, err)
+		}
+		name := path
+		if rel, err := filepath.Rel(root, path); err == nil {
+			name = rel
+		}
+		blocks = append(blocks, traceExcerpt(displayPath(name), string(content), lines[path], spec.context()))
+	}
+
+	return ContentSection{
+		Source:  displayPath(p.Value),
+		Content: normalizeContent(strings.Join(blocks, "\n\n")),
+		Type:    StacktraceOp,
+	}, nil
+}
+
+// traceExcerpt renders the lines around each implicated line of a file,
+// merging windows that overlap, with implicated lines marked by ">".
+func traceExcerpt(name, content string, implicated []int, context int) string {
+	sourceLines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	marked := make(map[int]bool)
+	for _, n := range implicated {
+		marked[n] = true
+	}
+	sort.Ints(implicated)
+
+	type window struct{ start, end int }
+	var windows []window
+	for _, n := range implicated {
+		if n < 1 || n > len(sourceLines) {
+			continue
+		}
+		start, end := max(n-context, 1), min(n+context, len(sourceLines))
+		if len(windows) > 0 && start <= windows[len(windows)-1].end+1 {
+			windows[len(windows)-1].end = max(windows[len(windows)-1].end, end)
+			continue
+		}
+		windows = append(windows, window{start, end})
+	}
+
+	var result strings.Builder
+	width := len(strconv.Itoa(len(sourceLines)))
+	for i, w := range windows {
+		if i > 0 {
+			result.WriteString("...\n")
+		}
+		fmt.Fprintf(&result, "// %s (lines %d-%d)\n", name, w.start, w.end)
+		for n := w.start; n <= w.end; n++ {
+			marker := " "
+			if marked[n] {
+				marker = ">"
+			}
+			fmt.Fprintf(&result, "%s %*d | %s\n", marker, width, n, sourceLines[n-1])
+		}
+	}
+	if len(windows) == 0 {
+		fmt.Fprintf(&result, "// %s (lines %v are past the end of the file)\n", name, implicated)
+	}
+	return strings.TrimRight(result.String(), "\n")
+}
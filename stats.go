@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// describeOperation renders an operation as "type: value" for reports,
+// shortening long values to their first line.
+func describeOperation(op Operation) string {
+	opType, err := op.GetType()
+	if err != nil {
+		return "invalid operation"
+	}
+
+	value, _, _ := strings.Cut(op.GetValue(), "\n")
+	if len(value) > 60 {
+		value = value[:57] + "..."
+	}
+	return fmt.Sprintf("%s: %s", opType, value)
+}
+
+func printStats(w io.Writer, stats CompileStats) {
+	fmt.Fprintf(w, "pcp stats:\n")
+	fmt.Fprintf(w, "  sections: %d\n", stats.Sections)
+	fmt.Fprintf(w, "  words: %d\n", stats.Words)
+	if stats.OutputWords > 0 {
+		budgeted := "content words"
+		if stats.ExactBudget {
+			budgeted = "output words (-exact-budget)"
+		}
+		fmt.Fprintf(w, "  content words: %d\n", stats.ContentWords)
+		fmt.Fprintf(w, "  output words: %d (headers and separators add %d)\n", stats.OutputWords, stats.OutputWords-stats.ContentWords)
+		fmt.Fprintf(w, "  budgeted on: %s\n", budgeted)
+	}
+	if stats.TruncatedWords > 0 {
+		fmt.Fprintf(w, "  truncated words: %d\n", stats.TruncatedWords)
+	}
+	if stats.TruncatedBytes > 0 {
+		fmt.Fprintf(w, "  truncated bytes: %d\n", stats.TruncatedBytes)
+	}
+	if stats.MergedSections > 0 {
+		fmt.Fprintf(w, "  merged sections: %d\n", stats.MergedSections)
+	}
+	if len(stats.Warnings) > 0 {
+		fmt.Fprintf(w, "  warnings: %d\n", len(stats.Warnings))
+	}
+	if len(stats.EmptySections) > 0 {
+		fmt.Fprintf(w, "  empty sections: %d\n", len(stats.EmptySections))
+		for _, source := range stats.EmptySections {
+			fmt.Fprintf(w, "    %s\n", source)
+		}
+	}
+	if len(stats.Failures) > 0 {
+		fmt.Fprintf(w, "  failed operations: %d\n", len(stats.Failures))
+		for _, failure := range stats.Failures {
+			fmt.Fprintf(w, "    %s (%s)\n", operationLocation(failure.File, failure.Line, failure.Index), failure.Description)
+		}
+	}
+	if len(stats.Reviewed) > 0 {
+		fmt.Fprintf(w, "  removed in review: %d\n", len(stats.Reviewed))
+		for _, source := range stats.Reviewed {
+			fmt.Fprintf(w, "    %s\n", source)
+		}
+	}
+	fmt.Fprintf(w, "  skipped operations: %d\n", len(stats.Skipped))
+	for _, skipped := range stats.Skipped {
+		fmt.Fprintf(w, "    %s operation %d (%s)\n", skipped.File, skipped.Index, skipped.Description)
+	}
+	if len(stats.Duplicates) > 0 {
+		fmt.Fprintf(w, "  duplicate sections: %d\n", len(stats.Duplicates))
+		for _, duplicate := range stats.Duplicates {
+			fmt.Fprintf(w, "    %s\n", describeDuplicate(duplicate))
+		}
+	}
+}
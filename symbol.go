@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SymbolSpec selects one declaration from a source file: a function, a
+// method (as Type.Method, or just Method when only one type has it) or a
+// type.
+type SymbolSpec struct {
+	File string `yaml:"file"`
+	Name string `yaml:"name"`
+}
+
+// String renders the symbol as "file#name", the operation's value.
+func (s SymbolSpec) String() string {
+	return s.File + "#" + s.Name
+}
+
+func validateSymbol(spec SymbolSpec) error {
+	if spec.File == "" || spec.Name == "" {
+		return fmt.Errorf("symbol needs both file and name")
+	}
+	return nil
+}
+
+// splitSymbol splits a symbol operation's expanded value back into its
+// file and name.
+func splitSymbol(value string) (file, name string) {
+	i := strings.LastIndex(value, "#")
+	return value[:i], value[i+1:]
+}
+
+func processSymbolOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	file, name := splitSymbol(p.Value)
+	content, err := ctx.ReadFile(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+	if strings.ToLower(filepath.Ext(p.Path)) != ".go" {
+		return ContentSection{}, fmt.Errorf("symbol extraction supports Go files only, not %s", displayPath(file))
+	}
+
+	decls, err := parseGoDecls(p.Path, content)
+	if err != nil {
+		return ContentSection{}, err
+	}
+	decl, err := findGoDecl(decls, name, p.Path)
+	if err != nil {
+		return ContentSection{}, err
+	}
+
+	return ContentSection{
+		Source:  displayPath(file) + "#" + name,
+		Content: normalizeContent(decl.code),
+		Type:    SymbolOp,
+	}, nil
+}
+
+// goDecl is a top-level Go function, method or type.
+type goDecl struct {
+	// name is the function or type name, or Type.Method for methods.
+	name   string
+	method string
+	isFunc bool
+	file   string
+	offset int
+
+	// line and endLine are where the declaration, without its doc comment,
+	// starts and ends.
+	line, endLine int
+
+	// code is the declaration's source with its doc comment.
+	code string
+
+	// calls lists the in-package names the body may call: functions by
+	// name, methods as Type.Method when the receiver's type is known and
+	// as .Method otherwise.
+	calls []string
+}
+
+// parseGoDecls returns the top-level declarations of a Go source file.
+func parseGoDecls(filePath string, content []byte) ([]goDecl, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, content, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	imports := make(map[string]bool)
+	for _, spec := range file.Imports {
+		name := strings.Trim(spec.Path.Value, `"`)
+		name = name[strings.LastIndex(name, "/")+1:]
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = true
+	}
+
+	var decls []goDecl
+	add := func(decl goDecl, doc *ast.CommentGroup, start, end token.Pos) {
+		decl.line, decl.endLine = fset.Position(start).Line, fset.Position(end).Line
+		if doc != nil {
+			start = doc.Pos()
+		}
+		decl.file = filePath
+		decl.offset = fset.Position(start).Offset
+		decl.code = string(content[decl.offset:fset.Position(end).Offset])
+		decls = append(decls, decl)
+	}
+	for _, d := range file.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			decl := goDecl{name: d.Name.Name, isFunc: true}
+			receivers := make(map[string]string)
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				field := d.Recv.List[0]
+				receiver := receiverTypeName(field.Type)
+				decl.name, decl.method = receiver+"."+d.Name.Name, d.Name.Name
+				for _, name := range field.Names {
+					receivers[name.Name] = receiver
+				}
+			}
+			if d.Body != nil {
+				decl.calls = goCalls(d.Body, receivers, imports)
+			}
+			add(decl, d.Doc, d.Pos(), d.End())
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				spec := spec.(*ast.TypeSpec)
+				// A lone type keeps its "type" keyword and the declaration's
+				// doc comment
+				if len(d.Specs) == 1 {
+					add(goDecl{name: spec.Name.Name}, d.Doc, d.Pos(), d.End())
+				} else {
+					add(goDecl{name: spec.Name.Name}, spec.Doc, spec.Pos(), spec.End())
+				}
+			}
+		}
+	}
+	return decls, nil
+}
+
+// goCalls finds the calls in a function body. Without type information a
+// method call on anything but the receiver could be any type's method.
+func goCalls(body *ast.BlockStmt, receivers map[string]string, imports map[string]bool) []string {
+	seen := make(map[string]bool)
+	var calls []string
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		name := ""
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			name = fun.Name
+		case *ast.SelectorExpr:
+			if x, ok := fun.X.(*ast.Ident); ok {
+				if receiver, ok := receivers[x.Name]; ok {
+					name = receiver + "." + fun.Sel.Name
+					break
+				}
+				if imports[x.Name] {
+					break
+				}
+			}
+			name = "." + fun.Sel.Name
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			calls = append(calls, name)
+		}
+		return true
+	})
+	return calls
+}
+
+// findGoDecl looks a symbol name up: a function or type name, Type.Method,
+// or a bare method name when only one type has that method.
+func findGoDecl(decls []goDecl, name, where string) (goDecl, error) {
+	var matches []goDecl
+	for _, decl := range decls {
+		if decl.name == name || !strings.Contains(name, ".") && decl.method == name {
+			matches = append(matches, decl)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return goDecl{}, fmt.Errorf("symbol %s not found in %s", name, where)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m.name
+	}
+	sort.Strings(names)
+	return goDecl{}, fmt.Errorf("symbol %s is ambiguous in %s: %s", name, where, strings.Join(names, ", "))
+}
+
+// receiverTypeName returns the type name of a method receiver, without
+// pointer or type parameters.
+func receiverTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// processSysinfoOperation describes the machine and repository the compile
+// runs in. Facts that cannot be determined, such as the git branch outside a
+// repository, are left out rather than reported as errors.
+func processSysinfoOperation(ctx *ProcessingContext) (ContentSection, error) {
+	dir := ctx.workDir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	var info strings.Builder
+	fmt.Fprintf(&info, "os: %s\n", runtime.GOOS)
+	fmt.Fprintf(&info, "arch: %s\n", runtime.GOARCH)
+	if version := toolOutput(dir, "go", "env", "GOVERSION"); version != "" {
+		fmt.Fprintf(&info, "go: %s\n", version)
+	}
+	fmt.Fprintf(&info, "cpus: %d\n", runtime.NumCPU())
+	fmt.Fprintf(&info, "cwd: %s\n", displayPath(dir))
+	if branch := toolOutput(dir, "git", "rev-parse", "--abbrev-ref", "HEAD"); branch != "" {
+		fmt.Fprintf(&info, "git branch: %s\n", branch)
+	}
+	if sha := toolOutput(dir, "git", "rev-parse", "HEAD"); sha != "" {
+		fmt.Fprintf(&info, "git commit: %s\n", sha)
+	}
+
+	return ContentSection{
+		Source:  "sysinfo",
+		Content: normalizeContent(info.String()),
+		Type:    SysinfoOp,
+	}, nil
+}
+
+// toolOutput runs a program and returns its trimmed stdout, or "" if the
+// program is missing or fails.
+func toolOutput(dir, name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = commandEnv()
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
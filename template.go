@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateData is what text operations with template: true can reference.
+// It describes the compile as a whole, without the template sections
+// themselves, so a prompt can frame what the agent has been given.
+type templateData struct {
+	WordsUsed      int
+	WordsRemaining int
+	MaxWords       int
+	SectionCount   int
+	FileCount      int
+	CommandCount   int
+	Files          []string
+	Vars           map[string]string
+}
+
+// parseTextTemplate parses a text template. include may be nil when the
+// template is only being validated.
+func parseTextTemplate(text string, include func(string) (string, error)) (*template.Template, error) {
+	return template.New("text").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"include": include}).
+		Parse(text)
+}
+
+// includeFile returns the include function for a template in dir. The file
+// is embedded inline, so its trailing newlines are dropped. A confined
+// template may only include files inside dir.
+func includeFile(dir string, confined bool, ctx *ProcessingContext) func(string) (string, error) {
+	return func(path string) (string, error) {
+		resolvedPath := resolvePath(dir, path)
+		if rel, err := filepath.Rel(dir, resolvedPath); confined && (err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return "", fmt.Errorf("a remote prompt's template cannot include %s from this machine; sign the prompt and pass -verify-key, or pass -allow-remote-commands", displayPath(path))
+		}
+		ctx.AddDependency(resolvedPath)
+		if _, err := os.Stat(resolvedPath); os.IsNotExist(err) {
+			return "", ErrFileNotFound{File: resolvedPath}
+		}
+		if isBinaryFile(resolvedPath) {
+			return "", ErrBinaryFile{File: resolvedPath}
+		}
+		content, err := ctx.ReadFile(resolvedPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %s: %w", resolvedPath, err)
+		}
+		text := string(content)
+		if !ctx.keepControlChars {
+			text = stripControlChars(text)
+		}
+		return strings.TrimRight(text, "\r\n"), nil
+	}
+}
+
+// validateTemplate checks template: true and the template's syntax.
+func validateTemplate(op Operation, opType OperationType) error {
+	if !op.Template {
+		return nil
+	}
+	if opType != TextOp {
+		return fmt.Errorf("template applies only to text operations")
+	}
+	if _, err := parseTextTemplate(*op.Text, nil); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	return nil
+}
+
+// renderTemplates runs the templates of text sections once every other
+// section is known, charging their rendered words against the budget.
+// Nested prompt sections containing templates are re-rendered.
+func renderTemplates(sections []ContentSection, ctx *ProcessingContext) ([]ContentSection, error) {
+	if !hasTemplates(sections) {
+		return sections, nil
+	}
+
+	data := templateData{MaxWords: ctx.maxWords, Vars: ctx.vars}
+	for _, section := range leafSections(sections) {
+		if section.template {
+			continue
+		}
+		data.SectionCount++
+		data.WordsUsed += sectionWords(section)
+		switch section.Type {
+		case FileOp:
+			data.FileCount++
+			data.Files = append(data.Files, section.Source)
+		case CommandOp, ScriptOp:
+			data.CommandCount++
+		}
+	}
+	data.WordsRemaining = max(ctx.maxWords-data.WordsUsed, 0)
+
+	return renderTemplateSections(sections, data, ctx)
+}
+
+func renderTemplateSections(sections []ContentSection, data templateData, ctx *ProcessingContext) ([]ContentSection, error) {
+	result := make([]ContentSection, len(sections))
+	for i, section := range sections {
+		switch {
+		case section.Type == PromptOp && hasTemplates(section.Children):
+			children, err := renderTemplateSections(section.Children, data, ctx)
+			if err != nil {
+				return nil, err
+			}
+			section.Children = children
+			section.Content = renderNestedContent(section.Source, children, ctx.delimiterStyle)
+		case section.template:
+			tmpl, err := parseTextTemplate(section.Content, includeFile(section.templateDir, section.templateConfined, ctx))
+			if err != nil {
+				return nil, fmt.Errorf("invalid template: %w", err)
+			}
+			var rendered strings.Builder
+			if err := tmpl.Execute(&rendered, data); err != nil {
+				return nil, fmt.Errorf("failed to render template: %w", err)
+			}
+			section.Content = normalizeContent(rendered.String())
+			section.template, section.templateDir, section.templateConfined = false, "", false
+			if err := ctx.AddWords(sectionWords(section)); err != nil {
+				return nil, err
+			}
+		}
+		result[i] = section
+	}
+	return result, nil
+}
+
+func hasTemplates(sections []ContentSection) bool {
+	for _, section := range sections {
+		if section.template || (section.Type == PromptOp && hasTemplates(section.Children)) {
+			return true
+		}
+	}
+	return false
+}
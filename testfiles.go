@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// testFileNames returns the conventional test files of a source file, as
+// paths relative to its directory, for with_tests.
+func testFileNames(path string) []string {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	switch ext {
+	case ".go":
+		if strings.HasSuffix(stem, "_test") {
+			return nil
+		}
+		return []string{stem + "_test.go"}
+	case ".py":
+		if strings.HasPrefix(stem, "test_") || strings.HasSuffix(stem, "_test") {
+			return nil
+		}
+		return []string{"test_" + base, stem + "_test.py", filepath.Join("tests", "test_"+base)}
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs":
+		if strings.HasSuffix(stem, ".test") || strings.HasSuffix(stem, ".spec") {
+			return nil
+		}
+		return []string{stem + ".test" + ext, stem + ".spec" + ext}
+	case ".rb":
+		if strings.HasSuffix(stem, "_spec") || strings.HasSuffix(stem, "_test") {
+			return nil
+		}
+		return []string{stem + "_spec.rb", stem + "_test.rb"}
+	case ".java", ".kt":
+		if strings.HasSuffix(stem, "Test") {
+			return nil
+		}
+		return []string{stem + "Test" + ext}
+	}
+	return nil
+}
+
+// planTestFiles returns file operations for the test files of a planned
+// file operation that exist. They inherit its caps, weight and targets but
+// not its filters or label, which describe the source file.
+func planTestFiles(p PlannedOperation, ctx *ProcessingContext) []PlannedOperation {
+	var planned []PlannedOperation
+	for _, name := range testFileNames(p.Path) {
+		path := filepath.Join(filepath.Dir(p.Path), name)
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		value := filepath.Join(filepath.Dir(p.Value), name)
+		op := Operation{
+			File:      &value,
+			Line:      p.Op.Line,
+			MaxWords:  p.Op.MaxWords,
+			MaxTokens: p.Op.MaxTokens,
+			Weight:    p.Op.Weight,
+			Binary:    p.Op.Binary,
+			Targets:   p.Op.Targets,
+		}
+		ctx.AddDependency(path)
+		planned = append(planned, PlannedOperation{Op: op, Type: FileOp, File: p.File, Index: p.Index, Value: value, Path: path})
+	}
+	return planned
+}
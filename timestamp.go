@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultTimestampFormat is used when a timestamp operation sets no format.
+const defaultTimestampFormat = time.RFC3339
+
+// TimestampSpec configures a timestamp operation. Format is a Go reference
+// time layout; UTC reports the time in UTC instead of the local zone.
+type TimestampSpec struct {
+	Format string `yaml:"format,omitempty"`
+	UTC    bool   `yaml:"utc,omitempty"`
+}
+
+// layout returns the format to render with.
+func (s TimestampSpec) layout() string {
+	if s.Format == "" {
+		return defaultTimestampFormat
+	}
+	return s.Format
+}
+
+// compileTime returns the time timestamp operations report. SOURCE_DATE_EPOCH,
+// when set, pins it so builds are reproducible.
+func compileTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now(), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: must be a Unix timestamp in seconds", epoch)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func processTimestampOperation(spec TimestampSpec) (ContentSection, error) {
+	now, err := compileTime()
+	if err != nil {
+		return ContentSection{}, err
+	}
+	if spec.UTC {
+		now = now.UTC()
+	}
+
+	return ContentSection{
+		Source:  "timestamp",
+		Content: normalizeContent(now.Format(spec.layout())),
+		Type:    TimestampOp,
+	}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+func validateExclude(op Operation, opType OperationType) error {
+	if op.Exclude == nil {
+		return nil
+	}
+	if opType != TreeOp {
+		return fmt.Errorf("exclude applies only to tree operations")
+	}
+	for _, pattern := range op.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// treeExcluded reports whether an entry, by its slash-separated path below
+// the tree's root, matches an exclude pattern. Patterns without a slash
+// match the entry's name at any depth, as .gitignore patterns do.
+func treeExcluded(rel string, exclude []string) bool {
+	for _, pattern := range exclude {
+		target := path.Base(rel)
+		if strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+			target = rel
+		}
+		if matched, _ := path.Match(strings.Trim(pattern, "/"), target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// processTreeOperation draws the directory like tree -F: directories end
+// in /, executables in * and symlinks show their target without being
+// followed. Hidden entries are left out, as are ignored ones, and MaxDepth
+// stops the tree that many levels down (1 is the directory's own entries).
+func processTreeOperation(p PlannedOperation, ctx *ProcessingContext) (ContentSection, error) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return ContentSection{}, ErrFileNotFound{File: p.Path}
+	}
+	if !info.IsDir() {
+		return ContentSection{}, fmt.Errorf("%s is not a directory", p.Path)
+	}
+
+	ignore := ctx.ignoreRules(p.Op, p.Path)
+	lines := []string{strings.TrimSuffix(displayPath(p.Value), "/") + "/"}
+	dirs, files := 0, 0
+	var walk func(dir, rel, indent string, depth int) error
+	walk = func(dir, rel, indent string, depth int) error {
+		ctx.AddDependency(dir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var shown []os.DirEntry
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") || treeExcluded(path.Join(rel, name), p.Op.Exclude) {
+				continue
+			}
+			if !ignore.Ignored(filepath.Join(dir, name), entry.IsDir()) {
+				shown = append(shown, entry)
+			}
+		}
+		for i, entry := range shown {
+			branch, next := "├── ", "│   "
+			if i == len(shown)-1 {
+				branch, next = "└── ", "    "
+			}
+			full := filepath.Join(dir, entry.Name())
+			name := entry.Name()
+			switch {
+			case entry.Type()&os.ModeSymlink != 0:
+				target, _ := os.Readlink(full)
+				lines = append(lines, indent+branch+name+" -> "+filepath.ToSlash(target))
+				files++
+			case entry.IsDir():
+				lines = append(lines, indent+branch+name+"/")
+				dirs++
+				if p.Op.MaxDepth == 0 || depth < p.Op.MaxDepth {
+					if err := walk(full, path.Join(rel, name), indent+next, depth+1); err != nil {
+						return err
+					}
+				}
+			default:
+				if info, err := entry.Info(); err == nil && info.Mode()&0111 != 0 && runtime.GOOS != "windows" {
+					name += "*"
+				}
+				lines = append(lines, indent+branch+name)
+				files++
+			}
+		}
+		return nil
+	}
+	if err := walk(p.Path, "", "", 1); err != nil {
+		return ContentSection{}, err
+	}
+
+	dirNoun, fileNoun := "directories", "files"
+	if dirs == 1 {
+		dirNoun = "directory"
+	}
+	if files == 1 {
+		fileNoun = "file"
+	}
+	lines = append(lines, "", fmt.Sprintf("%d %s, %d %s", dirs, dirNoun, files, fileNoun))
+	return ContentSection{
+		Source:  displayPath(p.Value),
+		Content: normalizeContent(strings.Join(lines, "\n")),
+		Type:    TreeOp,
+	}, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var validOverflowPolicies = map[string]bool{
+	"error":                 true,
+	"truncate":              true,
+	"truncate-proportional": true,
+	"recency":               true,
+}
+
+// applyOverflow trims sections to fit the word budget according to the
+// overflow policy and returns the kept sections and the number of words
+// removed. The error policy never reaches here: AddWords fails first.
+func applyOverflow(sections []ContentSection, maxWords int, policy, delimiterStyle string) ([]ContentSection, int) {
+	total := 0
+	for _, section := range sections {
+		total += sectionWords(section)
+	}
+	if total <= maxWords {
+		return sections, 0
+	}
+
+	var allowances []int
+	switch policy {
+	case "truncate-proportional":
+		allowances = proportionalAllowances(sections, maxWords, sectionWords)
+	case "recency":
+		allowances = recencyAllowances(sections, maxWords, sectionWords)
+	default:
+		allowances = tailAllowances(sections, maxWords, sectionWords)
+	}
+
+	kept := make([]ContentSection, 0, len(sections))
+	removed := 0
+	for i, section := range sections {
+		if allowances[i] == 0 && sectionWords(section) > 0 {
+			removed += sectionWords(section)
+			continue
+		}
+		trimmed, dropped := truncateSection(section, allowances[i], policy, delimiterStyle)
+		removed += dropped
+		kept = append(kept, trimmed)
+	}
+	return kept, removed
+}
+
+// applyByteOverflow is applyOverflow for a budget of content bytes, for
+// content such as minified code whose word count says little about its size.
+func applyByteOverflow(sections []ContentSection, maxBytes int, policy, delimiterStyle string) ([]ContentSection, int) {
+	if contentBytes(sections) <= maxBytes {
+		return sections, 0
+	}
+
+	var allowances []int
+	switch policy {
+	case "truncate-proportional":
+		allowances = proportionalAllowances(sections, maxBytes, sectionBytes)
+	case "recency":
+		allowances = recencyAllowances(sections, maxBytes, sectionBytes)
+	default:
+		allowances = tailAllowances(sections, maxBytes, sectionBytes)
+	}
+
+	kept := make([]ContentSection, 0, len(sections))
+	removed := 0
+	for i, section := range sections {
+		if allowances[i] == 0 && sectionBytes(section) > 0 {
+			removed += sectionBytes(section)
+			continue
+		}
+		trimmed, dropped := truncateSectionBytes(section, allowances[i], policy, delimiterStyle)
+		removed += dropped
+		kept = append(kept, trimmed)
+	}
+	return kept, removed
+}
+
+// truncateSectionBytes trims a section to at most allowance bytes of
+// content, marker included, cutting on a character boundary.
+func truncateSectionBytes(section ContentSection, allowance int, policy, delimiterStyle string) (ContentSection, int) {
+	size := sectionBytes(section)
+	if size <= allowance {
+		return section, 0
+	}
+
+	if section.Type == PromptOp {
+		children, removed := applyByteOverflow(section.Children, allowance, policy, delimiterStyle)
+		section.Children = children
+		section.Content = renderNestedContent(section.Source, children, delimiterStyle)
+		return section, removed
+	}
+
+	// The marker for all of size bytes is at least as long as the real one,
+	// and normalizeContent adds a trailing newline
+	keep := max(allowance-len(byteTruncationMarker(size))-1, 0)
+	for keep > 0 && !utf8.RuneStart(section.Content[keep]) {
+		keep--
+	}
+	section.Content = normalizeContent(section.Content[:keep] + byteTruncationMarker(size-keep))
+	return section, size - keep
+}
+
+func byteTruncationMarker(removed int) string {
+	return fmt.Sprintf("\n[... truncated %d bytes ...]", removed)
+}
+
+func contentBytes(sections []ContentSection) int {
+	total := 0
+	for _, section := range sections {
+		total += sectionBytes(section)
+	}
+	return total
+}
+
+// tailAllowances keeps sections in order until the budget, measured by
+// size, runs out.
+func tailAllowances(sections []ContentSection, budget int, size func(ContentSection) int) []int {
+	allowances := make([]int, len(sections))
+	for i, section := range sections {
+		words := size(section)
+		if words > budget {
+			words = budget
+		}
+		allowances[i] = words
+		budget -= words
+	}
+	return allowances
+}
+
+// proportionalAllowances splits the budget by weight. Sections smaller than
+// their share keep everything and the surplus is redistributed among the rest.
+func proportionalAllowances(sections []ContentSection, budget int, size func(ContentSection) int) []int {
+	allowances := make([]int, len(sections))
+	pending := make([]int, len(sections))
+	for i := range sections {
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		totalWeight := 0.0
+		for _, i := range pending {
+			totalWeight += sectionWeight(sections[i])
+		}
+
+		var unsatisfied []int
+		spent := 0
+		for _, i := range pending {
+			share := float64(budget) * sectionWeight(sections[i]) / totalWeight
+			if words := size(sections[i]); float64(words) <= share {
+				allowances[i] = words
+				spent += words
+			} else {
+				unsatisfied = append(unsatisfied, i)
+			}
+		}
+
+		if len(unsatisfied) == len(pending) {
+			for _, i := range pending {
+				allowances[i] = int(float64(budget) * sectionWeight(sections[i]) / totalWeight)
+			}
+			break
+		}
+		budget -= spent
+		pending = unsatisfied
+	}
+	return allowances
+}
+
+func sectionWeight(section ContentSection) float64 {
+	if section.Weight <= 0 {
+		return 1
+	}
+	return section.Weight
+}
+
+// truncateSection trims a section to at most allowance words, marker
+// included, distributing the allowance across the children of nested prompt
+// sections with the same policy.
+func truncateSection(section ContentSection, allowance int, policy, delimiterStyle string) (ContentSection, int) {
+	words := sectionWords(section)
+	if words <= allowance {
+		return section, 0
+	}
+
+	if section.Type == PromptOp {
+		children, removed := applyOverflow(section.Children, allowance, policy, delimiterStyle)
+		section.Children = children
+		section.Content = renderNestedContent(section.Source, children, delimiterStyle)
+		return section, removed
+	}
+
+	var keep int
+	section.Content, keep = cutWords(section.Content, allowance, words)
+	return section, words - keep
+}
+
+func truncationMarker(removed int) string {
+	return fmt.Sprintf("\n[... truncated %d words ...]", removed)
+}
+
+// truncationMarkerWords is how many words a truncation marker counts as.
+var truncationMarkerWords = countWords(truncationMarker(0))
+
+// cutWords cuts text of the given number of words to at most allowance
+// words, the truncation marker's included, and returns it with the number
+// of words of text kept. When the marker alone does not fit, text is cut
+// to the allowance unmarked.
+func cutWords(text string, allowance, words int) (string, int) {
+	if allowance < truncationMarkerWords {
+		return normalizeContent(truncateWords(text, allowance)), allowance
+	}
+	keep := allowance - truncationMarkerWords
+	if keep == 0 {
+		return normalizeContent(strings.TrimPrefix(truncationMarker(words), "\n")), 0
+	}
+	return normalizeContent(truncateWords(text, keep) + truncationMarker(words-keep)), keep
+}
+
+// truncateWords returns the prefix of text containing its first n words,
+// preserving the original whitespace between them.
+func truncateWords(text string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	count := 0
+	inWord := false
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if inWord && count == n {
+				return strings.TrimRightFunc(text[:i], unicode.IsSpace)
+			}
+			inWord = false
+			continue
+		}
+		if !inWord {
+			count++
+			inWord = true
+		}
+	}
+	return text
+}
+
+// capSection truncates a section to the operation's word and token caps,
+// truncation marker included, tokens estimated at charsPerToken. Zero caps
+// are ignored.
+func capSection(section ContentSection, maxWords, maxTokens int, charsPerToken float64, delimiterStyle string) ContentSection {
+	words := sectionWords(section)
+	allowance := words
+	if maxWords > 0 && maxWords < allowance {
+		allowance = maxWords
+	}
+	if maxTokens > 0 {
+		if tokenAllowance := wordsWithinTokens(section, maxTokens, charsPerToken); tokenAllowance < allowance {
+			allowance = tokenAllowance
+		}
+	}
+	if allowance >= words {
+		return section
+	}
+
+	section, _ = truncateSection(section, allowance, "truncate", delimiterStyle)
+	return section
+}
+
+// wordsWithinTokens finds the word allowance that keeps a section within
+// an estimated token count once it is cut, marker included.
+func wordsWithinTokens(section ContentSection, maxTokens int, charsPerToken float64) int {
+	text := sectionText(section)
+	words := countWords(text)
+	fits := func(allowance int) bool {
+		if allowance >= words {
+			return estimateTokens(text, charsPerToken) <= maxTokens
+		}
+		cut, _ := cutWords(text, allowance, words)
+		return estimateTokens(cut, charsPerToken) <= maxTokens
+	}
+	// A cut grows with its allowance, except where the marker first fits,
+	// so marked and unmarked cuts are searched apart
+	if allowance := largestFitting(truncationMarkerWords, words, fits); allowance >= 0 {
+		return allowance
+	}
+	return max(largestFitting(0, min(truncationMarkerWords-1, words), fits), 0)
+}
+
+// largestFitting is the largest n from low to high for which fits holds,
+// given that it holds up to some n and not beyond, or -1 if it never does.
+func largestFitting(low, high int, fits func(int) bool) int {
+	if low > high || !fits(low) {
+		return -1
+	}
+	for low < high {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+// sectionText joins a section's own content, leaving out nested headers.
+func sectionText(section ContentSection) string {
+	if section.Type != PromptOp {
+		return section.Content
+	}
+	parts := make([]string, 0, len(section.Children))
+	for _, child := range section.Children {
+		parts = append(parts, sectionText(child))
+	}
+	return strings.Join(parts, "")
+}
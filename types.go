@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type OperationType int
@@ -11,17 +17,209 @@ const (
 	PromptOp
 	CommandOp
 	TextOp
+	RefOp
+	SysinfoOp
+	TimestampOp
+	RemoteOp
+	AssertOp
+	CommentOp
+	SymbolOp
+	RelatedOp
+	CoverageOp
+	StacktraceOp
+	LogOp
+	DiffOp
+	BuildTargetsOp
+	ScriptOp
+	DirOp
+	TreeOp
+	GitOp
 )
 
 type PromptFile struct {
-	Prompt []Operation `yaml:"prompt"`
+	// Version is the prompt file format; unset means 1. See upgradeOperation
+	// for what each version changes.
+	Version int `yaml:"version,omitempty"`
+
+	Prompt  []Operation             `yaml:"prompt"`
+	Outputs map[string]OutputTarget `yaml:"outputs,omitempty"`
+	Vars    map[string]string       `yaml:"vars,omitempty"`
+
+	// Definitions holds anchored blocks for aliases elsewhere in the file.
+	// pcp itself ignores it.
+	Definitions any `yaml:"definitions,omitempty"`
+}
+
+// OutputTarget is a named build target selecting a subset of operations
+// (those listing it in their targets) with its own budget and destination.
+type OutputTarget struct {
+	Output   string `yaml:"output,omitempty"`
+	MaxWords int    `yaml:"max_words,omitempty"`
 }
 
 type Operation struct {
-	File    *string `yaml:"file,omitempty"`
-	Prompt  *string `yaml:"prompt,omitempty"`
-	Command *string `yaml:"command,omitempty"`
-	Text    *string `yaml:"text,omitempty"`
+	File      *string        `yaml:"file,omitempty"`
+	Prompt    *string        `yaml:"prompt,omitempty"`
+	Command   *CommandLine   `yaml:"command,omitempty"`
+	Text      *string        `yaml:"text,omitempty"`
+	Ref       *string        `yaml:"ref,omitempty"`
+	Sysinfo   *bool          `yaml:"sysinfo,omitempty"`
+	Timestamp *TimestampSpec `yaml:"timestamp,omitempty"`
+	Remote    *string        `yaml:"pcp_remote,omitempty"`
+	Assert    *AssertSpec    `yaml:"assert,omitempty"`
+
+	// Comment is a note for prompt authors and tooling such as -plan. It
+	// is never emitted into the compiled output.
+	Comment *string `yaml:"comment,omitempty"`
+
+	// Symbol includes a single function, method or type of a source file.
+	Symbol *SymbolSpec `yaml:"symbol,omitempty"`
+
+	// Related includes a Go function with its callers and callees.
+	Related *RelatedSpec `yaml:"related,omitempty"`
+
+	// Coverage includes the Go files or functions a test run executed.
+	Coverage *CoverageSpec `yaml:"coverage,omitempty"`
+
+	// Stacktrace includes the source around the lines a stack trace names.
+	Stacktrace *StacktraceSpec `yaml:"stacktrace,omitempty"`
+
+	// Log includes the tail of a log file, optionally deduplicated.
+	Log *LogSpec `yaml:"log,omitempty"`
+
+	// Diff includes a unified diff of two files.
+	Diff *DiffSpec `yaml:"diff,omitempty"`
+
+	// BuildTargets lists the targets of a Makefile, Taskfile or justfile.
+	// It is not called targets, which restricts an operation to output
+	// targets.
+	BuildTargets *string `yaml:"build_targets,omitempty"`
+
+	// Script runs a command as a terminal session, optionally under a
+	// pseudo-terminal, and renders what the terminal would show.
+	Script *ScriptSpec `yaml:"script,omitempty"`
+
+	// Dir includes every text file below a directory, one section each.
+	// Extensions limits it to files with those extensions and MaxDepth to
+	// that many levels of the tree (1 is the directory's own files).
+	Dir        *string  `yaml:"dir,omitempty"`
+	Extensions []string `yaml:"extensions,omitempty"`
+	MaxDepth   int      `yaml:"max_depth,omitempty"`
+
+	// Tree draws a directory as a tree without running tree(1). MaxDepth
+	// limits it as for Dir, and Exclude leaves out entries matching any of
+	// the patterns.
+	Tree    *string  `yaml:"tree,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	// Git includes a file as it was at a git ref.
+	Git *GitSpec `yaml:"git,omitempty"`
+
+	// RespectGitignore leaves out what the repository's .gitignore files
+	// ignore when a dir, tree or glob expands; unset follows
+	// -respect-gitignore.
+	RespectGitignore *bool `yaml:"respect_gitignore,omitempty"`
+
+	// Line is where the operation starts in its prompt file, for error
+	// messages; 0 when it is not known.
+	Line int `yaml:"-"`
+
+	// keyLines holds the line of each key of the operation's mapping.
+	keyLines map[string]int
+
+	// Label names the operation so later ref operations can reuse its
+	// content. Charge makes a ref count against the word budget again.
+	Label  string `yaml:"label,omitempty"`
+	Charge bool   `yaml:"charge,omitempty"`
+
+	// Disabled skips the operation while keeping it in the prompt file.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// MaxWords and MaxTokens cap this operation's contribution independently
+	// of the global budget, truncating with a marker.
+	MaxWords  int `yaml:"max_words,omitempty"`
+	MaxTokens int `yaml:"max_tokens,omitempty"`
+
+	// Cache overrides the global cache policy for command operations:
+	// never, content or ttl=<duration>.
+	Cache string `yaml:"cache,omitempty"`
+
+	// FromPattern and ToPattern select the lines of a file operation from
+	// the first line matching FromPattern through the next line matching
+	// ToPattern. Both are regular expressions matched against single lines.
+	FromPattern string `yaml:"from_pattern,omitempty"`
+	ToPattern   string `yaml:"to_pattern,omitempty"`
+
+	// LatestEntry keeps only the newest release section of a
+	// CHANGELOG.md-style file.
+	LatestEntry bool `yaml:"latest_entry,omitempty"`
+
+	// WithTests also includes a file's conventional test file, such as
+	// foo_test.go for foo.go, when there is one.
+	WithTests bool `yaml:"with_tests,omitempty"`
+
+	// Binary says what a file operation does with a binary file: error
+	// (the default), stub for a one-line description, or skip.
+	Binary string `yaml:"binary,omitempty"`
+
+	// StripFrontmatter drops a leading YAML or TOML frontmatter block from a
+	// file operation's content.
+	StripFrontmatter bool `yaml:"strip_frontmatter,omitempty"`
+
+	// Condense reduces an OpenAPI document or protobuf file to its
+	// endpoints, messages and fields, cutting descriptions to
+	// DescriptionLimit characters (default 100).
+	Condense         bool `yaml:"condense,omitempty"`
+	DescriptionLimit int  `yaml:"description_limit,omitempty"`
+
+	// DepsSummary reduces a go.mod, package.json or requirements file to
+	// its direct dependencies and their versions.
+	DepsSummary bool `yaml:"deps_summary,omitempty"`
+
+	// Template renders a text operation as a Go template with the compile's
+	// metadata, such as {{.FileCount}} and {{.WordsUsed}}.
+	Template bool `yaml:"template,omitempty"`
+
+	// CaptureAs stores a command's or file's output, without its trailing
+	// newline, as a variable for later operations. Suppress leaves the
+	// captured section out of the output.
+	CaptureAs string `yaml:"capture_as,omitempty"`
+	Suppress  bool   `yaml:"suppress,omitempty"`
+
+	// IncludeOnce skips a nested prompt operation when the same prompt file
+	// was already included elsewhere in the tree.
+	IncludeOnce bool `yaml:"include_once,omitempty"`
+
+	// AllowSelf lets a file operation read a prompt file that is currently
+	// being processed, such as the prompt file itself, as plain text.
+	AllowSelf bool `yaml:"allow_self,omitempty"`
+
+	// SHA256 pins the content of a registry: prompt, so a republished
+	// version fails the compile instead of changing it silently.
+	SHA256 string `yaml:"sha256,omitempty"`
+
+	// OkExitCodes lists the exit codes a command may return without failing
+	// the compile. Zero is always accepted. Unset means 0 and 1.
+	OkExitCodes []int `yaml:"ok_exit_codes,omitempty"`
+
+	// FallbackText replaces a command's output when its executable is not
+	// installed, instead of failing the compile.
+	FallbackText *string `yaml:"fallback_text,omitempty"`
+
+	// Weight sets the operation's share of the budget when output is
+	// truncated proportionally. Unset or zero means 1.
+	Weight float64 `yaml:"weight,omitempty"`
+
+	// Limits caps a command's memory, CPU time and open files.
+	Limits *CommandLimits `yaml:"limits,omitempty"`
+
+	// Serial keeps a command from running alongside any other under -jobs,
+	// for commands that share state such as a build directory.
+	Serial bool `yaml:"serial,omitempty"`
+
+	// Targets restricts the operation to the named output targets. An empty
+	// list includes the operation in every target.
+	Targets []string `yaml:"targets,omitempty"`
 }
 
 func (op *Operation) GetType() (OperationType, error) {
@@ -44,6 +242,74 @@ func (op *Operation) GetType() (OperationType, error) {
 		count++
 		opType = TextOp
 	}
+	if op.Ref != nil {
+		count++
+		opType = RefOp
+	}
+	if op.Sysinfo != nil {
+		count++
+		opType = SysinfoOp
+	}
+	if op.Timestamp != nil {
+		count++
+		opType = TimestampOp
+	}
+	if op.Remote != nil {
+		count++
+		opType = RemoteOp
+	}
+	if op.Assert != nil {
+		count++
+		opType = AssertOp
+	}
+	if op.Comment != nil {
+		count++
+		opType = CommentOp
+	}
+	if op.Symbol != nil {
+		count++
+		opType = SymbolOp
+	}
+	if op.Related != nil {
+		count++
+		opType = RelatedOp
+	}
+	if op.Coverage != nil {
+		count++
+		opType = CoverageOp
+	}
+	if op.Stacktrace != nil {
+		count++
+		opType = StacktraceOp
+	}
+	if op.Log != nil {
+		count++
+		opType = LogOp
+	}
+	if op.Diff != nil {
+		count++
+		opType = DiffOp
+	}
+	if op.BuildTargets != nil {
+		count++
+		opType = BuildTargetsOp
+	}
+	if op.Script != nil {
+		count++
+		opType = ScriptOp
+	}
+	if op.Dir != nil {
+		count++
+		opType = DirOp
+	}
+	if op.Tree != nil {
+		count++
+		opType = TreeOp
+	}
+	if op.Git != nil {
+		count++
+		opType = GitOp
+	}
 
 	if count == 0 {
 		return 0, ErrOperationEmpty
@@ -62,45 +328,426 @@ func (op *Operation) GetValue() string {
 	case op.Prompt != nil:
 		return *op.Prompt
 	case op.Command != nil:
-		return *op.Command
+		return op.Command.String()
 	case op.Text != nil:
 		return *op.Text
+	case op.Ref != nil:
+		return *op.Ref
+	case op.Sysinfo != nil:
+		return strconv.FormatBool(*op.Sysinfo)
+	case op.Timestamp != nil:
+		return op.Timestamp.layout()
+	case op.Remote != nil:
+		return *op.Remote
+	case op.Assert != nil:
+		return op.Assert.String()
+	case op.Comment != nil:
+		return *op.Comment
+	case op.Symbol != nil:
+		return op.Symbol.String()
+	case op.Related != nil:
+		return op.Related.String()
+	case op.Coverage != nil:
+		return op.Coverage.Profile
+	case op.Stacktrace != nil:
+		return op.Stacktrace.File
+	case op.Log != nil:
+		return op.Log.File
+	case op.Diff != nil:
+		return op.Diff.String()
+	case op.BuildTargets != nil:
+		return *op.BuildTargets
+	case op.Script != nil:
+		return op.Script.Command
+	case op.Dir != nil:
+		return *op.Dir
+	case op.Tree != nil:
+		return *op.Tree
+	case op.Git != nil:
+		return op.Git.Path
 	default:
 		return ""
 	}
 }
 
+func (t OperationType) String() string {
+	switch t {
+	case FileOp:
+		return "file"
+	case PromptOp:
+		return "prompt"
+	case CommandOp:
+		return "command"
+	case TextOp:
+		return "text"
+	case RefOp:
+		return "ref"
+	case SysinfoOp:
+		return "sysinfo"
+	case TimestampOp:
+		return "timestamp"
+	case RemoteOp:
+		return "pcp_remote"
+	case AssertOp:
+		return "assert"
+	case CommentOp:
+		return "comment"
+	case SymbolOp:
+		return "symbol"
+	case RelatedOp:
+		return "related"
+	case CoverageOp:
+		return "coverage"
+	case StacktraceOp:
+		return "stacktrace"
+	case LogOp:
+		return "log"
+	case DiffOp:
+		return "diff"
+	case BuildTargetsOp:
+		return "build_targets"
+	case ScriptOp:
+		return "script"
+	case DirOp:
+		return "dir"
+	case TreeOp:
+		return "tree"
+	case GitOp:
+		return "git"
+	default:
+		return "unknown"
+	}
+}
+
 type ContentSection struct {
-	Source  string
-	Content string
-	Type    OperationType
+	Source   string
+	Content  string
+	Type     OperationType
+	Children []ContentSection
+	Weight   float64
+
+	// Path is the absolute path a file section was read from.
+	Path string
+
+	// ExitCode is the tolerated nonzero exit status of a command section,
+	// a hint that its output may be partial.
+	ExitCode int
+
+	// ID identifies the section across runs; set with -section-ids.
+	ID string
+
+	// template marks a text section whose content is a template still to
+	// be rendered once the rest of the compile is known. templateDir is
+	// where its include paths are resolved from; templateConfined keeps
+	// them inside it, for an untrusted remote prompt.
+	template         bool
+	templateDir      string
+	templateConfined bool
+
+	// modified is when a file section last changed in git, for the recency
+	// overflow policy.
+	modified time.Time
+
+	// skipped marks a binary file left out by binary: skip.
+	skipped bool
 }
 
 type CompiledContent struct {
 	Sections []ContentSection
+	Stats    CompileStats
+
+	// Dependencies lists every prompt file and file the compile read, as
+	// absolute paths in sorted order.
+	Dependencies []string
+}
+
+type CompileStats struct {
+	Sections int
+	Words    int
+	Skipped  []SkippedOperation
+
+	// TruncatedWords counts words removed to fit the budget when an
+	// overflow policy other than error is in effect.
+	TruncatedWords int
+
+	// TruncatedBytes counts bytes removed to fit -max-output-bytes.
+	TruncatedBytes int
+
+	// MergedSections counts sections removed by -merge-sources.
+	MergedSections int
+
+	// Warnings holds every non-fatal problem reported during the compile.
+	Warnings []string
+
+	// EmptySections lists the sources of file and command sections that
+	// produced no words.
+	EmptySections []string
+
+	// Failures lists the operations that failed under -keep-going, each
+	// replaced in the output by a placeholder.
+	Failures []OperationFailure
+
+	// Duplicates lists pairs of sections with identical or near-identical
+	// content.
+	Duplicates []DuplicateSection
+
+	// Reviewed lists the sources of sections turned off under -review.
+	Reviewed []string
+
+	// ContentWords and OutputWords count the section content and the
+	// assembled text output, headers and separators included, under -stats
+	// and -exact-budget. ExactBudget records that Words is OutputWords.
+	ContentWords int
+	OutputWords  int
+	ExactBudget  bool
+}
+
+// OperationFailure is an operation that failed under -keep-going.
+type OperationFailure struct {
+	File        string
+	Line        int
+	Index       int
+	Description string
+	Err         error
+}
+
+type SkippedOperation struct {
+	File        string
+	Index       int
+	Description string
+}
+
+// Options holds everything needed to compile a prompt file and write the result.
+type Options struct {
+	PromptFile string
+	OutputFile string
+	OutputMode os.FileMode
+	OutputDir  string
+
+	// Routes send the sections of some operation types to their own output
+	// files; the rest go to OutputFile.
+	Routes         []outputRoute
+	BundleSources  bool
+	Compress       string
+	MaxWords       int
+	DelimiterStyle string
+
+	// SectionSeparator is written between sections of text output; nil
+	// means defaultSectionSeparator.
+	SectionSeparator *string
+	Format           string
+	Target           string
+	Vars             map[string]string
+	Stats            bool
+	Plan             bool
+	PrintCommands    bool
+	Check            bool
+	Checksum         bool
+	Quiet            bool
+	Strict           bool
+	Normalize        string
+	MergeSources     bool
+
+	// KeepGoing continues past failing operations, replacing each with a
+	// placeholder; the compile still fails once the output is written.
+	KeepGoing bool
+
+	// KeepControlChars disables stripping of control characters and
+	// terminal escape sequences from section content.
+	KeepControlChars bool
+	SectionIDs       bool
+
+	// RespectGitignore is the default of respect_gitignore for operations
+	// that expand directories and globs.
+	RespectGitignore bool
+
+	// ExactBudget counts the words of the assembled text output, headers
+	// and separators included, against MaxWords.
+	ExactBudget bool
+	Overflow    string
+
+	// RecencyLookback is how far back in git history the recency overflow
+	// policy looks, such as "90d". Empty means defaultRecencyLookback.
+	RecencyLookback string
+
+	// Jobs is how many commands may run at once; 0 or 1 runs them one at a
+	// time as the plan executes.
+	Jobs int
+
+	// MaxOutputBytes caps the size of the output as written, in its format
+	// and headers included, independently of MaxWords. Zero means no limit.
+	MaxOutputBytes int
+
+	// MaxSections fails the compile while planning once the prompt tree has
+	// more sections, such as from a runaway glob. Zero means no limit.
+	MaxSections int
+
+	Watch         bool
+	WatchInterval time.Duration
+
+	// Review lets the user turn sections off on the terminal before the
+	// output is assembled.
+	Review bool
+
+	// Cache is the default cache policy for commands; CacheDir holds the
+	// on-disk results.
+	Cache    string
+	CacheDir string
+
+	// NoCache fetches remote sources afresh instead of through the HTTP
+	// cache; RemoteCacheTTL is how long a cached response is used without
+	// revalidating it.
+	NoCache        bool
+	RemoteCacheTTL time.Duration
+
+	// Registry is the base URL registry: prompts are fetched from.
+	// VerifyKey is a minisign public key, or its file, that registry
+	// prompts must be signed with. AllowRemoteCommands lets https://
+	// prompts run commands and scripts, and read local files, without that
+	// signature.
+	Registry            string
+	VerifyKey           string
+	AllowRemoteCommands bool
+
+	// Model sets the word budget, unless -max-words is given, and the
+	// tokenizer estimate from a model preset. ReserveTokens is left for the
+	// response: taken off -max-words, or in place of the preset's reserve.
+	Model         string
+	ReserveTokens int
+
+	// WorkDir is where commands run (default: the current directory).
+	WorkDir string
+
+	cache       *sourceCache
+	maxWordsSet bool
 }
 
 type ProcessingContext struct {
-	basePath       string
-	visitedFiles   map[string]bool
+	basePath     string
+	visitedFiles map[string]bool
+	visitStack   []string
+
+	// includedPrompts records every nested prompt planned so far, for
+	// include_once.
+	includedPrompts map[string]bool
+
+	// captureNames lists the variables set by capture_as operations;
+	// captured holds the values of those that have run.
+	captureNames   map[string]bool
+	captured       map[string]string
 	maxWords       int
 	wordCount      int
 	delimiterStyle string
+	target         string
+	vars           map[string]string
+	labels         map[string]ContentSection
+	stats          CompileStats
+	overflow       string
+	workDir        string
+	cache          *sourceCache
+	dependencies   map[string]bool
+	cachePolicy    cachePolicy
+	results        *resultCache
+	registry       string
+	verifyKey      *minisignKey
+
+	allowRemoteCommands bool
+
+	// remoteBase is the URL of the remote prompt being planned, which its
+	// relative paths resolve against; remotePrompts maps the mirror of
+	// each remote prompt fetched to its URL.
+	remoteBase    *url.URL
+	remotePrompts map[string]*url.URL
+
+	keepControlChars bool
+	exactBudget      bool
+	keepGoing        bool
+	respectGitignore bool
+	noCache          bool
+	charsPerToken    float64
+	remoteCacheTTL   time.Duration
+
+	// maxSections is -max-sections; plannedSections counts the sections
+	// planned so far against it.
+	maxSections     int
+	plannedSections int
+
+	// pcpignore holds the patterns of the .pcpignore next to the root
+	// prompt file, nil when there is none.
+	pcpignore *gitignore
+
+	// prefetched holds command runs started ahead of time by -jobs, by
+	// cache key, in plan order.
+	prefetched map[string][]commandRun
+
+	// prefetchedURLs holds remote sources fetched ahead of time, until
+	// their first use.
+	prefetchedURLs map[remoteRequest]remoteFetch
+
+	// rootDir is the absolute directory of the root prompt file. sectionIDs
+	// counts the IDs assigned so far, when -section-ids is set.
+	rootDir    string
+	sectionIDs map[string]int
+
+	// quiet suppresses printing warnings; strict fails the compile on them.
+	// Either way they are collected in stats.
+	quiet  bool
+	strict bool
 }
 
 func NewProcessingContext(basePath string, maxWords int, delimiterStyle string) *ProcessingContext {
+	rootDir, _ := filepath.Abs(filepath.Dir(basePath))
 	return &ProcessingContext{
-		basePath:       filepath.Dir(basePath),
-		visitedFiles:   make(map[string]bool),
-		maxWords:       maxWords,
-		wordCount:      0,
-		delimiterStyle: delimiterStyle,
+		rootDir:         rootDir,
+		basePath:        filepath.Dir(basePath),
+		visitedFiles:    make(map[string]bool),
+		includedPrompts: make(map[string]bool),
+		captureNames:    make(map[string]bool),
+		captured:        make(map[string]string),
+		prefetched:      make(map[string][]commandRun),
+		prefetchedURLs:  make(map[remoteRequest]remoteFetch),
+		maxWords:        maxWords,
+		wordCount:       0,
+		delimiterStyle:  delimiterStyle,
+		vars:            make(map[string]string),
+		labels:          make(map[string]ContentSection),
+		dependencies:    make(map[string]bool),
+		cachePolicy:     cachePolicy{Mode: "never"},
+		charsPerToken:   defaultCharsPerToken,
+		remotePrompts:   make(map[string]*url.URL),
 	}
 }
 
 func (ctx *ProcessingContext) MarkVisited(path string) {
 	absPath, _ := filepath.Abs(path)
 	ctx.visitedFiles[absPath] = true
+	ctx.visitStack = append(ctx.visitStack, absPath)
+}
+
+// Unvisit removes a prompt file from the include stack once its operations
+// have been processed.
+func (ctx *ProcessingContext) Unvisit(path string) {
+	absPath, _ := filepath.Abs(path)
+	delete(ctx.visitedFiles, absPath)
+	if n := len(ctx.visitStack); n > 0 && ctx.visitStack[n-1] == absPath {
+		ctx.visitStack = ctx.visitStack[:n-1]
+	}
+}
+
+// Warn reports a non-fatal problem on stderr, unless -quiet is set, and
+// records it so -strict can fail the compile.
+func (ctx *ProcessingContext) Warn(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	ctx.stats.Warnings = append(ctx.stats.Warnings, message)
+	if !ctx.quiet {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+	}
+}
+
+// IncludeChain returns the prompt files currently being processed, in the
+// order they were included.
+func (ctx *ProcessingContext) IncludeChain() []string {
+	return append([]string(nil), ctx.visitStack...)
 }
 
 func (ctx *ProcessingContext) IsVisited(path string) bool {
@@ -108,16 +755,106 @@ func (ctx *ProcessingContext) IsVisited(path string) bool {
 	return ctx.visitedFiles[absPath]
 }
 
+// ResolvePath resolves a path of an operation against its prompt file. In
+// a remote prompt, relative paths resolve to the mirror of their URL.
 func (ctx *ProcessingContext) ResolvePath(path string) string {
-	if filepath.IsAbs(path) {
+	if u := ctx.remoteURL(path, false); u != nil {
+		return ctx.remoteMirror(u)
+	}
+	return resolvePath(ctx.basePath, path)
+}
+
+// ResolvePromptPath is ResolvePath for prompt operations, which may also
+// name a builtin, registry or https:// prompt.
+func (ctx *ProcessingContext) ResolvePromptPath(path string) string {
+	if u := ctx.remoteURL(path, true); u != nil {
+		return ctx.remoteMirror(u)
+	}
+	if isBuiltinPrompt(path) || isRegistryPrompt(path) {
 		return path
 	}
-	return filepath.Join(ctx.basePath, path)
+	return ctx.ResolvePath(path)
+}
+
+// AddDependency records a path the compiled output depends on, whether or
+// not it currently exists.
+func (ctx *ProcessingContext) AddDependency(path string) {
+	absPath, _ := filepath.Abs(path)
+	ctx.dependencies[absPath] = true
+}
+
+// Dependencies returns the recorded dependencies in sorted order.
+func (ctx *ProcessingContext) Dependencies() []string {
+	paths := make([]string, 0, len(ctx.dependencies))
+	for path := range ctx.dependencies {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ParsePromptFile parses a prompt file, through the cache when one is set.
+func (ctx *ProcessingContext) ParsePromptFile(path string) (*PromptFile, error) {
+	if isBuiltinPrompt(path) {
+		return parsePromptFile(path)
+	}
+	ctx.AddDependency(path)
+	if ctx.cache != nil {
+		return ctx.cache.parsePromptFile(path)
+	}
+	return parsePromptFile(path)
+}
+
+// ReadFile reads a file, through the cache when one is set.
+func (ctx *ProcessingContext) ReadFile(path string) ([]byte, error) {
+	if ctx.cache != nil {
+		return ctx.cache.readFile(path)
+	}
+	return os.ReadFile(path)
+}
+
+// SetVars copies variables into the context, overriding existing values.
+func (ctx *ProcessingContext) SetVars(vars map[string]string) {
+	for name, value := range vars {
+		ctx.vars[name] = value
+	}
+}
+
+// AddVarDefaults records variables declared by a prompt file without
+// overriding values that were already set (from -set or an earlier file).
+func (ctx *ProcessingContext) AddVarDefaults(vars map[string]string) {
+	for name, value := range vars {
+		if _, ok := ctx.vars[name]; !ok && !ctx.captureNames[name] {
+			ctx.vars[name] = value
+		}
+	}
+}
+
+func (ctx *ProcessingContext) Expand(s string) string {
+	return expandVars(s, ctx.vars)
+}
+
+// ExpandShell expands variables in a shell command line, quoting values.
+func (ctx *ProcessingContext) ExpandShell(s string) string {
+	return expandShellVars(s, ctx.vars)
+}
+
+// Includes reports whether an operation belongs to the target being built.
+func (ctx *ProcessingContext) Includes(op Operation) bool {
+	if ctx.target == "" || len(op.Targets) == 0 {
+		return true
+	}
+	for _, target := range op.Targets {
+		if target == ctx.target {
+			return true
+		}
+	}
+	return false
 }
 
 func (ctx *ProcessingContext) AddWords(count int) error {
 	ctx.wordCount += count
-	if ctx.wordCount > ctx.maxWords {
+	if ctx.wordCount > ctx.maxWords && (ctx.overflow == "" || ctx.overflow == "error") {
 		return ErrWordLimitExceeded{Current: ctx.wordCount, Limit: ctx.maxWords}
 	}
 	return nil
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	varPattern     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:raw)?\}`)
+	varNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// expandVars replaces ${name} references with their values. References to
+// undefined variables are left untouched so shell variables in commands
+// keep working.
+func expandVars(s string, vars map[string]string) string {
+	return replaceVars(s, vars, false)
+}
+
+// expandShellVars is expandVars for shell command lines: each value is
+// shell-quoted so it stays a single argument, unless referenced as
+// ${name:raw}.
+func expandShellVars(s string, vars map[string]string) string {
+	return replaceVars(s, vars, true)
+}
+
+func replaceVars(s string, vars map[string]string, quote bool) string {
+	if len(vars) == 0 || !strings.Contains(s, "${") {
+		return s
+	}
+	return varPattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := varPattern.FindStringSubmatch(match)
+		value, ok := vars[groups[1]]
+		if !ok {
+			return match
+		}
+		if quote && groups[2] == "" {
+			return shellQuote(value)
+		}
+		return value
+	})
+}
+
+// varFlag collects repeated -set key=value flags.
+type varFlag map[string]string
+
+func (v varFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlag) Set(s string) error {
+	key, value, err := splitVarAssignment(s)
+	if err != nil {
+		return err
+	}
+	v[key] = value
+	return nil
+}
+
+func splitVarAssignment(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !varNamePattern.MatchString(key) {
+		return "", "", fmt.Errorf("invalid variable assignment %q, expected name=value", s)
+	}
+	return key, value, nil
+}
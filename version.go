@@ -0,0 +1,21 @@
+package main
+
+// latestVersion is the newest prompt file format this pcp understands.
+const latestVersion = 2
+
+// upgradeOperation rewrites an operation from a prompt file of the given
+// format version into the terms of version 1, which the rest of pcp
+// implements, so files of every version can be mixed in one prompt tree.
+//
+// Version 2 changes:
+//   - commands must exit 0 unless they list ok_exit_codes; version 1 also
+//     tolerates status 1 with a warning
+func upgradeOperation(op Operation, version int) Operation {
+	if version < 2 {
+		return op
+	}
+	if op.Command != nil && op.OkExitCodes == nil {
+		op.OkExitCodes = []int{}
+	}
+	return op
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileState is what watch mode compares to decide whether a path changed.
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+type watchSnapshot map[string]fileState
+
+func takeSnapshot(paths []string) watchSnapshot {
+	snapshot := make(watchSnapshot, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			snapshot[path] = fileState{}
+			continue
+		}
+		snapshot[path] = fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+	}
+	return snapshot
+}
+
+// changed reports the first path whose state differs from the snapshot.
+func (s watchSnapshot) changed() (string, bool) {
+	for path, before := range s {
+		after := takeSnapshot([]string{path})[path]
+		if after.exists != before.exists || after.size != before.size || !after.modTime.Equal(before.modTime) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// watchAndCompile compiles, then recompiles whenever a dependency changes.
+// The dependency set is rediscovered on every compile, so nested prompts and
+// files added to or removed from the tree are picked up. When a compile
+// fails the previous set is kept so fixing the mistake triggers a rebuild.
+// It runs until stop is closed (forever when stop is nil).
+func watchAndCompile(opts Options, stop <-chan struct{}) error {
+	interval := opts.WatchInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	rootPath, _ := filepath.Abs(opts.PromptFile)
+	dependencies := []string{rootPath}
+
+	for {
+		compiled, err := compileAndWrite(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			dependencies = compiled.Dependencies
+			if !opts.Quiet {
+				fmt.Fprintf(os.Stderr, "pcp: compiled %s (watching %d files)\n", opts.PromptFile, len(dependencies))
+			}
+		}
+
+		snapshot := takeSnapshot(dependencies)
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(interval):
+			}
+			if path, ok := snapshot.changed(); ok {
+				if !opts.Quiet {
+					fmt.Fprintf(os.Stderr, "pcp: %s changed, recompiling\n", path)
+				}
+				break
+			}
+		}
+	}
+}